@@ -0,0 +1,193 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A Box talks privately with peers on the server's /api, through the server,
+// which passes on what they say without being able to read it. Peers are the
+// other clients in a room the client is in, by the connection ids that
+// presence gives. Each Box has a Curve25519 key pair of its own, made by
+// NewBox, and the public key is handed to a peer with the message from
+// KeyMessage, which the server passes on, and which the peer gives to
+// ReadKey. Once both have the other's key, each can Seal messages for the
+// other, and Open the ones it's sent, which are binary messages:
+//
+//	b, err := client.NewBox()
+//	...
+//	c.Send(ctx, websocket.TextMessage, b.KeyMessage(peer))
+//	...
+//	frame, err := b.Seal(peer, []byte("hello"))
+//	c.Send(ctx, websocket.BinaryMessage, frame)
+//
+// Messages are sealed with NaCl box, XSalsa20 and Poly1305, with a key
+// shared with the peer, so that nobody else can read them or change them
+// unnoticed. Each message's nonce is a prefix of 16 random bytes, made with
+// the Box, then a count of the messages it's sealed, so that no two messages
+// ever share one. A peer's messages have to come with its prefix, and a count
+// higher than any before it, so that one can't be sent again, or the
+// messages reordered: a message from a peer that isn't in order is refused
+// with ErrReplayed. A new key from a peer, such as once it's reconnected with
+// a new Box, starts it over.
+//
+// A binary message is the id of the peer, in 8 bytes, big-endian, then the
+// nonce, then the sealed message. The server replaces the id with the
+// sender's on the way.
+//
+// NaCl box needs golang.org/x/crypto, so it's only in builds made with
+// -tags nacl; otherwise NewBox fails.
+type Box struct {
+	public  *[32]byte
+	private *[32]byte
+	prefix  [16]byte
+
+	mut sync.Mutex
+	// How many messages have been sealed.
+	sealed uint64
+	peers  map[uint64]*boxPeer
+}
+
+type boxPeer struct {
+	public [32]byte
+	shared *[32]byte
+	// The nonce prefix of the peer's messages, once it's sent one, and the
+	// count of the last of them.
+	prefix *[16]byte
+	last   uint64
+}
+
+// The lengths of the parts at the front of a relayed binary message.
+const (
+	peerIDLength = 8
+	nonceLength  = 24
+)
+
+var (
+	// ErrNoPeerKey is a message for, or from, a peer whose key hasn't been
+	// read.
+	ErrNoPeerKey = errors.New("client: no key for the peer")
+	// ErrReplayed is a message from a peer that's already been opened, or
+	// that's out of order.
+	ErrReplayed = errors.New("client: message out of order, or replayed")
+	// ErrNotKey is a message given to ReadKey that isn't a key.
+	ErrNotKey = errors.New("client: not a key from a peer")
+
+	errBadFrame = errors.New("client: message can't be opened")
+)
+
+// NewBox makes a Box, with a new key pair.
+func NewBox() (*Box, error) {
+	public, private, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+	b := &Box{public: public, private: private, peers: map[uint64]*boxPeer{}}
+	if _, err := rand.Read(b.prefix[:]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// PublicKey gives the Box's public key, in base64.
+func (b *Box) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(b.public[:])
+}
+
+type keyEnvelope struct {
+	Type    string `json:"type"`
+	Payload struct {
+		To   uint64 `json:"to,omitempty"`
+		From uint64 `json:"from,omitempty"`
+		User string `json:"user,omitempty"`
+		Key  string `json:"key"`
+	} `json:"payload"`
+}
+
+// KeyMessage gives the text message that hands the Box's public key to the
+// peer.
+func (b *Box) KeyMessage(to uint64) []byte {
+	var e keyEnvelope
+	e.Type = "key"
+	e.Payload.To, e.Payload.Key = to, b.PublicKey()
+	message, _ := json.Marshal(e)
+	return message
+}
+
+// ReadKey reads a peer's key from a text message from the server, and gives
+// the peer's id, and whether its key is a new one. A message that isn't a
+// key gives ErrNotKey.
+func (b *Box) ReadKey(message []byte) (uint64, bool, error) {
+	var e keyEnvelope
+	if err := json.Unmarshal(message, &e); err != nil || e.Type != "key" || e.Payload.From == 0 {
+		return 0, false, ErrNotKey
+	}
+	key, err := base64.StdEncoding.DecodeString(e.Payload.Key)
+	if err != nil || len(key) != 32 {
+		return 0, false, fmt.Errorf("client: the key from peer %d isn't 32 bytes of base64", e.Payload.From)
+	}
+	var public [32]byte
+	copy(public[:], key)
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if p, ok := b.peers[e.Payload.From]; ok && p.public == public {
+		return e.Payload.From, false, nil
+	}
+	b.peers[e.Payload.From] = &boxPeer{public: public, shared: precompute(&public, b.private)}
+	return e.Payload.From, true, nil
+}
+
+// Seal seals the message for the peer, and gives the binary message to send.
+func (b *Box) Seal(to uint64, message []byte) ([]byte, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	p, ok := b.peers[to]
+	if !ok {
+		return nil, ErrNoPeerKey
+	}
+	b.sealed++
+	var nonce [nonceLength]byte
+	copy(nonce[:], b.prefix[:])
+	binary.BigEndian.PutUint64(nonce[len(b.prefix):], b.sealed)
+
+	frame := make([]byte, peerIDLength, peerIDLength+nonceLength+len(message)+boxOverhead)
+	binary.BigEndian.PutUint64(frame, to)
+	frame = append(frame, nonce[:]...)
+	return seal(frame, message, &nonce, p.shared), nil
+}
+
+// Open opens a binary message from the server, and gives the peer it's from,
+// and the message.
+func (b *Box) Open(frame []byte) (uint64, []byte, error) {
+	if len(frame) < peerIDLength+nonceLength+boxOverhead {
+		return 0, nil, errBadFrame
+	}
+	from := binary.BigEndian.Uint64(frame)
+	var nonce [nonceLength]byte
+	copy(nonce[:], frame[peerIDLength:])
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	p, ok := b.peers[from]
+	if !ok {
+		return from, nil, ErrNoPeerKey
+	}
+	message, ok := open(nil, frame[peerIDLength+nonceLength:], &nonce, p.shared)
+	if !ok {
+		return from, nil, errBadFrame
+	}
+	// Only once it's known to be from the peer does its nonce count.
+	var prefix [16]byte
+	copy(prefix[:], nonce[:])
+	count := binary.BigEndian.Uint64(nonce[len(prefix):])
+	if p.prefix != nil && (*p.prefix != prefix || count <= p.last) {
+		return from, nil, ErrReplayed
+	}
+	p.prefix, p.last = &prefix, count
+	return from, message, nil
+}
@@ -0,0 +1,29 @@
+//go:build nacl
+
+package client
+
+import (
+	"crypto/rand"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+const boxOverhead = box.Overhead
+
+func generateKey() (public, private *[32]byte, err error) {
+	return box.GenerateKey(rand.Reader)
+}
+
+func precompute(peersPublic, private *[32]byte) *[32]byte {
+	var shared [32]byte
+	box.Precompute(&shared, peersPublic, private)
+	return &shared
+}
+
+func seal(out, message []byte, nonce *[24]byte, shared *[32]byte) []byte {
+	return box.SealAfterPrecomputation(out, message, nonce, shared)
+}
+
+func open(out, sealed []byte, nonce *[24]byte, shared *[32]byte) ([]byte, bool) {
+	return box.OpenAfterPrecomputation(out, sealed, nonce, shared)
+}
@@ -0,0 +1,22 @@
+//go:build !nacl
+
+package client
+
+import "errors"
+
+// NaCl box needs golang.org/x/crypto, so it's only built in with -tags nacl.
+// Without it, there's no Box to be had, so the rest is never called.
+
+const boxOverhead = 16
+
+var errNoNaCl = errors.New("client: this build doesn't support end-to-end encryption; build with -tags nacl")
+
+func generateKey() (public, private *[32]byte, err error) {
+	return nil, nil, errNoNaCl
+}
+
+func precompute(peersPublic, private *[32]byte) *[32]byte { return nil }
+
+func seal(out, message []byte, nonce *[24]byte, shared *[32]byte) []byte { return nil }
+
+func open(out, sealed []byte, nonce *[24]byte, shared *[32]byte) ([]byte, bool) { return nil, false }
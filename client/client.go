@@ -0,0 +1,533 @@
+// Package client is the other half of the example: a WebSocket client that
+// stays connected to the server, for as long as it's running.
+//
+// It keeps the connection alive the same way the server does, by pinging and
+// expecting pongs, and answering the server's own pings. Anything at all from
+// the server counts as a sign of life. Whenever the connection drops, or the
+// server can't be reached, it reconnects, waiting longer after each failed
+// attempt, with jitter so that clients that were all dropped at once don't all
+// come back at once. A Retry-After from the server, such as when it's rate
+// limiting or shutting down, is waited out before trying again.
+//
+// A handshake the server turns away gives a *RejectedError, with the code
+// from the server's JSON error, which matches ErrAtCapacity, ErrUnauthorized
+// or ErrBanned with errors.Is. Trying again can't help when the client isn't
+// authorized, or is banned for good, so Run gives up and returns the error;
+// a ban that comes with a Retry-After, because it ends, is waited out like
+// any other.
+//
+//	c := &client.Client{
+//		URL:       "ws://localhost:8080/ws",
+//		OnMessage: func(messageType int, data []byte) { fmt.Println(string(data)) },
+//	}
+//	go c.Run(ctx)
+//	c.Send(ctx, websocket.TextMessage, []byte("hello"))
+//
+// Messages are sent over whichever connection is up by the time they get to
+// the front of the queue. A message that was being written when the
+// connection dropped is lost, rather than sent twice.
+//
+// Every ping carries the time it was sent, as the server's do, so every pong
+// gives the round trip to the server, and Latency gives the average of the
+// last few.
+//
+// Every message can be seen, and changed, on its way out and in, by the
+// interceptors in OnSend and OnReceive, such as to encrypt and decrypt it, or
+// to keep an audit log:
+//
+//	c.OnSend = append(c.OnSend, func(messageType int, data []byte) (int, []byte, bool) {
+//		return websocket.BinaryMessage, seal(data), true
+//	})
+//
+// Each interceptor is given what the one before it gave back. One that gives
+// back false vetoes the message, which is dropped, and the interceptors after
+// it never see it.
+//
+// Rather than be called back with every message, a client without OnMessage
+// can range over them, with Run going in another goroutine:
+//
+//	go c.Run(ctx)
+//	for m, err := range c.Messages(ctx) {
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Println(string(m.Data))
+//	}
+//
+// The loop carries on across reconnects, and ends once ctx is done, or once
+// Run has returned, with Run's error as the last one if the server turned the
+// client away for good. The reader holds on to each message until it's taken,
+// as it waits for OnMessage to return, so none are dropped when the loop is
+// broken out of, or between one loop and the next, or when the connection
+// drops with one not yet taken: the client doesn't reconnect until it has
+// been. Only once Run returns is a message that was never taken dropped.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"wsexample/internal/latency"
+)
+
+// ErrClosed is given by Send once the client has been closed.
+var ErrClosed = errors.New("client: closed")
+
+var (
+	// ErrAtCapacity is a handshake turned away because the server has all the
+	// connections it takes. It's tried again once the Retry-After is up.
+	ErrAtCapacity = errors.New("client: server at capacity")
+	// ErrUnauthorized is a handshake turned away for want of a valid token.
+	// It isn't tried again.
+	ErrUnauthorized = errors.New("client: unauthorized")
+	// ErrBanned is a handshake turned away because the client's address is
+	// banned. It's only tried again if the ban ends, once it has.
+	ErrBanned = errors.New("client: banned")
+)
+
+// The server's error codes for the errors above.
+const (
+	codeTooManyConns = "too_many_connections"
+	codeUnauthorized = "unauthorized"
+	codeBanned       = "banned"
+)
+
+const sendQueueSize = 64
+
+type outbound struct {
+	messageType int
+	data        []byte
+}
+
+// A Message is a message from the server, as Messages gives it.
+type Message struct {
+	// websocket.TextMessage or websocket.BinaryMessage.
+	Type int
+	Data []byte
+}
+
+// An Interceptor is given a message on its way out or in, and gives back the
+// message to carry on with, which can be changed, or false to drop it. Pings,
+// pongs and close frames don't go through interceptors.
+type Interceptor func(messageType int, data []byte) (int, []byte, bool)
+
+// intercept runs the message through the interceptors, in order, and reports
+// whether it got through all of them.
+func intercept(interceptors []Interceptor, messageType int, data []byte) (int, []byte, bool) {
+	for _, i := range interceptors {
+		var ok bool
+		if messageType, data, ok = i(messageType, data); !ok {
+			return 0, nil, false
+		}
+	}
+	return messageType, data, true
+}
+
+// Client is a connection to a server that reconnects itself. Only URL is
+// required. The fields mustn't be changed once Run has been called.
+type Client struct {
+	URL    string
+	Header http.Header
+	// Dialer defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+
+	// OnMessage is called with every message from the server, one at a time,
+	// from the goroutine reading the connection, even across reconnects: the
+	// client doesn't reconnect until the last call for the old connection has
+	// returned. Pongs aren't noticed while it's running, so it shouldn't take
+	// long. A client with OnMessage has nothing for Messages.
+	OnMessage func(messageType int, data []byte)
+	// OnConnect is called whenever the client connects.
+	OnConnect func()
+	// OnDisconnect is called whenever the client loses its connection, or
+	// fails to connect, with the reason why, and how long it's going to wait
+	// before trying again.
+	OnDisconnect func(err error, retryIn time.Duration)
+	// OnSend is run on every message just before it's written, from the
+	// goroutine writing the connection, and OnReceive on every message from
+	// the server before OnMessage is called with it, from the goroutine
+	// reading it.
+	OnSend    []Interceptor
+	OnReceive []Interceptor
+
+	// PingInterval defaults to 54 seconds, and PongWait to 60, the same as
+	// the server's. If nothing at all is heard from the server for PongWait,
+	// the connection is given up on.
+	PingInterval time.Duration
+	PongWait     time.Duration
+	// WriteWait is how long a write can take, 10 seconds by default.
+	WriteWait time.Duration
+
+	// The wait before reconnecting starts at MinBackoff, half a second by
+	// default, and doubles after every attempt up to MaxBackoff, 30 seconds
+	// by default, with up to half of it taken off at random. It starts over
+	// once a connection stays up for longer than the wait before it.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	init    sync.Once
+	send    chan outbound
+	closing chan struct{}
+	close   sync.Once
+	rtt     latency.Window
+	// The messages for Messages, once it's been called, and Run's error, once
+	// it has returned and finished is closed.
+	inbox     chan Message
+	iterating atomic.Bool
+	finished  chan struct{}
+	runErr    error
+	// For the jitter, seeded so that every client's is different. Only Run
+	// uses it.
+	rnd *rand.Rand
+}
+
+func (c *Client) setup() {
+	c.init.Do(func() {
+		c.send = make(chan outbound, sendQueueSize)
+		c.closing = make(chan struct{})
+		c.inbox = make(chan Message)
+		c.finished = make(chan struct{})
+		c.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	})
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// Run connects to the server, and reconnects whenever the connection drops,
+// until ctx is done, or Close is called. It returns ctx's error, nil once it
+// has closed the connection after Close, or the *RejectedError if the server
+// turns the client away for good. It mustn't be called more than once.
+func (c *Client) Run(ctx context.Context) error {
+	c.setup()
+	err := c.run(ctx)
+	c.runErr = err
+	close(c.finished)
+	return err
+}
+
+func (c *Client) run(ctx context.Context) error {
+	minBackoff := orDefault(c.MinBackoff, 500*time.Millisecond)
+	maxBackoff := orDefault(c.MaxBackoff, 30*time.Second)
+
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		connected, err := c.connect(ctx)
+		select {
+		case <-c.closing:
+			return nil
+		default:
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var rejected *RejectedError
+		if errors.As(err, &rejected) && rejected.final() {
+			return err
+		}
+		if connected && time.Since(start) > backoff {
+			backoff = minBackoff
+		}
+
+		wait := backoff/2 + time.Duration(c.rnd.Int63n(int64(backoff/2)+1))
+		if rejected != nil && rejected.RetryAfter > wait {
+			wait = rejected.RetryAfter
+		}
+		if c.OnDisconnect != nil {
+			c.OnDisconnect(err, wait)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-c.closing:
+			timer.Stop()
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Send queues a message, waiting for room in the queue until ctx is done. If
+// the client isn't connected, the message waits for it to be.
+func (c *Client) Send(ctx context.Context, messageType int, data []byte) error {
+	c.setup()
+	select {
+	case <-c.closing:
+		return ErrClosed
+	default:
+	}
+	select {
+	case c.send <- outbound{messageType, data}:
+		return nil
+	case <-c.closing:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Messages gives every message from the server, in order, across reconnects,
+// until ctx is done, or Run returns, and then Run's *RejectedError, if it
+// returned one. It's
+// for a client without OnMessage, and Run must be called, in another
+// goroutine, for it to give anything. Until the client is done, the message
+// after the last one a loop had is kept for the next; see the package doc.
+func (c *Client) Messages(ctx context.Context) iter.Seq2[Message, error] {
+	c.setup()
+	c.iterating.Store(true)
+	return func(yield func(Message, error) bool) {
+		for {
+			select {
+			case m := <-c.inbox:
+				if !yield(m, nil) {
+					return
+				}
+			case <-c.finished:
+				if c.runErr != nil && !errors.Is(c.runErr, context.Canceled) && !errors.Is(c.runErr, context.DeadlineExceeded) {
+					yield(Message{}, c.runErr)
+				}
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Latency gives the average round trip of the last few pings, across
+// reconnects, or zero until the first pong.
+func (c *Client) Latency() time.Duration {
+	return c.rtt.Average()
+}
+
+// Close closes the connection with a normal closure, and stops Run from
+// reconnecting. It doesn't wait for Run to return. Messages that haven't been
+// sent yet are dropped.
+func (c *Client) Close() error {
+	c.setup()
+	c.close.Do(func() { close(c.closing) })
+	return nil
+}
+
+// A RejectedError is a handshake that the server turned away. It unwraps to
+// websocket.ErrBadHandshake.
+type RejectedError struct {
+	// Status is the HTTP status of the response.
+	Status int
+	// Code and Message are from the server's JSON error, if it sent one.
+	Code    string
+	Message string
+	// RetryAfter is how long the server said to wait before trying again, or
+	// zero if it didn't say.
+	RetryAfter time.Duration
+
+	err error
+}
+
+// rejection makes the RejectedError for a handshake that was answered with
+// resp.
+func rejection(err error, resp *http.Response) *RejectedError {
+	e := &RejectedError{Status: resp.StatusCode, err: err}
+	if secs, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil && secs > 0 {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	// The dialer keeps only the start of the body, which is plenty for the
+	// server's errors. Anything else is left without a code.
+	if resp.Body != nil && json.NewDecoder(resp.Body).Decode(&body) == nil {
+		e.Code, e.Message = body.Error.Code, body.Error.Message
+	}
+	return e
+}
+
+func (e *RejectedError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("client: handshake rejected with status %d", e.Status)
+	}
+	return fmt.Sprintf("client: handshake rejected with status %d, %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *RejectedError) Unwrap() error { return e.err }
+
+// Is matches ErrAtCapacity, ErrUnauthorized and ErrBanned, by the code.
+func (e *RejectedError) Is(target error) bool {
+	switch target {
+	case ErrAtCapacity:
+		return e.Code == codeTooManyConns
+	case ErrUnauthorized:
+		return e.Code == codeUnauthorized
+	case ErrBanned:
+		return e.Code == codeBanned
+	}
+	return false
+}
+
+// final tells whether trying again can't help.
+func (e *RejectedError) final() bool {
+	return e.Code == codeUnauthorized || (e.Code == codeBanned && e.RetryAfter == 0)
+}
+
+// connect connects, and runs the connection until it's done. It tells whether
+// it ever connected.
+func (c *Client) connect(ctx context.Context) (bool, error) {
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	conn, resp, err := dialer.DialContext(ctx, c.URL, c.Header)
+	if err != nil {
+		if resp != nil {
+			return false, rejection(err, resp)
+		}
+		return false, err
+	}
+	if c.OnConnect != nil {
+		c.OnConnect()
+	}
+	return true, c.serve(ctx, conn)
+}
+
+// serve reads and writes the connection until it fails, ctx is done, or the
+// client is closed.
+func (c *Client) serve(ctx context.Context, conn *websocket.Conn) error {
+	pingInterval := orDefault(c.PingInterval, 54*time.Second)
+	pongWait := orDefault(c.PongWait, 60*time.Second)
+	writeWait := orDefault(c.WriteWait, 10*time.Second)
+
+	alive := func() { conn.SetReadDeadline(time.Now().Add(pongWait)) }
+	alive()
+	conn.SetPongHandler(func(payload string) error {
+		alive()
+		if sent, ok := latency.Sent([]byte(payload)); ok {
+			c.rtt.Observe(time.Since(sent))
+		}
+		return nil
+	})
+	conn.SetPingHandler(func(data string) error {
+		alive()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+
+	// The writer is always waited for, so that it can't take a message off the
+	// queue meant for the next connection, and so is the reader, so that
+	// OnMessage and the OnReceive interceptors are never called for this
+	// connection while the next one is being dialed or read. Only ever one
+	// call of them is running at a time. A message for Messages is held until
+	// it's taken, for as long as Run runs.
+	runCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	read := make(chan error, 1)
+	write := make(chan error, 1)
+	go func() {
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				read <- err
+				return
+			}
+			alive()
+			messageType, data, ok := intercept(c.OnReceive, messageType, data)
+			switch {
+			case !ok:
+			case c.OnMessage != nil:
+				c.OnMessage(messageType, data)
+			case c.iterating.Load():
+				select {
+				case c.inbox <- Message{messageType, data}:
+				case <-c.closing:
+				case <-runCtx.Done():
+				}
+			}
+		}
+	}()
+	go func() { write <- c.writeLoop(ctx, conn, pingInterval, writeWait) }()
+
+	select {
+	case err := <-read:
+		cancel()
+		conn.Close()
+		<-write
+		return err
+	case err := <-write:
+		conn.Close()
+		<-read
+		return err
+	case <-ctx.Done():
+		conn.Close()
+		<-write
+		<-read
+		return ctx.Err()
+	case <-c.closing:
+		// Wait for the server to answer the close frame, so that it knows the
+		// closure was on purpose.
+		cancel()
+		<-write
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+		select {
+		case <-read:
+			conn.Close()
+		case <-time.After(writeWait):
+			conn.Close()
+			<-read
+		}
+		return nil
+	}
+}
+
+// writeLoop writes the queued messages, and pings, until writing fails or ctx
+// is done.
+func (c *Client) writeLoop(ctx context.Context, conn *websocket.Conn, pingInterval, writeWait time.Duration) error {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-c.send:
+			messageType, data, ok := intercept(c.OnSend, m.messageType, m.data)
+			if !ok {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			now := time.Now()
+			if err := conn.WriteControl(websocket.PingMessage, latency.Payload(now), now.Add(writeWait)); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMessages(t *testing.T) {
+	// Each connection is sent three messages, numbered on from the last
+	// connection's, and then dropped, and the third is turned away for good.
+	var conns, sent atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conns.Add(1) == 3 {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":{"code":"unauthorized","message":"no"}}`)
+			return
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for i := 0; i < 3; i++ {
+			conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprint(sent.Add(1))))
+		}
+	}))
+	defer srv.Close()
+
+	c := &Client{URL: "ws" + strings.TrimPrefix(srv.URL, "http"), MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go c.Run(ctx)
+
+	// Breaking out of a loop, and dropping the connection, lose nothing.
+	var got []string
+	for m, err := range c.Messages(ctx) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(m.Data))
+		break
+	}
+	var last error
+	for m, err := range c.Messages(ctx) {
+		if err != nil {
+			last = err
+			continue
+		}
+		got = append(got, string(m.Data))
+	}
+	if want := "1 2 3 4 5 6"; strings.Join(got, " ") != want {
+		t.Fatalf("got %v, want %s", got, want)
+	}
+	if !errors.Is(last, ErrUnauthorized) {
+		t.Fatalf("the loop ended with %v, want the rejection", last)
+	}
+}
+
+func TestMessagesCancelled(t *testing.T) {
+	c := &Client{URL: "ws://127.0.0.1:1"}
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.Run(ctx)
+	cancel()
+	for _, err := range c.Messages(ctx) {
+		t.Fatalf("a cancelled loop gave %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+// Command autobahncheck goes over the results of an Autobahn TestSuite run,
+// and fails if any case didn't pass, other than those in the exceptions file.
+//
+// A case passes when both its behavior and its close behavior are OK,
+// NON-STRICT or INFORMATIONAL. Each line of the exceptions file is a case ID
+// followed by the reason it's allowed to fail; blank lines and lines starting
+// with # are ignored.
+//
+//	autobahncheck -exceptions autobahn/exceptions.txt autobahn/reports/servers/index.json
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type result struct {
+	Behavior      string `json:"behavior"`
+	BehaviorClose string `json:"behaviorClose"`
+}
+
+func passed(behavior string) bool {
+	switch behavior {
+	case "OK", "NON-STRICT", "INFORMATIONAL":
+		return true
+	}
+	return false
+}
+
+func readExceptions(path string) (map[string]string, error) {
+	exceptions := map[string]string{}
+	if path == "" {
+		return exceptions, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, reason, _ := strings.Cut(text, " ")
+		if strings.TrimSpace(reason) == "" {
+			return nil, fmt.Errorf("%s:%d: case %s has no reason given", path, line, id)
+		}
+		exceptions[id] = strings.TrimSpace(reason)
+	}
+	return exceptions, scanner.Err()
+}
+
+// caseLess orders case IDs like 1.2.10 numerically, part by part.
+func caseLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		if aerr != nil || berr != nil {
+			if as[i] != bs[i] {
+				return as[i] < bs[i]
+			}
+			continue
+		}
+		if an != bn {
+			return an < bn
+		}
+	}
+	return len(as) < len(bs)
+}
+
+func main() {
+	exceptionsFile := flag.String("exceptions", "", "file of cases that are allowed to fail, with the reasons why")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal("usage: autobahncheck [-exceptions file] index.json")
+	}
+
+	exceptions, err := readExceptions(*exceptionsFile)
+	if err != nil {
+		log.Fatalf("Failed to read the exceptions: %s", err.Error())
+	}
+	data, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to read the results: %s", err.Error())
+	}
+	var agents map[string]map[string]result
+	if err := json.Unmarshal(data, &agents); err != nil {
+		log.Fatalf("Failed to parse the results: %s", err.Error())
+	}
+
+	failures := 0
+	for agent, cases := range agents {
+		ids := make([]string, 0, len(cases))
+		for id := range cases {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return caseLess(ids[i], ids[j]) })
+
+		excused := 0
+		for _, id := range ids {
+			r := cases[id]
+			if passed(r.Behavior) && passed(r.BehaviorClose) {
+				continue
+			}
+			if reason, ok := exceptions[id]; ok {
+				excused++
+				fmt.Printf("%s: case %s: %s / %s (excused: %s)\n", agent, id, r.Behavior, r.BehaviorClose, reason)
+				continue
+			}
+			failures++
+			fmt.Printf("%s: case %s: %s / %s\n", agent, id, r.Behavior, r.BehaviorClose)
+		}
+		fmt.Printf("%s: %d cases, %d excused\n", agent, len(ids), excused)
+	}
+	if failures > 0 {
+		fmt.Printf("%d cases failed\n", failures)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,399 @@
+// Command loadtest opens a number of connections to the server at once, has
+// each of them send messages at a steady rate, and checks that every one
+// comes back: to its sender, in echo mode, or to every client, in broadcast
+// mode. At the end, it reports the latency of the messages that did, as
+// percentiles, and counts everything that went wrong, failing if anything
+// did.
+//
+//	loadtest -url ws://localhost:8080/echo -clients 500 -rate 10 -duration 1m
+//	loadtest -url ws://localhost:8080/chat -mode broadcast -clients 50 -rate 1
+//
+// The clients all connect first, over -ramp if it's given, and only then
+// start sending, each at -rate messages a second, for -duration. Whatever
+// hasn't come back -timeout after the last message is sent is missing. The
+// clients answer the server's pings, so a long run with a low rate, or none,
+// is a soak test of the keepalive; with -ping-interval, the clients ping the
+// server as well, and the round trips are reported alongside the messages'.
+//
+// Messages are text, made up of "lt", the client and its message number, and
+// -size bytes of padding, which is checked when it comes back. Anything else
+// the server sends, such as the session message on /chat, is ignored, and so
+// is anything before "lt", such as the "Got message: " that /ws echoes with.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"wsexample/internal/latency"
+)
+
+const messagePrefix = "lt "
+
+type run struct {
+	broadcast bool
+	padding   string
+	// The number of clients connected, which is how many a broadcast is
+	// expected to reach.
+	connected int64
+
+	sent, received int64
+	pings, pongs   int64
+
+	mut sync.Mutex
+	// The messages that haven't all come back, by ID.
+	pending   map[string]*sentMessage
+	latencies []time.Duration
+	rtts      []time.Duration
+	errors    map[string]int
+}
+
+type sentMessage struct {
+	at time.Time
+	// How many more times it's to be received.
+	remaining int64
+}
+
+func (r *run) fail(kind string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.errors[kind]++
+}
+
+// sending records the message as sent, just before it is.
+func (r *run) sending(id string) {
+	expected := int64(1)
+	if r.broadcast {
+		expected = atomic.LoadInt64(&r.connected)
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.pending[id] = &sentMessage{at: time.Now(), remaining: expected}
+}
+
+// got checks a message from the server, and counts it if it's one of the
+// clients'.
+func (r *run) got(client int, data []byte) {
+	s := string(data)
+	i := strings.Index(s, messagePrefix)
+	if i < 0 {
+		return
+	}
+	fields := strings.SplitN(s[i+len(messagePrefix):], " ", 2)
+	if len(fields) != 2 || fields[1] != r.padding {
+		r.fail("corrupted")
+		return
+	}
+	id := fields[0]
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	m, ok := r.pending[id]
+	owner, _, _ := strings.Cut(id, "-")
+	switch {
+	case !ok:
+		// More than expected, or a broadcast from before a client joined.
+		r.errors["unexpected"]++
+		return
+	case !r.broadcast && owner != strconv.Itoa(client):
+		r.errors["misdelivered"]++
+		return
+	}
+	r.received++
+	r.latencies = append(r.latencies, time.Since(m.at))
+	if m.remaining--; m.remaining <= 0 {
+		delete(r.pending, id)
+	}
+}
+
+func (r *run) pong(rtt time.Duration) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.pongs++
+	r.rtts = append(r.rtts, rtt)
+}
+
+type config struct {
+	url          string
+	header       http.Header
+	rate         float64
+	pingInterval time.Duration
+}
+
+// client connects, and sends messages between start and stop, until ctx is
+// done, when it closes the connection.
+func (r *run) client(ctx context.Context, id int, cfg config, start, stop <-chan struct{}, ready func(ok bool)) {
+	c, resp, err := websocket.DefaultDialer.DialContext(ctx, cfg.url, cfg.header)
+	if err != nil {
+		kind := "connect"
+		if resp != nil {
+			kind = fmt.Sprintf("connect (%d)", resp.StatusCode)
+		}
+		r.fail(kind)
+		ready(false)
+		return
+	}
+	defer c.Close()
+	atomic.AddInt64(&r.connected, 1)
+	ready(true)
+
+	c.SetPongHandler(func(payload string) error {
+		if sent, ok := latency.Sent([]byte(payload)); ok {
+			r.pong(time.Since(sent))
+		}
+		return nil
+	})
+	var closing int32
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				if atomic.LoadInt32(&closing) == 0 {
+					atomic.AddInt64(&r.connected, -1)
+					var ce *websocket.CloseError
+					if errors.As(err, &ce) {
+						r.fail(fmt.Sprintf("disconnected (%d)", ce.Code))
+					} else {
+						r.fail("disconnected")
+					}
+				}
+				return
+			}
+			r.got(id, data)
+		}
+	}()
+
+	select {
+	case <-start:
+	case <-readDone:
+		return
+	case <-ctx.Done():
+		return
+	}
+	var sends <-chan time.Time
+	if cfg.rate > 0 {
+		interval := time.Duration(float64(time.Second) / cfg.rate)
+		// So that the clients don't all send at the same moment.
+		time.Sleep(time.Duration(rand.Int63n(int64(interval))))
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		sends = ticker.C
+	}
+	var pings <-chan time.Time
+	if cfg.pingInterval > 0 {
+		ticker := time.NewTicker(cfg.pingInterval)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	seq := 0
+	for {
+		select {
+		case <-sends:
+			seq++
+			mid := fmt.Sprintf("%d-%d", id, seq)
+			r.sending(mid)
+			c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := c.WriteMessage(websocket.TextMessage, []byte(messagePrefix+mid+" "+r.padding)); err != nil {
+				r.fail("write")
+				return
+			}
+			atomic.AddInt64(&r.sent, 1)
+		case <-stop:
+			sends = nil
+			stop = nil
+		case now := <-pings:
+			atomic.AddInt64(&r.pings, 1)
+			if err := c.WriteControl(websocket.PingMessage, latency.Payload(now), now.Add(10*time.Second)); err != nil {
+				r.fail("ping")
+				return
+			}
+		case <-readDone:
+			return
+		case <-ctx.Done():
+			atomic.StoreInt32(&closing, 1)
+			c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			select {
+			case <-readDone:
+			case <-time.After(time.Second):
+			}
+			return
+		}
+	}
+}
+
+// percentiles formats the percentiles of the durations, which it sorts.
+func percentiles(ds []time.Duration) string {
+	if len(ds) == 0 {
+		return "none"
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	at := func(p float64) time.Duration {
+		return ds[int(p*float64(len(ds)-1))]
+	}
+	round := func(d time.Duration) time.Duration { return d.Round(time.Microsecond) }
+	return fmt.Sprintf("p50 %s, p90 %s, p99 %s, max %s", round(at(0.5)), round(at(0.9)), round(at(0.99)), round(ds[len(ds)-1]))
+}
+
+func main() {
+	url := flag.String("url", "ws://localhost:8080/echo", "URL of the endpoint to load")
+	mode := flag.String("mode", "echo", "what the endpoint does with a message: echo sends it back to its sender, broadcast to every client")
+	clients := flag.Int("clients", 100, "number of connections to open")
+	rate := flag.Float64("rate", 1, "messages per second for each client to send; zero sends none")
+	size := flag.Int("size", 64, "bytes of padding in each message")
+	duration := flag.Duration("duration", 30*time.Second, "how long to send messages for")
+	ramp := flag.Duration("ramp", 0, "time to spread opening the connections over")
+	timeout := flag.Duration("timeout", 15*time.Second, "how long to wait after the last message is sent for the rest to come back")
+	pingInterval := flag.Duration("ping-interval", 0, "how often each client pings the server; zero never does")
+	report := flag.Duration("report", 5*time.Second, "how often to report progress")
+	token := flag.String("token", "", "token to authenticate with, if the server requires one")
+	flag.Parse()
+
+	if (*mode != "echo" && *mode != "broadcast") || *clients < 1 || *rate < 0 || *size < 0 {
+		fmt.Fprintln(os.Stderr, "usage: loadtest [flags]")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	cfg := config{url: *url, rate: *rate, pingInterval: *pingInterval}
+	if *token != "" {
+		cfg.header = http.Header{"Authorization": {"Bearer " + *token}}
+	}
+	r := &run{
+		broadcast: *mode == "broadcast",
+		padding:   strings.Repeat("x", *size),
+		pending:   map[string]*sentMessage{},
+		errors:    map[string]int{},
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	connCtx, closeConns := context.WithCancel(context.Background())
+	start, stop := make(chan struct{}), make(chan struct{})
+	var wg, dialed sync.WaitGroup
+	var failed int64
+	began := time.Now()
+	for i := 0; i < *clients; i++ {
+		if *ramp > 0 && i > 0 {
+			select {
+			case <-time.After(*ramp / time.Duration(*clients)):
+			case <-ctx.Done():
+			}
+		}
+		wg.Add(1)
+		dialed.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			r.client(connCtx, id, cfg, start, stop, func(ok bool) {
+				if !ok {
+					atomic.AddInt64(&failed, 1)
+				}
+				dialed.Done()
+			})
+		}(i + 1)
+	}
+	dialed.Wait()
+	log.Printf("Connected %d of %d clients in %s", *clients-int(failed), *clients, time.Since(began).Round(time.Millisecond))
+
+	progress := time.NewTicker(*report)
+	defer progress.Stop()
+	logProgress := func() {
+		r.mut.Lock()
+		errs := 0
+		for _, n := range r.errors {
+			errs += n
+		}
+		received := r.received
+		r.mut.Unlock()
+		log.Printf("connected %d, sent %d, received %d, errors %d",
+			atomic.LoadInt64(&r.connected), atomic.LoadInt64(&r.sent), received, errs)
+	}
+
+	close(start)
+	sending := time.After(*duration)
+wait:
+	for {
+		select {
+		case <-sending:
+			break wait
+		case <-progress.C:
+			logProgress()
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	close(stop)
+	// The stragglers get the timeout to come back, unless they all have, or
+	// the run is interrupted.
+	deadline := time.After(*timeout)
+drain:
+	for {
+		r.mut.Lock()
+		left := len(r.pending)
+		r.mut.Unlock()
+		if left == 0 {
+			break
+		}
+		select {
+		case <-deadline:
+			break drain
+		case <-progress.C:
+			logProgress()
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			break drain
+		}
+	}
+	closeConns()
+	wg.Wait()
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	var missing int64
+	for _, m := range r.pending {
+		missing += m.remaining
+	}
+	if missing > 0 {
+		r.errors["missing"] += int(missing)
+	}
+	if r.pings > r.pongs {
+		r.errors["pong missing"] += int(r.pings - r.pongs)
+	}
+	fmt.Printf("clients   %d, %d failed to connect\n", *clients, failed)
+	fmt.Printf("messages  sent %d, received %d\n", r.sent, r.received)
+	fmt.Printf("latency   %s\n", percentiles(r.latencies))
+	if cfg.pingInterval > 0 {
+		fmt.Printf("ping rtt  %s\n", percentiles(r.rtts))
+	}
+	if len(r.errors) == 0 {
+		fmt.Println("errors    none")
+		return
+	}
+	kinds := make([]string, 0, len(r.errors))
+	for kind := range r.errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for i, kind := range kinds {
+		label := "errors   "
+		if i > 0 {
+			label = "         "
+		}
+		fmt.Printf("%s %s: %d\n", label, kind, r.errors[kind])
+	}
+	os.Exit(1)
+}
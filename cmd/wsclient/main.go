@@ -0,0 +1,146 @@
+// Command wsclient is a line-based client for the server, built on the client
+// package, so it stays connected through server restarts and dropped
+// connections. Every line read from standard input is sent as a text message,
+// and every message received is printed.
+//
+//	wsclient -url ws://localhost:8080/chat
+//
+// With -e2e, on /api, it talks privately with the other clients in its rooms,
+// by the ids presence gives them. "/key <id>" hands the peer its key, which
+// the peer hands back, and "/to <id> <message>" sends the peer a message that
+// the server can't read. Messages from peers are printed as "[<id>] ...".
+// That needs a build made with -tags nacl.
+//
+//	wsclient -e2e -url ws://localhost:8080/api
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"wsexample/client"
+)
+
+func main() {
+	url := flag.String("url", "ws://localhost:8080/ws", "URL of the server to connect to")
+	token := flag.String("token", "", "token to authenticate with, if the server requires one")
+	e2e := flag.Bool("e2e", false, "talk privately with peers on /api, with /key <id> and /to <id> <message>")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var box *client.Box
+	if *e2e {
+		var err error
+		if box, err = client.NewBox(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	c := &client.Client{
+		URL: *url,
+		OnConnect: func() {
+			log.Printf("Connected to %s", *url)
+		},
+		OnDisconnect: func(err error, retryIn time.Duration) {
+			log.Printf("Disconnected: %s; reconnecting in %s", err.Error(), retryIn.Round(time.Millisecond))
+		},
+	}
+
+	if *token != "" {
+		c.Header = http.Header{"Authorization": {"Bearer " + *token}}
+	}
+
+	// Closing standard input closes the connection.
+	go func() {
+		lines := bufio.NewScanner(os.Stdin)
+		for lines.Scan() {
+			messageType, message := websocket.TextMessage, []byte(lines.Text())
+			if box != nil {
+				var err error
+				if messageType, message, err = e2eCommand(box, lines.Text()); err != nil {
+					log.Print(err)
+					continue
+				}
+			}
+			if err := c.Send(ctx, messageType, message); err != nil {
+				break
+			}
+		}
+		c.Close()
+	}()
+
+	// The messages are ranged over, across reconnects, until Run returns.
+	go c.Run(ctx)
+	for m, err := range c.Messages(ctx) {
+		if err != nil {
+			log.Fatal(err)
+		}
+		printMessage(ctx, c, box, m)
+	}
+}
+
+// printMessage prints a message from the server, opening it, with -e2e, if it's
+// from a peer, and handing a peer that sends its key ours.
+func printMessage(ctx context.Context, c *client.Client, box *client.Box, m client.Message) {
+	if box == nil {
+		fmt.Println(string(m.Data))
+		return
+	}
+	if m.Type == websocket.BinaryMessage {
+		from, message, err := box.Open(m.Data)
+		if err != nil {
+			log.Printf("Couldn't open a message from peer %d: %s", from, err.Error())
+			return
+		}
+		fmt.Printf("[%d] %s\n", from, message)
+		return
+	}
+	from, isNew, err := box.ReadKey(m.Data)
+	switch {
+	case errors.Is(err, client.ErrNotKey):
+		fmt.Println(string(m.Data))
+	case err != nil:
+		log.Print(err)
+	case isNew:
+		log.Printf("Got the key of peer %d", from)
+		// Handing ours back, without holding up the reader.
+		go c.Send(ctx, websocket.TextMessage, box.KeyMessage(from))
+	}
+}
+
+// e2eCommand gives the message to send for a line, with -e2e: the key for
+// "/key <id>", the sealed message for "/to <id> <message>", or the line
+// itself.
+func e2eCommand(box *client.Box, line string) (int, []byte, error) {
+	command, rest, _ := strings.Cut(line, " ")
+	if command != "/key" && command != "/to" {
+		return websocket.TextMessage, []byte(line), nil
+	}
+	idText, message, _ := strings.Cut(rest, " ")
+	id, err := strconv.ParseUint(idText, 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("expected %s <id>, where the id is a peer's, from presence", command)
+	}
+	if command == "/key" {
+		return websocket.TextMessage, box.KeyMessage(id), nil
+	}
+	frame, err := box.Seal(id, []byte(message))
+	if err != nil {
+		return 0, nil, fmt.Errorf("couldn't seal the message for peer %d: %w; send it your key with /key %d first", id, err, id)
+	}
+	return websocket.BinaryMessage, frame, nil
+}
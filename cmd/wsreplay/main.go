@@ -0,0 +1,185 @@
+// Command wsreplay plays back the client's side of a recorded session against
+// a live server, and checks that the server answers the same way it did when
+// the session was recorded.
+//
+// Every message the client sent is sent again, at the same offset from the
+// start of the session as it originally was (or scaled with -speed). Every
+// message the server sends back is compared against what the server sent in
+// the recording, in order, and each one that differs is reported. With
+// -unordered, the responses only need to match as a whole, in any order.
+//
+//	wsreplay -url ws://localhost:8080/ws recordings/conn-1-1700000000.jsonl
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"wsexample/internal/recording"
+)
+
+type received struct {
+	offset time.Duration
+	kind   string
+	data   []byte
+}
+
+func main() {
+	url := flag.String("url", "ws://localhost:8080/ws", "URL of the server to replay against")
+	speed := flag.Float64("speed", 1, "playback speed; 2 plays back twice as fast")
+	wait := flag.Duration("wait", 15*time.Second, "how long to wait after the last message for the rest of the responses")
+	unordered := flag.Bool("unordered", false, "compare responses regardless of the order they arrived in")
+	flag.Parse()
+
+	if flag.NArg() != 1 || *speed <= 0 {
+		fmt.Fprintln(os.Stderr, "usage: wsreplay [flags] recording.jsonl")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	records, err := recording.Read(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("Failed to read the recording: %s", err.Error())
+	}
+
+	var inbound, outbound []recording.Record
+	for _, r := range records {
+		if !r.IsMessage() {
+			continue
+		}
+		if r.Direction == recording.In {
+			inbound = append(inbound, r)
+		} else {
+			outbound = append(outbound, r)
+		}
+	}
+
+	c, _, err := websocket.DefaultDialer.Dial(*url, nil)
+	if err != nil {
+		log.Fatalf("Failed to connect: %s", err.Error())
+	}
+	defer c.Close()
+
+	start := time.Now()
+	responses := make(chan received)
+	go func() {
+		defer close(responses)
+		for {
+			messageType, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			kind := recording.Text
+			if messageType == websocket.BinaryMessage {
+				kind = recording.Binary
+			}
+			responses <- received{time.Since(start), kind, data}
+		}
+	}()
+
+	scale := func(d time.Duration) time.Duration {
+		return time.Duration(float64(d) / *speed)
+	}
+
+	var got []received
+	collect := func(until time.Time) bool {
+		timer := time.NewTimer(time.Until(until))
+		defer timer.Stop()
+		for {
+			select {
+			case r, ok := <-responses:
+				if !ok {
+					return false
+				}
+				got = append(got, r)
+			case <-timer.C:
+				return true
+			}
+		}
+	}
+
+	open := true
+	for _, r := range inbound {
+		if open = collect(start.Add(scale(r.Offset))); !open {
+			log.Printf("The server closed the connection before the recording was done")
+			break
+		}
+		messageType := websocket.TextMessage
+		if r.Kind == recording.Binary {
+			messageType = websocket.BinaryMessage
+		}
+		if err := c.WriteMessage(messageType, r.Data); err != nil {
+			log.Fatalf("Failed to send: %s", err.Error())
+		}
+	}
+	if open {
+		deadline := time.Now().Add(*wait)
+		for len(got) < len(outbound) && time.Now().Before(deadline) {
+			if !collect(time.Now().Add(100 * time.Millisecond)) {
+				break
+			}
+		}
+	}
+
+	divergences := compare(outbound, got, *unordered)
+	for _, d := range divergences {
+		fmt.Println(d)
+	}
+	if len(divergences) > 0 {
+		fmt.Printf("%d divergences in %d responses\n", len(divergences), len(outbound))
+		os.Exit(1)
+	}
+	fmt.Printf("All %d responses matched\n", len(outbound))
+}
+
+func compare(expected []recording.Record, got []received, unordered bool) []string {
+	if unordered {
+		return compareUnordered(expected, got)
+	}
+
+	var divergences []string
+	for i := 0; i < len(expected) || i < len(got); i++ {
+		switch {
+		case i >= len(got):
+			divergences = append(divergences, fmt.Sprintf("#%d: expected %s %q at %s, got nothing", i, expected[i].Kind, expected[i].Data, expected[i].Offset))
+		case i >= len(expected):
+			divergences = append(divergences, fmt.Sprintf("#%d: expected nothing, got %s %q at %s", i, got[i].kind, got[i].data, got[i].offset))
+		case expected[i].Kind != got[i].kind || string(expected[i].Data) != string(got[i].data):
+			divergences = append(divergences, fmt.Sprintf("#%d: expected %s %q, got %s %q", i, expected[i].Kind, expected[i].Data, got[i].kind, got[i].data))
+		}
+	}
+	return divergences
+}
+
+func compareUnordered(expected []recording.Record, got []received) []string {
+	counts := map[string]int{}
+	for _, r := range expected {
+		counts[r.Kind+" "+fmt.Sprintf("%q", r.Data)]++
+	}
+	for _, r := range got {
+		counts[r.kind+" "+fmt.Sprintf("%q", r.data)]--
+	}
+
+	var divergences []string
+	for message, n := range counts {
+		switch {
+		case n > 0:
+			divergences = append(divergences, fmt.Sprintf("missing %s (x%d)", message, n))
+		case n < 0:
+			divergences = append(divergences, fmt.Sprintf("unexpected %s (x%d)", message, -n))
+		}
+	}
+	sort.Strings(divergences)
+	return divergences
+}
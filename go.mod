@@ -1,8 +1,10 @@
 module wsexample
 
-go 1.18
+go 1.23
 
 require (
+	github.com/coder/websocket v1.8.13
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.5.0
+	golang.org/x/sync v0.1.0
 )
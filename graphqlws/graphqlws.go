@@ -0,0 +1,373 @@
+// Package graphqlws implements the server side of the graphql-transport-ws
+// subprotocol, which carries GraphQL subscriptions over a WebSocket:
+//
+//	https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+//
+// Only the transport is implemented. Executing the operations is up to the
+// SubscriptionResolver, which hands back a channel of results for every
+// subscribe message. Every result is sent to the client as a next message,
+// and closing the channel completes the subscription.
+//
+// Protocol violations close the connection with the codes given by the spec:
+//
+//	4400  invalid message
+//	4401  subscribe before the connection was acknowledged
+//	4403  connection_init rejected by OnInit
+//	4406  the subprotocol wasn't negotiated
+//	4408  no connection_init within the init timeout
+//	4409  a subscription with the same id is already running
+//	4429  more than one connection_init
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocol is the name to negotiate during the WebSocket handshake.
+const Subprotocol = "graphql-transport-ws"
+
+// Close codes.
+const (
+	CloseBadRequest         = 4400
+	CloseUnauthorized       = 4401
+	CloseForbidden          = 4403
+	CloseBadSubprotocol     = 4406
+	CloseInitTimeout        = 4408
+	CloseSubscriberExists   = 4409
+	CloseTooManyInitRequest = 4429
+)
+
+// Message types.
+const (
+	typeConnectionInit = "connection_init"
+	typeConnectionAck  = "connection_ack"
+	typePing           = "ping"
+	typePong           = "pong"
+	typeSubscribe      = "subscribe"
+	typeNext           = "next"
+	typeError          = "error"
+	typeComplete       = "complete"
+)
+
+// Conn is a WebSocket connection. Messages use gorilla/websocket's message
+// types.
+type Conn interface {
+	// ReadMessage reads the next message. A read in progress is only
+	// interrupted by closing the connection.
+	ReadMessage(ctx context.Context) (messageType int, data []byte, err error)
+
+	// WriteMessage writes a message. Serve never calls it from more than one
+	// goroutine at a time.
+	WriteMessage(ctx context.Context, messageType int, data []byte) error
+
+	// Subprotocol gives the negotiated subprotocol.
+	Subprotocol() string
+
+	// Close sends a close frame with the given code and reason, and closes the
+	// connection.
+	Close(code int, reason string) error
+}
+
+// Request is the payload of a subscribe message.
+type Request struct {
+	OperationName string                 `json:"operationName,omitempty"`
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	Extensions    map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// Result is the payload of a next message.
+type Result struct {
+	Data       interface{}            `json:"data,omitempty"`
+	Errors     Errors                 `json:"errors,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// Error is a GraphQL error.
+type Error struct {
+	Message    string                 `json:"message"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// Errors is a list of GraphQL errors. It's also an error itself, so that a
+// resolver can return it to have the client get exactly these errors.
+type Errors []Error
+
+func (errs Errors) Error() string {
+	if len(errs) == 0 {
+		return "no errors"
+	}
+	if len(errs) == 1 {
+		return errs[0].Message
+	}
+	return fmt.Sprintf("%s (and %d more errors)", errs[0].Message, len(errs)-1)
+}
+
+// A SubscriptionResolver starts the operations that clients subscribe to.
+type SubscriptionResolver interface {
+	// Subscribe starts the operation. The operation runs until it closes the
+	// channel, or until ctx is done, which happens when the client cancels the
+	// subscription or goes away. An error rejects the operation outright; it's
+	// sent to the client as an error message.
+	Subscribe(ctx context.Context, req Request) (<-chan Result, error)
+}
+
+// ProtocolError is what Serve returns when it closed the connection because
+// the client didn't follow the protocol.
+type ProtocolError struct {
+	Code   int
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("graphql-transport-ws: close %d: %s", e.Code, e.Reason)
+}
+
+// Server serves the graphql-transport-ws subprotocol. It can serve any number
+// of connections at once.
+type Server struct {
+	Resolver SubscriptionResolver
+
+	// OnInit, when set, is given the payload of the connection_init message
+	// (which is nil without one), typically to authenticate the client. An
+	// error closes the connection as forbidden. Otherwise, the context it
+	// returns, which must be derived from ctx, is the one that every
+	// subscription of the connection is started with, so it can carry whatever
+	// the resolver needs to know about the client.
+	OnInit func(ctx context.Context, payload json.RawMessage) (context.Context, error)
+
+	// InitTimeout is how long the client has to send connection_init. Zero
+	// means forever.
+	InitTimeout time.Duration
+
+	// WriteTimeout bounds every write to the client. Zero means no bound.
+	WriteTimeout time.Duration
+}
+
+type message struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// conn is the state of one connection being served.
+type conn struct {
+	srv *Server
+	c   Conn
+
+	writeMu sync.Mutex
+
+	// Set once connection_init has been received, and acked once it has been
+	// accepted. The init timer sets timedOut when it closes the connection.
+	initReceived int32
+	acked        int32
+	timedOut     int32
+	initCtx      context.Context
+
+	mu   sync.Mutex
+	subs map[string]context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+// Serve speaks the protocol over c until the connection goes away, or until
+// the client breaks the protocol, in which case c is closed with the
+// appropriate code and a *ProtocolError is returned. Either way, every
+// subscription is cancelled, and Serve waits for all of them to end before
+// returning.
+//
+// Cancelling ctx doesn't interrupt Serve; closing c does.
+func (srv *Server) Serve(ctx context.Context, c Conn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	sc := &conn{srv: srv, c: c, initCtx: ctx, subs: make(map[string]context.CancelFunc)}
+	defer func() {
+		cancel()
+		sc.wg.Wait()
+	}()
+
+	if c.Subprotocol() != Subprotocol {
+		return sc.close(CloseBadSubprotocol, "Subprotocol not acceptable")
+	}
+
+	if srv.InitTimeout > 0 {
+		timer := time.AfterFunc(srv.InitTimeout, func() {
+			if atomic.LoadInt32(&sc.initReceived) == 0 {
+				atomic.StoreInt32(&sc.timedOut, 1)
+				sc.close(CloseInitTimeout, "Connection initialisation timeout")
+			}
+		})
+		defer timer.Stop()
+	}
+
+	for {
+		messageType, data, err := c.ReadMessage(context.Background())
+		if err != nil {
+			if atomic.LoadInt32(&sc.timedOut) == 1 {
+				return &ProtocolError{CloseInitTimeout, "Connection initialisation timeout"}
+			}
+			return err
+		}
+		if messageType != websocket.TextMessage {
+			return sc.close(CloseBadRequest, "Invalid message received")
+		}
+		var m message
+		if err := json.Unmarshal(data, &m); err != nil || m.Type == "" {
+			return sc.close(CloseBadRequest, "Invalid message received")
+		}
+		if err := sc.handle(ctx, m); err != nil {
+			return err
+		}
+	}
+}
+
+func (sc *conn) handle(ctx context.Context, m message) error {
+	switch m.Type {
+	case typePing:
+		return sc.write(message{Type: typePong})
+
+	case typePong:
+		return nil
+
+	case typeConnectionInit:
+		if !atomic.CompareAndSwapInt32(&sc.initReceived, 0, 1) {
+			return sc.close(CloseTooManyInitRequest, "Too many initialisation requests")
+		}
+		if sc.srv.OnInit != nil {
+			initCtx, err := sc.srv.OnInit(ctx, m.Payload)
+			if err != nil {
+				return sc.close(CloseForbidden, "Forbidden")
+			}
+			if initCtx != nil {
+				sc.initCtx = initCtx
+			}
+		}
+		atomic.StoreInt32(&sc.acked, 1)
+		return sc.write(message{Type: typeConnectionAck})
+
+	case typeSubscribe:
+		if atomic.LoadInt32(&sc.acked) == 0 {
+			return sc.close(CloseUnauthorized, "Unauthorized")
+		}
+		var req Request
+		if m.ID == "" || json.Unmarshal(m.Payload, &req) != nil || req.Query == "" {
+			return sc.close(CloseBadRequest, "Invalid message received")
+		}
+		return sc.subscribe(m.ID, req)
+
+	case typeComplete:
+		if m.ID == "" {
+			return sc.close(CloseBadRequest, "Invalid message received")
+		}
+		// The client doesn't expect a complete back for a subscription it
+		// completed itself, and it may well have already ended on its own.
+		sc.mu.Lock()
+		if cancel, ok := sc.subs[m.ID]; ok {
+			delete(sc.subs, m.ID)
+			cancel()
+		}
+		sc.mu.Unlock()
+		return nil
+	}
+	return sc.close(CloseBadRequest, fmt.Sprintf("Unexpected message of type %q received", m.Type))
+}
+
+func (sc *conn) subscribe(id string, req Request) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.subs[id]; ok {
+		return sc.close(CloseSubscriberExists, fmt.Sprintf("Subscriber for %s already exists", id))
+	}
+	ctx, cancel := context.WithCancel(sc.initCtx)
+	sc.subs[id] = cancel
+
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		defer cancel()
+		sc.run(ctx, id, req)
+	}()
+	return nil
+}
+
+// run runs a single subscription, until the resolver ends it, or ctx is done.
+func (sc *conn) run(ctx context.Context, id string, req Request) {
+	results, err := sc.srv.Resolver.Subscribe(ctx, req)
+	if err != nil {
+		if sc.end(ctx, id) {
+			var errs Errors
+			if !errors.As(err, &errs) {
+				errs = Errors{{Message: err.Error()}}
+			}
+			sc.write(message{ID: id, Type: typeError, Payload: marshal(errs)})
+		}
+		return
+	}
+	for {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				if sc.end(ctx, id) {
+					sc.write(message{ID: id, Type: typeComplete})
+				}
+				return
+			}
+			if err := sc.write(message{ID: id, Type: typeNext, Payload: marshal(result)}); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// end forgets about a subscription that's ending on the server's side, and
+// reports whether the client still needs to be told about it. It doesn't once
+// the client has completed it, or gone away.
+func (sc *conn) end(ctx context.Context, id string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	// The id is free for the client to use again as soon as it learns that
+	// this subscription ended, so it's freed before telling it.
+	delete(sc.subs, id)
+	return true
+}
+
+func marshal(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(Errors{{Message: "failed to encode the result: " + err.Error()}})
+	}
+	return data
+}
+
+func (sc *conn) write(m message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	ctx := context.Background()
+	if sc.srv.WriteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sc.srv.WriteTimeout)
+		defer cancel()
+	}
+	return sc.c.WriteMessage(ctx, websocket.TextMessage, data)
+}
+
+// close closes the connection for breaking the protocol.
+func (sc *conn) close(code int, reason string) error {
+	sc.c.Close(code, reason)
+	return &ProtocolError{code, reason}
+}
@@ -0,0 +1,238 @@
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeConn is a Conn whose client side is driven by the test: what's sent on
+// in is read, what the server writes comes out of out, and closing it
+// remembers the code.
+type fakeConn struct {
+	subprotocol string
+	in          chan frame
+	out         chan message
+
+	once   sync.Once
+	closed chan struct{}
+	code   int
+	reason string
+}
+
+type frame struct {
+	messageType int
+	data        string
+}
+
+func newFakeConn(subprotocol string) *fakeConn {
+	return &fakeConn{
+		subprotocol: subprotocol,
+		in:          make(chan frame),
+		out:         make(chan message, 16),
+		closed:      make(chan struct{}),
+	}
+}
+
+func (c *fakeConn) ReadMessage(ctx context.Context) (int, []byte, error) {
+	select {
+	case f := <-c.in:
+		return f.messageType, []byte(f.data), nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *fakeConn) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	var m message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	select {
+	case c.out <- m:
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+func (c *fakeConn) Subprotocol() string { return c.subprotocol }
+
+func (c *fakeConn) Close(code int, reason string) error {
+	c.once.Do(func() {
+		c.code, c.reason = code, reason
+		close(c.closed)
+	})
+	return nil
+}
+
+// send has the client send a text message, or fails if the server has
+// stopped reading.
+func (c *fakeConn) send(t *testing.T, data string) {
+	t.Helper()
+	select {
+	case c.in <- frame{websocket.TextMessage, data}:
+	case <-c.closed:
+		t.Fatalf("closed with %d %q before %s was sent", c.code, c.reason, data)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s wasn't read", data)
+	}
+}
+
+// expect waits for the server to write a message of the given type, and
+// gives it.
+func (c *fakeConn) expect(t *testing.T, typ string) message {
+	t.Helper()
+	select {
+	case m := <-c.out:
+		if m.Type != typ {
+			t.Fatalf("got a %s message, want %s", m.Type, typ)
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s message", typ)
+	}
+	return message{}
+}
+
+// blockingResolver starts subscriptions that send nothing and last until
+// they're cancelled, except for a query of "done", which sends one result and
+// completes, and "fail", which is rejected.
+type blockingResolver struct{}
+
+func (blockingResolver) Subscribe(ctx context.Context, req Request) (<-chan Result, error) {
+	if req.Query == "fail" {
+		return nil, errors.New("rejected")
+	}
+	results := make(chan Result)
+	go func() {
+		if req.Query == "done" {
+			results <- Result{Data: "once"}
+			close(results)
+		}
+	}()
+	return results, nil
+}
+
+func TestServeProtocolErrors(t *testing.T) {
+	const (
+		connectionInit = `{"type":"connection_init"}`
+		subscribe      = `{"id":"1","type":"subscribe","payload":{"query":"subscription { clock }"}}`
+	)
+	tests := []struct {
+		name        string
+		subprotocol string
+		onInit      func(context.Context, json.RawMessage) (context.Context, error)
+		send        []string
+		binary      bool
+		want        int
+	}{
+		{name: "init timeout", want: CloseInitTimeout},
+		{name: "subscribe before ack", send: []string{subscribe}, want: CloseUnauthorized},
+		{name: "duplicate id", send: []string{connectionInit, subscribe, subscribe}, want: CloseSubscriberExists},
+		{name: "second init", send: []string{connectionInit, connectionInit}, want: CloseTooManyInitRequest},
+		{name: "wrong subprotocol", subprotocol: "graphql-ws", want: CloseBadSubprotocol},
+		{
+			name:   "init rejected",
+			onInit: func(context.Context, json.RawMessage) (context.Context, error) { return nil, errors.New("no") },
+			send:   []string{connectionInit},
+			want:   CloseForbidden,
+		},
+		{name: "binary", binary: true, want: CloseBadRequest},
+		{name: "not json", send: []string{`{`}, want: CloseBadRequest},
+		{name: "no type", send: []string{`{"id":"1"}`}, want: CloseBadRequest},
+		{name: "unknown type", send: []string{`{"type":"start"}`}, want: CloseBadRequest},
+		{name: "subscribe without id", send: []string{connectionInit, `{"type":"subscribe","payload":{"query":"q"}}`}, want: CloseBadRequest},
+		{name: "subscribe without query", send: []string{connectionInit, `{"id":"1","type":"subscribe","payload":{}}`}, want: CloseBadRequest},
+		{name: "complete without id", send: []string{connectionInit, `{"type":"complete"}`}, want: CloseBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.subprotocol == "" {
+				tt.subprotocol = Subprotocol
+			}
+			c := newFakeConn(tt.subprotocol)
+			srv := &Server{Resolver: blockingResolver{}, OnInit: tt.onInit, InitTimeout: 100 * time.Millisecond}
+			served := make(chan error, 1)
+			go func() { served <- srv.Serve(context.Background(), c) }()
+
+			for _, data := range tt.send {
+				c.send(t, data)
+			}
+			if tt.binary {
+				c.in <- frame{websocket.BinaryMessage, connectionInit}
+			}
+
+			var err error
+			select {
+			case err = <-served:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Serve didn't return")
+			}
+			var protocolErr *ProtocolError
+			if !errors.As(err, &protocolErr) || protocolErr.Code != tt.want {
+				t.Fatalf("Serve() error = %v, want a protocol error with code %d", err, tt.want)
+			}
+			if c.code != tt.want {
+				t.Fatalf("closed with %d %q, want %d", c.code, c.reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeSubscriptions(t *testing.T) {
+	c := newFakeConn(Subprotocol)
+	srv := &Server{Resolver: blockingResolver{}, InitTimeout: 100 * time.Millisecond}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background(), c) }()
+
+	c.send(t, `{"type":"connection_init","payload":{"token":"x"}}`)
+	c.expect(t, typeConnectionAck)
+	// Past the init timeout, once acked, the connection stays up.
+	time.Sleep(200 * time.Millisecond)
+	c.send(t, `{"type":"ping"}`)
+	c.expect(t, typePong)
+
+	// A subscription that ends on its own is completed, and its id can be
+	// used again.
+	for i := 0; i < 2; i++ {
+		c.send(t, `{"id":"a","type":"subscribe","payload":{"query":"done"}}`)
+		if m := c.expect(t, typeNext); m.ID != "a" || string(m.Payload) != `{"data":"once"}` {
+			t.Fatalf("next %s %s, want the result for a", m.ID, m.Payload)
+		}
+		c.expect(t, typeComplete)
+	}
+
+	// As can the id of one the client completed.
+	c.send(t, `{"id":"b","type":"subscribe","payload":{"query":"forever"}}`)
+	c.send(t, `{"id":"b","type":"complete"}`)
+	c.send(t, `{"id":"b","type":"subscribe","payload":{"query":"forever"}}`)
+
+	// One the resolver rejects gets an error instead.
+	c.send(t, `{"id":"c","type":"subscribe","payload":{"query":"fail"}}`)
+	if m := c.expect(t, typeError); m.ID != "c" || string(m.Payload) != `[{"message":"rejected"}]` {
+		t.Fatalf("error %s %s, want the resolver's error for c", m.ID, m.Payload)
+	}
+
+	// Serve returns once the connection goes away, with b still running.
+	c.Close(websocket.CloseNormalClosure, "")
+	select {
+	case err := <-served:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Serve() error = %v, want the read error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return after the connection closed")
+	}
+	select {
+	case m := <-c.out:
+		t.Fatalf("unexpected %s message", m.Type)
+	default:
+	}
+}
@@ -0,0 +1,80 @@
+// Package latency measures round trips over WebSocket pings, for both the
+// server and the client. A ping carries the time it was sent as its
+// application data, which the pong has to echo back, so the round trip can be
+// told from the pong alone, and a pong that's late for an earlier ping can
+// be told apart from the one for the latest.
+//
+// The payload is the time in nanoseconds since the Unix epoch, as 8 bytes,
+// big-endian. Only the host that sent the ping ever reads the time back, so
+// the clocks of the two hosts never come into it.
+package latency
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Samples is how many round trips Window averages over.
+const Samples = 8
+
+// Payload gives the application data of a ping sent at t.
+func Payload(t time.Time) []byte {
+	var p [8]byte
+	binary.BigEndian.PutUint64(p[:], uint64(t.UnixNano()))
+	return p[:]
+}
+
+// Sent gives the time the ping with the payload was sent, if it's one of
+// Payload's.
+func Sent(payload []byte) (time.Time, bool) {
+	if len(payload) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(payload))), true
+}
+
+// Window keeps the last few round trips. The zero value is ready to use, and
+// it's safe for concurrent use.
+type Window struct {
+	mut     sync.Mutex
+	samples [Samples]time.Duration
+	n       int
+	next    int
+}
+
+// Observe adds a round trip.
+func (w *Window) Observe(rtt time.Duration) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	w.samples[w.next] = rtt
+	w.next = (w.next + 1) % Samples
+	if w.n < Samples {
+		w.n++
+	}
+}
+
+// Last gives the latest round trip, or zero if there hasn't been one.
+func (w *Window) Last() time.Duration {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	if w.n == 0 {
+		return 0
+	}
+	return w.samples[(w.next+Samples-1)%Samples]
+}
+
+// Average gives the average of the last Samples round trips, or of as many as
+// there have been, or zero if there haven't been any.
+func (w *Window) Average() time.Duration {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	if w.n == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, rtt := range w.samples[:w.n] {
+		sum += rtt
+	}
+	return sum / time.Duration(w.n)
+}
@@ -0,0 +1,319 @@
+// Package protowire encodes Go structs in the protocol buffers wire format,
+// without generated code.
+//
+// Each field to encode has its field number in a pb tag:
+//
+//	type Room struct {
+//		Name string `pb:"1"`
+//	}
+//
+// Fields can be strings, byte slices, bools, signed and unsigned integers,
+// which are encoded as varints (like int64 and uint64 in a .proto file), and
+// floats, which are encoded as fixed32 and fixed64 (like float and double),
+// and slices of strings and of structs, which are encoded as repeated strings
+// and repeated embedded messages.
+// Fields without a tag are left alone. Zero values aren't encoded, as in
+// proto3, and fields that Unmarshal doesn't know are skipped.
+//
+// Messages can also be written one after another, each prefixed with its
+// length as a varint, the same as protobuf's delimited format.
+package protowire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// Wire types.
+const (
+	varintType  = 0
+	fixed64Type = 1
+	bytesType   = 2
+	fixed32Type = 5
+)
+
+var errTruncated = errors.New("protowire: message is truncated")
+
+// Marshal encodes v, which must be a struct or a pointer to one.
+func Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("protowire: can't marshal %T", v)
+	}
+	var b []byte
+	for i := 0; i < rv.NumField(); i++ {
+		num, ok, err := fieldNumber(rv.Type().Field(i))
+		if err != nil {
+			return nil, err
+		}
+		if !ok || rv.Field(i).IsZero() {
+			continue
+		}
+		if b, err = appendField(b, num, rv.Field(i)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Check tells whether values of the type, which must be a struct, can be
+// encoded and decoded, and if not, why, so that a type that can't be doesn't
+// have to wait for a value with the wrong field set to show it.
+func Check(t reflect.Type) error {
+	if t.Kind() != reflect.Struct {
+		return fmt.Errorf("protowire: can't encode a %s, only structs", t)
+	}
+	seen := map[uint64]string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		num, ok, err := fieldNumber(f)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if other, ok := seen[num]; ok {
+			return fmt.Errorf("protowire: fields %s and %s have the same field number, %d", other, f.Name, num)
+		}
+		seen[num] = f.Name
+		if err := checkKind(f.Type); err != nil {
+			return fmt.Errorf("protowire: field %s: %w", f.Name, err)
+		}
+	}
+	// Fields without tags are left alone, but a struct with nothing but
+	// those is more likely missing its tags than meant to be empty.
+	if len(seen) == 0 && t.NumField() > 0 {
+		return fmt.Errorf("protowire: %s has no fields with pb tags", t)
+	}
+	return nil
+}
+
+func checkKind(t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return nil
+	case reflect.Slice:
+		switch t.Elem().Kind() {
+		case reflect.Uint8, reflect.String:
+			return nil
+		case reflect.Struct:
+			return Check(t.Elem())
+		}
+	}
+	return fmt.Errorf("can't encode a %s", t)
+}
+
+// Unmarshal decodes data into v, which must be a pointer to a struct.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("protowire: can't unmarshal into %T", v)
+	}
+	rv = rv.Elem()
+	fields := map[uint64]int{}
+	for i := 0; i < rv.NumField(); i++ {
+		num, ok, err := fieldNumber(rv.Type().Field(i))
+		if err != nil {
+			return err
+		}
+		if ok {
+			fields[num] = i
+		}
+	}
+
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		num, wireType := key>>3, int(key&7)
+		value, rest, err := splitValue(data, wireType)
+		if err != nil {
+			return err
+		}
+		data = rest
+		i, ok := fields[num]
+		if !ok {
+			continue
+		}
+		if err := setField(rv.Field(i), wireType, value); err != nil {
+			return fmt.Errorf("protowire: field %s: %w", rv.Type().Field(i).Name, err)
+		}
+	}
+	return nil
+}
+
+// AppendDelimited appends the message to b, prefixed with its length.
+func AppendDelimited(b, message []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(message)))
+	return append(b, message...)
+}
+
+// SplitDelimited splits data into the messages in it, each of which is
+// prefixed with its length.
+func SplitDelimited(data []byte) ([][]byte, error) {
+	var messages [][]byte
+	for len(data) > 0 {
+		message, rest, err := splitValue(data, bytesType)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+		data = rest
+	}
+	return messages, nil
+}
+
+func fieldNumber(f reflect.StructField) (uint64, bool, error) {
+	tag, ok := f.Tag.Lookup("pb")
+	if !ok {
+		return 0, false, nil
+	}
+	num, err := strconv.ParseUint(tag, 10, 29)
+	if err != nil || num == 0 {
+		return 0, false, fmt.Errorf("protowire: field %s has a bad field number %q", f.Name, tag)
+	}
+	return num, true, nil
+}
+
+func appendField(b []byte, num uint64, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.String:
+		b = binary.AppendUvarint(b, num<<3|bytesType)
+		return AppendDelimited(b, []byte(v.String())), nil
+	case reflect.Slice:
+		switch v.Type().Elem().Kind() {
+		case reflect.Uint8:
+			b = binary.AppendUvarint(b, num<<3|bytesType)
+			return AppendDelimited(b, v.Bytes()), nil
+		case reflect.Struct:
+			for i := 0; i < v.Len(); i++ {
+				m, err := Marshal(v.Index(i).Interface())
+				if err != nil {
+					return nil, err
+				}
+				b = binary.AppendUvarint(b, num<<3|bytesType)
+				b = AppendDelimited(b, m)
+			}
+			return b, nil
+		case reflect.String:
+			for i := 0; i < v.Len(); i++ {
+				b = binary.AppendUvarint(b, num<<3|bytesType)
+				b = AppendDelimited(b, []byte(v.Index(i).String()))
+			}
+			return b, nil
+		}
+	case reflect.Bool:
+		b = binary.AppendUvarint(b, num<<3|varintType)
+		return append(b, 1), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b = binary.AppendUvarint(b, num<<3|varintType)
+		return binary.AppendUvarint(b, uint64(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		b = binary.AppendUvarint(b, num<<3|varintType)
+		return binary.AppendUvarint(b, v.Uint()), nil
+	case reflect.Float32:
+		b = binary.AppendUvarint(b, num<<3|fixed32Type)
+		return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		b = binary.AppendUvarint(b, num<<3|fixed64Type)
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(v.Float())), nil
+	}
+	return nil, fmt.Errorf("protowire: can't marshal a field of type %s", v.Type())
+}
+
+// splitValue splits the value of the wire type off the front of data.
+func splitValue(data []byte, wireType int) (value, rest []byte, err error) {
+	switch wireType {
+	case varintType:
+		_, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, nil, errTruncated
+		}
+		return data[:n], data[n:], nil
+	case fixed64Type:
+		if len(data) < 8 {
+			return nil, nil, errTruncated
+		}
+		return data[:8], data[8:], nil
+	case fixed32Type:
+		if len(data) < 4 {
+			return nil, nil, errTruncated
+		}
+		return data[:4], data[4:], nil
+	case bytesType:
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size > uint64(len(data)-n) {
+			return nil, nil, errTruncated
+		}
+		end := n + int(size)
+		return data[n:end], data[end:], nil
+	}
+	return nil, nil, fmt.Errorf("protowire: unsupported wire type %d", wireType)
+}
+
+func setField(v reflect.Value, wireType int, value []byte) error {
+	want := varintType
+	switch v.Kind() {
+	case reflect.String, reflect.Slice:
+		want = bytesType
+	case reflect.Float32:
+		want = fixed32Type
+	case reflect.Float64:
+		want = fixed64Type
+	}
+	if wireType != want {
+		return fmt.Errorf("wire type %d can't go in a %s", wireType, v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(value))
+		return nil
+	case reflect.Slice:
+		switch v.Type().Elem().Kind() {
+		case reflect.Uint8:
+			v.SetBytes(append([]byte(nil), value...))
+			return nil
+		case reflect.Struct:
+			// Each element of a repeated field comes as a field of its own.
+			e := reflect.New(v.Type().Elem())
+			if err := Unmarshal(value, e.Interface()); err != nil {
+				return err
+			}
+			v.Set(reflect.Append(v, e.Elem()))
+			return nil
+		case reflect.String:
+			v.Set(reflect.Append(v, reflect.ValueOf(string(value)).Convert(v.Type().Elem())))
+			return nil
+		}
+	case reflect.Float32:
+		v.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(value))))
+		return nil
+	case reflect.Float64:
+		v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(value)))
+		return nil
+	}
+
+	x, _ := binary.Uvarint(value)
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(x != 0)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(x))
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(x)
+		return nil
+	}
+	return fmt.Errorf("can't unmarshal into a %s", v.Type())
+}
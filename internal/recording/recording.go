@@ -0,0 +1,83 @@
+// Package recording defines the format that sessions are recorded in.
+//
+// A recording is a JSON Lines file, with one Record per line. Records are in
+// the order they happened, and each one has an offset from when the session
+// started, measured with a monotonic clock.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Kinds of record.
+const (
+	// The session started.
+	Open = "open"
+
+	// Text and binary messages.
+	Text   = "text"
+	Binary = "binary"
+
+	// The session ended.
+	Close = "close"
+)
+
+// Directions of messages.
+const (
+	In  = "in"
+	Out = "out"
+)
+
+type Record struct {
+	Offset time.Duration `json:"offset_ns"`
+	Kind   string        `json:"kind"`
+
+	// For messages.
+	Direction string `json:"dir,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+
+	// For open records.
+	Conn uint64     `json:"conn,omitempty"`
+	Peer string     `json:"peer,omitempty"`
+	Time *time.Time `json:"time,omitempty"`
+
+	// For close records, why the session ended.
+	Reason string `json:"reason,omitempty"`
+}
+
+// IsMessage tells whether the record is of a text or binary message.
+func (r Record) IsMessage() bool {
+	return r.Kind == Text || r.Kind == Binary
+}
+
+// Writer writes records. It's not safe for concurrent use.
+type Writer struct {
+	enc *json.Encoder
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{json.NewEncoder(w)}
+}
+
+func (w *Writer) Write(r Record) error {
+	return w.enc.Encode(r)
+}
+
+// Read reads every record of a recording.
+func Read(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	// Messages can be up to the read limit, which doesn't fit the default.
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,257 @@
+// Package validate checks the fields of Go structs against rules in their
+// validate tags:
+//
+//	type Room struct {
+//		Name string `json:"name" validate:"required,max=64"`
+//		Kind string `json:"kind" validate:"oneof=public private"`
+//	}
+//
+// The rules are:
+//
+//   - required: the field can't be its zero value, or, for a slice or a map,
+//     empty;
+//   - min=N and max=N: a string has at least or at most N bytes, a slice or a
+//     map at least or at most N elements, and a number is at least or at most
+//     N;
+//   - oneof=a b c: a string or a number is one of the values, separated by
+//     spaces.
+//
+// Rules other than required don't apply to a field that's its zero value, so
+// that optional fields can be left out. The fields of embedded and nested
+// structs, and of the structs in slices, are checked too. Fields without a
+// tag, other than structs, are left alone.
+//
+// Fields are named in the errors as they are in JSON, going by their json
+// tags, with nested ones joined by dots and the elements of slices indexed, as
+// in members[2].user.
+package validate
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// FieldError is a field that breaks one of its rules.
+type FieldError struct {
+	// The field's name, as it is in JSON.
+	Field string
+	// What's wrong with it, such as "is required".
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// Check checks that the rules in the tags of v, which must be a struct or a
+// pointer to one, are all ones there are, so that a mistake in them shows up
+// before anything is validated with them.
+func Check(v interface{}) error {
+	t := reflect.Indirect(reflect.ValueOf(v)).Type()
+	if t.Kind() != reflect.Struct {
+		return fmt.Errorf("validate: can't validate %T", v)
+	}
+	return checkType(t)
+}
+
+func checkType(t reflect.Type) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if tag, ok := f.Tag.Lookup("validate"); ok {
+			for _, rule := range strings.Split(tag, ",") {
+				if _, err := checkRule(reflect.Zero(f.Type), rule); err != nil {
+					return fmt.Errorf("validate: field %s: %w", f.Name, err)
+				}
+			}
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr || ft.Kind() == reflect.Slice {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			if err := checkType(ft); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Struct gives every field of v, which must be a struct or a pointer to one,
+// that breaks one of its rules, in the order of the fields. It's only an error
+// if the rules themselves are bad.
+func Struct(v interface{}) ([]FieldError, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("validate: can't validate %T", v)
+	}
+	var errs []FieldError
+	if err := checkStruct(rv, "", &errs); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+func checkStruct(v reflect.Value, prefix string, errs *[]FieldError) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		fv := v.Field(i)
+		if f.Anonymous && fv.Kind() == reflect.Struct {
+			if err := checkStruct(fv, prefix, errs); err != nil {
+				return err
+			}
+			continue
+		}
+		name := prefix + fieldName(f)
+		if tag, ok := f.Tag.Lookup("validate"); ok {
+			for _, rule := range strings.Split(tag, ",") {
+				message, err := checkRule(fv, rule)
+				if err != nil {
+					return fmt.Errorf("validate: field %s: %w", f.Name, err)
+				}
+				if message != "" {
+					*errs = append(*errs, FieldError{name, message})
+					// One thing wrong with a field is enough to go on with.
+					break
+				}
+			}
+		}
+		if err := checkNested(fv, name, errs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNested checks the fields of the struct in v, if there is one.
+func checkNested(v reflect.Value, name string, errs *[]FieldError) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return checkNested(v.Elem(), name, errs)
+	case reflect.Struct:
+		return checkStruct(v, name+".", errs)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := checkStruct(v.Index(i), fmt.Sprintf("%s[%d].", name, i), errs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fieldName gives the field's name in JSON.
+func fieldName(f reflect.StructField) string {
+	if tag, ok := f.Tag.Lookup("json"); ok {
+		if name, _, _ := strings.Cut(tag, ","); name != "" && name != "-" {
+			return name
+		}
+	}
+	return f.Name
+}
+
+// checkRule gives what's wrong with v, if it breaks the rule, or "" if it
+// doesn't.
+func checkRule(v reflect.Value, rule string) (string, error) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+	switch name {
+	case "required":
+		if isEmpty(v) {
+			return "is required", nil
+		}
+		return "", nil
+	case "min", "max":
+		n, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return "", fmt.Errorf("bad %s %q", name, arg)
+		}
+		size, message, ok := measure(v)
+		if !ok {
+			return "", fmt.Errorf("%s doesn't apply to a %s", name, v.Type())
+		}
+		if isEmpty(v) {
+			return "", nil
+		}
+		bound := "at least"
+		if name == "max" {
+			bound = "at most"
+		}
+		if name == "min" && size < n || name == "max" && size > n {
+			return fmt.Sprintf(message, bound, arg), nil
+		}
+		return "", nil
+	case "oneof":
+		values := strings.Fields(arg)
+		if len(values) == 0 {
+			return "", fmt.Errorf("oneof has no values")
+		}
+		s, ok := format(v)
+		if !ok {
+			return "", fmt.Errorf("oneof doesn't apply to a %s", v.Type())
+		}
+		if isEmpty(v) {
+			return "", nil
+		}
+		for _, value := range values {
+			if s == value {
+				return "", nil
+			}
+		}
+		return "must be one of " + strings.Join(values, ", "), nil
+	}
+	return "", fmt.Errorf("unknown rule %q", name)
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// measure gives the size of v that min and max go by, with the format of the
+// message for one that's out of bounds, which takes the bound and the size.
+func measure(v reflect.Value) (float64, string, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(v.Len()), "must be %s %s bytes long", true
+	case reflect.Slice, reflect.Map:
+		return float64(v.Len()), "must have %s %s elements", true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), "must be %s %s", true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), "must be %s %s", true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), "must be %s %s", true
+	}
+	return 0, "", false
+}
+
+// format gives v as oneof compares it.
+func format(v reflect.Value) (string, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), true
+	}
+	return "", false
+}
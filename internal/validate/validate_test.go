@@ -0,0 +1,138 @@
+package validate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type member struct {
+	User string `json:"user" validate:"required"`
+	Role string `json:"role,omitempty" validate:"oneof=owner guest"`
+}
+
+type Common struct {
+	ID string `json:"id" validate:"max=4"`
+}
+
+type room struct {
+	Common
+	Name     string            `json:"name" validate:"required,max=8"`
+	Kind     string            `json:"kind" validate:"oneof=public private"`
+	Size     int               `json:"size" validate:"min=2,max=10"`
+	Priority uint              `json:"priority" validate:"oneof=1 2 3"`
+	Ratio    float64           `json:"ratio" validate:"max=1"`
+	Tags     []string          `json:"tags" validate:"max=2"`
+	Labels   map[string]string `json:"labels" validate:"required"`
+	Members  []member          `json:"members"`
+	Owner    *member           `json:"owner"`
+	NoJSON   string            `validate:"max=1"`
+	Untagged string
+	hidden   string `validate:"required"`
+}
+
+func validRoom() room {
+	return room{Name: "lobby", Labels: map[string]string{"a": "b"}}
+}
+
+func TestStruct(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*room)
+		want   []FieldError
+	}{
+		{"valid", func(r *room) {}, nil},
+		{"everything optional set", func(r *room) {
+			r.ID, r.Kind, r.Size, r.Priority, r.Ratio, r.Tags = "abcd", "private", 10, 3, 0.5, []string{"x", "y"}
+		}, nil},
+		{"required string", func(r *room) { r.Name = "" }, []FieldError{{"name", "is required"}}},
+		{"required map", func(r *room) { r.Labels = map[string]string{} }, []FieldError{{"labels", "is required"}}},
+		{"string too long", func(r *room) { r.Name = "much too long" }, []FieldError{{"name", "must be at most 8 bytes long"}}},
+		{"number too small", func(r *room) { r.Size = 1 }, []FieldError{{"size", "must be at least 2"}}},
+		{"number too big", func(r *room) { r.Size = 11 }, []FieldError{{"size", "must be at most 10"}}},
+		{"float too big", func(r *room) { r.Ratio = 1.5 }, []FieldError{{"ratio", "must be at most 1"}}},
+		{"too many elements", func(r *room) { r.Tags = []string{"a", "b", "c"} }, []FieldError{{"tags", "must have at most 2 elements"}}},
+		{"not one of", func(r *room) { r.Kind = "secret" }, []FieldError{{"kind", "must be one of public, private"}}},
+		{"number not one of", func(r *room) { r.Priority = 4 }, []FieldError{{"priority", "must be one of 1, 2, 3"}}},
+		{"embedded", func(r *room) { r.ID = "toolong" }, []FieldError{{"id", "must be at most 4 bytes long"}}},
+		{"no json name", func(r *room) { r.NoJSON = "ab" }, []FieldError{{"NoJSON", "must be at most 1 bytes long"}}},
+		{"untagged and unexported", func(r *room) { r.Untagged = strings.Repeat("x", 100) }, nil},
+		{"in a slice", func(r *room) {
+			r.Members = []member{{User: "alice"}, {Role: "admin"}}
+		}, []FieldError{{"members[1].user", "is required"}, {"members[1].role", "must be one of owner, guest"}}},
+		{"behind a pointer", func(r *room) { r.Owner = &member{} }, []FieldError{{"owner.user", "is required"}}},
+		{"one error per field, in order", func(r *room) {
+			r.Name, r.Labels = "", nil
+		}, []FieldError{{"name", "is required"}, {"labels", "is required"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := validRoom()
+			tt.modify(&r)
+			for _, v := range []interface{}{r, &r} {
+				got, err := Struct(v)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("Struct() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+type badRule struct {
+	B string `validate:"nope"`
+}
+
+type badNested struct {
+	A []badRule
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want string
+	}{
+		{"valid", &room{}, ""},
+		{"not a struct", "room", "can't validate string"},
+		{"unknown rule", struct {
+			A string `validate:"requred"`
+		}{}, `field A: unknown rule "requred"`},
+		{"bad bound", struct {
+			A string `validate:"max=ten"`
+		}{}, `field A: bad max "ten"`},
+		{"bound on a bool", struct {
+			A bool `validate:"min=1"`
+		}{}, "field A: min doesn't apply to a bool"},
+		{"oneof without values", struct {
+			A string `validate:"oneof="`
+		}{}, "field A: oneof has no values"},
+		{"oneof on a float", struct {
+			A float64 `validate:"oneof=1 2"`
+		}{}, "field A: oneof doesn't apply to a float64"},
+		{"nested", badNested{A: []badRule{{}}}, `field B: unknown rule "nope"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Check(tt.v)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("Check() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Check() error = %v, want %q", err, tt.want)
+			}
+			// Struct turns the rule away too, rather than passing it.
+			if _, ok := tt.v.(string); !ok {
+				if _, err := Struct(tt.v); err == nil {
+					t.Fatalf("Struct() passed a bad rule")
+				}
+			}
+		})
+	}
+}
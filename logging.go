@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// The server logs with log/slog, as key=value pairs, or, with -log-format
+// json, as one JSON object per line. -log-level is the least severe level
+// that's logged: debug, info (the default), warn or error, which log_level in
+// the -config file overrides, on every reload. Whatever still
+// goes through the standard log package, such as net/http's complaints about
+// bad requests, ends up in the same place.
+
+// newLogHandler gives the handler to log with, in the format, at the level of
+// v, which it sets to the named level to start with.
+func newLogHandler(w io.Writer, v *slog.LevelVar, level, format string) (slog.Handler, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q; expected debug, info, warn or error", level)
+	}
+	v.Set(l)
+	opts := &slog.HandlerOptions{Level: v}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q; expected text or json", format)
+}
+
+// fatal logs the error and exits, for whatever stops the server from starting.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -1,127 +1,244 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"log"
-	"math/rand"
-	"net/http"
-	"sync"
+	"log/slog"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
+	"wsexample/server"
 )
 
-// So, as it turns out, in order to maintain a more robust connection between
-// two hosts in a stable connection, ideally, both hosts need to be sending
-// pings to eachother. Otherwise, either hosts may mistake the other host as
-// having silently closed the connection.
+// The server itself is in the server package; this is just the command that
+// runs it, configured with flags, or environment variables.
 //
-// This example demoes on how to implement a WebSocket connection that will
-// be relatively stable.
-//
-// This example also demoes using some additional safeguards that WebSocket has.
-// For example, you may want to limit the amount of bytes being provided by the
-// client to the server. Additionally, set a read deadline. That is, the wait
-// time until the other host sends at least any message.
-
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
-const (
-	writeWait = 60 * time.Second
+// Every flag can also be given as an environment variable, named after the
+// flag with a WSEXAMPLE_ prefix, in upper case, and with underscores for
+// dashes: -read-limit is WSEXAMPLE_READ_LIMIT, and -admin-token is
+// WSEXAMPLE_ADMIN_TOKEN. A flag on the command line wins over the variable.
 
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
+const envPrefix = "WSEXAMPLE_"
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-)
-
-// A 64KiB read limit from the other host
-const readLimit = 1024 * 64
-
-// So the idea is this:
-//
-// A read deadline is set every time we receive a pong. However, a read deadline
-// will also be set when the program first starts up.
-
-var mut sync.Mutex
-
-func writeMessage(c *websocket.Conn, messageType int, data []byte) error {
-	mut.Lock()
-	defer mut.Unlock()
-	return c.WriteMessage(messageType, data)
-}
-
-func randInt(max int) int {
-	return int(rand.Float32() * float32(max))
+// envName gives the environment variable for the flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
 }
 
-func main() {
-	r := mux.NewRouter()
-	r.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		log.Print("Got a new connection")
-		// Handle the upgrade request, and acquire the WebSocket connection.
-		c, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Print(err.Error())
+// setFromEnv sets every flag that wasn't on the command line from its
+// environment variable, if that's set.
+func setFromEnv(fs *flag.FlagSet) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var problems []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] {
 			return
 		}
-		defer c.Close()
-
-		c.SetReadLimit(readLimit)
-
-		// Setting things up for pinging
-		c.SetReadDeadline(time.Now().Add(pongWait))
-		c.SetPongHandler(func(string) error {
-			c.SetReadDeadline(time.Now().Add(pongWait))
-			return nil
-		})
-
-		onClose := make(chan interface{})
-		messages := make(chan []byte)
-
-		go func() {
-			defer func() { onClose <- nil }()
-			for {
-				_, message, e := c.ReadMessage()
-				if e != nil {
-					return
-				}
-				messages <- message
-			}
-		}()
-
-		go func() {
-			ticker := time.Tick(time.Second * 50)
-			for {
-				select {
-				case <-ticker:
-					c.SetWriteDeadline(time.Now().Add(writeWait))
-					if err := writeMessage(c, websocket.PingMessage, nil); err != nil {
-						onClose <- nil
-					}
-				case msg := <-messages:
-					fmt.Println(string(msg))
-					c.SetWriteDeadline(time.Now().Add(writeWait))
-					go func() {
-						<-time.Tick(time.Second * time.Duration(randInt(10)))
-						if err := writeMessage(c, websocket.TextMessage, []byte(fmt.Sprintf("Got message: %s", string(msg)))); err != nil {
-							onClose <- nil
-						}
-					}()
-				case <-onClose:
-					return
-				}
-			}
-		}()
-
-		<-onClose
-
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", envName(f.Name), err))
+		}
 	})
+	if problems != nil {
+		return fmt.Errorf("invalid environment: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
 
-	log.Print("Server listening on port 8080")
-	panic(http.ListenAndServe("0.0.0.0:8080", r))
+func main() {
+	allow := flag.String("allow", "", "comma-separated list of CIDRs allowed to connect")
+	deny := flag.String("deny", "", "comma-separated list of CIDRs denied from connecting")
+	ipRulesFile := flag.String("ip-rules", "", "file of \"allow <cidr>\" and \"deny <cidr>\" lines, re-read on SIGHUP")
+	tokensFile := flag.String("auth-tokens", "", "file of \"<token> <user> [<roles>]\" lines; when set, upgrades need a token, re-read on SIGHUP")
+	jwtSecretFile := flag.String("jwt-secret-file", "", "file holding the secret for HS256 JWTs; when set, upgrades need a token, re-read on SIGHUP")
+	signingKeys := flag.String("signing-keys", "", "file of hex keys, newest last, to sign envelopes on /api with and check the clients' against; re-read on SIGHUP")
+	signatureStrikes := flag.Int("signature-strikes", 3, "envelopes with bad signatures a client may send before it's disconnected; zero is unlimited")
+	configFile := flag.String("config", "", "JSON file of settings that override the flags, re-read on SIGHUP")
+	addr := flag.String("addr", "0.0.0.0:8080", "address to listen on, either host:port or unix:///path/to/socket")
+	tlsCert := flag.String("tls-cert", "", "certificate file to serve TLS with, along with -tls-key")
+	tlsKey := flag.String("tls-key", "", "private key file to serve TLS with, along with -tls-cert")
+	autocertDomains := flag.String("autocert-domains", "", "comma-separated list of domains to serve TLS for with certificates from Let's Encrypt")
+	autocertCache := flag.String("autocert-cache", "autocert-cache", "directory to keep the certificates from Let's Encrypt in")
+	redirectAddr := flag.String("redirect-addr", "", "address to also listen on for plain HTTP, redirecting everything to HTTPS, e.g. :80")
+	requireHTTPSFlag := flag.Bool("require-https", false, "redirect requests that weren't made over HTTPS, going by X-Forwarded-Proto from trusted proxies")
+	socketMode := flag.String("socket-mode", "0660", "file mode of the unix socket, when listening on one")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 10*time.Second, "time allowed to read the headers of a request")
+	handshakeTimeout := flag.Duration("handshake-timeout", 10*time.Second, "time allowed to complete the WebSocket handshake")
+	handshakeGrace := flag.Duration("handshake-grace", 10*time.Second, "time allowed between the upgrade and the first frame from the client")
+	sendQueueSize := flag.Int("send-queue", 256, "most messages to queue for a client before -send-overflow kicks in")
+	sendOverflow := flag.String("send-overflow", "disconnect", "what to do with a message for a client whose queue is full: disconnect, drop-oldest or drop-newest")
+	sendQueueBytes := flag.Int("send-queue-bytes", 4<<20, "most bytes of messages to have pending for a client before -send-overflow kicks in; zero is no limit")
+	msgRate := flag.Int("message-rate", 20, "most messages per second a client may send, after -message-burst; zero is unlimited")
+	msgBurst := flag.Int("message-burst", 40, "messages a client may send at once before -message-rate kicks in; defaults to a second's worth")
+	ratePolicy := flag.String("message-rate-policy", "drop", "what to do with a message over -message-rate: drop, with a warning, or disconnect")
+	maxMessageSize := flag.Int64("read-limit", 1024*64, "maximum size in bytes of a message from the client")
+	streamLimit := flag.Int64("stream-limit", 64<<20, "maximum size in bytes of a message streamed in on /upload")
+	latencyReports := flag.Bool("latency-reports", false, "tell clients on /ws the round trip of every ping")
+	demo := flag.Bool("demo", true, "serve the browser demo at /")
+	minPingInterval := flag.Duration("min-ping-interval", 10*time.Second, "shortest ping interval a client may ask for")
+	maxPingInterval := flag.Duration("max-ping-interval", 5*time.Minute, "longest ping interval a client may ask for")
+	origins := flag.String("origins", "", "comma-separated list of origins allowed besides the server's own, e.g. https://example.com,*.example.com")
+	trustedProxies := flag.String("trusted-proxies", "", "comma-separated list of CIDRs of reverse proxies whose forwarding headers are believed")
+	transportName := flag.String("transport", "gorilla", "WebSocket library to use, either gorilla or coder")
+	compress := flag.Bool("compression", false, "negotiate permessage-deflate with clients that offer it")
+	compressThreshold := flag.Int("compression-threshold", 512, "smallest message in bytes to compress, when compression is negotiated")
+	traceFrames := flag.Bool("trace-frames", false, "log every frame of every connection")
+	traceFile := flag.String("trace-file", "", "file to write frame traces to, instead of the standard logger")
+	recordDir := flag.String("record-dir", "", "directory to write session recordings to")
+	dev := flag.Bool("dev", false, "enable development conveniences, such as recording a session with ?record=1")
+	chaosSpec := flag.String("chaos", "", "faults to inject into every connection, e.g. latency=10ms-200ms,drop=0.05")
+	idleTimeout := flag.Duration("idle-timeout", 0, "time a client may go without sending a message before it's closed, or warned on /ws; zero is forever")
+	idleGrace := flag.Duration("idle-grace", 30*time.Second, "time between warning an idle client on /ws and closing it; zero closes it without a warning")
+	writeRate := flag.Int("write-rate", 0, "most bytes per second of messages to send to each client; zero is unlimited")
+	writeBurst := flag.Int("write-burst", 0, "bytes a client can be sent at once before -write-rate kicks in; defaults to a second's worth")
+	roomWriteRate := flag.Int("room-write-rate", 0, "most bytes per second of broadcasts to send the members of each room, between them; zero is unlimited")
+	roomWriteBurst := flag.Int("room-write-burst", 0, "bytes a room's members can be sent at once before -room-write-rate kicks in; defaults to a second's worth")
+	broadcastWorkers := flag.Int("broadcast-workers", runtime.NumCPU(), "most goroutines to queue a broadcast to a big room for its members at once")
+	labelKeys := flag.String("label-keys", "", "comma-separated list of the label keys clients can set, e.g. region,tier")
+	roomMaxMembers := flag.Int("room-max-members", 0, "most members a room can have, unless it's given its own limits through /admin/rooms/limits; zero is unlimited")
+	roomMessageRate := flag.Int("room-message-rate", 0, "most messages per second the members of each room can send it, between them; zero is unlimited")
+	roomMessageBurst := flag.Int("room-message-burst", 0, "messages a room's members can send at once before -room-message-rate kicks in; defaults to a second's worth")
+	roomMaxMessage := flag.Int("room-max-message", 0, "most bytes a message to a room can be; zero leaves it to -read-limit")
+	upgradeRate := flag.Int("upgrade-rate", 0, "most upgrade attempts allowed from an address per -upgrade-window; zero is unlimited")
+	upgradeWindow := flag.Duration("upgrade-window", time.Minute, "window that -upgrade-rate applies to")
+	upgradeAddrs := flag.Int("upgrade-rate-addrs", 10000, "most addresses to keep track of for -upgrade-rate")
+	maxConns := flag.Int("max-connections", 0, "most connections to have open at once, across every endpoint; zero is unlimited")
+	maxConnsPerIP := flag.Int("max-connections-per-ip", 0, "most connections to have open at once from any one client address; zero is unlimited")
+	historySize := flag.Int("history-size", 100, "most envelopes to keep for each room on /api, for clients that resume; zero keeps none")
+	historyRooms := flag.Int("history-rooms", 1000, "most rooms on /api to keep the history of")
+	nameConflicts := flag.String("name-conflicts", "suffix", "what to do with a name a client asks for on /api that's taken in the room: suffix or reject")
+	typingInterval := flag.Duration("typing-interval", 3*time.Second, "most often the members of a room on /api are told that another is typing")
+	typingTimeout := flag.Duration("typing-timeout", 5*time.Second, "how long after a member last says it's typing on /api that it's taken to have stopped; zero turns typing indicators off")
+	mailboxTTL := flag.Duration("mailbox-ttl", 0, "how long a direct message on /api for a user who isn't connected is held for them; zero turns mailboxes off")
+	mailboxSize := flag.Int("mailbox-size", 100, "most direct messages held for each user")
+	duplicateSessions := flag.String("duplicate-sessions", "allow", "what to do with a connection for a user that already has one open: allow, kick_oldest or reject_newest")
+	sessionGrace := flag.Duration("session-grace", 30*time.Second, "how long to keep the session of a client on /chat or /api whose connection drops; zero keeps none")
+	redisURL := flag.String("redis-url", "", "Redis server to relay broadcasts through, to and from other instances, e.g. redis://localhost:6379")
+	redisChannel := flag.String("redis-channel", "wsexample", "prefix of the Redis channels that broadcasts are relayed on")
+	banFile := flag.String("ban-file", "", "file to keep the bans in, so that they survive restarts")
+	rpcTimeoutFlag := flag.Duration("rpc-timeout", 10*time.Second, "time allowed to answer a request on /api")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "time to give connections to close on SIGINT or SIGTERM before exiting anyway")
+	adminToken := flag.String("admin-token", "", "bearer token for the /admin endpoints; they are disabled when empty")
+	writeWait := flag.Duration("write-wait", 60*time.Second, "time allowed to write a message to a client, other than a broadcast or a stream")
+	controlWriteWait := flag.Duration("control-write-wait", 5*time.Second, "time allowed to write a ping or a close frame to a client")
+	broadcastWriteWait := flag.Duration("broadcast-write-wait", 2*time.Minute, "time allowed to write a message broadcast to a room, or to everyone, to a client")
+	streamWriteWait := flag.Duration("stream-write-wait", 5*time.Minute, "time allowed to write the whole of a streamed message to a client")
+	pongWait := flag.Duration("pong-wait", 60*time.Second, "time allowed for a pong to come back, for clients that haven't asked for a keepalive of their own")
+	logLevel := flag.String("log-level", "info", "least severe level to log: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "format to log in, either text or json")
+	flag.Parse()
+
+	if err := setFromEnv(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	var level slog.LevelVar
+	logHandler, err := newLogHandler(os.Stderr, &level, *logLevel, *logFormat)
+	if err != nil {
+		fatal(err.Error())
+	}
+	slog.SetDefault(slog.New(logHandler))
+
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		fatal("Invalid socket mode", "mode", *socketMode, "error", err)
+	}
+	srv, err := server.New(
+		server.WithAddr(*addr),
+		server.WithSocketMode(os.FileMode(mode)),
+		server.WithTLS(*tlsCert, *tlsKey),
+		server.WithAutocert(server.SplitList(*autocertDomains), *autocertCache),
+		server.WithHTTPSRedirect(*redirectAddr),
+		server.WithRequireHTTPS(*requireHTTPSFlag),
+		server.WithReadHeaderTimeout(*readHeaderTimeout),
+		server.WithHandshakeTimeout(*handshakeTimeout),
+		server.WithHandshakeGrace(*handshakeGrace),
+		server.WithWriteWait(*writeWait),
+		server.WithControlWriteWait(*controlWriteWait),
+		server.WithBroadcastWriteWait(*broadcastWriteWait),
+		server.WithStreamWriteWait(*streamWriteWait),
+		server.WithPongWait(*pongWait),
+		server.WithPingIntervalBounds(*minPingInterval, *maxPingInterval),
+		server.WithReadLimit(*maxMessageSize),
+		server.WithStreamLimit(*streamLimit),
+		server.WithLatencyReports(*latencyReports),
+		server.WithDemo(*demo),
+		server.WithSendQueue(*sendQueueSize, *sendOverflow),
+		server.WithSendQueueBytes(*sendQueueBytes),
+		server.WithMessageRate(*msgRate, *msgBurst, *ratePolicy),
+		server.WithWriteRate(*writeRate, *writeBurst),
+		server.WithRoomWriteRate(*roomWriteRate, *roomWriteBurst),
+		server.WithRoomLimits(*roomMaxMembers, *roomMessageRate, *roomMessageBurst, *roomMaxMessage),
+		server.WithBroadcastWorkers(*broadcastWorkers),
+		server.WithLabelKeys(server.SplitList(*labelKeys)),
+		server.WithIPRules(server.SplitList(*allow), server.SplitList(*deny), *ipRulesFile),
+		server.WithAuth(*tokensFile, *jwtSecretFile),
+		server.WithSigning(*signingKeys, *signatureStrikes),
+		server.WithConfigFile(*configFile),
+		server.WithOrigins(server.SplitList(*origins)),
+		server.WithTrustedProxies(server.SplitList(*trustedProxies)),
+		server.WithTransport(*transportName),
+		server.WithCompression(*compress, *compressThreshold),
+		server.WithFrameTracing(*traceFrames, *traceFile),
+		server.WithRecordDir(*recordDir),
+		server.WithDev(*dev),
+		server.WithChaos(*chaosSpec),
+		server.WithIdleTimeout(*idleTimeout, *idleGrace),
+		server.WithUpgradeRate(*upgradeRate, *upgradeWindow, *upgradeAddrs),
+		server.WithMaxConnections(*maxConns, *maxConnsPerIP),
+		server.WithHistory(*historySize, *historyRooms),
+		server.WithSessionGrace(*sessionGrace),
+		server.WithNameConflicts(*nameConflicts),
+		server.WithDuplicateSessions(*duplicateSessions),
+		server.WithTyping(*typingInterval, *typingTimeout),
+		server.WithMailbox(*mailboxTTL, *mailboxSize),
+		server.WithRedis(*redisURL, *redisChannel),
+		server.WithBanFile(*banFile),
+		server.WithRPCTimeout(*rpcTimeoutFlag),
+		server.WithShutdownTimeout(*shutdownTimeout),
+		server.WithAdminToken(*adminToken),
+		server.WithLogLevel(&level),
+	)
+	if err != nil {
+		fatal("Failed to start the server", "error", err)
+	}
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := srv.Reload(); err != nil {
+				slog.Error("Failed to reload settings, keeping the old ones", "problems", err)
+				continue
+			}
+			slog.Info("Reloaded settings")
+		}
+	}()
+
+	// On SIGINT or SIGTERM, the server shuts down, giving connections
+	// -shutdown-timeout to close. A second signal exits straight away.
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		sig := make(chan os.Signal, 2)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		stop()
+		<-sig
+		fatal("Exiting without waiting for connections to close")
+	}()
+
+	if err := srv.Run(ctx); err != nil {
+		fatal("Server failed", "error", err)
+	}
 }
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// The admin endpoints are only served when an admin token is configured, and
+// every request to them must carry it as "Authorization: Bearer <token>".
+//
+// Besides the endpoints for tracing, recording and banning, there are:
+//
+//	GET    /admin/connections       every open connection, oldest first
+//	DELETE /admin/connections/{id}  close the connection, with 4004
+//	POST   /admin/broadcast         send an announcement to every client of
+//	                                /chat and /api, or to those in a room
+//
+// An announcement is {"message":"...","room":"..."}, where the room is
+// optional, as is a "ttl_ms" for it, see ttl.go, and a "selector" of labels,
+// for only the clients with all of them; see labels.go. Clients of /chat get it as
+//
+//	{"type":"announcement","room":"lobby","message":"..."}
+//
+// and clients of /api as a server.announcement envelope with the same
+// payload. With a bus, it goes out on every instance. Its room's history
+// keeps it, if it's sent to a room.
+
+const closeDisconnected = 4004
+
+var adminDisconnects = expvar.NewInt("admin_disconnects")
+
+// requireAdmin only lets requests with the admin token through to h. The
+// token is only taken as a bearer token, never on its own, and is compared
+// in constant time, so that how long the check takes gives nothing away.
+func requireAdmin(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "a valid admin token is required", 0)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func reloadHandler(holder *settingsHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if problems := holder.reload(); problems != nil {
+			slog.Error("Failed to reload settings, keeping the old ones", "problems", strings.Join(problems, "; "))
+			writeErrorDetail(w, http.StatusUnprocessableEntity, errorDetail{
+				Code:    codeInvalidConfig,
+				Message: "the new settings are invalid, and were not applied",
+				Details: problems,
+			}, 0)
+			return
+		}
+		slog.Info("Reloaded settings")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "reloaded"})
+	}
+}
+
+// connFromVars looks up the connection named by the {id} in the route.
+func connFromVars(reg *connRegistry, r *http.Request) (*liveConn, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return reg.get(id)
+}
+
+// connInfo is a connection, as listed by GET /admin/connections.
+type connInfo struct {
+	ID          uint64    `json:"id"`
+	UUID        string    `json:"uuid"`
+	IP          string    `json:"ip,omitempty"`
+	Peer        string    `json:"peer"`
+	User        string    `json:"user,omitempty"`
+	Endpoint    string    `json:"endpoint"`
+	Subprotocol string    `json:"subprotocol,omitempty"`
+	Rooms       []string  `json:"rooms"`
+	ConnectedAt time.Time `json:"connected_at"`
+	UptimeMS    int64     `json:"uptime_ms"`
+	MessagesIn  int64     `json:"messages_in"`
+	MessagesOut int64     `json:"messages_out"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	// The messages queued for the connection, and the bytes of them, and of
+	// the one being written.
+	QueuedMessages int `json:"queued_messages"`
+	PendingBytes   int `json:"pending_bytes"`
+	// The average round trip of the last few pings, once there's been one.
+	RTTMS float64 `json:"rtt_ms,omitempty"`
+	// What handlers have kept on the connection; see connstate.go.
+	State map[string]string `json:"state,omitempty"`
+	// With -write-rate, the rate the connection is throttled to, what it's
+	// used of it, as bytes in all and on average since it connected, and
+	// the writes that had to wait for it.
+	WriteRate       int     `json:"write_rate,omitempty"`
+	WriteBurst      int     `json:"write_burst,omitempty"`
+	WriteConsumed   int64   `json:"write_bytes_consumed,omitempty"`
+	WriteRateUsed   float64 `json:"write_rate_consumed,omitempty"`
+	ThrottledWrites int64   `json:"throttled_writes,omitempty"`
+	ThrottleWaitMS  int64   `json:"throttle_wait_ms,omitempty"`
+}
+
+// describeConn gives the connection as it's listed, with the rooms it's in in
+// any of the hubs.
+func describeConn(c *liveConn, now time.Time, hubs []*hub) connInfo {
+	info := connInfo{
+		ID:          c.id,
+		UUID:        c.uuid,
+		Peer:        c.peer,
+		User:        c.user,
+		Endpoint:    c.path,
+		Subprotocol: c.subprotocol,
+		Rooms:       []string{},
+		ConnectedAt: c.connected.UTC(),
+		UptimeMS:    now.Sub(c.connected).Milliseconds(),
+		MessagesIn:  atomic.LoadInt64(&c.stats.messagesIn),
+		MessagesOut: atomic.LoadInt64(&c.stats.messagesOut),
+		BytesIn:     atomic.LoadInt64(&c.stats.bytesIn),
+		BytesOut:    atomic.LoadInt64(&c.stats.bytesOut),
+	}
+	if c.addr.IsValid() {
+		info.IP = c.addr.String()
+	}
+	if c.throttle != nil {
+		s := c.throttle.stats()
+		info.WriteRate, info.WriteBurst = s.rate, s.burst
+		info.WriteConsumed = s.consumed
+		if up := now.Sub(c.connected).Seconds(); up > 0 {
+			info.WriteRateUsed = float64(s.consumed) / up
+		}
+		info.ThrottledWrites, info.ThrottleWaitMS = s.throttled, s.waited.Milliseconds()
+	}
+	if cl := c.served(); cl != nil {
+		for _, h := range hubs {
+			info.Rooms = append(info.Rooms, h.roomsOf(cl)...)
+		}
+		info.RTTMS = milliseconds(cl.rtt.Average())
+		info.QueuedMessages, info.PendingBytes = cl.pending()
+		if cl.conn != nil {
+			info.State = stateOf(cl.conn)
+		}
+	}
+	return info
+}
+
+func connectionsHandler(reg *connRegistry, hubs ...*hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conns := reg.list()
+		sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+		now := time.Now()
+		infos := make([]connInfo, len(conns))
+		for i, c := range conns {
+			infos[i] = describeConn(c, now, hubs)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	}
+}
+
+func disconnectHandler(reg *connRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := connFromVars(reg, r)
+		if !ok {
+			writeError(w, http.StatusNotFound, codeNotFound, "no such connection", 0)
+			return
+		}
+		disconnect(c, closeDisconnected, "disconnected by an admin")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// disconnect closes the connection, as an admin asked, with the code and the
+// reason, without waiting for it to close.
+func disconnect(c *liveConn, code int, reason string) {
+	adminDisconnects.Add(1)
+	c.log.Info("Disconnecting the connection, as asked by an admin", "code", code)
+	go func() {
+		c.transport.Close(code, reason)
+		c.transport.CloseNow()
+	}()
+}
+
+// announcement is the body of POST /admin/broadcast, and the payload it's
+// sent to clients with.
+type announcement struct {
+	Room    string `json:"room,omitempty" pb:"1"`
+	Message string `json:"message" pb:"2"`
+}
+
+// broadcastHandler announces what it's posted; see announce.
+func broadcastHandler(chat, api *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			announcement
+			TTLMS    int64             `json:"ttl_ms"`
+			Selector map[string]string `json:"selector"`
+		}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "invalid announcement: "+err.Error(), 0)
+			return
+		}
+		if err := checkAnnouncement(body.announcement); err != nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, err.Error(), 0)
+			return
+		}
+		if body.TTLMS < 0 {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "ttl_ms can't be negative", 0)
+			return
+		}
+		if err := checkSelector(body.Selector); err != nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, err.Error(), 0)
+			return
+		}
+		announce(r.Context(), chat, api, body.announcement, body.Selector, ttlOf(body.TTLMS))
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// checkAnnouncement tells what's wrong with the announcement, if anything.
+func checkAnnouncement(a announcement) error {
+	if a.Message == "" {
+		return errors.New("an announcement needs a message")
+	}
+	if a.Room != "" {
+		return checkRoomName(a.Room)
+	}
+	return nil
+}
+
+// announce sends the announcement to the clients of the chat hub, as plain
+// JSON, and of the API hub, as envelopes, for the TTL, if it's given one, and
+// only to those with the selector's labels, if it has any. One that only
+// goes to some of them isn't kept in the room's history.
+func announce(ctx context.Context, chat, api *hub, a announcement, selector map[string]string, ttl time.Duration) {
+	api.send(ctx, broadcastMessage{
+		room:     a.Room,
+		envelope: newOutgoing("server.announcement", a),
+		kept:     a.Room != "" && len(selector) == 0,
+		ttl:      ttl,
+		selector: selector,
+	})
+	data, _ := json.Marshal(struct {
+		Type string `json:"type"`
+		announcement
+	}{"announcement", a})
+	chat.send(ctx, broadcastMessage{room: a.Room, messageType: websocket.TextMessage, data: data, ttl: ttl, selector: selector})
+	slog.Info("Broadcast an announcement", "room", a.Room, "selector", selector)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"strconv"
+)
+
+// An operator connected to /api with a token that gives it the admin role
+// (see auth.go) can do some of what the admin endpoints do without leaving
+// the connection. It can send everyone a notice, as
+//
+//	{"type":"admin.notice","payload":{"text":"back in five"}}
+//
+// which goes out just as POST /admin/broadcast's announcements to everyone
+// do, as a server.announcement envelope on /api and an announcement on
+// /chat, and it can kick a connection, or everyone in a room, with
+//
+//	{"type":"admin.kick","payload":{"target":"7","reason":"spam"}}
+//
+// where the target is a connection id, or else a room, and the reason, up to
+// 123 bytes to fit in a close frame, is optional. Each connection is closed
+// with 4001 and the reason, the same way DELETE /admin/connections/{id}
+// closes one, and the operator is answered with an admin.kicked saying how
+// many were. A connection id that isn't open is answered with not_found; a
+// room nobody is in kicks nobody. The members of a room are the ones in it
+// as the kick starts: one that's leaving anyway at the same time is closed
+// if it's still open, and skipped if it's not, and one that joins just after
+// isn't kicked.
+//
+// Each command checks on its own that the sender's principal has the admin
+// role, before it does anything. One that doesn't is answered with
+// forbidden, logged, and counted under admin_commands as denied, and the
+// rest are counted by type.
+
+var adminCommands = expvar.NewMap("admin_commands")
+
+const (
+	roleAdmin = "admin"
+
+	closeKicked = 4001
+
+	codeForbidden = "forbidden"
+)
+
+var errNoSuchConn = errors.New("no such connection")
+
+type noticePayload struct {
+	Text string `json:"text" pb:"1" validate:"required,max=1024"`
+}
+
+type kickPayload struct {
+	// A connection id, or a room.
+	Target string `json:"target" pb:"1" validate:"required,max=64"`
+	Reason string `json:"reason,omitempty" pb:"2" validate:"max=123"`
+}
+
+type kickedPayload struct {
+	Target string `json:"target" pb:"1"`
+	Kicked int    `json:"kicked" pb:"2"`
+}
+
+// requireRole only lets clients whose principal has the role through to the
+// handler.
+func requireRole(role string, next handlerFunc) handlerFunc {
+	return func(ctx context.Context, c *client, p payload) error {
+		if !c.has(role) {
+			adminCommands.Add("denied", 1)
+			c.log.Warn("Denied a command", "type", p.typ, "role", role)
+			return &replyError{codeForbidden, "only a connection with the " + role + " role can send " + p.typ}
+		}
+		adminCommands.Add(p.typ, 1)
+		return next(ctx, c, p)
+	}
+}
+
+// kickTarget closes the connection with the id that's the target, or else
+// every connection in the room that is, in any of the hubs, and gives how many
+// it closed.
+func kickTarget(reg *connRegistry, hubs []*hub, target, reason string) (int, error) {
+	if reason == "" {
+		reason = "kicked by an admin"
+	}
+	if id, err := strconv.ParseUint(target, 10, 64); err == nil {
+		c, ok := reg.get(id)
+		if !ok {
+			return 0, errNoSuchConn
+		}
+		disconnect(c, closeKicked, reason)
+		return 1, nil
+	}
+	if err := checkRoomName(target); err != nil {
+		return 0, &replyError{codeBadPayload, err.Error()}
+	}
+	kicked := map[uint64]bool{}
+	for _, h := range hubs {
+		for _, member := range h.roomMembers(target) {
+			if kicked[member.id] {
+				continue
+			}
+			// A stand-in has no connection, and one that's closed
+			// in the meantime is gone from the registry.
+			if c, ok := reg.get(member.id); ok {
+				disconnect(c, closeKicked, reason)
+				kicked[member.id] = true
+			}
+		}
+	}
+	return len(kicked), nil
+}
+
+// roomMembers gives the clients in the room as it is now, to be gone through
+// without the hub's lock.
+func (h *hub) roomMembers(room string) []*client {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	members := make([]*client, 0, len(h.rooms[room]))
+	for c := range h.rooms[room] {
+		members = append(members, c)
+	}
+	return members
+}
+
+// handleAdmin registers admin.notice and admin.kick with the dispatcher, for
+// the connections in the registry, and the clients of the hubs.
+func handleAdmin(d *dispatcher, reg *connRegistry, chat, api *hub) {
+	d.validate("admin.notice", noticePayload{})
+	d.validate("admin.kick", kickPayload{})
+	d.handle("admin.notice", requireRole(roleAdmin, func(ctx context.Context, c *client, payload payload) error {
+		var p noticePayload
+		if err := decodePayload(payload, &p); err != nil {
+			return err
+		}
+		c.log.Info("Sending a notice, as an admin")
+		announce(ctx, chat, api, announcement{Message: p.Text}, nil, payload.ttl)
+		return nil
+	}))
+	d.handle("admin.kick", requireRole(roleAdmin, func(ctx context.Context, c *client, payload payload) error {
+		var p kickPayload
+		if err := decodePayload(payload, &p); err != nil {
+			return err
+		}
+		n, err := kickTarget(reg, []*hub{chat, api}, p.Target, p.Reason)
+		if errors.Is(err, errNoSuchConn) {
+			return &replyError{codeNotFound, err.Error()}
+		} else if err != nil {
+			return err
+		}
+		c.log.Info("Kicked, as an admin", "target", p.Target, "kicked", n)
+		return sendEnvelope(ctx, c, "admin.kicked", kickedPayload{p.Target, n})
+	}))
+}
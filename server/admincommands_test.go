@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenRoles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens")
+	os.WriteFile(file, []byte("t1 alice admin,ops\nt2 bob\n"), 0o600)
+	a, err := loadAuthenticator(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		token string
+		user  string
+		admin bool
+	}{
+		{"t1", "alice", true},
+		{"t2", "bob", false},
+	} {
+		p, err := a.authenticate(tt.token, time.Now())
+		if err != nil || p.user != tt.user || p.has(roleAdmin) != tt.admin {
+			t.Errorf("%s: %+v, %v", tt.token, p, err)
+		}
+	}
+	os.WriteFile(file, []byte("t1 alice admin extra\n"), 0o600)
+	if _, err := loadAuthenticator(file, ""); err == nil {
+		t.Error("loaded a line with four fields")
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens")
+	os.WriteFile(file, []byte("root-token root admin\nbob-token bob\ncarol-token carol\n"), 0o600)
+	u := testServer(t, WithAuth(file, ""))
+	dial := func(token, room string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(u+"/api", http.Header{"Authorization": {"Bearer " + token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if room != "" {
+			conn.WriteJSON(map[string]interface{}{"type": "chat.join", "payload": map[string]string{"room": room}})
+			nextEnvelope(t, conn, "chat.joined")
+		}
+		return conn
+	}
+	send := func(conn *websocket.Conn, typ string, payload interface{}) {
+		t.Helper()
+		if err := conn.WriteJSON(map[string]interface{}{"type": typ, "payload": payload}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errorCode := func(conn *websocket.Conn) string {
+		t.Helper()
+		var p errorPayload
+		json.Unmarshal(nextEnvelope(t, conn, "error").Payload, &p)
+		return p.Code
+	}
+	closedWith := func(conn *websocket.Conn) (int, string) {
+		t.Helper()
+		for {
+			_, _, err := conn.ReadMessage()
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				return ce.Code, ce.Text
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	root := dial("root-token", "")
+	bob := dial("bob-token", "lobby")
+	carol := dial("carol-token", "lobby")
+	carolID := joinedID(t, bob)
+	watcher := dial("carol-token", "elsewhere")
+	other := dial("bob-token", "elsewhere")
+	otherID := joinedID(t, watcher)
+
+	// Without the role, nothing happens.
+	send(bob, "admin.notice", map[string]string{"text": "hello"})
+	send(bob, "admin.kick", map[string]string{"target": fmt.Sprint(carolID)})
+	for i := 0; i < 2; i++ {
+		if code := errorCode(bob); code != codeForbidden {
+			t.Fatalf("bob's admin command gave %s, want %s", code, codeForbidden)
+		}
+	}
+
+	send(root, "admin.notice", map[string]string{"text": "back in five"})
+	for _, conn := range []*websocket.Conn{root, bob, other} {
+		var a announcement
+		json.Unmarshal(nextEnvelope(t, conn, "server.announcement").Payload, &a)
+		if a != (announcement{Message: "back in five"}) {
+			t.Fatalf("announcement %+v", a)
+		}
+	}
+
+	kicked := func() kickedPayload {
+		t.Helper()
+		var p kickedPayload
+		json.Unmarshal(nextEnvelope(t, root, "admin.kicked").Payload, &p)
+		return p
+	}
+	send(root, "admin.kick", map[string]string{"target": "999"})
+	if code := errorCode(root); code != codeNotFound {
+		t.Fatalf("kicking a connection that isn't open gave %s", code)
+	}
+	send(root, "admin.kick", map[string]string{"target": "lobby", "reason": "spam"})
+	if p := kicked(); p != (kickedPayload{"lobby", 2}) {
+		t.Fatalf("admin.kicked %+v", p)
+	}
+	for _, conn := range []*websocket.Conn{bob, carol} {
+		if code, reason := closedWith(conn); code != closeKicked || reason != "spam" {
+			t.Fatalf("closed with %d %q, want %d spam", code, reason, closeKicked)
+		}
+	}
+	send(root, "admin.kick", map[string]string{"target": "nowhere"})
+	if p := kicked(); p.Kicked != 0 {
+		t.Fatalf("kicked %d from an empty room", p.Kicked)
+	}
+
+	send(root, "admin.kick", map[string]string{"target": fmt.Sprint(otherID)})
+	if p := kicked(); p.Kicked != 1 {
+		t.Fatalf("kicked %d by id", p.Kicked)
+	}
+	if code, reason := closedWith(other); code != closeKicked || reason != "kicked by an admin" {
+		t.Fatalf("closed with %d %q", code, reason)
+	}
+}
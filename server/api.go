@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// The /api endpoint speaks nothing but envelopes, and is where the dispatcher's
+// handlers are registered. For now, that's chat in rooms:
+//
+//	{"type":"chat.join","payload":{"room":"lobby"}}
+//	{"type":"chat.send","payload":{"room":"lobby","message":"hello"}}
+//	{"type":"chat.leave","payload":{"room":"lobby"}}
+//
+// Joining and leaving are answered with chat.joined and chat.left, and a send
+// goes out to everyone in the room, the sender included, as
+//
+//	{"type":"chat.message","payload":{"room":"lobby","message":"hello"}}
+//
+// The message can be any JSON. When authentication is on, the payload also
+// says who it's from. /api has a hub of its own, so its rooms aren't
+// the same as the ones on /chat.
+//
+// A client that negotiates proto.v1 sends and is sent the same envelopes in
+// protobuf instead. Either can be signed; see signing.go. The same chat, in versions a client can rely on not to
+// change, is served on /api/versioned; see protocols.go.
+//
+// A client that reconnects can get its session back, and be back in its
+// rooms, see session.go, or resume a room with chat.resume, and be sent what
+// it missed; see history.go. It can also page back through a room's history
+// with history.fetch; see fetch.go. Members of a room are told who joins and
+// leaves it, and can ask who's in it, with presence.list; see presence.go.
+// There's also one method, chat.rooms, which gives the rooms the client is in.
+// Members can have names in their rooms, see names.go, and say they're
+// typing; see typing.go.
+// Clients in a room together can talk without the server reading it; see
+// relay.go. Clients can have labels, and be broadcast to by them; see
+// labels.go.
+
+const (
+	codeBadRoom      = "bad_room"
+	codeNotInRoom    = "not_in_room"
+	codeTooManyRooms = "too_many_rooms"
+)
+
+// The rules in the validate tags are checked before the handlers get the
+// payloads; 64 is maxRoomNameLength.
+
+type roomPayload struct {
+	Room string `json:"room" pb:"1" validate:"required,max=64"`
+}
+
+type resumePayload struct {
+	Room string `json:"room" pb:"1" validate:"required,max=64"`
+	// The sequence number of the last envelope the client saw.
+	After uint64 `json:"after" pb:"2"`
+}
+
+type resumedPayload struct {
+	Room     string `json:"room" pb:"1"`
+	Complete bool   `json:"complete" pb:"2"`
+}
+
+type chatMessagePayload struct {
+	Room string `json:"room" pb:"1" validate:"required,max=64"`
+	// With protobuf, the message is still JSON, so that clients using either
+	// codec can be in the same room.
+	Message json.RawMessage `json:"message" pb:"2" validate:"required"`
+	// The user who sent it, when authentication is on. Whatever the client
+	// put here is replaced.
+	From string `json:"from,omitempty" pb:"3"`
+	// What the sender calls the message, from chat.v2 on. Before that, it's
+	// left out.
+	ID string `json:"id,omitempty" pb:"4" validate:"max=64"`
+}
+
+// attributedMessage is a chat.message as chat.v3 has it, from a chatSender, and
+// before that, a chatMessagePayload, from the user.
+type attributedMessage struct {
+	Room    string          `json:"room"`
+	Message json.RawMessage `json:"message"`
+	From    *chatSender     `json:"from"`
+	ID      string          `json:"id,omitempty"`
+}
+
+func (m attributedMessage) legacy() interface{} {
+	return chatMessagePayload{Room: m.Room, Message: m.Message, From: m.From.User, ID: m.ID}
+}
+
+// sentPayload acknowledges a chat.send, from chat.v2 on.
+type sentPayload struct {
+	Room string `json:"room" pb:"1"`
+	ID   string `json:"id,omitempty" pb:"2"`
+}
+
+// apiServer serves the dispatcher, with every client in the hub, and its
+// envelopes signed by s, if it isn't nil.
+func apiServer(d *dispatcher, h *hub, s *signer) connServer {
+	return func(ctx context.Context, g *errgroup.Group, c *client) error {
+		c.codec = s.codec(codecFor(c.t.Subprotocol()))
+		c.opaque = relaysBinary(d, c)
+		return serveAPI(ctx, g, c, d, h)
+	}
+}
+
+// versionServer serves a version of /api's protocol, with every client in the
+// hub, as apiServer does.
+func versionServer(h *hub, s *signer) func(v protocolVersion) connServer {
+	return func(v protocolVersion) connServer {
+		return func(ctx context.Context, g *errgroup.Group, c *client) error {
+			c.codec = s.codec(v.codec)
+			return serveAPI(ctx, g, c, v.dispatcher, h)
+		}
+	}
+}
+
+func serveAPI(ctx context.Context, g *errgroup.Group, c *client, d *dispatcher, h *hub) error {
+	leave, err := h.joinSession(c, func(p sessionPayload) error {
+		return sendEnvelope(ctx, c, "session", p)
+	})
+	if err != nil {
+		return err
+	}
+	defer leave()
+	h.watch(ctx, g, c)
+	return d.serve(ctx, g, c)
+}
+
+// handleChat registers the chat handlers with the dispatcher, as they are in
+// the version of the protocol, which is 1 on /api.
+func handleChat(d *dispatcher, h *hub, version int) {
+	d.validate("chat.join", joinPayload{})
+	d.validate("chat.resume", resumePayload{})
+	d.validate("chat.leave", roomPayload{})
+	d.validate("chat.send", chatMessagePayload{})
+	d.validate("presence.list", roomPayload{})
+	d.handle("chat.join", func(ctx context.Context, c *client, payload payload) error {
+		var p joinPayload
+		if err := decodeRoomPayload(payload, &p, &p.Room); err != nil {
+			return err
+		}
+		name, err := h.joinRoomAs(c, p.Room, p.Name)
+		var le *roomLimitError
+		if errors.Is(err, errTooManyRooms) {
+			return &replyError{codeTooManyRooms, err.Error()}
+		} else if errors.As(err, &le) {
+			return &replyError{le.code, le.msg}
+		} else if err != nil {
+			return nameError(err)
+		}
+		p.Name = name
+		return sendEnvelope(ctx, c, "chat.joined", p)
+	})
+	d.handle("chat.resume", func(ctx context.Context, c *client, payload payload) error {
+		var p resumePayload
+		if err := decodeRoomPayload(payload, &p, &p.Room); err != nil {
+			return err
+		}
+		complete, err := h.resume(c, p.Room, p.After)
+		var le *roomLimitError
+		if errors.Is(err, errTooManyRooms) {
+			return &replyError{codeTooManyRooms, err.Error()}
+		} else if errors.As(err, &le) {
+			return &replyError{le.code, le.msg}
+		} else if err != nil {
+			return err
+		}
+		return sendEnvelope(ctx, c, "chat.resumed", resumedPayload{p.Room, complete})
+	})
+	d.handle("chat.leave", func(ctx context.Context, c *client, payload payload) error {
+		var p roomPayload
+		if err := decodeRoomPayload(payload, &p, &p.Room); err != nil {
+			return err
+		}
+		if !h.leaveRoom(c, p.Room) {
+			return &replyError{codeNotInRoom, errNotInRoom.Error()}
+		}
+		return sendEnvelope(ctx, c, "chat.left", p)
+	})
+	d.handle("chat.send", func(ctx context.Context, c *client, payload payload) error {
+		var p chatMessagePayload
+		if err := decodeRoomPayload(payload, &p, &p.Room); err != nil {
+			return err
+		}
+		if !json.Valid(p.Message) {
+			return &replyError{codeBadPayload, "the message isn't JSON"}
+		}
+		if !h.sending(c, p.Room) {
+			return &replyError{codeNotInRoom, errNotInRoom.Error()}
+		}
+		var le *roomLimitError
+		if err := h.admitToRoom(p.Room, len(p.Message), time.Now()); errors.As(err, &le) {
+			return &replyError{le.code, le.msg}
+		}
+		if version < 2 {
+			p.ID = ""
+		}
+		h.broadcastEnvelope(ctx, p.Room, "chat.message", attributedMessage{p.Room, p.Message, h.sender(c, p.Room), p.ID}, payload.ttl)
+		if version < 2 {
+			return nil
+		}
+		return sendEnvelope(ctx, c, "chat.sent", sentPayload{p.Room, p.ID})
+	})
+	d.handle("presence.list", func(ctx context.Context, c *client, payload payload) error {
+		var p roomPayload
+		if err := decodeRoomPayload(payload, &p, &p.Room); err != nil {
+			return err
+		}
+		members, ok := h.members(c, p.Room)
+		if !ok {
+			return &replyError{codeNotInRoom, errNotInRoom.Error()}
+		}
+		return sendEnvelope(ctx, c, "presence.list", presenceList{p.Room, members})
+	})
+	handleNames(d, h)
+	handleTyping(d, h)
+	handleDirect(d, h)
+	handleHistory(d, h)
+	handleLabels(d, h)
+	d.method("chat.rooms", func(ctx context.Context, c *client, params json.RawMessage) (interface{}, error) {
+		return roomsResult{h.roomsOf(c)}, nil
+	})
+}
+
+type roomsResult struct {
+	Rooms []string `json:"rooms"`
+}
+
+// decodeRoomPayload decodes the payload into v, and checks the room name that
+// it decoded into room.
+func decodeRoomPayload(payload payload, v interface{}, room *string) error {
+	if err := decodePayload(payload, v); err != nil {
+		return err
+	}
+	if err := checkRoomName(*room); err != nil {
+		return &replyError{codeBadRoom, err.Error()}
+	}
+	return nil
+}
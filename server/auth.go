@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// With -auth-tokens or -jwt-secret-file, every upgrade request has to come
+// with a token, or it's turned away with a 401. The token can be given in any
+// of the ways a client might be able to:
+//
+//	Authorization: Bearer <token>
+//	Sec-WebSocket-Protocol: access_token, <token>
+//	?token=<token>
+//
+// Browsers can't set headers on a WebSocket, so they have to use one of the
+// other two, as new WebSocket(url, ["access_token", token]), for instance.
+// The server then picks access_token as the subprotocol (unless the endpoint
+// has one of its own that the client also offered), since browsers fail the
+// connection if none is picked. The query string ends up in access logs, so
+// it's the last resort.
+//
+// A token is either one of the opaque tokens in the -auth-tokens file, which
+// has a "<token> <user>" per line, or a JWT signed with HS256 using the secret
+// in the -jwt-secret-file, whose sub claim is the user. A JWT has to have an
+// exp claim, and is only accepted before then (and not before its nbf, if it
+// has one). Both files are part of the settings, so tokens can be added or
+// revoked, and the secret rotated, by reloading them.
+//
+// A token can also give its user roles: a line of the file can end with a
+// comma-separated list of them, as "<token> <user> admin", and a JWT can have
+// a roles claim, a list of strings. For now, the only one that means anything
+// is admin; see admincommands.go. A JWT can give the connection labels too,
+// with a labels claim; see labels.go.
+//
+// The user and its roles, the principal, are logged with the connection, and
+// handlers can get them from the client. They're only checked on the upgrade,
+// so a connection outlives the expiry of the token it was opened with.
+
+var authFailures = expvar.NewMap("auth_failures")
+
+// authSubprotocol is offered alongside the token, when the token comes as a
+// subprotocol.
+const authSubprotocol = "access_token"
+
+var (
+	errNoToken      = errors.New("no token")
+	errInvalidToken = errors.New("invalid token")
+	errTokenExpired = errors.New("expired or not yet valid token")
+)
+
+// A principal is who a client authenticated as.
+type principal struct {
+	// The user, or "" when authentication is off.
+	user  string
+	roles []string
+	// The labels its token gives it; see labels.go.
+	claimedLabels map[string]string
+}
+
+// has tells whether the principal has the role.
+func (p principal) has(role string) bool {
+	for _, r := range p.roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type authenticator struct {
+	// The principals of the opaque tokens, by the tokens' SHA-256, so that
+	// looking one up doesn't give away how much of a token was right.
+	tokens    map[[sha256.Size]byte]principal
+	jwtSecret []byte
+}
+
+// loadAuthenticator loads the tokens and the secret. If there are neither,
+// authentication is off, and the authenticator is nil.
+func loadAuthenticator(tokensFile, jwtSecretFile string) (*authenticator, error) {
+	if tokensFile == "" && jwtSecretFile == "" {
+		return nil, nil
+	}
+	a := &authenticator{tokens: map[[sha256.Size]byte]principal{}}
+	if jwtSecretFile != "" {
+		secret, err := os.ReadFile(jwtSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		if a.jwtSecret = []byte(strings.TrimSpace(string(secret))); len(a.jwtSecret) == 0 {
+			return nil, fmt.Errorf("%s is empty", jwtSecretFile)
+		}
+	}
+	if tokensFile == "" {
+		return a, nil
+	}
+
+	f, err := os.Open(tokensFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"<token> <user> [<roles>]\"", tokensFile, line)
+		}
+		p := principal{user: fields[1]}
+		if len(fields) == 3 {
+			p.roles = strings.Split(fields[2], ",")
+		}
+		a.tokens[sha256.Sum256([]byte(fields[0]))] = p
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// requestToken finds the token in the request, if there is one, and tells
+// whether it came as a subprotocol.
+func requestToken(r *http.Request) (token string, subprotocol bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer "), false
+	}
+	protocols := websocket.Subprotocols(r)
+	for i, p := range protocols {
+		if p == authSubprotocol && i+1 < len(protocols) {
+			return protocols[i+1], true
+		}
+	}
+	return r.URL.Query().Get("token"), false
+}
+
+// authenticate gives the principal that the token belongs to.
+func (a *authenticator) authenticate(token string, now time.Time) (principal, error) {
+	if token == "" {
+		return principal{}, errNoToken
+	}
+	if p, ok := a.tokens[sha256.Sum256([]byte(token))]; ok {
+		return p, nil
+	}
+	if a.jwtSecret != nil && strings.Count(token, ".") == 2 {
+		return a.verifyJWT(token, now)
+	}
+	return principal{}, errInvalidToken
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Sub   string   `json:"sub"`
+	Exp   *float64 `json:"exp"`
+	Nbf   *float64 `json:"nbf"`
+	Roles []string `json:"roles"`
+	// Only in a JWT.
+	Labels map[string]string `json:"labels"`
+}
+
+func (a *authenticator) verifyJWT(token string, now time.Time) (principal, error) {
+	parts := strings.Split(token, ".")
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return principal{}, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return principal{}, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, a.jwtSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return principal{}, errInvalidToken
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil || claims.Sub == "" || claims.Exp == nil {
+		return principal{}, errInvalidToken
+	}
+	unix := float64(now.Unix())
+	if unix >= *claims.Exp || (claims.Nbf != nil && unix < *claims.Nbf) {
+		return principal{}, errTokenExpired
+	}
+	return principal{user: claims.Sub, roles: claims.Roles, claimedLabels: claims.Labels}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
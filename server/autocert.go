@@ -0,0 +1,23 @@
+//go:build autocert
+
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func autocertTLS(domains []string, cacheDir string) (*tls.Config, func(http.Handler) http.Handler, error) {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+	cfg := m.TLSConfig()
+	// Without h2, which autocert offers by default.
+	cfg.NextProtos = []string{"http/1.1", "acme-tls/1"}
+	cfg.MinVersion = tls.VersionTLS12
+	return cfg, m.HTTPHandler, nil
+}
@@ -0,0 +1,15 @@
+//go:build !autocert
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+)
+
+// Getting certificates from Let's Encrypt needs golang.org/x/crypto, so it's
+// only built in with -tags autocert.
+func autocertTLS(domains []string, cacheDir string) (*tls.Config, func(http.Handler) http.Handler, error) {
+	return nil, nil, errors.New("this build doesn't support -autocert-domains; build with -tags autocert")
+}
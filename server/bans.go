@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Bans are for clients that have been kicked for abuse, and would otherwise
+// just reconnect. Unlike the IP rules, which are configuration, bans are
+// managed at runtime through the admin API, can expire, and are kept in a
+// file (with -ban-file) so that they survive restarts.
+//
+// Every upgrade request is checked against the bans, so the check must not
+// get slower with the number of bans. They're kept in a map by prefix, along
+// with how many bans there are of each prefix length, and an address is only
+// looked up once for each prefix length in use.
+//
+// Adding a ban also closes every connection already open from the banned
+// addresses, with 4003.
+
+const (
+	closeBanned = 4003
+
+	banJanitorInterval = time.Minute
+)
+
+var (
+	banRejections = expvar.NewInt("ban_rejections")
+	banKicks      = expvar.NewInt("ban_kicks")
+)
+
+type ban struct {
+	Prefix  netip.Prefix `json:"cidr"`
+	Reason  string       `json:"reason,omitempty"`
+	Created time.Time    `json:"created"`
+	Expires *time.Time   `json:"expires,omitempty"`
+}
+
+func (b ban) expired(now time.Time) bool {
+	return b.Expires != nil && !now.Before(*b.Expires)
+}
+
+type banList struct {
+	// Where the bans are kept, if anywhere.
+	path string
+
+	mut     sync.RWMutex
+	bans    map[netip.Prefix]ban
+	lengths [129]int
+}
+
+// loadBanList reads the bans kept in the file at path. A file that doesn't
+// exist yet is the same as an empty one.
+func loadBanList(path string) (*banList, error) {
+	l := &banList{path: path, bans: map[netip.Prefix]ban{}}
+	if path == "" {
+		return l, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bans []ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	now := time.Now()
+	for _, b := range bans {
+		if !b.expired(now) {
+			l.put(b)
+		}
+	}
+	return l, nil
+}
+
+func (l *banList) put(b ban) {
+	if _, ok := l.bans[b.Prefix]; !ok {
+		l.lengths[b.Prefix.Bits()]++
+	}
+	l.bans[b.Prefix] = b
+}
+
+func (l *banList) delete(prefix netip.Prefix) bool {
+	if _, ok := l.bans[prefix]; !ok {
+		return false
+	}
+	delete(l.bans, prefix)
+	l.lengths[prefix.Bits()]--
+	return true
+}
+
+// check gives the ban on the address, if there is one. An IPv4-mapped IPv6
+// address, as a dual-stack listener gives IPv4 peers, is checked as the IPv4
+// address it is.
+func (l *banList) check(addr netip.Addr, now time.Time) (ban, bool) {
+	addr = addr.Unmap()
+	l.mut.RLock()
+	var found ban
+	ok := false
+	for bits := 0; bits <= addr.BitLen() && !ok; bits++ {
+		if l.lengths[bits] == 0 {
+			continue
+		}
+		prefix, _ := addr.Prefix(bits)
+		found, ok = l.bans[prefix]
+	}
+	l.mut.RUnlock()
+
+	if ok && found.expired(now) {
+		// The janitor would get to it eventually, but there's no reason to keep
+		// checking it until then.
+		l.mut.Lock()
+		if b, still := l.bans[found.Prefix]; still && b.expired(now) {
+			l.delete(found.Prefix)
+		}
+		l.mut.Unlock()
+		return ban{}, false
+	}
+	return found, ok
+}
+
+func (l *banList) add(b ban) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.put(b)
+	return l.save()
+}
+
+func (l *banList) remove(prefix netip.Prefix) (bool, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if !l.delete(prefix) {
+		return false, nil
+	}
+	return true, l.save()
+}
+
+func (l *banList) list(now time.Time) []ban {
+	l.mut.RLock()
+	defer l.mut.RUnlock()
+	bans := []ban{}
+	for _, b := range l.bans {
+		if !b.expired(now) {
+			bans = append(bans, b)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Created.Before(bans[j].Created) })
+	return bans
+}
+
+// save writes every ban to the file, if there is one. It must be called with
+// mut held.
+func (l *banList) save() error {
+	if l.path == "" {
+		return nil
+	}
+	bans := make([]ban, 0, len(l.bans))
+	for _, b := range l.bans {
+		bans = append(bans, b)
+	}
+	data, err := json.MarshalIndent(bans, "", "\t")
+	if err != nil {
+		return err
+	}
+	// Written to the side and then moved into place, so that a crash halfway
+	// through doesn't lose every ban.
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// janitor purges expired bans every once in a while.
+func (l *banList) janitor(ctx context.Context) {
+	ticker := time.NewTicker(banJanitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.mut.Lock()
+			purged := 0
+			for prefix, b := range l.bans {
+				if b.expired(now) {
+					l.delete(prefix)
+					purged++
+				}
+			}
+			if purged > 0 {
+				if err := l.save(); err != nil {
+					slog.Error("Failed to save the bans", "error", err)
+				}
+			}
+			l.mut.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// kick closes every connection from the banned prefix, and says how many
+// there were.
+func kick(reg *connRegistry, prefix netip.Prefix) int {
+	kicked := 0
+	for _, c := range reg.list() {
+		if !c.addr.IsValid() || !prefix.Contains(c.addr.Unmap()) {
+			continue
+		}
+		kicked++
+		banKicks.Add(1)
+		c.log.Info("Kicking banned connection", "ban", prefix)
+		go func(c *liveConn) {
+			c.transport.Close(closeBanned, "banned")
+			c.transport.CloseNow()
+		}(c)
+	}
+	return kicked
+}
+
+// banRequest is the body of POST /admin/bans. The duration is a Go duration,
+// such as "24h"; without one, the ban is permanent.
+type banRequest struct {
+	CIDR     string `json:"cidr"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"`
+}
+
+func bansHandler(bans *banList, reg *connRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(bans.list(time.Now()))
+
+		case http.MethodPost:
+			var req banRequest
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, codeBadRequest, "invalid ban: "+err.Error(), 0)
+				return
+			}
+			rule, err := parseIPRule(false, req.CIDR)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeBadRequest, "invalid cidr: "+err.Error(), 0)
+				return
+			}
+			b := ban{Prefix: rule.prefix, Reason: req.Reason, Created: time.Now().UTC()}
+			if req.Duration != "" {
+				d, err := time.ParseDuration(req.Duration)
+				if err != nil || d <= 0 {
+					writeError(w, http.StatusBadRequest, codeBadRequest, "invalid duration", 0)
+					return
+				}
+				expires := b.Created.Add(d)
+				b.Expires = &expires
+			}
+			if err := bans.add(b); err != nil {
+				// The ban still applies until the server restarts.
+				slog.Error("Failed to save the bans", "error", err)
+			}
+			slog.Info("Banned", "cidr", b.Prefix, "reason", b.Reason)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(struct {
+				ban
+				Kicked int `json:"kicked"`
+			}{b, kick(reg, b.Prefix)})
+
+		case http.MethodDelete:
+			rule, err := parseIPRule(false, r.URL.Query().Get("cidr"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeBadRequest, "invalid cidr: "+err.Error(), 0)
+				return
+			}
+			removed, err := bans.remove(rule.prefix)
+			if err != nil {
+				slog.Error("Failed to save the bans", "error", err)
+			}
+			if !removed {
+				writeError(w, http.StatusNotFound, codeNotFound, "no such ban", 0)
+				return
+			}
+			slog.Info("Unbanned", "cidr", rule.prefix)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBanListCheck(t *testing.T) {
+	now := time.Now()
+	expired := now.Add(-time.Minute)
+	l, err := loadBanList("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cidr := range []string{"192.0.2.0/24", "198.51.100.7", "2001:db8::/32", "::ffff:203.0.113.0/120"} {
+		rule, err := parseIPRule(false, cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.add(ban{Prefix: rule.prefix, Created: now})
+	}
+	l.add(ban{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Created: now, Expires: &expired})
+
+	tests := []struct {
+		addr   string
+		banned string
+	}{
+		{"192.0.2.1", "192.0.2.0/24"},
+		{"::ffff:192.0.2.1", "192.0.2.0/24"},
+		{"192.0.3.1", ""},
+		{"::ffff:192.0.3.1", ""},
+		{"198.51.100.7", "198.51.100.7/32"},
+		{"::ffff:198.51.100.7", "198.51.100.7/32"},
+		{"198.51.100.8", ""},
+		{"2001:db8::1", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+		// Banned by an IPv4-mapped CIDR, which is taken as plain IPv4.
+		{"203.0.113.9", "203.0.113.0/24"},
+		{"::ffff:203.0.113.9", "203.0.113.0/24"},
+		// Only until the ban expires.
+		{"10.1.2.3", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got := ""
+			if b, ok := l.check(netip.MustParseAddr(tt.addr), now); ok {
+				got = b.Prefix.String()
+			}
+			if got != tt.banned {
+				t.Fatalf("banned by %q, want %q", got, tt.banned)
+			}
+		})
+	}
+}
+
+func TestKickMapped(t *testing.T) {
+	reg := newConnRegistry()
+	conns := map[string]*fakeTransport{}
+	for i, addr := range []string{"::ffff:192.0.2.1", "192.0.2.2", "192.0.3.1"} {
+		ft := newFakeTransport()
+		conns[addr] = ft
+		reg.add(&liveConn{
+			id:        uint64(i + 1),
+			addr:      netip.MustParseAddr(addr),
+			transport: ft,
+			log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		})
+	}
+	if n := kick(reg, netip.MustParsePrefix("192.0.2.0/24")); n != 2 {
+		t.Fatalf("kicked %d connections, want 2", n)
+	}
+	for addr, want := range map[string]bool{"::ffff:192.0.2.1": true, "192.0.2.2": true, "192.0.3.1": false} {
+		wait := 100 * time.Millisecond
+		if want {
+			wait = 5 * time.Second
+		}
+		code, _, closed := conns[addr].closedWith(wait)
+		if closed != want || (closed && code != closeBanned) {
+			t.Fatalf("%s: closed = %t with %d, want closed = %t with %d", addr, closed, code, want, closeBanned)
+		}
+	}
+}
+
+func TestBanOverAdminAPI(t *testing.T) {
+	const token = "secret"
+	u := testServer(t, WithAdminToken(token), WithTrustedProxies([]string{"127.0.0.1"}))
+	admin := func(method, path string, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, "http"+strings.TrimPrefix(u, "ws")+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	// dial connects as the client at addr, behind the test's proxy, and gives
+	// the connection, or the code of the error the upgrade was refused with.
+	dial := func(addr string) (*websocket.Conn, string) {
+		t.Helper()
+		conn, resp, err := websocket.DefaultDialer.Dial(u+"/echo", http.Header{"X-Forwarded-For": {addr}})
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+			return conn, ""
+		}
+		if resp == nil {
+			t.Fatalf("dial as %s: %v", addr, err)
+		}
+		var body struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("dial as %s: status %d, want %d", addr, resp.StatusCode, http.StatusForbidden)
+		}
+		return nil, body.Error.Code
+	}
+
+	banned, _ := dial("192.0.2.1")
+	mapped, _ := dial("::ffff:192.0.2.2")
+	other, _ := dial("198.51.100.1")
+
+	// Banning the IPv4-mapped form of the range bans the range.
+	resp := admin(http.MethodPost, "/admin/bans", `{"cidr":"::ffff:192.0.2.0/120","reason":"testing"}`)
+	var created struct {
+		Kicked int `json:"kicked"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("ban: status %d, %v", resp.StatusCode, err)
+	}
+	if created.Kicked != 2 {
+		t.Fatalf("kicked %d connections, want 2", created.Kicked)
+	}
+
+	// Those already connected from it are closed.
+	for _, conn := range []*websocket.Conn{banned, mapped} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, closeBanned) {
+			t.Fatalf("read error = %v, want a %d close", err, closeBanned)
+		}
+	}
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := other.WriteMessage(websocket.TextMessage, []byte("still here")); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := other.ReadMessage(); err != nil || string(data) != "still here" {
+		t.Fatalf("read %q, %v from the connection outside the ban", data, err)
+	}
+
+	// New connections from it are refused, in either form.
+	for _, addr := range []string{"192.0.2.9", "::ffff:192.0.2.9"} {
+		if _, code := dial(addr); code != codeBanned {
+			t.Fatalf("dial as %s: refused with %q, want %q", addr, code, codeBanned)
+		}
+	}
+	if conn, code := dial("192.0.3.1"); conn == nil {
+		t.Fatalf("dial from outside the ban: refused with %q", code)
+	}
+
+	// Until it's lifted.
+	resp = admin(http.MethodDelete, "/admin/bans?cidr="+url.QueryEscape("192.0.2.0/24"), "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unban: status %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if conn, code := dial("192.0.2.9"); conn == nil {
+		t.Fatalf("dial after the ban was lifted: refused with %q", code)
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log/slog"
+	"sync"
+	"time"
+
+	"wsexample/internal/resp"
+)
+
+// One process can only broadcast to its own clients. To run more than one
+// behind a load balancer, -redis-url has each hub publish its broadcasts to a
+// Redis channel, rather than sending them itself, and send out whatever comes
+// in on the channel, from any instance, its own included. Since every message
+// goes through the channel, every client on every instance gets them in the
+// same order.
+//
+// Each hub has a channel of its own, -redis-channel with the hub's name after
+// it, such as wsexample:chat. Messages go over the channel as JSON, with the
+// payloads of envelopes already encoded by every codec, so that no instance
+// has to know the payload's type.
+//
+// If publishing fails, the broadcast only goes to this instance's clients. If
+// the subscription fails, it's made again, and whatever was published in the
+// meantime is lost, as is the way of Redis pub/sub. Counts are kept under
+// bus_messages.
+//
+// Only broadcasts go through Redis. Who's in a room, and so the presence
+// events and lists, are only as this instance sees them.
+
+var busMessages = expvar.NewMap("bus_messages")
+
+const (
+	busTimeout    = 5 * time.Second
+	busMinBackoff = 100 * time.Millisecond
+	busMaxBackoff = 5 * time.Second
+)
+
+// A bus carries broadcasts between every instance of a hub.
+type bus interface {
+	// publish sends the message to every instance.
+	publish(ctx context.Context, m busMessage) error
+	// subscribe calls deliver with every message sent to any instance, until
+	// ctx is done.
+	subscribe(ctx context.Context, deliver func(busMessage))
+}
+
+// busMessage is a broadcast as it's sent between instances.
+type busMessage struct {
+	Room string `json:"room,omitempty"`
+	// A message that's the same for every client,
+	MessageType int    `json:"message_type,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+	// or an envelope, with its payload encoded by each codec, by its name.
+	Type     string            `json:"type,omitempty"`
+	Payloads map[string][]byte `json:"payloads,omitempty"`
+	Kept     bool              `json:"kept,omitempty"`
+	TTLMS    int64             `json:"ttl_ms,omitempty"`
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+// toBusMessage gives the message to send for the broadcast.
+func toBusMessage(m broadcastMessage) busMessage {
+	bm := busMessage{Room: m.room, MessageType: m.messageType, Data: m.data, Kept: m.kept, TTLMS: m.ttl.Milliseconds(), Selector: m.selector}
+	if m.envelope != nil {
+		bm.Type, bm.Payloads = m.envelope.typ, m.envelope.payloads
+	}
+	return bm
+}
+
+// fromBusMessage gives the broadcast for a message from the bus.
+func fromBusMessage(bm busMessage) broadcastMessage {
+	m := broadcastMessage{room: bm.Room, messageType: bm.MessageType, data: bm.Data, kept: bm.Kept, ttl: ttlOf(bm.TTLMS), selector: bm.Selector}
+	if bm.Type != "" {
+		m.envelope = &outgoing{typ: bm.Type, payloads: bm.Payloads}
+	}
+	return m
+}
+
+// redisBus is a bus over a Redis channel.
+type redisBus struct {
+	url     string
+	channel string
+
+	mut sync.Mutex
+	// The connection to publish with, dialled when it's first needed, and
+	// again after it fails.
+	pub *resp.Conn
+}
+
+func newRedisBus(url, channel string) *redisBus {
+	return &redisBus{url: url, channel: channel}
+}
+
+func (b *redisBus) publish(ctx context.Context, m busMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, busTimeout)
+	defer cancel()
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.pub == nil {
+		if b.pub, err = resp.Dial(ctx, b.url); err != nil {
+			return err
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	b.pub.SetDeadline(deadline)
+	if _, err := b.pub.Do("PUBLISH", b.channel, string(data)); err != nil {
+		b.pub.Close()
+		b.pub = nil
+		return err
+	}
+	busMessages.Add("published", 1)
+	return nil
+}
+
+func (b *redisBus) subscribe(ctx context.Context, deliver func(busMessage)) {
+	backoff := busMinBackoff
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := b.receive(ctx, deliver)
+		if ctx.Err() != nil {
+			return
+		}
+		// A subscription that lasted a while was working, so the next one
+		// starts over.
+		if time.Since(start) > busMaxBackoff {
+			backoff = busMinBackoff
+		}
+		slog.Warn("Subscribing to Redis failed, retrying", "channel", b.channel, "backoff", backoff, "error", err)
+		busMessages.Add("subscribe_failures", 1)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > busMaxBackoff {
+			backoff = busMaxBackoff
+		}
+	}
+}
+
+// receive subscribes to the channel, and delivers what comes in on it until
+// the subscription fails, or ctx is done.
+func (b *redisBus) receive(ctx context.Context, deliver func(busMessage)) error {
+	dialCtx, cancel := context.WithTimeout(ctx, busTimeout)
+	conn, err := resp.Dial(dialCtx, b.url)
+	cancel()
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		conn.Close()
+	}()
+
+	if err := conn.Send("SUBSCRIBE", b.channel); err != nil {
+		return err
+	}
+	for {
+		reply, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		if e, ok := reply.(resp.Error); ok {
+			return e
+		}
+		// Every message is ["message", channel, data]; anything else, such as
+		// the confirmation of the subscription, is skipped.
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 {
+			continue
+		}
+		if kind, _ := items[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		data, _ := items[2].([]byte)
+		var m busMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			slog.Warn("Skipping a malformed message from Redis", "channel", b.channel, "error", err)
+			busMessages.Add("malformed", 1)
+			continue
+		}
+		busMessages.Add("received", 1)
+		deliver(m)
+	}
+}
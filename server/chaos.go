@@ -0,0 +1,198 @@
+//go:build !nochaos
+
+package server
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chaos mode makes the server misbehave on purpose, to see how well clients
+// hold up against it. It's configured with -chaos (or, when running with -dev,
+// per connection with ?chaos= in the URL), as a comma-separated list of
+// faults:
+//
+//	latency=10ms-200ms  delay every outbound message by a random amount in the range
+//	drop=0.05           silently drop this fraction of outbound messages
+//	pongs=0.1           ignore this fraction of the pongs the client sends back
+//	disconnect=0.01     abruptly drop the connection, with this probability per second
+//
+// Control frames are never delayed or dropped. An ignored pong makes the ping
+// it answers time out, just as if the pong had been lost.
+//
+// Every fault injected is logged, and counted by kind under chaos_faults at
+// /debug/vars, so that what a client saw can be matched up with what the
+// server did.
+//
+// Building with -tags nochaos leaves all of this out, and the server then
+// refuses to start with -chaos.
+
+var chaosFaults = expvar.NewMap("chaos_faults")
+
+type chaosConfig struct {
+	minLatency time.Duration
+	maxLatency time.Duration
+	drop       float64
+	pongs      float64
+	disconnect float64
+}
+
+func parseChaos(spec string) (*chaosConfig, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	cfg := &chaosConfig{}
+	for _, fault := range SplitList(spec) {
+		key, value, ok := strings.Cut(fault, "=")
+		if !ok {
+			return nil, fmt.Errorf("chaos: expected key=value, got %q", fault)
+		}
+		var err error
+		switch key {
+		case "latency":
+			min, max, ok := strings.Cut(value, "-")
+			if !ok {
+				max = min
+			}
+			if cfg.minLatency, err = time.ParseDuration(min); err == nil {
+				cfg.maxLatency, err = time.ParseDuration(max)
+			}
+			if err == nil && (cfg.minLatency < 0 || cfg.maxLatency < cfg.minLatency) {
+				err = fmt.Errorf("invalid range %q", value)
+			}
+		case "drop":
+			cfg.drop, err = parseProbability(value)
+		case "pongs":
+			cfg.pongs, err = parseProbability(value)
+		case "disconnect":
+			cfg.disconnect, err = parseProbability(value)
+		default:
+			err = fmt.Errorf("unknown fault")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chaos: %s: %w", key, err)
+		}
+	}
+	return cfg, nil
+}
+
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("%v is not between 0 and 1", p)
+	}
+	return p, nil
+}
+
+type chaosTransport struct {
+	Transport
+	cfg  *chaosConfig
+	log  *slog.Logger
+	stop chan struct{}
+	once sync.Once
+
+	// math/rand's top-level functions are safe for concurrent use, but a
+	// *rand.Rand isn't.
+	mut sync.Mutex
+	rnd *rand.Rand
+}
+
+// wrapChaos has the transport misbehave as configured. A nil config leaves it
+// alone.
+func wrapChaos(t Transport, cfg *chaosConfig, lg *slog.Logger) Transport {
+	if cfg == nil {
+		return t
+	}
+	ct := &chaosTransport{
+		Transport: t,
+		cfg:       cfg,
+		log:       lg,
+		stop:      make(chan struct{}),
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if cfg.disconnect > 0 {
+		go ct.disconnector()
+	}
+	return ct
+}
+
+func (t *chaosTransport) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.rnd.Float64() < p
+}
+
+// injected counts and logs a fault of the kind, with the attributes.
+func (t *chaosTransport) injected(kind string, args ...interface{}) {
+	chaosFaults.Add(kind, 1)
+	t.log.Info("Injected a fault", append([]interface{}{"fault", kind}, args...)...)
+}
+
+func (t *chaosTransport) disconnector() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if t.chance(t.cfg.disconnect) {
+				t.injected("disconnect")
+				t.Transport.CloseNow()
+				return
+			}
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (t *chaosTransport) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	if t.chance(t.cfg.drop) {
+		t.injected("drop", "bytes", len(data))
+		return nil
+	}
+	if t.cfg.maxLatency > 0 {
+		t.mut.Lock()
+		delay := t.cfg.minLatency + time.Duration(t.rnd.Int63n(int64(t.cfg.maxLatency-t.cfg.minLatency)+1))
+		t.mut.Unlock()
+		t.injected("latency", "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return &unwrittenError{ctx.Err()}
+		}
+	}
+	return t.Transport.WriteMessage(ctx, messageType, data)
+}
+
+func (t *chaosTransport) Ping(ctx context.Context) (time.Duration, error) {
+	rtt, err := t.Transport.Ping(ctx)
+	if err == nil && t.chance(t.cfg.pongs) {
+		t.injected("pong")
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	return rtt, err
+}
+
+func (t *chaosTransport) Close(code int, reason string) error {
+	t.once.Do(func() { close(t.stop) })
+	return t.Transport.Close(code, reason)
+}
+
+func (t *chaosTransport) CloseNow() error {
+	t.once.Do(func() { close(t.stop) })
+	return t.Transport.CloseNow()
+}
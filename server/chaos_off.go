@@ -0,0 +1,21 @@
+//go:build nochaos
+
+package server
+
+import (
+	"errors"
+	"log/slog"
+)
+
+type chaosConfig struct{}
+
+func parseChaos(spec string) (*chaosConfig, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	return nil, errors.New("chaos mode was left out of this build")
+}
+
+func wrapChaos(t Transport, cfg *chaosConfig, lg *slog.Logger) Transport {
+	return t
+}
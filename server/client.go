@@ -0,0 +1,521 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+
+	"wsexample/internal/latency"
+)
+
+// Every message for a client goes through its send queue, and only its write
+// pump ever writes messages to its transport. So writes to one client never
+// wait on writes to another, and nothing that wants to send a client a
+// message has to wait for the write itself.
+//
+// The queue is bounded, to -send-queue messages. What happens to a message
+// for a client whose queue is full is up to -send-overflow:
+//
+//   - disconnect, the default, closes the client with 1008 (policy
+//     violation), since it's too slow to keep up;
+//   - drop-oldest drops the message at the front of the queue to make room;
+//   - drop-newest drops the message itself.
+//
+// Close frames are never dropped, and aren't counted against the limit.
+// Dropped messages are counted under dropped_messages, and disconnected
+// clients under slow_clients.
+//
+// Pings are control frames, which both libraries let through alongside
+// messages, so the ping loop sends them directly rather than through the
+// queue, and a late pong doesn't hold up the messages behind it.
+
+var (
+	droppedMessages = expvar.NewInt("dropped_messages")
+	slowClients     = expvar.NewInt("slow_clients")
+)
+
+type overflowPolicy int
+
+const (
+	overflowDisconnect overflowPolicy = iota
+	overflowDropOldest
+	overflowDropNewest
+)
+
+func parseOverflowPolicy(s string) (overflowPolicy, error) {
+	switch s {
+	case "disconnect":
+		return overflowDisconnect, nil
+	case "drop-oldest":
+		return overflowDropOldest, nil
+	case "drop-newest":
+		return overflowDropNewest, nil
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q; expected disconnect, drop-oldest or drop-newest", s)
+}
+
+// sendQueue is how big a client's queue is, and what to do when it's full.
+type sendQueue struct {
+	size     int
+	overflow overflowPolicy
+	// The most bytes of messages it can have pending, or 0 for no limit.
+	bytes int
+}
+
+// outbound is a message to write, or, when close is set, a close frame to
+// send once everything before it has been written.
+type outbound struct {
+	messageType int
+	data        []byte
+	close       *closeFrame
+	// Set for a message that's streamed out, rather than written whole.
+	stream *outStream
+	// Set for a message broadcast to a room, or to everyone, which is given
+	// the broadcast write wait.
+	broadcast bool
+	// The bucket of the room it was broadcast to, when rooms are throttled,
+	// which it waits for before it's written.
+	room *byteBucket
+	// Set for a message relayed from a peer, which interceptors don't see.
+	opaque bool
+	// When the message's TTL is up, if it has one; see ttl.go.
+	expires time.Time
+}
+
+type closeFrame struct {
+	code   int
+	reason string
+}
+
+// client is a connection being served.
+type client struct {
+	t          Transport
+	keepalives chan keepalive
+
+	// Who the client authenticated as.
+	principal
+	// Logs with the connection's attributes.
+	log *slog.Logger
+	// The client's idle state, or nil when idle clients are left alone.
+	idle *idleConn
+	// When the connection was made.
+	connected time.Time
+	// The time allowed to write each category of message.
+	writeWaits writeWaits
+	// The read limit the connection was made with, which an endpoint that
+	// raises it for some messages still holds the others to.
+	readLimit int64
+	// The connection's id, as the registry has it.
+	id uint64
+	// How envelopes are encoded for the client, on the endpoints that speak
+	// them. JSON unless the endpoint says otherwise.
+	codec codec
+	// Whether the client's binary messages, and the ones it's sent, are
+	// relayed between peers without being looked at; see relay.go.
+	opaque bool
+	// The session the client asked to resume, until it's in one, and then that
+	// one, or, on a stand-in, the one it stands in for. Changed with the
+	// sessions' lock held.
+	session string
+	// The round trips of the last few pings, and whether the client is told
+	// them, which is 1 if it is.
+	rtt           latency.Window
+	reportLatency int32
+
+	// The bucket of messages the client may send, or nil when it's unlimited.
+	inbound    *byteBucket
+	ratePolicy ratePolicy
+
+	limits sendQueue
+	mut    sync.Mutex
+	queue  []outbound
+	// The bytes of the messages in the queue, and of the one being written,
+	// which they're held until it has been.
+	pendingBytes int
+	// Set once a close frame is queued, since nothing can be sent after it.
+	closing bool
+	// Set once the client has been closed for being too slow.
+	tooSlow bool
+	// Signalled whenever there's something new in the queue.
+	wake chan struct{}
+	// When the write pump last took a message off the queue, or, if the queue
+	// was empty before, when the message at its front was queued.
+	pumped time.Time
+
+	// Closed once the write pump is done.
+	done chan struct{}
+
+	hooks []disconnectHook
+	// What every whole message to and from the client goes through, and the
+	// Connection they're given.
+	interceptIn  interceptorChain
+	interceptOut interceptorChain
+	conn         *Connection
+	// Reports errors that don't end the connection, such as messages dropped
+	// from a full queue, or nil to leave them unreported.
+	reportError func(op string, err error, message []byte) error
+	// How many envelopes the client has sent with bad signatures, when
+	// they're signed.
+	badSignatures int
+	// How many history fetches the client has going; see fetch.go.
+	fetching int32
+}
+
+var (
+	errClientDone = errors.New("client is no longer being written to")
+	errSlowClient = errors.New("client is too slow to keep up")
+)
+
+func newClient(t Transport, user string, limits sendQueue, rate messageRate) *client {
+	return &client{
+		t:          t,
+		principal:  principal{user: user},
+		connected:  time.Now(),
+		codec:      jsonCodec{},
+		keepalives: make(chan keepalive, 1),
+		limits:     limits,
+		inbound:    rate.bucket(),
+		ratePolicy: rate.policy,
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+}
+
+// write queues a message. If the queue is full, of messages or of bytes, the
+// message, or as many at the front of the queue as it takes to make room, is
+// dropped and reported as ErrBackpressureDrop, or the client is closed and
+// write fails with errSlowClient, depending on the overflow policy.
+func (c *client) write(messageType int, data []byte) error {
+	return c.enqueue(outbound{messageType: messageType, data: data})
+}
+
+// writeBroadcast queues a message broadcast to the client, as write does. It
+// waits for the room's bucket, if it's given one, as well as the client's, and
+// is dropped if it's still queued when it expires.
+func (c *client) writeBroadcast(messageType int, data []byte, room *byteBucket, expires time.Time) error {
+	return c.enqueue(outbound{messageType: messageType, data: data, broadcast: true, room: room, expires: expires})
+}
+
+// writeOpaque queues a binary message relayed from a peer, as write does.
+func (c *client) writeOpaque(data []byte) error {
+	return c.enqueue(outbound{messageType: websocket.BinaryMessage, data: data, opaque: true})
+}
+
+func (c *client) enqueue(m outbound) error {
+	c.mut.Lock()
+	if c.closing {
+		c.mut.Unlock()
+		return errClientDone
+	}
+	var dropped []outbound
+	full := c.full(len(m.data))
+	switch {
+	case !full:
+		c.push(m)
+	case c.limits.overflow == overflowDropNewest:
+		dropped = append(dropped, m)
+	case c.limits.overflow == overflowDropOldest:
+		// As many as it takes to make room, by count and by bytes.
+		for c.full(len(m.data)) {
+			dropped = append(dropped, c.queue[0])
+			c.pendingBytes -= len(c.queue[0].data)
+			c.dropFront()
+		}
+		c.push(m)
+	default:
+		// Closing it gets its reader to notice, and end the connection.
+		// The close frame goes out straight away, rather than behind
+		// everything the client is too slow to read.
+		c.closing, c.tooSlow = true, true
+		c.mut.Unlock()
+		slowClients.Add(1)
+		go c.t.Close(websocket.ClosePolicyViolation, "too slow")
+		return errSlowClient
+	}
+	c.mut.Unlock()
+
+	// Reported once the queue is unlocked, since the error hook might well
+	// write to the client.
+	for _, d := range dropped {
+		droppedMessages.Add(1)
+		if c.reportError != nil {
+			c.reportError("write", ErrBackpressureDrop, d.data)
+		}
+	}
+	return nil
+}
+
+// full tells whether the queue is too full for a message of n more bytes: it
+// has as many messages as it can, or, unless it's empty, would have more
+// bytes pending than it can. So a message bigger than the whole budget still
+// goes out, on its own. c.mut must be held.
+func (c *client) full(n int) bool {
+	if len(c.queue) >= c.limits.size {
+		return true
+	}
+	return c.limits.bytes > 0 && len(c.queue) > 0 && c.pendingBytes+n > c.limits.bytes
+}
+
+// onDisconnect has h called once the connection is over, with how it was
+// closed.
+func (c *client) onDisconnect(h disconnectHook) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.hooks = append(c.hooks, h)
+}
+
+func (c *client) disconnected(s closeStatus) {
+	c.mut.Lock()
+	hooks := c.hooks
+	c.mut.Unlock()
+	for _, h := range hooks {
+		h(c, s.code, s.reason)
+	}
+	if c.conn != nil {
+		c.conn.dropState()
+	}
+}
+
+// tryWrite queues a message if there's room in the queue, whatever the
+// overflow policy, and reports whether there was.
+func (c *client) tryWrite(messageType int, data []byte) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.closing || c.full(len(data)) {
+		return false
+	}
+	c.push(outbound{messageType: messageType, data: data})
+	return true
+}
+
+func (c *client) push(m outbound) {
+	if len(c.queue) == 0 {
+		c.pumped = time.Now()
+	}
+	c.queue = append(c.queue, m)
+	c.pendingBytes += len(m.data)
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop takes the message at the front of the queue, if there is one.
+func (c *client) pop() (outbound, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if len(c.queue) == 0 {
+		return outbound{}, false
+	}
+	m := c.queue[0]
+	c.dropFront()
+	c.pumped = time.Now()
+	return m, true
+}
+
+// written releases the bytes of a message popped off the queue, once
+// writing it is over, whether it went out or not.
+func (c *client) written(m outbound) {
+	if len(m.data) == 0 {
+		return
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.pendingBytes -= len(m.data)
+}
+
+// pending gives how many messages are queued, and how many bytes of them, and
+// of the one being written, are pending.
+func (c *client) pending() (messages, bytes int) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return len(c.queue), c.pendingBytes
+}
+
+// queueStalledFor gives how many messages are queued, and how long it's been
+// since the write pump took one off the queue, or zero if nothing is queued.
+func (c *client) queueStalledFor(now time.Time) (int, time.Duration) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if len(c.queue) == 0 {
+		return 0, 0
+	}
+	return len(c.queue), now.Sub(c.pumped)
+}
+
+// dropFront shifts the queue along, keeping it at the start of its array, so
+// that it never needs more than one.
+func (c *client) dropFront() {
+	n := copy(c.queue, c.queue[1:])
+	c.queue[n] = outbound{}
+	c.queue = c.queue[:n]
+}
+
+// failed gives errSlowClient as the reason for err, if the client was closed
+// for being too slow, since that's what made reading or writing fail.
+func (c *client) failed(err error) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.tooSlow {
+		return errSlowClient
+	}
+	return err
+}
+
+// close closes the connection with a close frame, once everything queued so
+// far has been written, and waits for that to happen, or for ctx to be done.
+func (c *client) close(ctx context.Context, code int, reason string) error {
+	c.mut.Lock()
+	if !c.closing {
+		c.closing = true
+		c.push(outbound{close: &closeFrame{code, reason}})
+	}
+	c.mut.Unlock()
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// read reads the next message, which is what keeps the client from being
+// idle. Neither library checks that text messages are
+// valid UTF-8, so read does, and closes the connection with 1007 over one that
+// isn't. Messages over the client's rate are dropped, or the connection is
+// closed over them, depending on the rate policy. The ones let through go
+// through the inbound interceptors, if there are any, unless they're relayed
+// to a peer.
+func (c *client) read(ctx context.Context) (int, []byte, error) {
+	for {
+		messageType, data, err := c.t.ReadMessage(context.Background())
+		if err != nil {
+			if c.idle != nil {
+				err = c.idle.readError(err)
+			}
+			return 0, nil, c.failed(err)
+		}
+		if c.idle != nil {
+			c.idle.touch()
+		}
+		if messageType == websocket.TextMessage && !utf8.Valid(data) {
+			c.close(ctx, websocket.CloseInvalidFramePayloadData, "invalid UTF-8")
+			return 0, nil, errInvalidUTF8
+		}
+		if ok, err := c.admit(ctx); err != nil {
+			return 0, nil, err
+		} else if !ok {
+			continue
+		}
+		if c.interceptIn != nil && !(c.opaque && messageType == websocket.BinaryMessage) {
+			m, err := c.interceptIn.run(c.conn, &Message{messageType, data})
+			if err != nil {
+				interceptedMessages.Add("inbound_rejected", 1)
+				sendError(ctx, c, "", codeRejected, err.Error())
+				continue
+			}
+			if m == nil {
+				continue
+			}
+			messageType, data = m.Type, m.Data
+		}
+		return messageType, data, nil
+	}
+}
+
+// admit counts a message that's come in against the client's rate, and tells
+// whether it's let through.
+func (c *client) admit(ctx context.Context) (bool, error) {
+	if c.inbound == nil {
+		return true, nil
+	}
+	wait := c.inbound.take(1, time.Now())
+	if wait <= 0 {
+		return true, nil
+	}
+	// Only the messages that are let through count.
+	c.inbound.give(1)
+	rateLimitedMessages.Add(1)
+	if c.ratePolicy == rateDisconnect {
+		c.close(ctx, websocket.ClosePolicyViolation, "too many messages")
+		return false, errMessageRate
+	}
+	// If there's no room for the warning, the client isn't reading anyway.
+	c.tryWrite(websocket.TextMessage, rateLimited(wait))
+	return false, nil
+}
+
+var errInvalidUTF8 = ProtocolViolation{websocket.CloseInvalidFramePayloadData}
+
+// writePump writes the queued messages, in order, until writing fails, a
+// close frame is sent, or ctx is done. Messages still queued by then are
+// dropped.
+func (c *client) writePump(ctx context.Context) error {
+	defer close(c.done)
+	// The message being written, whose bytes are pending until it has been.
+	var writing outbound
+	defer func() { c.written(writing) }()
+	for ctx.Err() == nil {
+		c.written(writing)
+		writing = outbound{}
+		m, ok := c.pop()
+		if !ok {
+			select {
+			case <-c.wake:
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if m.close != nil {
+			c.t.Close(m.close.code, m.close.reason)
+			return nil
+		}
+		writing = m
+		if expired(m.expires, time.Now()) {
+			expiredMessages.Add(1)
+			continue
+		}
+		if m.stream != nil {
+			if err := copyStream(c.t, c.writeWaits.stream, m.messageType, m.stream); err != nil {
+				var source *sourceError
+				if errors.As(err, &source) {
+					return c.failed(source.err)
+				}
+				return c.failed(&connWriteError{err})
+			}
+			continue
+		}
+		if c.interceptOut != nil && !m.opaque {
+			out, err := c.interceptOut.run(c.conn, &Message{m.messageType, m.data})
+			if err != nil {
+				interceptedMessages.Add("outbound_dropped", 1)
+				c.log.Debug("Dropped an outbound message", "error", err)
+				continue
+			}
+			if out == nil {
+				continue
+			}
+			m.messageType, m.data = out.Type, out.Data
+		}
+		timeout := c.writeWaits.message
+		if m.broadcast {
+			timeout = c.writeWaits.broadcast
+		}
+		t := c.t
+		if m.room != nil {
+			t = &throttledTransport{t, m.room}
+		}
+		if err := writeMessage(t, timeout, m.messageType, m.data); err != nil {
+			return c.failed(&connWriteError{err})
+		}
+	}
+	return nil
+}
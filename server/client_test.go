@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    overflowPolicy
+		wantErr bool
+	}{
+		{"disconnect", overflowDisconnect, false},
+		{"drop-oldest", overflowDropOldest, false},
+		{"drop-newest", overflowDropNewest, false},
+		{"", 0, true},
+		{"drop", 0, true},
+		{"Disconnect", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseOverflowPolicy(tt.in)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("parseOverflowPolicy(%q) = %d, %v, want %d, error %t", tt.in, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+// queued gives the data of the messages in the client's queue, with a close
+// frame as "close".
+func queued(c *client) []string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	var data []string
+	for _, m := range c.queue {
+		if m.close != nil {
+			data = append(data, "close")
+			continue
+		}
+		data = append(data, string(m.data))
+	}
+	return data
+}
+
+func TestSendQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  overflowPolicy
+		queued  []string
+		dropped int64
+		// The messages reported as dropped.
+		reported []string
+		// Whether the fourth message fails, and the client is closed as too
+		// slow.
+		slow bool
+	}{
+		{"disconnect", overflowDisconnect, []string{"1", "2", "3"}, 0, nil, true},
+		{"drop-oldest", overflowDropOldest, []string{"3", "4", "5"}, 2, []string{"1", "2"}, false},
+		{"drop-newest", overflowDropNewest, []string{"1", "2", "3"}, 2, []string{"4", "5"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ft := newFakeTransport()
+			c := newClient(ft, "", sendQueue{size: 3, overflow: tt.policy}, messageRate{})
+			dropped, slow := droppedMessages.Value(), slowClients.Value()
+			var reported []string
+			c.reportError = func(op string, err error, message []byte) error {
+				if !errors.Is(err, ErrBackpressureDrop) {
+					t.Errorf("reported %v, want ErrBackpressureDrop", err)
+				}
+				reported = append(reported, string(message))
+				return err
+			}
+
+			var errs []error
+			for _, data := range []string{"1", "2", "3", "4", "5"} {
+				errs = append(errs, c.write(websocket.TextMessage, []byte(data)))
+			}
+			if got := queued(c); strings.Join(got, " ") != strings.Join(tt.queued, " ") {
+				t.Fatalf("queued %q, want %q", got, tt.queued)
+			}
+			if got := droppedMessages.Value() - dropped; got != tt.dropped {
+				t.Fatalf("dropped_messages went up by %d, want %d", got, tt.dropped)
+			}
+			if strings.Join(reported, " ") != strings.Join(tt.reported, " ") {
+				t.Fatalf("reported %q as dropped, want %q", reported, tt.reported)
+			}
+
+			if !tt.slow {
+				for i, err := range errs {
+					if err != nil {
+						t.Fatalf("write %d: %v", i+1, err)
+					}
+				}
+				if _, _, closed := ft.closedWith(10 * time.Millisecond); closed {
+					t.Fatal("closed a client that only had messages dropped")
+				}
+				return
+			}
+			if !errors.Is(errs[3], errSlowClient) {
+				t.Fatalf("write 4 error = %v, want errSlowClient", errs[3])
+			}
+			if !errors.Is(errs[4], errClientDone) {
+				t.Fatalf("write 5 error = %v, want errClientDone", errs[4])
+			}
+			if got := slowClients.Value() - slow; got != 1 {
+				t.Fatalf("slow_clients went up by %d, want 1", got)
+			}
+			code, _, closed := ft.closedWith(5 * time.Second)
+			if !closed || code != websocket.ClosePolicyViolation {
+				t.Fatalf("closed = %t with %d, want %d", closed, code, websocket.ClosePolicyViolation)
+			}
+		})
+	}
+}
+
+func TestSendQueueCloseFrame(t *testing.T) {
+	c := newClient(newFakeTransport(), "", sendQueue{size: 2, overflow: overflowDropNewest}, messageRate{})
+	c.write(websocket.TextMessage, []byte("1"))
+	c.write(websocket.TextMessage, []byte("2"))
+
+	// A full queue still takes the close frame, behind everything else. The
+	// write pump isn't running, so there's no point waiting for it to go out.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.close(ctx, websocket.CloseNormalClosure, "")
+	if got := queued(c); strings.Join(got, " ") != "1 2 close" {
+		t.Fatalf("queued %q, want the close frame after the messages", got)
+	}
+
+	// And nothing can be queued after it.
+	if err := c.write(websocket.TextMessage, []byte("3")); !errors.Is(err, errClientDone) {
+		t.Fatalf("write after close error = %v, want errClientDone", err)
+	}
+	if c.tryWrite(websocket.TextMessage, []byte("3")) {
+		t.Fatal("tryWrite after close queued the message")
+	}
+}
+
+func TestSendQueueBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   overflowPolicy
+		queued   []string
+		reported []string
+		slow     bool
+	}{
+		// Room for 10 messages, but only 10 bytes of them: "cccc" would make
+		// 12.
+		{"disconnect", overflowDisconnect, []string{"aaaa", "bbbb"}, nil, true},
+		{"drop-oldest", overflowDropOldest, []string{"bbbb", "cccc"}, []string{"aaaa"}, false},
+		{"drop-newest", overflowDropNewest, []string{"aaaa", "bbbb"}, []string{"cccc"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newClient(newFakeTransport(), "", sendQueue{size: 10, overflow: tt.policy, bytes: 10}, messageRate{})
+			var reported []string
+			c.reportError = func(op string, err error, message []byte) error {
+				reported = append(reported, string(message))
+				return err
+			}
+			var err error
+			for _, data := range []string{"aaaa", "bbbb", "cccc"} {
+				err = c.write(websocket.TextMessage, []byte(data))
+			}
+			if got := queued(c); strings.Join(got, " ") != strings.Join(tt.queued, " ") {
+				t.Fatalf("queued %q, want %q", got, tt.queued)
+			}
+			if strings.Join(reported, " ") != strings.Join(tt.reported, " ") {
+				t.Fatalf("reported %q as dropped, want %q", reported, tt.reported)
+			}
+			if tt.slow != errors.Is(err, errSlowClient) {
+				t.Fatalf("write 3 error = %v, want errSlowClient %t", err, tt.slow)
+			}
+			if _, bytes := c.pending(); bytes != 8 {
+				t.Fatalf("%d bytes pending, want 8", bytes)
+			}
+		})
+	}
+
+	// A message bigger than the whole budget goes into an empty queue, on its
+	// own, and the bytes are released once it's written.
+	c := newClient(newFakeTransport(), "", sendQueue{size: 10, overflow: overflowDropNewest, bytes: 10}, messageRate{})
+	c.write(websocket.TextMessage, []byte("too big for it"))
+	if c.tryWrite(websocket.TextMessage, []byte("a")) {
+		t.Fatal("queued a message behind one that takes all the bytes")
+	}
+	m, _ := c.pop()
+	if n, bytes := c.pending(); n != 0 || bytes != 14 {
+		t.Fatalf("pending %d, %d bytes while it's written, want 0, 14", n, bytes)
+	}
+	c.written(m)
+	c.write(websocket.TextMessage, []byte("aaaa"))
+	c.write(websocket.TextMessage, []byte("bbbb"))
+	c.takeQueue()
+	if n, bytes := c.pending(); n != 0 || bytes != 0 {
+		t.Fatalf("pending %d, %d bytes once the queue's taken, want nothing", n, bytes)
+	}
+}
+
+func TestSendQueueBytesStalledReader(t *testing.T) {
+	const frame, budget = 30000, 100000
+	s := pipeServer(t, WithSendQueue(256, "drop-oldest"), WithSendQueueBytes(budget))
+	dropped := droppedMessages.Value()
+	reader := pipeDial(t, s, "/chat")
+	reader.Stall()
+	var c *client
+	for deadline := time.Now().Add(5 * time.Second); c == nil; time.Sleep(time.Millisecond) {
+		if conns := s.reg.list(); len(conns) == 1 {
+			c = conns[0].served()
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the reader wasn't served")
+		}
+	}
+	writer := pipeDial(t, s, "/chat")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	const frames = 10
+	for i := 1; i <= frames; i++ {
+		data := fmt.Sprintf("%02d%s", i, strings.Repeat("x", frame-2))
+		writer.Inject(websocket.TextMessage, []byte(data))
+		for {
+			m, err := writer.Next(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.Data) == frame {
+				break
+			}
+		}
+	}
+
+	// However much is sent to it, what's pending for the stalled reader never
+	// comes to more than its budget, the one it's stuck writing included.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := queued(c)
+		if len(got) > 0 && strings.HasPrefix(got[len(got)-1], fmt.Sprint(frames)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the last frame wasn't queued for the stalled reader")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, bytes := c.pending(); bytes > budget {
+		t.Fatalf("%d bytes pending, over the budget of %d", bytes, budget)
+	}
+	if droppedMessages.Value() == dropped {
+		t.Fatal("nothing was dropped to keep to the budget")
+	}
+
+	// Once it reads again, it gets the newest of them, and nothing's left.
+	reader.Resume()
+	var last string
+	for !strings.HasPrefix(last, fmt.Sprint(frames)) {
+		m, err := reader.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = string(m.Data)
+	}
+	for {
+		if n, bytes := c.pending(); n == 0 && bytes == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			n, bytes := c.pending()
+			t.Fatalf("pending %d, %d bytes once it's all been read", n, bytes)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
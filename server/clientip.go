@@ -0,0 +1,161 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// When running behind a reverse proxy or a load balancer, r.RemoteAddr is the
+// address of the proxy, not of the client. Proxies tell us who the client
+// actually is via the X-Forwarded-For header, or the standardized Forwarded
+// header (RFC 7239).
+//
+// The catch is that anyone can send those headers. So they are only looked at
+// when the direct peer is one of our own trusted proxies. Even then, every hop
+// appends to the header, and only the entries appended by trusted proxies are
+// believable. So we walk the chain from right to left, skipping over trusted
+// proxies, and the first address that isn't one of ours is the client.
+//
+// Peers connecting over a unix socket don't have an address at all. They can
+// only be processes on the same host, most likely a reverse proxy, so they are
+// always trusted. If such a peer doesn't forward a client address, the result
+// is the zero netip.Addr.
+
+type clientIPResolver struct {
+	trustedProxies []netip.Prefix
+}
+
+func newClientIPResolver(trustedProxies []string) (*clientIPResolver, error) {
+	resolver := &clientIPResolver{}
+	for _, s := range trustedProxies {
+		rule, err := parseIPRule(true, s)
+		if err != nil {
+			return nil, err
+		}
+		resolver.trustedProxies = append(resolver.trustedProxies, rule.prefix)
+	}
+	return resolver, nil
+}
+
+func (resolver *clientIPResolver) trusted(addr netip.Addr) bool {
+	for _, prefix := range resolver.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP gives the effective address of the client that made the request.
+func (resolver *clientIPResolver) clientIP(r *http.Request) (netip.Addr, error) {
+	var peer netip.Addr
+	if !isUnixPeer(r) {
+		var err error
+		peer, err = parseForwardedAddr(r.RemoteAddr)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		if !resolver.trusted(peer) {
+			return peer, nil
+		}
+	}
+
+	var hops []string
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		hops = forwardedFor(values)
+	} else {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := parseForwardedAddr(hops[i])
+		if err != nil {
+			// We can't tell who handed this entry to our proxy, so the best we
+			// can do is the last hop that we know was appended by one of ours.
+			break
+		}
+		client = addr
+		if !resolver.trusted(addr) {
+			break
+		}
+	}
+	return client, nil
+}
+
+// scheme gives the scheme the client made the request with, "http" or
+// "https". Behind a trusted proxy, that's the proto= of the last element of
+// the Forwarded header, which the proxy added, or the last X-Forwarded-Proto if
+// there's no Forwarded header.
+func (resolver *clientIPResolver) scheme(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if !isUnixPeer(r) {
+		peer, err := parseForwardedAddr(r.RemoteAddr)
+		if err != nil || !resolver.trusted(peer) {
+			return scheme
+		}
+	}
+
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		elements := strings.Split(values[len(values)-1], ",")
+		for _, pair := range strings.Split(elements[len(elements)-1], ";") {
+			key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "proto") {
+				return strings.ToLower(strings.Trim(val, "\""))
+			}
+		}
+		return scheme
+	}
+	if values := r.Header.Values("X-Forwarded-Proto"); len(values) > 0 {
+		protos := strings.Split(values[len(values)-1], ",")
+		return strings.ToLower(strings.TrimSpace(protos[len(protos)-1]))
+	}
+	return scheme
+}
+
+// forwardedFor extracts the for= parameter of every element of the given
+// Forwarded header values, in order.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			// An element without a for= parameter still represents a hop, so an
+			// empty string is used in its place to have it rejected as malformed.
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hop = strings.Trim(val, "\"")
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseForwardedAddr parses an address as found in RemoteAddr, the
+// X-Forwarded-For header, or the for= parameter of a Forwarded header. That
+// is, an IPv4 or IPv6 address, optionally with a port, and where IPv6
+// addresses with ports are enclosed in square brackets.
+func parseForwardedAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	host := s
+	if h, _, err := net.SplitHostPort(s); err == nil {
+		host = h
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		host = s[1 : len(s)-1]
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap().WithZone(""), nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "2001:db8:ffff::/48"}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		unix       bool
+		forwarded  []string
+		xff        []string
+		want       string
+		err        bool
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:1234", want: "192.0.2.1"},
+		{name: "direct IPv6", remoteAddr: "[2001:db8::1]:1234", want: "2001:db8::1"},
+		{name: "direct IPv4-mapped", remoteAddr: "[::ffff:192.0.2.1]:1234", want: "192.0.2.1"},
+		{name: "direct with a zone", remoteAddr: "[fe80::1%eth0]:1234", want: "fe80::1"},
+		{name: "bad remote address", remoteAddr: "nonsense", err: true},
+		{name: "untrusted peer's headers ignored", remoteAddr: "192.0.2.1:1234", xff: []string{"198.51.100.1"}, forwarded: []string{"for=198.51.100.2"}, want: "192.0.2.1"},
+		{name: "trusted proxy without headers", remoteAddr: "10.0.0.1:1234", want: "10.0.0.1"},
+
+		{name: "X-Forwarded-For", remoteAddr: "10.0.0.1:1234", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "X-Forwarded-For, several hops", remoteAddr: "10.0.0.1:1234", xff: []string{"203.0.113.9, 198.51.100.1, 10.0.0.2"}, want: "198.51.100.1"},
+		{name: "X-Forwarded-For, several headers", remoteAddr: "10.0.0.1:1234", xff: []string{"203.0.113.9", "198.51.100.1", "10.0.0.2"}, want: "198.51.100.1"},
+		{name: "X-Forwarded-For, only proxies", remoteAddr: "10.0.0.1:1234", xff: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "X-Forwarded-For, IPv4 with a port", remoteAddr: "10.0.0.1:1234", xff: []string{"198.51.100.1:5678"}, want: "198.51.100.1"},
+		{name: "X-Forwarded-For, IPv6", remoteAddr: "10.0.0.1:1234", xff: []string{"2001:db8::5"}, want: "2001:db8::5"},
+		{name: "X-Forwarded-For, IPv6 with a port", remoteAddr: "10.0.0.1:1234", xff: []string{"[2001:db8::5]:5678"}, want: "2001:db8::5"},
+		{name: "X-Forwarded-For, IPv6 in brackets", remoteAddr: "10.0.0.1:1234", xff: []string{"[2001:db8::5]"}, want: "2001:db8::5"},
+		{name: "X-Forwarded-For, trusted IPv6 proxy", remoteAddr: "[2001:db8:ffff::1]:1234", xff: []string{"2001:db8::5, 2001:db8:ffff::2"}, want: "2001:db8::5"},
+		// A malformed entry stops the walk at the last hop that a trusted
+		// proxy vouched for.
+		{name: "X-Forwarded-For, malformed client", remoteAddr: "10.0.0.1:1234", xff: []string{"nonsense"}, want: "10.0.0.1"},
+		{name: "X-Forwarded-For, malformed behind a proxy", remoteAddr: "10.0.0.1:1234", xff: []string{"nonsense, 10.0.0.2"}, want: "10.0.0.2"},
+		{name: "X-Forwarded-For, malformed further back", remoteAddr: "10.0.0.1:1234", xff: []string{"198.51.100.7, nonsense, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "X-Forwarded-For, empty entry", remoteAddr: "10.0.0.1:1234", xff: []string{"198.51.100.7, , 10.0.0.2"}, want: "10.0.0.2"},
+		{name: "X-Forwarded-For, IPv6 without brackets and a port", remoteAddr: "10.0.0.1:1234", xff: []string{"2001:db8::5:5678"}, want: "2001:db8::5:5678"},
+
+		{name: "Forwarded", remoteAddr: "10.0.0.1:1234", forwarded: []string{"for=198.51.100.1"}, want: "198.51.100.1"},
+		{name: "Forwarded, quoted", remoteAddr: "10.0.0.1:1234", forwarded: []string{`for="198.51.100.1"`}, want: "198.51.100.1"},
+		{name: "Forwarded, other parameters", remoteAddr: "10.0.0.1:1234", forwarded: []string{"proto=https;For=198.51.100.1;by=10.0.0.1"}, want: "198.51.100.1"},
+		{name: "Forwarded, several hops", remoteAddr: "10.0.0.1:1234", forwarded: []string{"for=203.0.113.9, for=198.51.100.1, for=10.0.0.2"}, want: "198.51.100.1"},
+		{name: "Forwarded, several headers", remoteAddr: "10.0.0.1:1234", forwarded: []string{"for=203.0.113.9", "for=198.51.100.1;proto=https"}, want: "198.51.100.1"},
+		{name: "Forwarded, IPv6 with a port", remoteAddr: "10.0.0.1:1234", forwarded: []string{`for="[2001:db8::5]:5678"`}, want: "2001:db8::5"},
+		{name: "Forwarded, IPv6 without a port", remoteAddr: "10.0.0.1:1234", forwarded: []string{`for="[2001:db8::5]"`}, want: "2001:db8::5"},
+		{name: "Forwarded, obfuscated", remoteAddr: "10.0.0.1:1234", forwarded: []string{"for=_hidden, for=10.0.0.2"}, want: "10.0.0.2"},
+		{name: "Forwarded, unknown", remoteAddr: "10.0.0.1:1234", forwarded: []string{"for=unknown"}, want: "10.0.0.1"},
+		{name: "Forwarded, element without for", remoteAddr: "10.0.0.1:1234", forwarded: []string{"for=198.51.100.7, proto=https"}, want: "10.0.0.1"},
+		// Forwarded is preferred, since it's the standard one.
+		{name: "both headers", remoteAddr: "10.0.0.1:1234", forwarded: []string{"for=198.51.100.1"}, xff: []string{"203.0.113.9"}, want: "198.51.100.1"},
+
+		{name: "unix peer", unix: true, xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "unix peer, through a proxy", unix: true, xff: []string{"198.51.100.1, 10.0.0.2"}, want: "198.51.100.1"},
+		{name: "unix peer without headers", unix: true, want: "invalid IP"},
+	}
+	resolver, err := newClientIPResolver(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.unix {
+				r.RemoteAddr = "@"
+				r = r.WithContext(withConn(r.Context(), &net.UnixConn{}))
+			}
+			for _, v := range tt.forwarded {
+				r.Header.Add("Forwarded", v)
+			}
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			addr, err := resolver.clientIP(r)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("clientIP() = %s, want an error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != tt.want {
+				t.Fatalf("clientIP() = %s, want %s", addr, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClientIPResolverInvalid(t *testing.T) {
+	for _, s := range []string{"10.0.0.0/33", "nonsense", "10.0.0"} {
+		if _, err := newClientIPResolver([]string{s}); err == nil {
+			t.Errorf("newClientIPResolver(%q) succeeded", s)
+		}
+	}
+}
+
+func TestScheme(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		proto      string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:1234", want: "http"},
+		{name: "untrusted peer's headers ignored", remoteAddr: "192.0.2.1:1234", proto: "https", forwarded: "proto=https", want: "http"},
+		{name: "X-Forwarded-Proto", remoteAddr: "10.0.0.1:1234", proto: "https", want: "https"},
+		{name: "X-Forwarded-Proto, last hop", remoteAddr: "10.0.0.1:1234", proto: "https, http", want: "http"},
+		{name: "Forwarded", remoteAddr: "10.0.0.1:1234", forwarded: "for=198.51.100.1;proto=HTTPS", want: "https"},
+		{name: "Forwarded, last element", remoteAddr: "10.0.0.1:1234", forwarded: "proto=http, for=198.51.100.1;proto=https", want: "https"},
+		{name: "Forwarded without proto", remoteAddr: "10.0.0.1:1234", forwarded: "for=198.51.100.1", proto: "https", want: "http"},
+	}
+	resolver, err := newClientIPResolver([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("Forwarded", tt.forwarded)
+			}
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if got := resolver.scheme(r); got != tt.want {
+				t.Fatalf("scheme() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
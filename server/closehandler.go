@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"wsexample/graphqlws"
+)
+
+// How a connection ended is kept track of by a closeHandler wrapped around it:
+// the code and reason of the first close frame, and whether the client or the
+// server sent it. Close frames from the client are answered by the libraries
+// themselves, with the same code, as the RFC asks.
+//
+// When the connection ends for some other reason, without a close frame
+// either way, the server sends one that says why if it still can:
+//
+//   - the close code the violation earns, such as 1002 (protocol error) or
+//     1007 (invalid payload data), when the client broke the protocol spoken
+//     on top of WebSocket;
+//   - 1011 (internal error) when something went wrong in the server.
+//
+// If the connection broke, such as when a write failed or a pong didn't show
+// up, there's no point in trying; it ends as 1006 (abnormal closure), the
+// same as when the client goes away without a close frame. The libraries
+// close the connection themselves over a WebSocket protocol error, with 1002,
+// and over a message over the read limit, with 1009 (message too big).
+//
+// Once it's over, the connection's disconnect hooks are called with the code
+// and reason, so that what the server does about a client going away can
+// depend on whether it was a normal closure, a protocol error, or the client
+// (or the server) going away.
+
+// closeStatus is how a connection was closed.
+type closeStatus struct {
+	code     int
+	reason   string
+	byClient bool
+}
+
+func (s closeStatus) String() string {
+	by := "server"
+	if s.byClient {
+		by = "client"
+	}
+	if s.reason == "" {
+		return fmt.Sprintf("%d from the %s", s.code, by)
+	}
+	return fmt.Sprintf("%d from the %s (%s)", s.code, by, s.reason)
+}
+
+// A disconnectHook is told how a client's connection was closed, once it's
+// done with.
+type disconnectHook func(c *client, code int, reason string)
+
+// closeHandler remembers the first close frame sent or received on the
+// connection.
+type closeHandler struct {
+	Transport
+
+	mut    sync.Mutex
+	status *closeStatus
+}
+
+func (t *closeHandler) record(s closeStatus) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if t.status == nil {
+		t.status = &s
+	}
+}
+
+// closed tells whether a close frame has been sent or received yet.
+func (t *closeHandler) closed() bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.status != nil
+}
+
+func (t *closeHandler) ReadMessage(ctx context.Context) (int, []byte, error) {
+	messageType, data, err := t.Transport.ReadMessage(ctx)
+	t.readFailed(err)
+	return messageType, data, err
+}
+
+// A close frame can also turn up partway through a streamed message.
+func (t *closeHandler) NextReader(ctx context.Context) (int, io.Reader, error) {
+	messageType, r, err := t.Transport.NextReader(ctx)
+	if err != nil {
+		t.readFailed(err)
+		return 0, nil, err
+	}
+	return messageType, readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		t.readFailed(err)
+		return n, err
+	}), nil
+}
+
+// readFailed records how the connection was closed, if that's what err says,
+// which it doesn't if it's nil, or io.EOF at the end of a streamed message.
+func (t *closeHandler) readFailed(err error) {
+	var ce *websocket.CloseError
+	var ne net.Error
+	switch {
+	case err == nil:
+	case errors.As(err, &ce):
+		t.record(closeStatus{ce.Code, ce.Text, true})
+	case errors.Is(err, websocket.ErrReadLimit):
+		t.record(closeStatus{websocket.CloseMessageTooBig, "", false})
+	// Anything else that isn't the connection breaking is a WebSocket protocol
+	// error, which the library has answered with a close frame.
+	case !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, net.ErrClosed) &&
+		!errors.As(err, &ne) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded):
+		t.record(closeStatus{websocket.CloseProtocolError, "", false})
+	}
+}
+
+func (t *closeHandler) Close(code int, reason string) error {
+	t.record(closeStatus{code, reason, false})
+	return t.Transport.Close(code, reason)
+}
+
+// closeStatus gives how the connection was closed. Without a close frame
+// either way, it was closed abnormally.
+func (t *closeHandler) closeStatus() closeStatus {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if t.status != nil {
+		return *t.status
+	}
+	return closeStatus{websocket.CloseAbnormalClosure, "", true}
+}
+
+// closeFrameFor gives the close frame to send over err, if there is one worth
+// sending.
+func closeFrameFor(err error) (code int, reason string, ok bool) {
+	var pv ProtocolViolation
+	var pe *graphqlws.ProtocolError
+	var reported *reportedError
+	var we *connWriteError
+	var ce *websocket.CloseError
+	switch {
+	case err == nil:
+		return 0, "", false
+	case errors.As(err, &pv):
+		return pv.Code, "protocol violation", true
+	case errors.As(err, &pe):
+		return pe.Code, pe.Reason, true
+	// Queued already, but the pump may not have got to it, such as on /echo,
+	// which only queues it.
+	case errors.Is(err, errMessageRate):
+		return websocket.ClosePolicyViolation, "too many messages", true
+	// Reading, writing or pinging failed, so the connection is broken, or the
+	// library has already closed it.
+	case errors.As(err, &reported), errors.As(err, &we), errors.Is(err, errPongTimeout),
+		errors.Is(err, net.ErrClosed), errors.Is(err, websocket.ErrCloseSent):
+		return 0, "", false
+	// The client closed it, and the library answered.
+	case errors.As(err, &ce):
+		return 0, "", false
+	}
+	return websocket.CloseInternalServerErr, "internal error", true
+}
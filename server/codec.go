@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"wsexample/internal/protowire"
+)
+
+// protoSubprotocol is the subprotocol for protobuf envelopes.
+const protoSubprotocol = "proto.v1"
+
+// A codec is how envelopes are encoded on a connection.
+type codec interface {
+	// name is the codec's name, for telling it apart from the others.
+	name() string
+	// decode gives the envelopes in a message from the client.
+	decode(messageType int, message []byte) ([]incoming, error)
+	// decodePayload decodes the payload of an envelope into v.
+	decodePayload(data []byte, v interface{}) error
+	// encodePayload encodes the payload of an envelope.
+	encodePayload(payload interface{}) ([]byte, error)
+	// encode gives the message for an envelope of the type, with the payload
+	// already encoded, and the sequence number, if it has one.
+	encode(typ string, seq uint64, payload []byte) (messageType int, message []byte, err error)
+}
+
+// encodeEnvelope gives the message for an envelope of the type, with the
+// payload, in the codec.
+func encodeEnvelope(c codec, typ string, payload interface{}) (int, []byte, error) {
+	data, err := c.encodePayload(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	return c.encode(typ, 0, data)
+}
+
+// codecs is every codec there is.
+var codecs = []codec{jsonCodec{}, protoCodec{}, attributedCodec{}}
+
+// codecFor gives the codec for the negotiated subprotocol.
+func codecFor(subprotocol string) codec {
+	if subprotocol == protoSubprotocol {
+		return protoCodec{}
+	}
+	return jsonCodec{}
+}
+
+// incoming is an envelope from the client, with its payload still encoded.
+type incoming struct {
+	typ     string
+	payload []byte
+	// What it's signed with, when envelopes are signed; see signing.go.
+	seq uint64
+	ts  int64
+	sig []byte
+	// Why it's not to be trusted, when its signature doesn't check out.
+	sigErr error
+	// The TTL it gives what it sends, if any; see ttl.go.
+	ttl time.Duration
+}
+
+// payload is the payload of an envelope, for a handler to decode.
+type payload struct {
+	// The type of the envelope it came in.
+	typ   string
+	data  []byte
+	codec codec
+	// The TTL the envelope gives what the handler sends for it, if any.
+	ttl time.Duration
+}
+
+// jsonCodec is for JSON envelopes, in text messages.
+type jsonCodec struct{}
+
+type jsonEnvelope struct {
+	Type    string          `json:"type"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	TS      int64           `json:"ts,omitempty"`
+	Sig     string          `json:"sig,omitempty"`
+	TTLMS   int64           `json:"ttl_ms,omitempty"`
+}
+
+func (jsonCodec) name() string {
+	return "json"
+}
+
+func (jsonCodec) decode(messageType int, message []byte) ([]incoming, error) {
+	if messageType != websocket.TextMessage {
+		return nil, errors.New("messages must be JSON text")
+	}
+	var e jsonEnvelope
+	if err := json.Unmarshal(message, &e); err != nil {
+		return nil, err
+	}
+	in := incoming{typ: e.Type, payload: e.Payload, seq: e.Seq, ts: e.TS, ttl: ttlOf(e.TTLMS)}
+	if e.Sig != "" {
+		// A signature that isn't hex can't be right, and is as good as none.
+		if sig, err := hex.DecodeString(e.Sig); err == nil {
+			in.sig = sig
+		}
+	}
+	return []incoming{in}, nil
+}
+
+func (jsonCodec) decodePayload(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return errors.New("the message has no payload")
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) encodePayload(payload interface{}) ([]byte, error) {
+	return json.Marshal(legacyOf(payload))
+}
+
+func (c jsonCodec) encode(typ string, seq uint64, payload []byte) (int, []byte, error) {
+	return c.encodeSigned(typ, seq, payload, 0, nil)
+}
+
+// canonicalPayload takes the whitespace out of the payload, as signing.go
+// describes. Payloads the server encodes have all been through json.Marshal,
+// which has them as they'd be written in the envelope, so they're signed as
+// they're sent.
+func (jsonCodec) canonicalPayload(payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	var b bytes.Buffer
+	if err := json.Compact(&b, payload); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (jsonCodec) encodeSigned(typ string, seq uint64, payload []byte, ts int64, sig []byte) (int, []byte, error) {
+	e := jsonEnvelope{Type: typ, Seq: seq, Payload: payload, TS: ts}
+	if sig != nil {
+		e.Sig = hex.EncodeToString(sig)
+	}
+	message, err := json.Marshal(e)
+	return websocket.TextMessage, message, err
+}
+
+// protoCodec is for protobuf envelopes, in binary messages, each prefixed with
+// its length.
+type protoCodec struct{}
+
+type protoEnvelope struct {
+	Type    string `pb:"1"`
+	Payload []byte `pb:"2"`
+	Seq     uint64 `pb:"3"`
+	TS      int64  `pb:"4"`
+	Sig     []byte `pb:"5"`
+	TTLMS   int64  `pb:"6"`
+}
+
+func (protoCodec) name() string {
+	return protoSubprotocol
+}
+
+func (protoCodec) decode(messageType int, message []byte) ([]incoming, error) {
+	if messageType != websocket.BinaryMessage {
+		return nil, errors.New("messages must be binary protobuf")
+	}
+	messages, err := protowire.SplitDelimited(message)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("the message has no envelopes")
+	}
+	envelopes := make([]incoming, len(messages))
+	for i, m := range messages {
+		var e protoEnvelope
+		if err := protowire.Unmarshal(m, &e); err != nil {
+			return nil, err
+		}
+		envelopes[i] = incoming{typ: e.Type, payload: e.Payload, seq: e.Seq, ts: e.TS, sig: e.Sig, ttl: ttlOf(e.TTLMS)}
+	}
+	return envelopes, nil
+}
+
+// decodePayload decodes a missing payload as an empty one, since protobuf
+// doesn't tell them apart.
+func (protoCodec) decodePayload(data []byte, v interface{}) error {
+	return protowire.Unmarshal(data, v)
+}
+
+func (protoCodec) encodePayload(payload interface{}) ([]byte, error) {
+	return protowire.Marshal(legacyOf(payload))
+}
+
+func (c protoCodec) encode(typ string, seq uint64, payload []byte) (int, []byte, error) {
+	return c.encodeSigned(typ, seq, payload, 0, nil)
+}
+
+func (protoCodec) canonicalPayload(payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+func (protoCodec) encodeSigned(typ string, seq uint64, payload []byte, ts int64, sig []byte) (int, []byte, error) {
+	e, err := protowire.Marshal(protoEnvelope{Type: typ, Payload: payload, Seq: seq, TS: ts, Sig: sig})
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.BinaryMessage, protowire.AppendDelimited(nil, e), nil
+}
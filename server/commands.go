@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// On /chat, a text message that starts with a slash is a command, as it
+// would be on IRC, and isn't broadcast; see slash.go for how it's parsed.
+// The commands are the room actions, and a few of what /api can do:
+//
+//	/join <room>               joins the room, as the join action does
+//	/leave [room]              leaves it
+//	/nick <name>               takes the name in every room the client is in
+//	/msg <id|name> <message>   sends a direct message to a member of one
+//	/who [room]                lists who's in the room
+//
+// Without a room, /leave and /who are for the only room the client is in.
+// /join and /leave are answered as their actions are, /nick with the
+// chat.renamed envelope everyone in the room is sent, and /who with
+//
+//	{"type":"who","room":"lobby","members":[{"connected_at":"...","id":4,"name":"alice"}]}
+//
+// with the members as presence.list has them. /msg's message is the rest of
+// the text, as it is, and the recipient is the member with the connection id,
+// or, failing that, with the name in a room the two of them share; it's sent
+// the same direct envelope as on /api, with the message as a JSON string. A
+// command that can't be done is answered with
+//
+//	{"type":"error","command":"nick","code":"name_taken","error":"the name is taken in the room"}
+//
+// and one there's no such command as, with unknown_command and the usage of
+// every one there is, in "commands". A hub's own commands are added with
+// Hub.HandleCommand, alongside these. Commands are counted by name under
+// chat_commands.
+
+const (
+	codeUnknownCommand = "unknown_command"
+	codeBadCommand     = "bad_command"
+	codeCommandFailed  = "command_failed"
+)
+
+var chatCommands = expvar.NewMap("chat_commands")
+
+// commandFunc does the command for the client.
+type commandFunc func(ctx context.Context, h *hub, c *client, cmd Command) error
+
+type chatCommand struct {
+	// How it's used, as in "/join <room>".
+	usage string
+	run   commandFunc
+}
+
+func builtinCommands() map[string]chatCommand {
+	return map[string]chatCommand{
+		"join":  {"/join <room>", joinCommand},
+		"leave": {"/leave [room]", leaveCommand},
+		"nick":  {"/nick <name>", nickCommand},
+		"msg":   {"/msg <id|name> <message>", msgCommand},
+		"who":   {"/who [room]", whoCommand},
+	}
+}
+
+type commandErrorReply struct {
+	Type     string   `json:"type"`
+	Command  string   `json:"command,omitempty"`
+	Code     string   `json:"code"`
+	Error    string   `json:"error"`
+	Commands []string `json:"commands,omitempty"`
+}
+
+type whoReply struct {
+	Type string `json:"type"`
+	presenceList
+}
+
+// usages gives how every command is used, in order.
+func (h *hub) usages() []string {
+	usages := make([]string, 0, len(h.commands))
+	for _, command := range h.commands {
+		usages = append(usages, command.usage)
+	}
+	sort.Strings(usages)
+	return usages
+}
+
+// usageError is the error for a command with the wrong arguments.
+func (h *hub) usageError(name string) error {
+	return &replyError{codeBadCommand, "usage: " + h.commands[name].usage}
+}
+
+// handleCommand does the command, which failed to parse if err isn't nil,
+// and sends the client the error, if it can't be done.
+func handleCommand(ctx context.Context, h *hub, c *client, cmd Command, err error) error {
+	reply := commandErrorReply{Type: "error", Command: cmd.Name}
+	command, ok := h.commands[cmd.Name]
+	switch {
+	case err != nil:
+		chatCommands.Add("bad", 1)
+		reply.Code, reply.Error = codeBadCommand, err.Error()
+	case !ok:
+		chatCommands.Add("unknown", 1)
+		reply.Code, reply.Error = codeUnknownCommand, fmt.Sprintf("there's no /%s command", cmd.Name)
+		reply.Commands = h.usages()
+	default:
+		chatCommands.Add(cmd.Name, 1)
+		if err = command.run(ctx, h, c, cmd); err == nil {
+			return nil
+		}
+		var re *replyError
+		if !errors.As(err, &re) {
+			re = &replyError{codeCommandFailed, err.Error()}
+		}
+		reply.Code, reply.Error = re.code, re.message
+	}
+	message, _ := json.Marshal(reply)
+	return c.write(websocket.TextMessage, message)
+}
+
+// commandRoom gives the room a command is for: the one it names, or
+// otherwise the only one the client is in.
+func (h *hub) commandRoom(c *client, args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	switch rooms := h.roomsOf(c); len(rooms) {
+	case 0:
+		return "", &replyError{codeNotInRoom, "not in any room"}
+	case 1:
+		return rooms[0], nil
+	default:
+		return "", &replyError{codeBadCommand, "in more than one room, so say which: " + strings.Join(rooms, ", ")}
+	}
+}
+
+func joinCommand(ctx context.Context, h *hub, c *client, cmd Command) error {
+	if len(cmd.Args) != 1 {
+		return h.usageError(cmd.Name)
+	}
+	return handleRoomMessage(ctx, h, c, roomMessage{Action: "join", Room: cmd.Args[0]}, nil)
+}
+
+func leaveCommand(ctx context.Context, h *hub, c *client, cmd Command) error {
+	if len(cmd.Args) > 1 {
+		return h.usageError(cmd.Name)
+	}
+	room, err := h.commandRoom(c, cmd.Args)
+	if err != nil {
+		return err
+	}
+	return handleRoomMessage(ctx, h, c, roomMessage{Action: "leave", Room: room}, nil)
+}
+
+func nickCommand(ctx context.Context, h *hub, c *client, cmd Command) error {
+	if len(cmd.Args) != 1 {
+		return h.usageError(cmd.Name)
+	}
+	rooms := h.roomsOf(c)
+	if len(rooms) == 0 {
+		return &replyError{codeNotInRoom, "names are for rooms, so join one first"}
+	}
+	for _, room := range rooms {
+		if err := h.rename(c, room, cmd.Args[0]); err != nil {
+			return nameError(err)
+		}
+	}
+	return nil
+}
+
+func msgCommand(ctx context.Context, h *hub, c *client, cmd Command) error {
+	if len(cmd.Args) < 2 {
+		return h.usageError(cmd.Name)
+	}
+	to := cmd.Args[0]
+	id, err := strconv.ParseUint(to, 10, 64)
+	if err != nil {
+		var ok bool
+		if id, ok = h.named(c, to); !ok {
+			return &replyError{codeNoPeer, fmt.Sprintf("%s named %q in any of your rooms", errNoPeer.Error(), to)}
+		}
+	}
+	message, _ := json.Marshal(cmd.After(1))
+	return h.sendDirect(ctx, c, directPayload{To: id, Message: message})
+}
+
+func whoCommand(ctx context.Context, h *hub, c *client, cmd Command) error {
+	if len(cmd.Args) > 1 {
+		return h.usageError(cmd.Name)
+	}
+	room, err := h.commandRoom(c, cmd.Args)
+	if err != nil {
+		return err
+	}
+	members, ok := h.members(c, room)
+	if !ok {
+		return &replyError{codeNotInRoom, errNotInRoom.Error()}
+	}
+	message, _ := json.Marshal(whoReply{"who", presenceList{Room: room, Members: members}})
+	return c.write(websocket.TextMessage, message)
+}
+
+// named gives the id of the member with the name in one of c's rooms, other
+// than c.
+func (h *hub) named(c *client, name string) (uint64, bool) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	name = strings.ToLower(strings.TrimSpace(name))
+	for room := range h.clients[c] {
+		if member, ok := h.names[room][name]; ok && member != c {
+			return member.id, true
+		}
+	}
+	return 0, false
+}
+
+// HandleCommand has f do the slash command with the name for the hub's
+// clients on HubHandler, and lists it with the others by its usage, as in
+// "/roll <dice>". The error f returns, if any, is sent to the client, as the
+// built-in commands' are. Like http.ServeMux, it panics if the name is taken,
+// and it has to be called before the server is run.
+func (h *Hub) HandleCommand(name, usage string, f func(conn *Connection, cmd Command) error) {
+	name = strings.ToLower(name)
+	if _, ok := h.h.commands[name]; ok {
+		panic(fmt.Sprintf("hub: the command %q is already handled", name))
+	}
+	h.h.commands[name] = chatCommand{usage, func(ctx context.Context, h *hub, c *client, cmd Command) error {
+		return f(c.conn, cmd)
+	}}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestChatCommands(t *testing.T) {
+	s, err := New(WithUpgradeRate(0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	(&Hub{s.chat}).HandleCommand("Roll", "/roll <sides>", func(conn *Connection, cmd Command) error {
+		if len(cmd.Args) != 1 {
+			return errors.New("roll what?")
+		}
+		return conn.Write(websocket.TextMessage, []byte("rolled a "+cmd.Args[0]))
+	})
+	pipeServe(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// next gives the next message that isn't the session, or a receipt.
+	next := func(conn *pipedConn) string {
+		t.Helper()
+		for {
+			m, err := conn.Next(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(m.Data), `{"type":"session"`) && !strings.HasPrefix(string(m.Data), `{"type":"receipt"`) {
+				return string(m.Data)
+			}
+		}
+	}
+	send := func(conn *pipedConn, text string) {
+		conn.Inject(websocket.TextMessage, []byte(text))
+	}
+	commandError := func(conn *pipedConn) commandErrorReply {
+		t.Helper()
+		var r commandErrorReply
+		if err := json.Unmarshal([]byte(next(conn)), &r); err != nil || r.Type != "error" {
+			t.Fatalf("got %+v, %v, want an error", r, err)
+		}
+		return r
+	}
+
+	alice, bob := pipeDial(t, s, "/chat"), pipeDial(t, s, "/chat")
+	for _, conn := range []*pipedConn{alice, bob} {
+		send(conn, "/JOIN lobby")
+		if got := next(conn); got != `{"type":"joined","room":"lobby"}` {
+			t.Fatalf("/join gave %s", got)
+		}
+	}
+
+	// A name with a space in it, quoted, is told to the whole room.
+	send(alice, `/nick "alice smith"`)
+	for _, conn := range []*pipedConn{alice, bob} {
+		var e testEnvelope
+		json.Unmarshal([]byte(next(conn)), &e)
+		var p renamedPayload
+		if json.Unmarshal(e.Payload, &p); e.Type != "chat.renamed" || p.Name != "alice smith" {
+			t.Fatalf("/nick gave %s %+v", e.Type, p)
+		}
+	}
+
+	// A direct message by name, with the spaces in it as they were.
+	send(bob, `/msg "Alice Smith" hello,  "alice"`)
+	var e testEnvelope
+	json.Unmarshal([]byte(next(alice)), &e)
+	var direct directMessagePayload
+	if json.Unmarshal(e.Payload, &direct); e.Type != "direct" || string(direct.Message) != `"hello,  \"alice\""` {
+		t.Fatalf("/msg gave %s %s", e.Type, direct.Message)
+	}
+	send(alice, "/msg 999999 hi")
+	if got := commandError(alice); got.Code != codeNoPeer || got.Command != "msg" {
+		t.Fatalf("/msg to nobody gave %+v", got)
+	}
+
+	send(alice, "/who")
+	var who whoReply
+	json.Unmarshal([]byte(next(alice)), &who)
+	if who.Type != "who" || who.Room != "lobby" || len(who.Members) != 2 || who.Members[0].Name+who.Members[1].Name != "alice smith" {
+		t.Fatalf("/who gave %+v", who)
+	}
+
+	// Commands of the hub's own go through the same registry.
+	send(alice, "/roll 20")
+	if got := next(alice); got != "rolled a 20" {
+		t.Fatalf("/roll gave %q", got)
+	}
+	send(alice, "/roll")
+	if got := commandError(alice); got.Code != codeCommandFailed || got.Error != "roll what?" {
+		t.Fatalf("/roll without sides gave %+v", got)
+	}
+	send(alice, "/dance")
+	got := commandError(alice)
+	if got.Code != codeUnknownCommand || strings.Join(got.Commands, " ") != "/join <room> /leave [room] /msg <id|name> <message> /nick <name> /roll <sides> /who [room]" {
+		t.Fatalf("an unknown command gave %+v", got)
+	}
+	send(alice, `/nick "alice`)
+	if got := commandError(alice); got.Code != codeBadCommand {
+		t.Fatalf("a quote that isn't closed gave %+v", got)
+	}
+	send(alice, "/join")
+	if got := commandError(alice); got.Code != codeBadCommand || got.Error != "usage: /join <room>" {
+		t.Fatalf("/join without a room gave %+v", got)
+	}
+
+	// Two slashes are text that starts with one, broadcast as ever.
+	send(alice, "//shrug")
+	if got := next(bob); got != "/shrug" {
+		t.Fatalf("//shrug was broadcast as %q", got)
+	}
+	next(alice)
+
+	send(alice, "/leave")
+	if got := next(alice); got != `{"type":"left","room":"lobby"}` {
+		t.Fatalf("/leave gave %s", got)
+	}
+	send(alice, "/who")
+	if got := commandError(alice); got.Code != codeNotInRoom {
+		t.Fatalf("/who, in no rooms, gave %+v", got)
+	}
+}
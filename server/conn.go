@@ -0,0 +1,417 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sync/errgroup"
+)
+
+// Every connection has a few goroutines working on it: one reading, one
+// writing, one pinging, one closing the connection once the others are done,
+// and whatever else the reader starts. They all run in the same errgroup, so that as soon
+// as any one of them fails, the others are told to stop, and the error that
+// started it all is the one that gets reported.
+//
+// That error is one of:
+//
+//   - a *websocket.CloseError, when the client closed the connection;
+//   - errHandshakeTimeout or errPongTimeout, when the client went quiet;
+//   - a *connWriteError, when writing to the client failed;
+//   - errServerShutdown, when the server is going away;
+//   - errRequestCancelled, when the request the connection was upgraded from
+//     was cancelled some other way;
+//   - errHubClosed, when the hub the connection is served by has stopped;
+//   - or whatever else made reading fail.
+
+var (
+	errServerShutdown   = errors.New("server shutting down")
+	errRequestCancelled = errors.New("request cancelled")
+	errHubClosed        = errors.New("hub closed")
+	errHandshakeTimeout = errors.New("no message received within the handshake grace period")
+	errPongTimeout      = errors.New("no pong received in time")
+)
+
+type connWriteError struct {
+	err error
+}
+
+func (e *connWriteError) Error() string { return "write failed: " + e.err.Error() }
+
+func (e *connWriteError) Unwrap() error { return e.err }
+
+// stopping is for errors that happen while the connection might be getting
+// torn down. At that point, whatever fails is only a consequence of the
+// teardown, and not worth reporting.
+func stopping(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// A connServer reads the client until it's done. It can start more goroutines
+// in g, and can change the keepalive by sending to the client's keepalives.
+type connServer func(ctx context.Context, g *errgroup.Group, c *client) error
+
+// runConn serves the live connection in the mode until it's done, and gives
+// the reason why. It has idle close the connection if the client goes idle,
+// unless it's nil.
+// Cancelling ctx, which is the request's, closes the connection with a going
+// away close frame, once the messages already queued for the client have been
+// written, or the write timeout is up. That's put down to the server shutting
+// down if shutdown is closed by then. Otherwise, when the connection ends
+// without a close frame, it's closed with one for the reason why, if that's
+// possible. Either way, runConn only returns once every goroutine of the
+// connection is done.
+func runConn(ctx context.Context, shutdown <-chan struct{}, t *closeHandler, cfg *settings, idle *idleReaper, lc *liveConn, m Mode) error {
+	t.SetReadLimit(cfg.readLimit)
+
+	// A client that completes the upgrade and then never sends anything is
+	// just holding on to a goroutine and a file descriptor, so it only gets the
+	// handshake grace period to send its first message.
+	// Unless it only ever listens.
+	grace := &graceTransport{Transport: t}
+	if !m.listenOnly {
+		grace.timer = time.AfterFunc(cfg.handshakeGrace, func() {
+			atomic.StoreInt32(&grace.timedOut, 1)
+			lc.log.Info("Connection sent nothing within the handshake grace period", "grace", cfg.handshakeGrace)
+			handshakeTimeouts.Add(1)
+			t.Close(closeHandshakeTimeout, "handshake timeout")
+		})
+		defer grace.timer.Stop()
+	}
+
+	// The connection's goroutines don't stop as soon as ctx is done, so that
+	// the write pump is still there to send the close frame.
+	c := newClient(grace, lc.user, cfg.sendQueue, cfg.messageRate)
+	c.id = lc.id
+	c.log = lc.log
+	c.reportError = lc.reportError
+	c.writeWaits = cfg.writeWaits
+	c.readLimit = cfg.readLimit
+	c.session = lc.session
+	c.roles = lc.roles
+	c.claimedLabels = lc.claimedLabels
+	if idle != nil {
+		c.idle = idle.watch(c)
+		defer idle.unwatch(c.idle)
+	}
+	// The error that ended the connection, for the closer to send a close
+	// frame for.
+	var failed sync.Once
+	var first error
+	g, gctx := errgroup.WithContext(detach(ctx))
+	c.conn = lc.connection(gctx, c)
+	if lc.interceptIn != nil || lc.interceptOut != nil {
+		c.interceptIn, c.interceptOut = lc.interceptIn, lc.interceptOut
+	}
+	lc.serving(c)
+	// Why ctx is done. The server's context is the request's parent, so it's
+	// done first.
+	cancelled := func() error {
+		select {
+		case <-shutdown:
+			return errServerShutdown
+		default:
+			return errRequestCancelled
+		}
+	}
+	// Once ctx is done, that's why anything fails.
+	reason := func(err error) error {
+		if ctx.Err() != nil {
+			return cancelled()
+		}
+		err = stopping(gctx, err)
+		if err != nil {
+			failed.Do(func() { first = err })
+		}
+		return err
+	}
+
+	g.Go(func() error {
+		setPumpLabel(gctx, "read")
+		return reason(m.serve(gctx, g, c))
+	})
+
+	g.Go(func() error {
+		setPumpLabel(gctx, "write")
+		return reason(c.writePump(gctx))
+	})
+
+	g.Go(func() error {
+		setPumpLabel(gctx, "ping")
+		return reason(pingLoop(gctx, t, cfg.keepalive, c.keepalives, c.observeRTT))
+	})
+
+	// The reader is only ever unblocked by the connection going away, so once
+	// anything else has failed, close the connection for it.
+	g.Go(func() error {
+		select {
+		case <-gctx.Done():
+			// Whichever goroutine failed first set first before returning.
+			if code, text, ok := closeFrameFor(first); ok && !t.closed() {
+				t.Close(code, text)
+			}
+			t.CloseNow()
+			return nil
+		case <-ctx.Done():
+			err := cancelled()
+			closeCtx, cancel := context.WithTimeout(gctx, cfg.writeWaits.message)
+			defer cancel()
+			c.close(closeCtx, websocket.CloseGoingAway, err.Error())
+			// In case the close frame never made it out.
+			t.CloseNow()
+			return err
+		}
+	})
+
+	err := g.Wait()
+	c.disconnected(t.closeStatus())
+	return err
+}
+
+// detach gives a context with ctx's values, such as its pprof labels, but
+// that's never done.
+func detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// graceTransport stops the handshake timer, if there is one, as soon as the
+// first message is read, and turns the read error into errHandshakeTimeout when the timer is
+// what closed the connection.
+type graceTransport struct {
+	Transport
+	timer    *time.Timer
+	timedOut int32
+}
+
+func (t *graceTransport) ReadMessage(ctx context.Context) (int, []byte, error) {
+	messageType, data, err := t.Transport.ReadMessage(ctx)
+	if err != nil {
+		if atomic.LoadInt32(&t.timedOut) == 1 {
+			return 0, nil, errHandshakeTimeout
+		}
+		return 0, nil, err
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	return messageType, data, nil
+}
+
+func (t *graceTransport) NextReader(ctx context.Context) (int, io.Reader, error) {
+	messageType, r, err := t.Transport.NextReader(ctx)
+	if err != nil {
+		if atomic.LoadInt32(&t.timedOut) == 1 {
+			return 0, nil, errHandshakeTimeout
+		}
+		return 0, nil, err
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	return messageType, r, nil
+}
+
+// pingLoop pings the client every ping interval, starting with current's,
+// until it fails to answer within the pong wait. onPong is told the round trip
+// of every pong, when the transport can tell.
+func pingLoop(ctx context.Context, t Transport, current keepalive, keepalives <-chan keepalive, onPong func(time.Duration)) error {
+	ticker := time.NewTicker(current.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case current = <-keepalives:
+			ticker.Reset(current.pingInterval)
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, current.pongWait)
+			rtt, err := t.Ping(pingCtx)
+			cancel()
+			if err == nil && rtt > 0 {
+				onPong(rtt)
+			}
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				pongTimeouts.Add(1)
+				return errPongTimeout
+			}
+			return &connWriteError{err}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// echoServer is the /ws endpoint: every message is answered, after a random
+// delay, with "Got message: " and the message. Clients that go idle are
+// warned before they're closed, and told their latency after every pong, if
+// reportLatency is set.
+func echoServer(bounds keepaliveBounds, reportLatency bool) connServer {
+	return func(ctx context.Context, g *errgroup.Group, c *client) error {
+		if reportLatency {
+			atomic.StoreInt32(&c.reportLatency, 1)
+		}
+		if c.idle != nil {
+			c.idle.warnFirst()
+		}
+		for {
+			_, message, err := c.read(ctx)
+			if err != nil {
+				return err
+			}
+			if ka, ok := parseConfigure(message, bounds); ok {
+				// If the ping loop hasn't picked up the last one yet, this one
+				// replaces it.
+				select {
+				case <-c.keepalives:
+				default:
+				}
+				c.keepalives <- ka
+				if err := c.write(websocket.TextMessage, configuredReply(ka)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			c.log.Debug("Got message", "message", string(message))
+			g.Go(func() error {
+				setPumpLabel(ctx, "reply")
+				select {
+				case <-time.After(time.Second * time.Duration(randInt(10))):
+				case <-ctx.Done():
+					return nil
+				}
+				return stopping(ctx, c.write(websocket.TextMessage, []byte(fmt.Sprintf("Got message: %s", string(message)))))
+			})
+		}
+	}
+}
+
+// chatServer is the /chat endpoint: every message from a client is broadcast
+// to every client connected to the endpoint, apart from the room actions,
+// which are scoped to the clients in a room.
+func chatServer(h *hub) connServer {
+	return func(ctx context.Context, g *errgroup.Group, c *client) error {
+		leave, err := h.joinSession(c, func(p sessionPayload) error {
+			return c.write(websocket.TextMessage, sessionReply(p))
+		})
+		if err != nil {
+			return err
+		}
+		defer leave()
+		h.watch(ctx, g, c)
+		for {
+			messageType, message, err := c.read(ctx)
+			if err != nil {
+				return err
+			}
+			if messageType == websocket.TextMessage {
+				if bytes.HasPrefix(message, []byte("//")) {
+					// Text that starts with a slash, escaped.
+					message = message[1:]
+				} else if bytes.HasPrefix(message, []byte("/")) {
+					cmd, _, err := ParseCommand(string(message))
+					if err := handleCommand(ctx, h, c, cmd, err); err != nil {
+						return err
+					}
+					continue
+				}
+				if labels, ok := parseLabelMessage(message); ok {
+					if err := handleLabelMessage(h, c, labels); err != nil {
+						return err
+					}
+					continue
+				}
+				if m, ok := parseRoomMessage(message); ok {
+					if err := handleRoomMessage(ctx, h, c, m, message); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			h.broadcast(ctx, messageType, message)
+		}
+	}
+}
+
+// strictEchoServer is the /echo endpoint, for conformance testing: every
+// message is sent straight back as it is, with the same type, and nothing else
+// is ever sent. Each message is streamed back as it comes in, so it can be as
+// big as the read limit without ever being held whole, and invalid UTF-8 is
+// caught where it is, rather than once the whole message is in.
+func strictEchoServer() connServer {
+	return func(ctx context.Context, g *errgroup.Group, c *client) error {
+		// The message is read by the write pump, as it streams it back, so a
+		// close over it, such as for invalid UTF-8, can only be queued; waiting
+		// for the close frame to be sent would have the pump waiting on itself.
+		queueOnly, cancel := context.WithCancel(ctx)
+		cancel()
+		for {
+			messageType, r, err := c.readStream(queueOnly, nil)
+			if err != nil {
+				return err
+			}
+			echoed := make(chan error, 1)
+			if err := c.writeStream(messageType, &echoReader{r, echoed}, nil); err != nil {
+				return err
+			}
+			// The reader is only good until the next read.
+			select {
+			case err := <-echoed:
+				if err != nil {
+					return err
+				}
+			case <-c.done:
+				return errClientDone
+			}
+		}
+	}
+}
+
+// echoReader is a message being echoed, which tells done how reading it
+// ended. A chunk that comes with an error, such as one with invalid UTF-8 in
+// it, isn't echoed.
+type echoReader struct {
+	r    io.Reader
+	done chan<- error
+}
+
+func (e *echoReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == nil {
+		return n, nil
+	}
+	result := err
+	if err == io.EOF {
+		result = nil
+	} else {
+		n = 0
+	}
+	select {
+	case e.done <- result:
+	default:
+	}
+	return n, err
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestStrictEcho(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	tests := []struct {
+		name        string
+		messageType int
+		// The message, as the fragments it's sent in.
+		fragments [][]byte
+	}{
+		{"text", websocket.TextMessage, [][]byte{[]byte("hello")}},
+		{"empty binary", websocket.BinaryMessage, [][]byte{{}}},
+		{"fragmented text", websocket.TextMessage, [][]byte{[]byte("h\xc3"), []byte("\xa9llo, w"), []byte("\xe2\x82"), []byte("\xacrld")}},
+		{"large binary", websocket.BinaryMessage, [][]byte{big[:1<<19], big[1<<19:]}},
+	}
+	for _, name := range transportNames {
+		t.Run(name, func(t *testing.T) {
+			url := testServer(t, WithTransport(name), WithReadLimit(2<<20), WithMessageRate(0, 0, "drop"))
+			conn, _, err := websocket.DefaultDialer.Dial(url+"/echo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					w, err := conn.NextWriter(tt.messageType)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, f := range tt.fragments {
+						if _, err := w.Write(f); err != nil {
+							t.Fatal(err)
+						}
+					}
+					if err := w.Close(); err != nil {
+						t.Fatal(err)
+					}
+					conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+					messageType, data, err := conn.ReadMessage()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if want := bytes.Join(tt.fragments, nil); messageType != tt.messageType || !bytes.Equal(data, want) {
+						t.Fatalf("echoed %d bytes of type %d, want the %d bytes of type %d sent", len(data), messageType, len(want), tt.messageType)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestStrictEchoInvalidUTF8(t *testing.T) {
+	for _, name := range transportNames {
+		t.Run(name, func(t *testing.T) {
+			url := testServer(t, WithTransport(name), WithMessageRate(0, 0, "drop"))
+			conn, _, err := websocket.DefaultDialer.Dial(url+"/echo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// The start of the message is fine, and the end of it never comes.
+			// Enough is written after the invalid byte for it to be sent.
+			w, err := conn.NextWriter(websocket.TextMessage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(strings.Repeat("fine ", 1000) + "\xff" + strings.Repeat("more ", 4000)))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				_, r, err := conn.NextReader()
+				var ce *websocket.CloseError
+				if errors.As(err, &ce) {
+					if ce.Code != websocket.CloseInvalidFramePayloadData {
+						t.Fatalf("closed with %d, want %d", ce.Code, websocket.CloseInvalidFramePayloadData)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("read error %v, want a close frame", err)
+				}
+				// Whatever is echoed of the message before it's closed is
+				// fine, and never finished.
+				if _, err := io.Copy(io.Discard, r); err == nil {
+					t.Fatal("the message with invalid UTF-8 was echoed whole")
+				}
+			}
+		})
+	}
+}
+
+func TestErrorHook(t *testing.T) {
+	for _, name := range transportNames {
+		t.Run(name, func(t *testing.T) {
+			type reported struct {
+				conn ConnInfo
+				err  error
+			}
+			errs := make(chan reported, 10)
+			hook := func(conn ConnInfo, err error, message []byte) {
+				errs <- reported{conn, err}
+			}
+			url := testServer(t, WithTransport(name), WithReadLimit(1024), WithErrorHook(hook))
+			conn, _, err := websocket.DefaultDialer.Dial(url+"/echo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := conn.WriteMessage(websocket.TextMessage, bytes.Repeat([]byte("x"), 4096)); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case r := <-errs:
+				if !errors.Is(r.err, ErrReadLimitExceeded) {
+					t.Fatalf("reported %v, want ErrReadLimitExceeded", r.err)
+				}
+				if r.conn.Path != "/echo" || r.conn.ID == 0 {
+					t.Fatalf("reported on %+v, want a connection to /echo", r.conn)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no error reported for a message over the read limit")
+			}
+		})
+	}
+}
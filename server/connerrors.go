@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"wsexample/graphqlws"
+)
+
+// Most of what goes wrong on a connection only ever showed up as the reason it
+// closed, if it showed up at all. Instead, every error is now reported as it
+// happens, fatal or not: it's classified under one of the causes below when
+// possible, counted under conn_errors by cause, and handed to the connection's
+// error hook along with the message involved, if there is one.
+//
+// Reporting doesn't change what happens next. A fatal error still tears the
+// connection down; it's just observed on the way.
+//
+// Things that are part of the connection ending normally aren't errors: the
+// client closing with 1000, 1001 or no code at all, the server shutting down,
+// stopping a hub or closing an idle client, the request being cancelled, or
+// reads and writes failing because the connection has already been closed.
+
+var connErrors = expvar.NewMap("conn_errors")
+
+// The causes an error on a connection can be classified under, which the
+// error hook can match with errors.Is or errors.As.
+var (
+	// ErrWriteTimeout is the cause when a write didn't finish in the time
+	// allowed for it.
+	ErrWriteTimeout = errors.New("write timed out")
+	// ErrReadLimitExceeded is the cause when the client sent a message over
+	// the read limit.
+	ErrReadLimitExceeded = errors.New("message exceeds the read limit")
+	// ErrBackpressureDrop is the cause when a message was dropped because the
+	// client's send queue was full, under the drop-oldest or drop-newest
+	// policy. It doesn't end the connection.
+	ErrBackpressureDrop = errors.New("message dropped from a full send queue")
+)
+
+// ProtocolViolation is the cause when the client broke the protocol, either
+// WebSocket's or the one spoken on top of it. Code is the close code it earns.
+type ProtocolViolation struct {
+	Code int
+}
+
+func (e ProtocolViolation) Error() string {
+	return fmt.Sprintf("protocol violation (close code %d)", e.Code)
+}
+
+// reportedError is an error that has been reported, along with its cause, if
+// it has one.
+type reportedError struct {
+	cause error
+	err   error
+}
+
+func (e *reportedError) Error() string { return e.err.Error() }
+
+func (e *reportedError) Unwrap() error { return e.err }
+
+func (e *reportedError) Is(target error) bool { return e.cause != nil && e.cause == target }
+
+func (e *reportedError) As(target interface{}) bool {
+	return e.cause != nil && errors.As(e.cause, target)
+}
+
+// An errorHook is told about every error on a connection, along with the
+// message that was being written when it happened, if any.
+type errorHook func(c *liveConn, err error, message []byte)
+
+// ConnInfo identifies the connection an error happened on, for an ErrorHook.
+type ConnInfo struct {
+	// The connection's ID, as the admin API and the logs give it.
+	ID   uint64
+	UUID string
+	// The address the request came from, and the client's address, which is
+	// different behind a trusted proxy.
+	Peer string
+	Addr netip.Addr
+	// The authenticated user, or "" when authentication is off.
+	User string
+	// The path of the endpoint, and the subprotocol negotiated on it, if any.
+	Path        string
+	Subprotocol string
+}
+
+// An ErrorHook is told about every error on a connection, as WithErrorHook
+// describes. message is the message involved, if there is one: the one being
+// written, or the one dropped. It's called on the connection's goroutines,
+// so it mustn't block for long.
+type ErrorHook func(conn ConnInfo, err error, message []byte)
+
+func (h ErrorHook) hook() errorHook {
+	return func(c *liveConn, err error, message []byte) {
+		h(c.info(), err, message)
+	}
+}
+
+func (c *liveConn) info() ConnInfo {
+	return ConnInfo{
+		ID:          c.id,
+		UUID:        c.uuid,
+		Peer:        c.peer,
+		Addr:        c.addr,
+		User:        c.user,
+		Path:        c.path,
+		Subprotocol: c.subprotocol,
+	}
+}
+
+// logError is the default error hook.
+func logError(c *liveConn, err error, message []byte) {
+	// A client that can't keep up has a lot of messages dropped, one at a
+	// time, so they're only for debugging.
+	if errors.Is(err, ErrBackpressureDrop) {
+		c.log.Debug("Dropped a message", "error", err, "size", len(message))
+		return
+	}
+	if message != nil {
+		c.log.Warn("Connection error", "error", err, "writing", len(message))
+		return
+	}
+	c.log.Warn("Connection error", "error", err)
+}
+
+// errorCause classifies err. The cause is nil when it's an error that's none
+// of the known ones, and ok is false when it's not an error at all.
+func errorCause(op string, err error) (cause error, ok bool) {
+	var ce *websocket.CloseError
+	var pv ProtocolViolation
+	var pe *graphqlws.ProtocolError
+	var ne net.Error
+	switch {
+	case errors.Is(err, errServerShutdown), errors.Is(err, errRequestCancelled), errors.Is(err, errHubClosed),
+		errors.Is(err, errIdle), errors.Is(err, net.ErrClosed),
+		errors.Is(err, websocket.ErrCloseSent), errors.Is(err, context.Canceled):
+		return nil, false
+	case errors.As(err, &ce):
+		switch ce.Code {
+		case websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived:
+			return nil, false
+		}
+		return nil, true
+	case errors.Is(err, websocket.ErrReadLimit):
+		return ErrReadLimitExceeded, true
+	case errors.Is(err, errHandshakeTimeout):
+		return errHandshakeTimeout, true
+	case errors.Is(err, errPongTimeout):
+		return errPongTimeout, true
+	case errors.Is(err, errSlowClient):
+		return errSlowClient, true
+	case errors.Is(err, errMessageRate):
+		return errMessageRate, true
+	case errors.Is(err, ErrBackpressureDrop):
+		return ErrBackpressureDrop, true
+	case errors.As(err, &pv):
+		return pv, true
+	case errors.As(err, &pe):
+		return ProtocolViolation{pe.Code}, true
+	case op == "write" && (errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout()):
+		return ErrWriteTimeout, true
+	}
+	return nil, true
+}
+
+// causeName is the name a cause is counted under.
+func causeName(op string, cause error) string {
+	switch cause {
+	case ErrWriteTimeout:
+		return "write_timeout"
+	case ErrReadLimitExceeded:
+		return "read_limit_exceeded"
+	case errHandshakeTimeout:
+		return "handshake_timeout"
+	case errPongTimeout:
+		return "pong_timeout"
+	case errSlowClient:
+		return "slow_client"
+	case errMessageRate:
+		return "message_rate_exceeded"
+	case ErrBackpressureDrop:
+		return "backpressure_drop"
+	case nil:
+		return op
+	}
+	if _, ok := cause.(ProtocolViolation); ok {
+		return "protocol_violation"
+	}
+	return op
+}
+
+// reportError reports err, unless it isn't really an error, or it has already
+// been reported. It gives the error to carry on with, which has the cause
+// attached.
+func (c *liveConn) reportError(op string, err error, message []byte) error {
+	var reported *reportedError
+	if err == nil || errors.As(err, &reported) {
+		return err
+	}
+	cause, ok := errorCause(op, err)
+	if !ok {
+		return err
+	}
+	connErrors.Add(causeName(op, cause), 1)
+	err = &reportedError{cause, err}
+	if c.onError != nil {
+		c.onError(c, err, message)
+	}
+	return err
+}
+
+// reportingTransport reports every error that reading, writing or pinging
+// runs into, until the server closes the connection. From then on, failing is
+// what the connection is expected to do.
+type reportingTransport struct {
+	Transport
+	c      *liveConn
+	closed int32
+}
+
+func (t *reportingTransport) report(op string, err error, message []byte) error {
+	if err == nil || atomic.LoadInt32(&t.closed) == 1 {
+		return err
+	}
+	return t.c.reportError(op, err, message)
+}
+
+func (t *reportingTransport) ReadMessage(ctx context.Context) (int, []byte, error) {
+	messageType, data, err := t.Transport.ReadMessage(ctx)
+	return messageType, data, t.report("read", err, nil)
+}
+
+func (t *reportingTransport) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	err := t.Transport.WriteMessage(ctx, messageType, data)
+	// A write that's to be tried again isn't an error yet.
+	if willRetry(ctx, err) {
+		return err
+	}
+	return t.report("write", err, data)
+}
+
+func (t *reportingTransport) NextReader(ctx context.Context) (int, io.Reader, error) {
+	messageType, r, err := t.Transport.NextReader(ctx)
+	if err != nil {
+		return 0, nil, t.report("read", err, nil)
+	}
+	return messageType, readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		if err == io.EOF {
+			return n, err
+		}
+		return n, t.report("read", err, nil)
+	}), nil
+}
+
+func (t *reportingTransport) NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error) {
+	w, err := t.Transport.NextWriter(ctx, messageType)
+	if err != nil {
+		return nil, t.report("write", err, nil)
+	}
+	return &streamWriter{
+		write: func(p []byte) (int, error) {
+			n, err := w.Write(p)
+			return n, t.report("write", err, nil)
+		},
+		close: func() error { return t.report("write", w.Close(), nil) },
+	}, nil
+}
+
+func (t *reportingTransport) Ping(ctx context.Context) (time.Duration, error) {
+	rtt, err := t.Transport.Ping(ctx)
+	// Not getting the pong in time is the ping loop's to decide, and it will
+	// report it as a pong timeout.
+	if errors.Is(err, context.DeadlineExceeded) {
+		return rtt, err
+	}
+	return rtt, t.report("ping", err, nil)
+}
+
+func (t *reportingTransport) Close(code int, reason string) error {
+	atomic.StoreInt32(&t.closed, 1)
+	return t.Transport.Close(code, reason)
+}
+
+func (t *reportingTransport) CloseNow() error {
+	atomic.StoreInt32(&t.closed, 1)
+	return t.Transport.CloseNow()
+}
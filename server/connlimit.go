@@ -0,0 +1,84 @@
+package server
+
+import (
+	"expvar"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// However cheap a connection is, the server can only hold so many. With
+// -max-connections, upgrades past that many open connections, across every
+// endpoint, are turned away with a 503; with -max-connections-per-ip, so are
+// upgrades from an address that already has that many open, so that no single
+// client can take up all of them. Zero is unlimited for either.
+//
+// The address is the client's, as resolved from the forwarding headers of a
+// trusted proxy, so clients behind the same proxy each get their own cap.
+// Unix socket peers that don't forward an address only count towards the
+// total.
+//
+// Both limits are settings, so they can be changed with a reload. Lowering
+// them doesn't close any connection that's already open; it just means no new
+// ones until enough of them have closed. Rejections are counted under
+// connection_limit_rejections, by which limit was hit, and come with a
+// Retry-After of connLimitRetry, since there's no telling how soon a
+// connection will close.
+
+// connLimitRetry is how long a client turned away for a connection limit is
+// told to wait before trying again.
+const connLimitRetry = 5 * time.Second
+
+var connLimitRejections = expvar.NewMap("connection_limit_rejections")
+
+// connLimits is how many connections can be open at once, in total and from
+// any one address. Zero is unlimited.
+type connLimits struct {
+	total int
+	perIP int
+}
+
+// connCounter counts the open connections, in total and by address.
+type connCounter struct {
+	mut   sync.Mutex
+	total int
+	byIP  map[netip.Addr]int
+}
+
+func newConnCounter() *connCounter {
+	return &connCounter{byIP: map[netip.Addr]int{}}
+}
+
+// acquire counts a new connection from the address, if the limits allow it,
+// and gives the function to call once it's closed. If they don't, it says
+// which limit was hit. The address can be the zero Addr, for a peer without
+// one.
+func (c *connCounter) acquire(addr netip.Addr, limits connLimits) (release func(), limit string, ok bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if limits.total > 0 && c.total >= limits.total {
+		connLimitRejections.Add("total", 1)
+		return nil, "total", false
+	}
+	if addr.IsValid() && limits.perIP > 0 && c.byIP[addr] >= limits.perIP {
+		connLimitRejections.Add("per_ip", 1)
+		return nil, "per_ip", false
+	}
+	c.total++
+	if addr.IsValid() {
+		c.byIP[addr]++
+	}
+	return func() { c.release(addr) }, "", true
+}
+
+func (c *connCounter) release(addr netip.Addr) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.total--
+	if !addr.IsValid() {
+		return
+	}
+	if c.byIP[addr]--; c.byIP[addr] == 0 {
+		delete(c.byIP, addr)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A handler can keep what it needs between a connection's messages, such as
+// the upload under way, the last cursor fetched, or an option the client
+// asked for, on the Connection, rather than in a map of its own, keyed by
+// connection, that it has to remember to clean up:
+//
+//	conn.Set("upload", u)
+//	...
+//	if u, ok := conn.Get("upload"); ok {
+//		u.(*upload).write(data)
+//	}
+//
+// Get, Set and Delete are safe to call from any goroutine, such as an
+// interceptor's. The state is dropped once the connection is over, after the
+// funcs given to OnDisconnect have been called, so that they can still get
+// at it, to abort the upload or release a lock; a Set after that does
+// nothing. It's the connection's own, and isn't handed to one that resumes
+// its session.
+//
+// Range goes over the state in order of key, with each value as a string, for
+// debugging, and GET /admin/connections lists it as each connection's
+// "state". Each value is formatted with %v, outside the state's lock, so that
+// a String method can use the state itself, and only the first 256 bytes of it
+// are kept; fmt turns a String method that panics into the panic's text.
+
+// maxStateString is the most bytes of a value Range gives.
+const maxStateString = 256
+
+// Get gives the value of the key in the connection's state, and whether it
+// has one.
+func (c *Connection) Get(key string) (any, bool) {
+	c.stateMut.Lock()
+	defer c.stateMut.Unlock()
+	v, ok := c.state[key]
+	return v, ok
+}
+
+// Set sets the key in the connection's state, unless the connection is
+// over.
+func (c *Connection) Set(key string, v any) {
+	c.stateMut.Lock()
+	defer c.stateMut.Unlock()
+	if c.stateDropped {
+		return
+	}
+	if c.state == nil {
+		c.state = map[string]any{}
+	}
+	c.state[key] = v
+}
+
+// Delete takes the key out of the connection's state.
+func (c *Connection) Delete(key string) {
+	c.stateMut.Lock()
+	defer c.stateMut.Unlock()
+	delete(c.state, key)
+}
+
+// Range calls f with each key in the connection's state, in order, and its
+// value as a string, until f returns false.
+func (c *Connection) Range(f func(key, value string) bool) {
+	c.stateMut.Lock()
+	keys := make([]string, 0, len(c.state))
+	values := make(map[string]any, len(c.state))
+	for k, v := range c.state {
+		keys = append(keys, k)
+		values[k] = v
+	}
+	c.stateMut.Unlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !f(k, stateString(values[k])) {
+			return
+		}
+	}
+}
+
+// OnDisconnect has f called once the connection is over, with the code and
+// reason it was closed with, before its state is dropped.
+func (c *Connection) OnDisconnect(f func(conn *Connection, code int, reason string)) {
+	c.client.onDisconnect(func(_ *client, code int, reason string) {
+		f(c, code, reason)
+	})
+}
+
+// dropState drops the connection's state, for good.
+func (c *Connection) dropState() {
+	c.stateMut.Lock()
+	defer c.stateMut.Unlock()
+	c.state = nil
+	c.stateDropped = true
+}
+
+// stateString gives the value as Range does.
+func stateString(v any) string {
+	s := fmt.Sprintf("%v", v)
+	if len(s) <= maxStateString {
+		return s
+	}
+	return strings.ToValidUTF8(s[:maxStateString], "") + "…"
+}
+
+// stateOf gives the connection's state as GET /admin/connections lists it, or
+// nil if it has none.
+func stateOf(c *Connection) map[string]string {
+	var state map[string]string
+	c.Range(func(key, value string) bool {
+		if state == nil {
+			state = map[string]string{}
+		}
+		state[key] = value
+		return true
+	})
+	return state
+}
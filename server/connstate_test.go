@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// upload is something a handler keeps on a connection.
+type upload struct {
+	name     string
+	aborted  bool
+	received int
+}
+
+func (u *upload) String() string { return u.name }
+
+// panicky can't be formatted.
+type panicky struct{}
+
+func (panicky) String() string { panic("can't say") }
+
+func TestConnectionState(t *testing.T) {
+	const token = "secret"
+	s, err := New(WithUpgradeRate(0, 0, 0), WithAdminToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type disconnect struct {
+		code   int
+		upload *upload
+		ok     bool
+		conn   *Connection
+	}
+	ended := make(chan disconnect, 1)
+	s.Handle("/uploads", ConnectionHandler(func(conn *Connection) error {
+		conn.OnDisconnect(func(conn *Connection, code int, reason string) {
+			v, ok := conn.Get("upload")
+			u, _ := v.(*upload)
+			if ok {
+				u.aborted = true
+			}
+			ended <- disconnect{code, u, ok, conn}
+		})
+		for m, err := range conn.Messages(context.Background()) {
+			if err != nil {
+				return err
+			}
+			switch cmd, arg, _ := strings.Cut(string(m.Data), " "); cmd {
+			case "start":
+				conn.Set("upload", &upload{name: arg})
+				conn.Set("note", strings.Repeat("é", maxStateString))
+				conn.Set("panicky", panicky{})
+			case "done":
+				conn.Delete("upload")
+			default:
+				v, _ := conn.Get("upload")
+				v.(*upload).received += len(m.Data)
+			}
+			conn.Write(websocket.TextMessage, []byte("ok"))
+		}
+		return nil
+	}))
+	pipeServe(t, s)
+	admin := func() []connInfo {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/admin/connections", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, r)
+		var conns []connInfo
+		json.NewDecoder(w.Body).Decode(&conns)
+		return conns
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := pipeDial(t, s, "/uploads")
+	for _, m := range []string{"start report.pdf", "chunk", "done", "start photo.jpg", "chunk"} {
+		conn.Inject(websocket.TextMessage, []byte(m))
+		if _, err := conn.Next(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The admin API lists the state, in strings, the long one cut short, and
+	// the one that panics as the panic.
+	conns := admin()
+	if len(conns) != 1 {
+		t.Fatalf("listed %d connections", len(conns))
+	}
+	state := conns[0].State
+	if state["upload"] != "photo.jpg" {
+		t.Errorf("upload is listed as %q", state["upload"])
+	}
+	if note := state["note"]; len(note) > maxStateString+len("…") || !strings.HasSuffix(note, "é…") {
+		t.Errorf("a long value is listed as %d bytes, ending %q", len(note), note[len(note)-8:])
+	}
+	if !strings.Contains(state["panicky"], "can't say") {
+		t.Errorf("a value that panics is listed as %q", state["panicky"])
+	}
+
+	// The disconnect hooks still have the state, and it's dropped after.
+	conn.InjectClose(4001, "bye")
+	var d disconnect
+	select {
+	case d = <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the disconnect hook wasn't called")
+	}
+	if d.code != 4001 || !d.ok || d.upload.name != "photo.jpg" || !d.upload.aborted || d.upload.received != len("chunk") {
+		t.Fatalf("the disconnect hook got %d, %+v, %t", d.code, d.upload, d.ok)
+	}
+	<-conn.served
+	if _, ok := d.conn.Get("upload"); ok {
+		t.Fatal("the state was kept once the connection was over")
+	}
+	d.conn.Set("upload", &upload{})
+	n := 0
+	d.conn.Range(func(key, value string) bool {
+		n++
+		return true
+	})
+	if n != 0 {
+		t.Fatalf("%d set once the connection was over", n)
+	}
+}
+
+func TestConnectionStateRange(t *testing.T) {
+	c := &Connection{}
+	for _, k := range []string{"c", "a", "b"} {
+		c.Set(k, k)
+	}
+	c.Set("n", 42)
+	c.Delete("c")
+	var got []string
+	c.Range(func(key, value string) bool {
+		got = append(got, key+"="+value)
+		return key != "b"
+	})
+	if strings.Join(got, " ") != "a=a b=b" {
+		t.Fatalf("ranged over %q, want a and b, stopping there", got)
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A client on /api can send a message to just one other member of a room
+// it's in, by its connection id, which it learns from presence:
+//
+//	{"type":"direct","payload":{"to":7,"message":"hello","ref":"a1"}}
+//
+// and nobody else sees it. Connection 7 is sent
+//
+//	{"type":"direct","payload":{"id":12,"message":"hello","from":4,"name":"alice","user":"alice"}}
+//
+// with the id the server gave the message, and who it's from: the sender's
+// connection id, its name in a room they share, if it has one there, and its
+// user, when authentication is on. The message is JSON, as in chat.send,
+// and ref, up to 64 characters, is whatever the sender wants to call it,
+// which is handed back to it in the message's receipts; see receipts.go.
+// Once the recipient has read it, it says so with
+//
+//	{"type":"read","payload":{"id":12}}
+//
+// Rather than a connection, a direct message can be for a user, by who they
+// authenticated as, with "user":"bob" in place of to. It goes to every
+// connection of the user's, wherever they are, and, when there are none, can
+// be held for them in a mailbox until they're back; see mailbox.go.
+//
+// A direct message for a connection that isn't in any room with the sender,
+// or for a user with no connections and no mailbox, is answered with a
+// no_peer error, and a read for a message that wasn't sent to the client, or
+// that the hub has forgotten, with no_message. Direct
+// messages aren't kept in the history, and, like relayed ones, only reach
+// connections to the same instance.
+
+const codeNoMessage = "no_message"
+
+var errNoMessage = errors.New("there's no such direct message to you")
+
+type directPayload struct {
+	// Either the connection it's for, or the user.
+	To      uint64          `json:"to,omitempty" pb:"1"`
+	User    string          `json:"user,omitempty" pb:"4" validate:"max=64"`
+	Message json.RawMessage `json:"message" pb:"2" validate:"required"`
+	Ref     string          `json:"ref,omitempty" pb:"3" validate:"max=64"`
+	// The TTL of the envelope it came in, if it had one.
+	ttl time.Duration
+}
+
+type directMessagePayload struct {
+	ID      uint64          `json:"id" pb:"1"`
+	Message json.RawMessage `json:"message" pb:"2"`
+	From    uint64          `json:"from" pb:"3"`
+	Name    string          `json:"name,omitempty" pb:"4"`
+	User    string          `json:"user,omitempty" pb:"5"`
+}
+
+type readPayload struct {
+	ID uint64 `json:"id" pb:"1" validate:"required"`
+}
+
+// roommate gives the member with the id of a room c is in, other than c, and
+// the room. h.mut must be held.
+func (h *hub) roommate(c *client, id uint64) (*client, string, bool) {
+	for room := range h.clients[c] {
+		for member := range h.rooms[room] {
+			if member != c && member.id == id {
+				return member, room, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// sendDirect sends the message from c to the member of one of its rooms with
+// the id, or to the user, and tells c it's delivered.
+func (h *hub) sendDirect(ctx context.Context, c *client, p directPayload) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if p.User != "" {
+		return h.sendToUser(ctx, c, p)
+	}
+	peer, room, ok := h.roommate(c, p.To)
+	if !ok {
+		return noPeer(p.To)
+	}
+	d := h.receipts.add(p.Ref, c, peer)
+	d.expires = expiry(p.ttl, time.Now())
+	message := directMessagePayload{ID: d.id, Message: p.Message, From: c.id, Name: h.nameIn(c, room), User: c.user}
+	if err := sendExpiring(ctx, peer, "direct", message, d.expires); err != nil {
+		h.receipts.forget(d)
+		return noPeer(p.To)
+	}
+	if h.receipts.advance(d, receiptDelivered) {
+		h.tellReceipt(d)
+	}
+	return nil
+}
+
+// sendToUser sends the message from c to every connection of the user's in
+// the hub, other than c itself, or, if there are none, holds it for the user
+// in the mailbox. h.mut must be held.
+func (h *hub) sendToUser(ctx context.Context, c *client, p directPayload) error {
+	now := time.Now()
+	d := h.receipts.add(p.Ref, c, nil)
+	d.toUser, d.expires = p.User, expiry(p.ttl, now)
+	message := directMessagePayload{ID: d.id, Message: p.Message, From: c.id, User: c.user}
+	delivered := false
+	for member := range h.clients {
+		if member != c && member.user == p.User && sendExpiring(ctx, member, "direct", message, d.expires) == nil {
+			delivered = true
+		}
+	}
+	if delivered {
+		if h.receipts.advance(d, receiptDelivered) {
+			h.tellReceipt(d)
+		}
+		return nil
+	}
+	if h.mailbox == nil || !h.mailbox.knows(p.User) {
+		h.receipts.forget(d)
+		return &replyError{codeNoPeer, fmt.Sprintf("%s as %q", errNoPeer.Error(), p.User)}
+	}
+	h.holdMail(d, message, now)
+	return nil
+}
+
+// read has c, the recipient of the direct message with the id, say it's read
+// it, and tells the sender, if it hasn't been told already.
+func (h *hub) read(c *client, id uint64) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	d := h.receipts.find(id)
+	if d == nil || !d.isFor(c) {
+		return errNoMessage
+	}
+	if h.receipts.advance(d, receiptRead) {
+		h.tellReceipt(d)
+	}
+	return nil
+}
+
+// handleDirect registers direct and read with the dispatcher.
+func handleDirect(d *dispatcher, h *hub) {
+	d.validate("direct", directPayload{})
+	d.validate("read", readPayload{})
+	d.handle("direct", func(ctx context.Context, c *client, payload payload) error {
+		var p directPayload
+		if err := decodePayload(payload, &p); err != nil {
+			return err
+		}
+		p.ttl = payload.ttl
+		if (p.To == 0) == (p.User == "") {
+			return &replyError{codeBadPayload, "a direct message is either to a connection or for a user"}
+		}
+		return h.sendDirect(ctx, c, p)
+	})
+	d.handle("read", func(ctx context.Context, c *client, payload payload) error {
+		var p readPayload
+		if err := decodePayload(payload, &p); err != nil {
+			return err
+		}
+		if err := h.read(c, p.ID); err != nil {
+			return &replyError{codeNoMessage, err.Error()}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sync/errgroup"
+
+	"wsexample/internal/validate"
+)
+
+// Rather than every endpoint working out for itself what a message is, the
+// dispatcher has every message come in the same envelope,
+//
+//	{"type":"chat.send","payload":{"room":"lobby","message":"hello"}}
+//
+// and hands the payload to whichever handler is registered for the type.
+// Everything the server sends back comes in the same kind of envelope. A
+// message that can't be dispatched, or that its handler fails on, is answered
+// with
+//
+//	{"type":"error","payload":{"code":"unknown_type","message":"...","type":"chat.sned"}}
+//
+// and the connection carries on. As with HTTP errors, the code is meant for
+// machines and the message for humans; the type, if there is one, is the type
+// of the message that the error is about.
+//
+// That's with the JSON codec. A client can instead negotiate the proto.v1
+// subprotocol, and send and be sent protobuf envelopes, from proto/v1/api.proto,
+// in binary messages. Each message is one or more envelopes, each prefixed
+// with its length as a varint. Either way, the messages go to the same
+// handlers, which decode the payloads with whichever codec the client uses.
+//
+// A type can also have a struct registered for its payload, with validate
+// tags on its fields, as internal/validate has them. Every payload of the type
+// is decoded into one, and checked against its rules, before its handler ever
+// sees it, and one that breaks any of them is answered with every field that
+// does:
+//
+//	{"type":"error","payload":{"code":"invalid_payload","message":"the payload is invalid","type":"chat.join",
+//		"fields":[{"field":"room","error":"is required"}]}}
+//
+// Requests, which get an answer of their own rather than an envelope, are in
+// rpc.go.
+
+const (
+	codeBadEnvelope   = "bad_envelope"
+	codeUnknownType   = "unknown_type"
+	codeBadPayload    = "bad_payload"
+	codeInvalid       = "invalid_payload"
+	codeHandlerFailed = "handler_failed"
+)
+
+var invalidPayloads = expvar.NewMap("invalid_payloads")
+
+type errorPayload struct {
+	Code    string `json:"code" pb:"1"`
+	Message string `json:"message" pb:"2"`
+	Type    string `json:"type,omitempty" pb:"3"`
+	// The fields that are invalid, for invalid_payload.
+	Fields []fieldError `json:"fields,omitempty" pb:"4"`
+}
+
+type fieldError struct {
+	Field string `json:"field" pb:"1"`
+	Error string `json:"error" pb:"2"`
+}
+
+// handlerFunc handles the payload of a message. If it returns an error, the
+// client is sent it; a *replyError gets its own code, and any other error
+// gets codeHandlerFailed.
+type handlerFunc func(ctx context.Context, c *client, p payload) error
+
+// replyError is an error for a handler to return to the client.
+type replyError struct {
+	code    string
+	message string
+}
+
+func (e *replyError) Error() string {
+	return e.message
+}
+
+// invalidError is a payload that breaks the rules of its type, in the fields.
+type invalidError struct {
+	fields []fieldError
+}
+
+func (e *invalidError) Error() string {
+	return "the payload is invalid"
+}
+
+type dispatcher struct {
+	handlers map[string]handlerFunc
+	// The types of the payloads to validate, by the type of envelope.
+	schemas    map[string]reflect.Type
+	methods    map[string]methodFunc
+	middleware []middleware
+	// How long a request gets to be answered.
+	timeout time.Duration
+	// What's done with the binary messages of clients that relay them, or
+	// nil when binary messages are envelopes; see relay.go.
+	opaque func(ctx context.Context, c *client, message []byte) error
+}
+
+func newDispatcher(timeout time.Duration) *dispatcher {
+	return &dispatcher{
+		handlers: map[string]handlerFunc{},
+		schemas:  map[string]reflect.Type{},
+		methods:  map[string]methodFunc{},
+		timeout:  timeout,
+	}
+}
+
+// handle registers the handler for messages of the type, wrapped in the
+// middleware. Like http.ServeMux, it panics if the type already has one.
+func (d *dispatcher) handle(typ string, h handlerFunc) {
+	if _, ok := d.handlers[typ]; ok {
+		panic(fmt.Sprintf("dispatcher: a handler for %q is already registered", typ))
+	}
+	// Payloads are validated last, so that middleware that turns an envelope
+	// away, such as for the client not being allowed to send it, gets to
+	// first.
+	h = d.validating(h)
+	for i := len(d.middleware) - 1; i >= 0; i-- {
+		h = d.middleware[i](h)
+	}
+	d.handlers[typ] = h
+}
+
+// validate has the payloads of messages of the type checked against the
+// rules in the validate tags of v, a struct, or a pointer to one, the payload
+// is decoded into. It panics if the rules are bad, or if the type already has
+// a struct to validate with.
+func (d *dispatcher) validate(typ string, v interface{}) {
+	if err := validate.Check(v); err != nil {
+		panic(fmt.Sprintf("dispatcher: %s", err))
+	}
+	if _, ok := d.schemas[typ]; ok {
+		panic(fmt.Sprintf("dispatcher: %q already has a payload to validate with", typ))
+	}
+	d.schemas[typ] = reflect.Indirect(reflect.ValueOf(v)).Type()
+}
+
+// validating checks the payload against the rules of its type, if it has any,
+// before h gets it.
+func (d *dispatcher) validating(h handlerFunc) handlerFunc {
+	return func(ctx context.Context, c *client, p payload) error {
+		t, ok := d.schemas[p.typ]
+		if !ok {
+			return h(ctx, c, p)
+		}
+		v := reflect.New(t).Interface()
+		if err := decodePayload(p, v); err != nil {
+			return err
+		}
+		invalid, err := validate.Struct(v)
+		if err != nil {
+			return err
+		}
+		if len(invalid) > 0 {
+			invalidPayloads.Add(p.typ, 1)
+			fields := make([]fieldError, len(invalid))
+			for i, fe := range invalid {
+				fields[i] = fieldError{fe.Field, fe.Message}
+			}
+			return &invalidError{fields}
+		}
+		return h(ctx, c, p)
+	}
+}
+
+// serve reads and dispatches messages until reading fails, or replying to one
+// does. Requests run in g.
+func (d *dispatcher) serve(ctx context.Context, g *errgroup.Group, c *client) error {
+	inFlight := make(chan struct{}, maxCallsInFlight)
+	for {
+		messageType, message, err := c.read(ctx)
+		if err != nil {
+			return err
+		}
+		// Requests are JSON, whichever codec the client uses for envelopes.
+		// They can't be signed, so they're only taken when envelopes aren't.
+		if _, signed := c.codec.(*signedCodec); !signed && messageType == websocket.TextMessage {
+			if req, ok := parseRPCRequest(message); ok {
+				if err := d.call(ctx, g, c, req, inFlight); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if c.opaque && messageType == websocket.BinaryMessage {
+			if err := d.opaque(ctx, c, message); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.dispatch(ctx, c, messageType, message); err != nil {
+			return err
+		}
+	}
+}
+
+// dispatch hands each envelope in the message to its handler. It only fails
+// if sending the client an error does.
+func (d *dispatcher) dispatch(ctx context.Context, c *client, messageType int, message []byte) error {
+	envelopes, err := c.codec.decode(messageType, message)
+	if err != nil {
+		return sendError(ctx, c, "", codeBadEnvelope, err.Error())
+	}
+	for _, e := range envelopes {
+		if err := d.dispatchEnvelope(ctx, c, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dispatcher) dispatchEnvelope(ctx context.Context, c *client, e incoming) error {
+	if e.sigErr != nil {
+		return rejectSignature(ctx, c, e)
+	}
+	if e.typ == "" {
+		return sendError(ctx, c, "", codeBadEnvelope, "the message has no type")
+	}
+	h, ok := d.handlers[e.typ]
+	if !ok {
+		return sendError(ctx, c, e.typ, codeUnknownType, fmt.Sprintf("there's no handler for %q", e.typ))
+	}
+	if err := h(ctx, c, payload{typ: e.typ, data: e.payload, codec: c.codec, ttl: e.ttl}); err != nil {
+		var ie *invalidError
+		if errors.As(err, &ie) {
+			return sendEnvelope(ctx, c, "error", errorPayload{Code: codeInvalid, Message: ie.Error(), Type: e.typ, Fields: ie.fields})
+		}
+		var re *replyError
+		if !errors.As(err, &re) {
+			re = &replyError{codeHandlerFailed, err.Error()}
+		}
+		return sendError(ctx, c, e.typ, re.code, re.message)
+	}
+	return nil
+}
+
+// decodePayload decodes the payload into v, failing with a bad_payload error
+// for the client if it doesn't fit.
+func decodePayload(p payload, v interface{}) error {
+	if err := p.codec.decodePayload(p.data, v); err != nil {
+		return &replyError{codeBadPayload, err.Error()}
+	}
+	return nil
+}
+
+// sendEnvelope sends the client a message of the type, with the payload.
+func sendEnvelope(ctx context.Context, c *client, typ string, payload interface{}) error {
+	messageType, message, err := encodeEnvelope(c.codec, typ, payload)
+	if err != nil {
+		return err
+	}
+	return c.write(messageType, message)
+}
+
+func sendError(ctx context.Context, c *client, typ, code, message string) error {
+	return sendEnvelope(ctx, c, "error", errorPayload{Code: code, Message: message, Type: typ})
+}
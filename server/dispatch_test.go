@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDispatchValidation(t *testing.T) {
+	u := testServer(t)
+	conn := apiDial(t, u, "")
+	tests := []struct {
+		name    string
+		message string
+		// The fields the error gives, or nil if the payload is valid.
+		fields []fieldError
+	}{
+		{"missing room", `{"type":"chat.join","payload":{}}`, []fieldError{{"room", "is required"}}},
+		{"room too long", `{"type":"chat.join","payload":{"room":"` + strings.Repeat("x", 65) + `"}}`, []fieldError{{"room", "must be at most 64 bytes long"}}},
+		{"several fields", `{"type":"chat.send","payload":{"id":"` + strings.Repeat("x", 65) + `"}}`, []fieldError{
+			{"room", "is required"},
+			{"message", "is required"},
+			{"id", "must be at most 64 bytes long"},
+		}},
+		{"valid", `{"type":"chat.join","payload":{"room":"` + strings.Repeat("x", 64) + `"}}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(tt.message)); err != nil {
+				t.Fatal(err)
+			}
+			if tt.fields == nil {
+				nextEnvelope(t, conn, "chat.joined")
+				return
+			}
+			var p errorPayload
+			json.Unmarshal(nextEnvelope(t, conn, "error").Payload, &p)
+			if p.Code != codeInvalid || !reflect.DeepEqual(p.Fields, tt.fields) {
+				t.Fatalf("error %+v, want %s with %v", p, codeInvalid, tt.fields)
+			}
+		})
+	}
+}
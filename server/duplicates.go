@@ -0,0 +1,183 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// With authentication on, the same user can have any number of connections
+// open at once, each of them on its own. An app that expects one connection
+// per user can say what's done with a second one with -duplicate-sessions:
+//
+//   - allow, the default, lets it be.
+//   - kick_oldest lets the new connection in, and closes the user's others
+//     with 4004 and the reason "superseded".
+//   - reject_newest turns the upgrade away with a 409 and already_connected,
+//     as long as the user has another connection open.
+//
+// A user's connections are kept track of from before they're upgraded, so two
+// that are upgraded at the same time can't both get in: with reject_newest,
+// the first to get through the checks has the user's slot, and the other is
+// turned away, and with kick_oldest, the last of them wins, whichever of them
+// finishes its upgrade first. A connection superseded before it's even up is
+// closed as soon as it is. Connections without a user, with authentication
+// off, are never duplicates, and the policy counts every endpoint the same.
+//
+// When kick_oldest closes a connection on /chat or /api with a session, the
+// new connection on the same endpoint, unless it asked to resume one of its
+// own, takes it over, as it would if it reconnected with ?session=, so that
+// it's in the old one's rooms, and gets what was still queued for it; see
+// session.go. What's done is counted under duplicate_sessions.
+
+// closeSuperseded is the close code of a connection another of its user's has
+// taken the place of, which is the same as an admin's disconnect.
+const closeSuperseded = closeDisconnected
+
+const codeAlreadyConnected = "already_connected"
+
+var duplicateSessions = expvar.NewMap("duplicate_sessions")
+
+// duplicatePolicy is what to do with a connection for a user with another
+// open.
+type duplicatePolicy int
+
+const (
+	duplicatesAllowed duplicatePolicy = iota
+	duplicatesKickOldest
+	duplicatesRejectNewest
+)
+
+func parseDuplicatePolicy(s string) (duplicatePolicy, error) {
+	switch s {
+	case "allow":
+		return duplicatesAllowed, nil
+	case "kick_oldest":
+		return duplicatesKickOldest, nil
+	case "reject_newest":
+		return duplicatesRejectNewest, nil
+	}
+	return 0, fmt.Errorf("unknown duplicate session policy %q; expected allow, kick_oldest or reject_newest", s)
+}
+
+// principalIndex is the connections of each user, both those that are open and
+// those still being upgraded.
+type principalIndex struct {
+	mut    sync.Mutex
+	seq    uint64
+	byUser map[string][]*principalSlot
+}
+
+// principalSlot is one of a user's connections, from before it's upgraded.
+type principalSlot struct {
+	user string
+	// The order the slots were taken in.
+	seq uint64
+	// The connection, once it's up.
+	conn *liveConn
+	// Set once a newer connection has taken the slot's place.
+	superseded bool
+}
+
+func newPrincipalIndex() *principalIndex {
+	return &principalIndex{byUser: map[string][]*principalSlot{}}
+}
+
+// reserve takes a slot for a new connection of the user, unless the policy is
+// reject_newest and the user has one already.
+func (x *principalIndex) reserve(user string, policy duplicatePolicy) (*principalSlot, bool) {
+	x.mut.Lock()
+	defer x.mut.Unlock()
+	if policy == duplicatesRejectNewest && len(x.byUser[user]) > 0 {
+		duplicateSessions.Add("rejected", 1)
+		return nil, false
+	}
+	x.seq++
+	slot := &principalSlot{user: user, seq: x.seq}
+	x.byUser[user] = append(x.byUser[user], slot)
+	return slot, true
+}
+
+// attach gives the slot its connection, once it's up, and supersedes the
+// user's older ones, giving those that are up, oldest first. It reports false
+// if the slot has been superseded itself, by a newer one that was up first.
+func (x *principalIndex) attach(slot *principalSlot, c *liveConn) ([]*liveConn, bool) {
+	x.mut.Lock()
+	defer x.mut.Unlock()
+	slot.conn = c
+	if slot.superseded {
+		return nil, false
+	}
+	var older []*liveConn
+	for _, other := range x.byUser[slot.user] {
+		if other.seq >= slot.seq || other.superseded {
+			continue
+		}
+		other.superseded = true
+		if other.conn != nil {
+			older = append(older, other.conn)
+		}
+	}
+	return older, true
+}
+
+// release gives up the slot, once its connection is closed, or never made.
+func (x *principalIndex) release(slot *principalSlot) {
+	x.mut.Lock()
+	defer x.mut.Unlock()
+	slots := x.byUser[slot.user]
+	for i, other := range slots {
+		if other == slot {
+			slots = append(slots[:i], slots[i+1:]...)
+			break
+		}
+	}
+	if len(slots) == 0 {
+		delete(x.byUser, slot.user)
+		return
+	}
+	x.byUser[slot.user] = slots
+}
+
+// takeOver puts the connection in its user's others' place, closing them, and
+// taking over the session of the newest of those on its endpoint, unless it
+// asked for one of its own. It reports false if a newer connection of the
+// user's has already taken its own place.
+func (s *Server) takeOver(slot *principalSlot, c *liveConn) bool {
+	older, ok := s.principals.attach(slot, c)
+	if !ok {
+		duplicateSessions.Add("superseded", 1)
+		return false
+	}
+	for i := len(older) - 1; i >= 0; i-- {
+		old := older[i]
+		if c.session == "" && old.path == c.path {
+			c.session = s.supersedeSession(old)
+		}
+		duplicateSessions.Add("kicked", 1)
+		old.log.Info("Closing the connection, as another of its user's has taken its place", "by", c.id)
+		go func() {
+			old.transport.Close(closeSuperseded, "superseded")
+			old.transport.CloseNow()
+		}()
+	}
+	return true
+}
+
+// supersedeSession gives the session of the connection's client, if it has
+// one, kept for another connection to take over once it's closed.
+func (s *Server) supersedeSession(c *liveConn) string {
+	cl := c.served()
+	if cl == nil {
+		return ""
+	}
+	for _, h := range s.hubs {
+		if h.sessions == nil {
+			continue
+		}
+		if id := h.sessions.supersede(cl); id != "" {
+			return id
+		}
+	}
+	return ""
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"wsexample/wstest"
+)
+
+func TestPrincipalIndex(t *testing.T) {
+	x := newPrincipalIndex()
+	a, b := &liveConn{id: 1}, &liveConn{id: 2}
+
+	// Two connections upgraded at once: the newer is up first, so the older
+	// is superseded before it's up.
+	older, _ := x.reserve("alice", duplicatesKickOldest)
+	newer, _ := x.reserve("alice", duplicatesKickOldest)
+	if kicked, ok := x.attach(newer, b); !ok || len(kicked) != 0 {
+		t.Fatalf("the newer connection kicked %d, %t", len(kicked), ok)
+	}
+	if _, ok := x.attach(older, a); ok {
+		t.Fatal("the older connection got in after the newer one")
+	}
+	x.release(older)
+
+	// One that's up is kicked by a newer one, once that's up.
+	next, _ := x.reserve("alice", duplicatesKickOldest)
+	if kicked, ok := x.attach(next, a); !ok || len(kicked) != 1 || kicked[0] != b {
+		t.Fatalf("the next connection kicked %v, %t", kicked, ok)
+	}
+	x.release(newer)
+	x.release(next)
+	if len(x.byUser) != 0 {
+		t.Fatalf("%d users left once every connection's gone", len(x.byUser))
+	}
+
+	// With reject_newest, a slot taken, even for an upgrade under way, turns
+	// the next away, until it's given up.
+	first, _ := x.reserve("bob", duplicatesRejectNewest)
+	if _, ok := x.reserve("bob", duplicatesRejectNewest); ok {
+		t.Fatal("a second connection got a slot")
+	}
+	if _, ok := x.reserve("carol", duplicatesRejectNewest); !ok {
+		t.Fatal("another user's connection was turned away")
+	}
+	x.release(first)
+	if _, ok := x.reserve("bob", duplicatesRejectNewest); !ok {
+		t.Fatal("a connection was turned away once the first was gone")
+	}
+}
+
+// duplicateServer gives a server with the duplicate session policy, and a
+// func that gives the path to /api as a user.
+func duplicateServer(t *testing.T, policy string) (*Server, func(user string) string) {
+	t.Helper()
+	const secret = "jwt-secret"
+	secretFile := filepath.Join(t.TempDir(), "jwt")
+	os.WriteFile(secretFile, []byte(secret), 0o600)
+	s := pipeServer(t, WithAuth("", secretFile), WithDuplicateSessions(policy))
+	return s, func(user string) string {
+		exp := time.Now().Add(time.Hour).Unix()
+		return "/api?token=" + signedJWT(secret, map[string]interface{}{"sub": user, "exp": exp})
+	}
+}
+
+// pipedSession gives the session the connection is told it has.
+func pipedSession(t *testing.T, conn *pipedConn) sessionPayload {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var e testEnvelope
+	if err := conn.NextJSON(ctx, &e); err != nil || e.Type != "session" {
+		t.Fatalf("first envelope %s, %v, want the session", e.Type, err)
+	}
+	var p sessionPayload
+	json.Unmarshal(e.Payload, &p)
+	return p
+}
+
+// closedWith waits for the server to be done with the connection, and gives
+// the code and reason it closed it with.
+func closedWith(t *testing.T, conn *pipedConn) (int, string) {
+	t.Helper()
+	select {
+	case <-conn.served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection is still open")
+	}
+	code, reason, _ := conn.Closed()
+	return code, reason
+}
+
+func TestDuplicateSessions(t *testing.T) {
+	t.Run("allow", func(t *testing.T) {
+		s, as := duplicateServer(t, "allow")
+		first := pipeDial(t, s, as("alice"))
+		pipedSession(t, pipeDial(t, s, as("alice")))
+		first.InjectJSON(map[string]interface{}{"type": "chat.join", "payload": map[string]string{"room": "lobby"}})
+		nextPiped(t, first, "chat.joined")
+	})
+
+	t.Run("kick_oldest", func(t *testing.T) {
+		s, as := duplicateServer(t, "kick_oldest")
+		old := pipeDial(t, s, as("alice"))
+		first := pipedSession(t, old)
+		old.InjectJSON(map[string]interface{}{"type": "chat.join", "payload": map[string]string{"room": "lobby"}})
+		nextPiped(t, old, "chat.joined")
+		bob := pipeDial(t, s, as("bob"))
+		bob.InjectJSON(map[string]interface{}{"type": "chat.join", "payload": map[string]string{"room": "lobby"}})
+		nextPiped(t, bob, "chat.joined")
+		_ = pipeDial(t, s, as("carol"))
+
+		// What's said while the old connection isn't reading stays queued
+		// for it, for the new one to be sent.
+		old.Stall()
+		for _, m := range []string{"one", "two"} {
+			bob.InjectJSON(map[string]interface{}{"type": "chat.send", "payload": map[string]string{"room": "lobby", "message": m}})
+			nextPiped(t, bob, "chat.message")
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		conn := pipeDial(t, s, as("alice"))
+		if code, reason := closedWith(t, old); code != closeSuperseded || reason != "superseded" {
+			t.Fatalf("the old connection was closed with %d %q", code, reason)
+		}
+		if got := pipedSession(t, conn); !got.Resumed || got.Session != first.Session || len(got.Rooms) != 1 || got.Rooms[0] != "lobby" {
+			t.Fatalf("session %+v, want %s taken over in the lobby", got, first.Session)
+		}
+		// Less whatever the old connection was in the middle of writing.
+		message := chatMessage(nextPiped(t, conn, "chat.message"))
+		if message == "one" {
+			message = chatMessage(nextPiped(t, conn, "chat.message"))
+		}
+		if message != "two" {
+			t.Fatalf("got %q, want what was queued for the old connection", message)
+		}
+
+		// Nobody else's connection was touched.
+		if len(s.reg.list()) != 3 {
+			t.Fatalf("%d connections open, want the new one, bob's and carol's", len(s.reg.list()))
+		}
+	})
+
+	t.Run("reject_newest", func(t *testing.T) {
+		s, as := duplicateServer(t, "reject_newest")
+		first := pipeDial(t, s, as("alice"))
+		pipedSession(t, first)
+		w := httptest.NewRecorder()
+		s.ServeTransport(w, httptest.NewRequest(http.MethodGet, as("alice"), nil), wstest.NewConn())
+		var body errorBody
+		json.NewDecoder(w.Body).Decode(&body)
+		if w.Code != http.StatusConflict || body.Error.Code != codeAlreadyConnected {
+			t.Fatalf("a second connection got %d %+v", w.Code, body)
+		}
+
+		// Once the first is gone, the user can connect again.
+		first.hangUp()
+		pipedSession(t, pipeDial(t, s, as("alice")))
+	})
+
+	t.Run("reject_newest at once", func(t *testing.T) {
+		s, as := duplicateServer(t, "reject_newest")
+		const n = 10
+		codes := make(chan int, n)
+		for range n {
+			conn := &pipedConn{wstest.NewConn(), make(chan struct{})}
+			go func() {
+				defer close(conn.served)
+				w := httptest.NewRecorder()
+				s.ServeTransport(w, httptest.NewRequest(http.MethodGet, as("alice"), nil), conn.Conn)
+				codes <- w.Code
+			}()
+			t.Cleanup(conn.hangUp)
+		}
+		// Every one but the connection that got in is turned away.
+		for range n - 1 {
+			select {
+			case code := <-codes:
+				if code != http.StatusConflict {
+					t.Fatalf("a connection that didn't get in got %d", code)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("more than one connection got in")
+			}
+		}
+		select {
+		case code := <-codes:
+			t.Fatalf("every connection was turned away, the last with %d", code)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Some networks, mostly corporate ones with proxies that don't know any
+// better, block WebSockets outright, while letting plain HTTP through. So the
+// hubs on /chat and /api can also be reached without one: the server pushes
+// messages down a Server-Sent Events stream, and the client sends its own
+// with POSTs, correlated by a session token.
+//
+// A client opens the stream with GET /events?endpoint=chat (or api), which
+// goes through the same checks as an upgrade, authentication included. The
+// first event on it is the session:
+//
+//	event: session
+//	data: {"token":"9f86d081884c7d659a2feaa0c55ad015"}
+//
+// and from then on, every text message the endpoint sends the client is a
+// plain event, with the message as its data, and every binary one a "binary"
+// event, base64-encoded. Every message the client POSTs to /send, with the
+// token as its X-Session-Token header, is one the endpoint gets from it: a
+// binary one if its Content-Type is application/octet-stream, and a text one
+// otherwise. Each POST is answered once the endpoint has read the message,
+// with a 204, or a 404 if the session is gone.
+//
+// Behind the stream, the session is served as a connection like any other,
+// through a transport that speaks SSE, so that rate limits, idle clients,
+// metrics and the rest work on it as they do on a WebSocket. The pings are
+// comments on the stream, which keep proxies from timing it out, but since
+// there's no such thing as a pong, they only tell that the stream can still
+// be written to. The close frame is a "close" event:
+//
+//	event: close
+//	data: {"code":1001,"reason":"server shutting down"}
+//
+// and the session is over once the stream is, whichever side ends it.
+
+const sessionTokenHeader = "X-Session-Token"
+
+// eventSessions is the sessions whose streams are open, by token.
+type eventSessions struct {
+	// Bounds writing the events the server sends of its own accord, which are
+	// its control frames.
+	writeWait time.Duration
+
+	mut      sync.Mutex
+	sessions map[string]*eventsTransport
+}
+
+func newEventSessions(writeWait time.Duration) *eventSessions {
+	return &eventSessions{writeWait: writeWait, sessions: map[string]*eventsTransport{}}
+}
+
+func (s *eventSessions) get(token string) (*eventsTransport, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	t, ok := s.sessions[token]
+	return t, ok
+}
+
+func (s *eventSessions) remove(token string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	delete(s.sessions, token)
+}
+
+// acceptEvents is the acceptFunc for event streams: it starts the stream, and
+// gives the session its token.
+func (s *eventSessions) acceptEvents(w http.ResponseWriter, r *http.Request, subprotocols []string) (Transport, error) {
+	if _, ok := w.(http.Flusher); !ok {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "streaming isn't supported", 0)
+		return nil, errNoFlusher
+	}
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternalError, "failed to make a session token", 0)
+		return nil, err
+	}
+	t := &eventsTransport{
+		w:         w,
+		rc:        http.NewResponseController(w),
+		token:     hex.EncodeToString(token[:]),
+		sessions:  s,
+		inbox:     make(chan inbound),
+		closed:    make(chan struct{}),
+		readLimit: readLimit,
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	session, _ := json.Marshal(struct {
+		Token string `json:"token"`
+	}{t.token})
+	if err := t.event("session", session); err != nil {
+		return nil, err
+	}
+
+	s.mut.Lock()
+	s.sessions[t.token] = t
+	s.mut.Unlock()
+	return t, nil
+}
+
+var errNoFlusher = errors.New("the response can't be flushed")
+
+// eventsHandler serves GET /events, with the handler of the endpoint asked
+// for.
+func eventsHandler(endpoints map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := endpoints[r.URL.Query().Get("endpoint")]
+		if !ok {
+			writeError(w, http.StatusNotFound, codeNotFound, "no such endpoint", 0)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// sendHandler serves POST /send, handing the message to the session's
+// endpoint.
+func (s *eventSessions) sendHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.get(r.Header.Get(sessionTokenHeader))
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNotFound, "no such session", 0)
+		return
+	}
+	limit := atomic.LoadInt64(&t.readLimit)
+	data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "failed to read the message", 0)
+		return
+	}
+	m := inbound{messageType: websocket.TextMessage, data: data}
+	if r.Header.Get("Content-Type") == "application/octet-stream" {
+		m.messageType = websocket.BinaryMessage
+	}
+	// As on a WebSocket, a message over the read limit ends the session.
+	tooBig := int64(len(data)) > limit
+	if tooBig {
+		m = inbound{err: websocket.ErrReadLimit}
+	}
+	select {
+	case t.inbox <- m:
+	case <-t.closed:
+		writeError(w, http.StatusNotFound, codeNotFound, "no such session", 0)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	if tooBig {
+		writeError(w, http.StatusRequestEntityTooLarge, codeTooBig, "the message is over the read limit", 0)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type inbound struct {
+	messageType int
+	data        []byte
+	err         error
+}
+
+// eventsTransport is a session, with the messages from the client coming in
+// through /send, and the ones to it going out on the event stream.
+type eventsTransport struct {
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	token    string
+	sessions *eventSessions
+
+	inbox     chan inbound
+	readLimit int64
+
+	// Only one event is written at a time, and none once the stream is
+	// closed, since the response is done with by then.
+	writeMut sync.Mutex
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// formatEvent gives an event of the kind, unless it's "", with each line of
+// data as a data line.
+func formatEvent(kind string, data []byte) []byte {
+	var buf bytes.Buffer
+	if kind != "" {
+		fmt.Fprintf(&buf, "event: %s\n", kind)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", strings.TrimSuffix(line, "\r"))
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// event writes an event of the server's own, within the write wait.
+func (t *eventsTransport) event(kind string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.sessions.writeWait)
+	defer cancel()
+	return t.write(ctx, formatEvent(kind, data))
+}
+
+func (t *eventsTransport) write(ctx context.Context, p []byte) error {
+	t.writeMut.Lock()
+	defer t.writeMut.Unlock()
+	select {
+	case <-t.closed:
+		return net.ErrClosed
+	default:
+	}
+	t.rc.SetWriteDeadline(deadline(ctx))
+	if _, err := t.w.Write(p); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+func (t *eventsTransport) ReadMessage(ctx context.Context) (int, []byte, error) {
+	select {
+	case m := <-t.inbox:
+		if errors.Is(m.err, websocket.ErrReadLimit) {
+			// As the libraries do, over a message that's too big.
+			t.Close(websocket.CloseMessageTooBig, "")
+		}
+		if m.err != nil {
+			return 0, nil, m.err
+		}
+		return m.messageType, m.data, nil
+	case <-t.closed:
+		return 0, nil, net.ErrClosed
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+func (t *eventsTransport) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	if messageType == websocket.BinaryMessage {
+		return t.write(ctx, formatEvent("binary", []byte(base64.StdEncoding.EncodeToString(data))))
+	}
+	return t.write(ctx, formatEvent("", data))
+}
+
+// Messages from the client are whole by the time they're read anyway.
+func (t *eventsTransport) NextReader(ctx context.Context) (int, io.Reader, error) {
+	messageType, data, err := t.ReadMessage(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	return messageType, bytes.NewReader(data), nil
+}
+
+// An event can't be sent in pieces, so a streamed message is held on to until
+// it's all been written.
+func (t *eventsTransport) NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error) {
+	var buf bytes.Buffer
+	return &streamWriter{
+		write: buf.Write,
+		close: func() error { return t.WriteMessage(ctx, messageType, buf.Bytes()) },
+	}, nil
+}
+
+// Ping writes a comment, which is all there is to answer it, so there's no
+// round trip to time.
+func (t *eventsTransport) Ping(ctx context.Context) (time.Duration, error) {
+	return 0, t.write(ctx, []byte(": ping\n\n"))
+}
+
+func (t *eventsTransport) SetReadLimit(limit int64) {
+	atomic.StoreInt64(&t.readLimit, limit)
+}
+
+func (t *eventsTransport) Subprotocol() string {
+	return ""
+}
+
+func (t *eventsTransport) Extensions() string {
+	return ""
+}
+
+func (t *eventsTransport) Close(code int, reason string) error {
+	frame, _ := json.Marshal(struct {
+		Code   int    `json:"code"`
+		Reason string `json:"reason"`
+	}{code, reason})
+	err := t.event("close", frame)
+	t.CloseNow()
+	return err
+}
+
+func (t *eventsTransport) CloseNow() error {
+	t.once.Do(func() {
+		t.writeMut.Lock()
+		close(t.closed)
+		t.writeMut.Unlock()
+		t.sessions.remove(t.token)
+	})
+	return nil
+}
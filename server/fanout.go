@@ -0,0 +1,57 @@
+package server
+
+import "sync"
+
+// A broadcast to a room with tens of thousands of members spends nearly all
+// of its time queueing it for each of them, and while it does, the hub can't
+// get on with the next one. So past a few hundred recipients, deliver splits
+// them between up to -broadcast-workers goroutines (one for each CPU by
+// default), which each queue the broadcast for a slice of them. The hub waits
+// for all of them before it goes on to the next broadcast, so every client is
+// still queued its broadcasts one at a time, in the order the hub delivers
+// them, whichever worker queues each one. The clients that can't be queued
+// any more, for their overflow policy, are taken out of the hub once the
+// workers are done, as they were before there were any.
+
+// minFanOut is the fewest recipients given to a worker of their own; below
+// it, starting one costs more than it saves.
+const minFanOut = 256
+
+// fanOut sends to every client, between up to h.workers goroutines, and gives
+// the clients it failed for. Each goroutine sends with a func of its own from
+// sender, so that what it keeps, such as the encodings of an envelope, is
+// its own. h.mut must be held, and the funcs mustn't touch the hub.
+func (h *hub) fanOut(clients []*client, sender func() func(c *client) error) []*client {
+	workers := min(h.workers, (len(clients)+minFanOut-1)/minFanOut)
+	if workers <= 1 {
+		return sendAll(clients, sender())
+	}
+	failed := make([][]*client, workers)
+	var wg sync.WaitGroup
+	per := (len(clients) + workers - 1) / workers
+	for i := range failed {
+		slice := clients[min(i*per, len(clients)):min((i+1)*per, len(clients))]
+		send := sender()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			failed[i] = sendAll(slice, send)
+		}()
+	}
+	wg.Wait()
+	var all []*client
+	for _, f := range failed {
+		all = append(all, f...)
+	}
+	return all
+}
+
+func sendAll(clients []*client, send func(c *client) error) []*client {
+	var failed []*client
+	for _, c := range clients {
+		if err := send(c); err != nil {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
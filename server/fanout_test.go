@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+// fanOutHub gives a hub with the workers, and n clients in the lobby, each
+// with room in its queue for size messages.
+func fanOutHub(workers, n, size int) (*hub, []*client) {
+	h := newHub()
+	h.workers = workers
+	clients := make([]*client, n)
+	for i := range clients {
+		c := newClient(newFakeTransport(), "", sendQueue{size: size, overflow: overflowDisconnect}, messageRate{})
+		h.join(c)
+		h.joinRoom(c, "lobby")
+		clients[i] = c
+	}
+	return h, clients
+}
+
+func TestFanOut(t *testing.T) {
+	const n, broadcasts = 3000, 20
+	for _, workers := range []int{1, 4, 64} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			h, clients := fanOutHub(workers, n, broadcasts)
+			// One whose queue is already full is taken out of the room by
+			// the first broadcast, and sent nothing more.
+			slow := newClient(newFakeTransport(), "", sendQueue{size: 0, overflow: overflowDisconnect}, messageRate{})
+			h.join(slow)
+			h.joinRoom(slow, "lobby")
+			h.mut.Lock()
+			for i := 0; i < broadcasts; i++ {
+				payload := chatMessagePayload{Room: "lobby", Message: json.RawMessage(fmt.Sprint(i))}
+				h.deliver(broadcastMessage{room: "lobby", envelope: newOutgoing("chat.message", payload), except: clients[0]})
+			}
+			h.mut.Unlock()
+
+			if h.inRoom(slow, "lobby") {
+				t.Error("the slow client is still in the room")
+			}
+			if got := len(clients[0].takeQueue()); got != 0 {
+				t.Errorf("the client left out was sent %d", got)
+			}
+			for i, c := range clients[1:] {
+				envelopes := queuedEnvelopes(c)
+				if len(envelopes) != broadcasts {
+					t.Fatalf("client %d was sent %d, want %d", i+1, len(envelopes), broadcasts)
+				}
+				for j, e := range envelopes {
+					var p chatMessagePayload
+					json.Unmarshal(e.Payload, &p)
+					if string(p.Message) != fmt.Sprint(j) {
+						t.Fatalf("client %d was sent %s in place %d", i+1, p.Message, j)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkFanOut delivers a broadcast to a room of 10k and 50k members, with
+// one worker, as it was before the fan-out, and with one for each CPU, and
+// reports the 99th percentile of how long it took to queue it for all of them.
+func BenchmarkFanOut(b *testing.B) {
+	workers := []int{1}
+	if runtime.NumCPU() > 1 {
+		workers = append(workers, runtime.NumCPU())
+	}
+	for _, n := range []int{10000, 50000} {
+		for _, workers := range workers {
+			b.Run(fmt.Sprintf("recipients=%d/workers=%d", n, workers), func(b *testing.B) {
+				h, clients := fanOutHub(workers, n, 1)
+				m := broadcastMessage{room: "lobby", envelope: newOutgoing("chat.message", chatMessagePayload{Room: "lobby", Message: json.RawMessage(`"hello"`)})}
+				took := make([]time.Duration, 0, b.N)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					start := time.Now()
+					h.mut.Lock()
+					h.deliver(m)
+					h.mut.Unlock()
+					took = append(took, time.Since(start))
+
+					b.StopTimer()
+					for _, c := range clients {
+						c.takeQueue()
+					}
+					b.StartTimer()
+				}
+				sort.Slice(took, func(i, j int) bool { return took[i] < took[j] })
+				b.ReportMetric(float64(took[len(took)*99/100].Microseconds()), "p99-µs")
+			})
+		}
+	}
+}
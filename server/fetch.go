@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// A member of a room on /api can page back through the room's history, on
+// top of what chat.resume sends it, newest first:
+//
+//	{"type":"history.fetch","payload":{"room":"lobby","before_seq":1200,"limit":50}}
+//
+// gets the envelopes broadcast to the room before sequence number 1200, or
+// its newest, without a before_seq, as
+//
+//	{"type":"history.page","payload":{"room":"lobby","before_seq":1200,"messages":[{"seq":1199,"type":"chat.message","payload":{...}},...],"next_cursor":1130}}
+//
+// with each envelope's payload encoded as the client's envelopes are. The
+// next_cursor is the before_seq of the page before, and is left out once
+// there's nothing older kept. The limit is 50 if it isn't given, and no more
+// than maxHistoryPage. A page only has what the history still keeps, which
+// for the memory history is the last -history-size envelopes; a history kept
+// on disk or in a database would reach further back.
+//
+// A page is sent in as many history.page envelopes as it takes to keep each
+// of them under historyChunkBytes, all but the last with "continued":true,
+// so that a big page never has a message to itself that's much bigger than a
+// live one. Fetches are served off the connection's reader, so the envelopes
+// the client sends after one are handled without waiting for it, and a page
+// can arrive after what's broadcast to the room in the meantime. A
+// connection can have up to maxFetchesInFlight fetches going at once; any
+// more get too_many_fetches.
+
+const (
+	defaultHistoryPage = 50
+	maxHistoryPage     = 200
+	maxFetchesInFlight = 4
+	historyChunkBytes  = 64 << 10
+)
+
+const codeTooManyFetches = "too_many_fetches"
+
+type fetchPayload struct {
+	Room      string `json:"room" pb:"1" validate:"required,max=64"`
+	BeforeSeq uint64 `json:"before_seq,omitempty" pb:"2"`
+	Limit     int    `json:"limit,omitempty" pb:"3"`
+}
+
+type historyPagePayload struct {
+	Room      string          `json:"room" pb:"1"`
+	BeforeSeq uint64          `json:"before_seq,omitempty" pb:"2"`
+	Messages  []pagedEnvelope `json:"messages" pb:"3"`
+	// Set on the last of the page's envelopes, if there are older ones.
+	NextCursor uint64 `json:"next_cursor,omitempty" pb:"4"`
+	// Set on all but the last.
+	Continued bool `json:"continued,omitempty" pb:"5"`
+}
+
+// pagedEnvelope is an envelope from the history, with its payload encoded
+// for the client it's sent to.
+type pagedEnvelope struct {
+	Seq     uint64          `json:"seq" pb:"1"`
+	Type    string          `json:"type" pb:"2"`
+	Payload json.RawMessage `json:"payload" pb:"3"`
+}
+
+// pageLimit gives how many envelopes to page through for a fetch that asks
+// for limit of them.
+func pageLimit(limit int) int {
+	switch {
+	case limit <= 0:
+		return defaultHistoryPage
+	case limit > maxHistoryPage:
+		return maxHistoryPage
+	}
+	return limit
+}
+
+// fetch sends c the page of the room's history it asks for, once it's read,
+// and fails if c isn't in the room, or has too many fetches going already.
+func (h *hub) fetch(ctx context.Context, c *client, p fetchPayload) error {
+	h.mut.Lock()
+	_, ok := h.clients[c][p.Room]
+	h.mut.Unlock()
+	if !ok {
+		return &replyError{codeNotInRoom, errNotInRoom.Error()}
+	}
+	if atomic.AddInt32(&c.fetching, 1) > maxFetchesInFlight {
+		atomic.AddInt32(&c.fetching, -1)
+		return &replyError{codeTooManyFetches, fmt.Sprintf("no more than %d history fetches can be in flight", maxFetchesInFlight)}
+	}
+	go func() {
+		defer atomic.AddInt32(&c.fetching, -1)
+		for _, chunk := range h.historyPage(c, p, time.Now()) {
+			if sendEnvelope(ctx, c, "history.page", chunk) != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// historyPage gives the page of the room's history the fetch asks for,
+// encoded for c, in the history.page payloads to send it in. What's expired
+// by now is left out.
+func (h *hub) historyPage(c *client, p fetchPayload, now time.Time) []historyPagePayload {
+	var kept []keptEnvelope
+	var older bool
+	if h.history != nil {
+		kept, older = h.history.before(p.Room, p.BeforeSeq, pageLimit(p.Limit))
+	}
+	var chunks []historyPagePayload
+	page := historyPagePayload{Room: p.Room, BeforeSeq: p.BeforeSeq, Messages: []pagedEnvelope{}}
+	size := 0
+	for _, k := range kept {
+		if expired(k.envelope.expires, now) {
+			continue
+		}
+		data, ok := k.envelope.payloads[c.codec.name()]
+		if !ok {
+			continue
+		}
+		if len(page.Messages) > 0 && size+len(data) > historyChunkBytes {
+			page.Continued = true
+			chunks = append(chunks, page)
+			page = historyPagePayload{Room: p.Room, BeforeSeq: p.BeforeSeq}
+			size = 0
+		}
+		page.Messages = append(page.Messages, pagedEnvelope{k.seq, k.envelope.typ, data})
+		size += len(data)
+	}
+	if older {
+		page.NextCursor = kept[len(kept)-1].seq
+	}
+	return append(chunks, page)
+}
+
+// handleHistory registers history.fetch with the dispatcher.
+func handleHistory(d *dispatcher, h *hub) {
+	d.validate("history.fetch", fetchPayload{})
+	d.handle("history.fetch", func(ctx context.Context, c *client, payload payload) error {
+		var p fetchPayload
+		if err := decodeRoomPayload(payload, &p, &p.Room); err != nil {
+			return err
+		}
+		return h.fetch(ctx, c, p)
+	})
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fetchHub gives a hub with a history, and a client in the room, which has had
+// n envelopes broadcast to it, each with its number as its message.
+func fetchHub(room string, n int) (*hub, *client) {
+	h := newHub()
+	h.history = newMemoryHistory(1000, 10)
+	c := newClient(newFakeTransport(), "", sendQueue{size: 2 * n}, messageRate{})
+	h.join(c)
+	h.joinRoom(c, room)
+	h.mut.Lock()
+	for i := 1; i <= n; i++ {
+		payload := chatMessagePayload{Room: room, Message: json.RawMessage(fmt.Sprint(i))}
+		h.deliver(broadcastMessage{room: room, envelope: newOutgoing("chat.message", payload), kept: true})
+	}
+	h.mut.Unlock()
+	c.takeQueue()
+	return h, c
+}
+
+func TestHistoryFetch(t *testing.T) {
+	const n, limit = 1000, 64
+	h, c := fetchHub("lobby", n)
+	var cursor, last uint64
+	want := n
+	pages := 0
+	for {
+		chunks := h.historyPage(c, fetchPayload{Room: "lobby", BeforeSeq: cursor, Limit: limit}, time.Now())
+		if len(chunks) != 1 {
+			t.Fatalf("page %d came in %d chunks", pages, len(chunks))
+		}
+		page := chunks[0]
+		pages++
+		if size := len(page.Messages); size != limit && (page.NextCursor != 0 || size != n%limit) {
+			t.Fatalf("page %d has %d envelopes", pages, size)
+		}
+		for _, m := range page.Messages {
+			var p chatMessagePayload
+			json.Unmarshal(m.Payload, &p)
+			if string(p.Message) != fmt.Sprint(want) {
+				t.Fatalf("page %d has %s, want %d", pages, p.Message, want)
+			}
+			if last != 0 && m.Seq >= last {
+				t.Fatalf("page %d has %d after %d", pages, m.Seq, last)
+			}
+			last = m.Seq
+			want--
+		}
+		if page.NextCursor == 0 {
+			break
+		}
+		if page.NextCursor != last {
+			t.Fatalf("page %d's cursor is %d, want %d", pages, page.NextCursor, last)
+		}
+		cursor = page.NextCursor
+	}
+	if want != 0 || pages != (n+limit-1)/limit {
+		t.Fatalf("paged through to %d in %d pages", want, pages)
+	}
+
+	for _, tt := range []struct {
+		limit, want int
+	}{
+		{0, defaultHistoryPage},
+		{-1, defaultHistoryPage},
+		{5000, maxHistoryPage},
+	} {
+		page := h.historyPage(c, fetchPayload{Room: "lobby", Limit: tt.limit}, time.Now())[0]
+		if len(page.Messages) != tt.want {
+			t.Errorf("a limit of %d gave %d envelopes, want %d", tt.limit, len(page.Messages), tt.want)
+		}
+	}
+	if page := h.historyPage(c, fetchPayload{Room: "elsewhere"}, time.Now())[0]; len(page.Messages) != 0 || page.NextCursor != 0 {
+		t.Errorf("a room with no history gave %+v", page)
+	}
+}
+
+func TestHistoryFetchChunks(t *testing.T) {
+	h := newHub()
+	h.history = newMemoryHistory(10, 10)
+	c := newClient(newFakeTransport(), "", sendQueue{size: 10}, messageRate{})
+	h.join(c)
+	h.joinRoom(c, "lobby")
+	big := json.RawMessage(`"` + strings.Repeat("x", historyChunkBytes/2) + `"`)
+	h.mut.Lock()
+	for i := 0; i < 5; i++ {
+		payload := chatMessagePayload{Room: "lobby", Message: big}
+		h.deliver(broadcastMessage{room: "lobby", envelope: newOutgoing("chat.message", payload), kept: true})
+	}
+	h.mut.Unlock()
+	chunks := h.historyPage(c, fetchPayload{Room: "lobby"}, time.Now())
+	if len(chunks) != 5 {
+		t.Fatalf("page came in %d chunks, want 5", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if len(chunk.Messages) != 1 || chunk.Continued != (i < len(chunks)-1) {
+			t.Fatalf("chunk %d has %d envelopes, and continued %v", i, len(chunk.Messages), chunk.Continued)
+		}
+	}
+}
+
+func TestHistoryFetchLimits(t *testing.T) {
+	h, c := fetchHub("lobby", 10)
+	var re *replyError
+	err := h.fetch(context.Background(), c, fetchPayload{Room: "elsewhere"})
+	if !errors.As(err, &re) || re.code != codeNotInRoom {
+		t.Fatalf("fetching from a room the client isn't in gave %v", err)
+	}
+	c.fetching = maxFetchesInFlight
+	err = h.fetch(context.Background(), c, fetchPayload{Room: "lobby"})
+	if !errors.As(err, &re) || re.code != codeTooManyFetches {
+		t.Fatalf("fetching with %d already going gave %v", maxFetchesInFlight, err)
+	}
+	c.fetching = 0
+	if err := h.fetch(context.Background(), c, fetchPayload{Room: "lobby", Limit: 3}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for n, _ := c.queueStalledFor(time.Now()); n == 0 && time.Now().Before(deadline); n, _ = c.queueStalledFor(time.Now()) {
+		time.Sleep(time.Millisecond)
+	}
+	envelopes := queuedEnvelopes(c)
+	if len(envelopes) != 1 || envelopes[0].Type != "history.page" {
+		t.Fatalf("was sent %+v", envelopes)
+	}
+	var page historyPagePayload
+	json.Unmarshal(envelopes[0].Payload, &page)
+	if len(page.Messages) != 3 || page.NextCursor == 0 {
+		t.Fatalf("history.page %+v", page)
+	}
+}
+
+func TestHistoryFetchOverAPI(t *testing.T) {
+	u := testServer(t)
+	conn := apiDial(t, u, "lobby")
+	for i := 0; i < 3; i++ {
+		conn.WriteJSON(map[string]interface{}{"type": "chat.send", "payload": map[string]interface{}{"room": "lobby", "message": i}})
+		nextEnvelope(t, conn, "chat.message")
+	}
+	conn.WriteJSON(map[string]interface{}{"type": "history.fetch", "payload": map[string]interface{}{"room": "lobby", "limit": 2}})
+	var page historyPagePayload
+	json.Unmarshal(nextEnvelope(t, conn, "history.page").Payload, &page)
+	if len(page.Messages) != 2 || string(page.Messages[0].Payload) == "" || page.NextCursor != page.Messages[1].Seq {
+		t.Fatalf("history.page %+v", page)
+	}
+	conn.WriteJSON(map[string]interface{}{"type": "history.fetch", "payload": map[string]interface{}{"room": "lobby", "before_seq": page.NextCursor}})
+	var oldest historyPagePayload
+	json.Unmarshal(nextEnvelope(t, conn, "history.page").Payload, &oldest)
+	if len(oldest.Messages) != 1 || oldest.NextCursor != 0 {
+		t.Fatalf("the last history.page %+v", oldest)
+	}
+	var p chatMessagePayload
+	json.Unmarshal(oldest.Messages[0].Payload, &p)
+	if string(p.Message) != "0" {
+		t.Fatalf("the oldest message is %s", p.Message)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"wsexample/graphqlws"
+)
+
+// The /graphql endpoint speaks graphql-transport-ws instead of echoing. There's
+// no GraphQL engine behind it; whatever the query, a subscription just gets
+// the time every second, like so:
+//
+//	{"data":{"clock":"2006-01-02T15:04:05Z"}}
+//
+// With a "count" variable, the subscription completes after that many ticks.
+
+// graphqlServer serves graphql-transport-ws over the connection. The ping loop
+// keeps running underneath, independently of the protocol's own pings.
+func graphqlServer(srv *graphqlws.Server) connServer {
+	return func(ctx context.Context, g *errgroup.Group, c *client) error {
+		return srv.Serve(ctx, clientConn{c})
+	}
+}
+
+// clientConn has graphqlws read and write through the client, like everything
+// else does.
+type clientConn struct {
+	*client
+}
+
+func (c clientConn) ReadMessage(ctx context.Context) (int, []byte, error) {
+	return c.read(ctx)
+}
+
+func (c clientConn) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	return c.write(messageType, data)
+}
+
+func (c clientConn) Subprotocol() string {
+	return c.t.Subprotocol()
+}
+
+// Close lets whatever graphqlws sent before closing go out first.
+func (c clientConn) Close(code int, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.writeWaits.message)
+	defer cancel()
+	return c.close(ctx, code, reason)
+}
+
+type clockResolver struct{}
+
+func (clockResolver) Subscribe(ctx context.Context, req graphqlws.Request) (<-chan graphqlws.Result, error) {
+	count := -1
+	if n, ok := req.Variables["count"].(float64); ok {
+		if n < 1 {
+			return nil, graphqlws.Errors{{Message: "count must be at least 1"}}
+		}
+		count = int(n)
+	}
+
+	results := make(chan graphqlws.Result)
+	go func() {
+		defer close(results)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for ; count != 0; count-- {
+			select {
+			case now := <-ticker.C:
+				result := graphqlws.Result{Data: map[string]string{"clock": now.UTC().Format(time.RFC3339)}}
+				select {
+				case results <- result:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return results, nil
+}
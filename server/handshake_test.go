@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// rawUpgrade upgrades a plain TCP connection to the server's endpoint at u,
+// without a WebSocket library, and gives the connection, and a reader of what
+// comes after the handshake response.
+func rawUpgrade(t *testing.T, u string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", parsed.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req := "GET " + parsed.Path + " HTTP/1.1\r\n" +
+		"Host: " + parsed.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	return conn, br
+}
+
+// readCloseFrame reads frames until a close frame, and gives its code, or
+// fails if the connection ends first.
+func readCloseFrame(t *testing.T, br *bufio.Reader) (int, string) {
+	t.Helper()
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			t.Fatalf("connection ended without a close frame: %v", err)
+		}
+		opcode, n := header[0]&0x0f, int(header[1]&0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			io.ReadFull(br, ext[:])
+			n = int(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			io.ReadFull(br, ext[:])
+			n = int(binary.BigEndian.Uint64(ext[:]))
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			t.Fatalf("connection ended partway through a frame: %v", err)
+		}
+		if opcode == websocket.CloseMessage {
+			if n < 2 {
+				return websocket.CloseNoStatusReceived, ""
+			}
+			return int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+		}
+	}
+}
+
+func TestHandshakeGrace(t *testing.T) {
+	const grace = 200 * time.Millisecond
+	for _, name := range transportNames {
+		t.Run(name, func(t *testing.T) {
+			u := testServer(t, WithTransport(name), WithHandshakeGrace(grace))
+
+			// A client that upgrades and then says nothing is closed once the
+			// grace period is up.
+			before := handshakeTimeouts.Value()
+			start := time.Now()
+			_, br := rawUpgrade(t, u+"/echo")
+			code, reason := readCloseFrame(t, br)
+			if code != closeHandshakeTimeout {
+				t.Fatalf("closed with %d %q, want %d", code, reason, closeHandshakeTimeout)
+			}
+			if took := time.Since(start); took < grace {
+				t.Fatalf("closed after %s, before the grace period of %s was up", took, grace)
+			}
+			if got := handshakeTimeouts.Value() - before; got != 1 {
+				t.Fatalf("handshake_timeouts went up by %d, want 1", got)
+			}
+
+			// One that sends something in time is left alone after it.
+			conn, _, err := websocket.DefaultDialer.Dial(u+"/echo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(2 * grace)
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("still here")); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for _, want := range []string{"hello", "still here"} {
+				if _, data, err := conn.ReadMessage(); err != nil || string(data) != want {
+					t.Fatalf("read %q, %v, want %q", data, err, want)
+				}
+			}
+		})
+	}
+}
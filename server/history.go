@@ -0,0 +1,211 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+)
+
+// The hub of /api keeps the last -history-size envelopes broadcast to each
+// room, so that a client that loses its connection can pick up where it left
+// off. Every envelope broadcast to a room comes with a sequence number,
+//
+//	{"type":"chat.message","seq":42,"payload":{"room":"lobby","message":"hello"}}
+//
+// and a client coming back sends the last one it saw for the room:
+//
+//	{"type":"chat.resume","payload":{"room":"lobby","after":42}}
+//
+// That joins the room, as chat.join does, and sends the client every envelope
+// it missed, in order, before anything broadcast to the room after it. Once
+// they're queued, the client is told whether that was all of them, or whether
+// some were too old to still be kept:
+//
+//	{"type":"chat.resumed","payload":{"room":"lobby","complete":true}}
+//
+// Sequence numbers go up across every room, so they aren't contiguous within
+// one. Presence events aren't kept, and don't have one.
+//
+// The history is in memory, for the rooms broadcast to most recently, up to
+// -history-rooms of them. How many envelopes are kept for each room can be
+// changed with history_size in the config file, and a reload makes rooms with
+// more than that forget the oldest of them straight away. It's behind the history interface, so that it could
+// as well be kept on disk or in a database. Either way, it belongs to the
+// instance, so with more than one, a client has to resume on the one it was
+// connected to, and it doesn't survive a restart.
+
+// A history keeps the recent envelopes broadcast to each room.
+type history interface {
+	// add keeps the envelope, and gives it its sequence number. Envelopes
+	// are added in the order they're broadcast in.
+	add(room string, e *outgoing) uint64
+	// since gives the room's envelopes after the sequence number, oldest
+	// first, and whether that's all of them, or some of them are no longer
+	// kept.
+	since(room string, after uint64) ([]keptEnvelope, bool)
+	// before gives up to limit of the room's envelopes before the sequence
+	// number, or its newest if it's 0, newest first, and whether there are
+	// older ones still kept; see fetch.go.
+	before(room string, seq uint64, limit int) ([]keptEnvelope, bool)
+}
+
+type keptEnvelope struct {
+	seq      uint64
+	envelope *outgoing
+}
+
+// memoryHistory keeps a ring of envelopes for each room, for the rooms added
+// to most recently.
+type memoryHistory struct {
+	size     int
+	maxRooms int
+
+	mut sync.Mutex
+	// The last sequence number given out.
+	seq uint64
+	// The highest sequence number of any room that was pushed out, so that a
+	// room that comes back can't claim to know about anything before that.
+	evicted uint64
+	lru     *list.List
+	rooms   map[string]*list.Element
+}
+
+type roomHistory struct {
+	room string
+	// The envelopes, as a ring, with next being where the next one goes, and,
+	// once it's full, the oldest.
+	ring []keptEnvelope
+	next int
+	full bool
+	// The sequence number up to which envelopes are no longer kept.
+	forgotten uint64
+}
+
+func newMemoryHistory(size, maxRooms int) *memoryHistory {
+	return &memoryHistory{
+		size:     size,
+		maxRooms: maxRooms,
+		lru:      list.New(),
+		rooms:    map[string]*list.Element{},
+	}
+}
+
+func (h *memoryHistory) add(room string, e *outgoing) uint64 {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.seq++
+	r, ok := h.room(room)
+	if !ok {
+		if h.lru.Len() >= h.maxRooms {
+			oldest := h.lru.Back()
+			h.lru.Remove(oldest)
+			gone := oldest.Value.(*roomHistory)
+			delete(h.rooms, gone.room)
+			if last := gone.last(); last > h.evicted {
+				h.evicted = last
+			}
+		}
+		r = &roomHistory{room: room, ring: make([]keptEnvelope, h.size), forgotten: h.evicted}
+		h.rooms[room] = h.lru.PushFront(r)
+	}
+	if r.full {
+		r.forgotten = r.ring[r.next].seq
+	}
+	r.ring[r.next] = keptEnvelope{h.seq, e}
+	r.next = (r.next + 1) % len(r.ring)
+	r.full = r.full || r.next == 0
+	return h.seq
+}
+
+func (h *memoryHistory) since(room string, after uint64) ([]keptEnvelope, bool) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	// A sequence number that hasn't been given out yet is from before a
+	// restart, or from another instance.
+	if after > h.seq {
+		return nil, false
+	}
+	r, ok := h.room(room)
+	if !ok {
+		return nil, after >= h.evicted
+	}
+	var kept []keptEnvelope
+	for _, k := range r.kept() {
+		if k.seq > after {
+			kept = append(kept, k)
+		}
+	}
+	return kept, after >= r.forgotten
+}
+
+func (h *memoryHistory) before(room string, seq uint64, limit int) ([]keptEnvelope, bool) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	r, ok := h.room(room)
+	if !ok {
+		return nil, false
+	}
+	all := r.kept()
+	i := len(all)
+	if seq != 0 {
+		for i > 0 && all[i-1].seq >= seq {
+			i--
+		}
+	}
+	var kept []keptEnvelope
+	for ; i > 0 && len(kept) < limit; i-- {
+		kept = append(kept, all[i-1])
+	}
+	return kept, i > 0
+}
+
+// resize changes how many envelopes are kept for each room. A room with more
+// than that forgets the oldest of them.
+func (h *memoryHistory) resize(size int) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if size == h.size {
+		return
+	}
+	h.size = size
+	for e := h.lru.Front(); e != nil; e = e.Next() {
+		r := e.Value.(*roomHistory)
+		kept := r.kept()
+		if len(kept) > size {
+			r.forgotten = kept[len(kept)-size-1].seq
+			kept = kept[len(kept)-size:]
+		}
+		r.ring = make([]keptEnvelope, size)
+		copy(r.ring, kept)
+		r.next, r.full = len(kept)%size, len(kept) == size
+	}
+}
+
+// room finds the room's history, and marks it as the most recently used.
+func (h *memoryHistory) room(room string) (*roomHistory, bool) {
+	e, ok := h.rooms[room]
+	if !ok {
+		return nil, false
+	}
+	h.lru.MoveToFront(e)
+	return e.Value.(*roomHistory), true
+}
+
+// kept gives the room's envelopes, oldest first.
+func (r *roomHistory) kept() []keptEnvelope {
+	start := 0
+	if r.full {
+		start = r.next
+	}
+	var kept []keptEnvelope
+	for i := range r.ring {
+		if k := r.ring[(start+i)%len(r.ring)]; k.envelope != nil {
+			kept = append(kept, k)
+		}
+	}
+	return kept
+}
+
+// last gives the sequence number of the room's newest envelope.
+func (r *roomHistory) last() uint64 {
+	return r.ring[(r.next+len(r.ring)-1)%len(r.ring)].seq
+}
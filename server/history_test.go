@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMemoryHistory(t *testing.T) {
+	h := newMemoryHistory(3, 2)
+	// Each step adds an envelope to the room, when want is nil, or otherwise
+	// checks what's kept after the sequence number.
+	tests := []struct {
+		room     string
+		after    uint64
+		want     []uint64
+		complete bool
+	}{
+		{room: "a"},
+		{room: "a"},
+		{room: "b"},
+		{room: "a"},
+		// The ring of three pushes out 1.
+		{room: "a"},
+		{"a", 0, []uint64{2, 4, 5}, false},
+		{"a", 1, []uint64{2, 4, 5}, true},
+		{"a", 2, []uint64{4, 5}, true},
+		{"a", 5, []uint64{}, true},
+		// From before a restart, or another instance.
+		{"a", 9, []uint64{}, false},
+		// Which leaves a as the least recently used room.
+		{"b", 0, []uint64{3}, true},
+		{"never", 0, []uint64{}, true},
+		// So c pushes it out.
+		{room: "c"},
+		{"a", 5, []uint64{}, true},
+		{"a", 4, []uint64{}, false},
+		// A room that's new can't be told apart from one pushed out before,
+		// so only what's after the last of a counts as complete.
+		{"c", 0, []uint64{6}, false},
+		{"c", 5, []uint64{6}, true},
+		{"b", 0, []uint64{3}, true},
+	}
+	seq := uint64(0)
+	for i, tt := range tests {
+		if tt.want == nil {
+			seq++
+			if got := h.add(tt.room, newOutgoing("chat.message", nil)); got != seq {
+				t.Fatalf("step %d: added as %d, want %d", i, got, seq)
+			}
+			continue
+		}
+		kept, complete := h.since(tt.room, tt.after)
+		got := []uint64{}
+		for _, k := range kept {
+			got = append(got, k.seq)
+		}
+		if !equalSeqs(got, tt.want) || complete != tt.complete {
+			t.Fatalf("step %d: since(%q, %d) = %v, %t, want %v, %t", i, tt.room, tt.after, got, complete, tt.want, tt.complete)
+		}
+	}
+}
+
+func TestMemoryHistoryResize(t *testing.T) {
+	h := newMemoryHistory(3, 2)
+	for i := 0; i < 3; i++ {
+		h.add("a", newOutgoing("chat.message", nil))
+	}
+	h.add("b", newOutgoing("chat.message", nil))
+	check := func(room string, after uint64, want []uint64, complete bool) {
+		t.Helper()
+		kept, gotComplete := h.since(room, after)
+		got := []uint64{}
+		for _, k := range kept {
+			got = append(got, k.seq)
+		}
+		if !equalSeqs(got, want) || gotComplete != complete {
+			t.Fatalf("since(%q, %d) = %v, %t, want %v, %t", room, after, got, gotComplete, want, complete)
+		}
+	}
+
+	// Shrinking forgets the oldest straight away.
+	h.resize(2)
+	check("a", 0, []uint64{2, 3}, false)
+	check("a", 1, []uint64{2, 3}, true)
+	check("b", 0, []uint64{4}, true)
+	h.add("a", newOutgoing("chat.message", nil))
+	check("a", 1, []uint64{3, 5}, false)
+	check("a", 2, []uint64{3, 5}, true)
+
+	// Growing keeps what's there, and makes room for more.
+	h.resize(4)
+	h.add("a", newOutgoing("chat.message", nil))
+	h.add("a", newOutgoing("chat.message", nil))
+	check("a", 2, []uint64{3, 5, 6, 7}, true)
+	h.add("a", newOutgoing("chat.message", nil))
+	check("a", 2, []uint64{5, 6, 7, 8}, false)
+	check("b", 0, []uint64{4}, true)
+}
+
+func equalSeqs(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type testEnvelope struct {
+	Type    string          `json:"type"`
+	Seq     uint64          `json:"seq"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// apiDial connects to /api, and joins the room.
+func apiDial(t *testing.T, u, room string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(u+"/api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if room != "" {
+		conn.WriteJSON(map[string]interface{}{"type": "chat.join", "payload": map[string]string{"room": room}})
+		nextEnvelope(t, conn, "chat.joined")
+	}
+	return conn
+}
+
+// nextEnvelope reads envelopes until one that isn't about the session or
+// presence, and checks that it's of the type.
+func nextEnvelope(t *testing.T, conn *websocket.Conn, typ string) testEnvelope {
+	t.Helper()
+	for {
+		var e testEnvelope
+		if err := conn.ReadJSON(&e); err != nil {
+			t.Fatalf("reading a %s: %v", typ, err)
+		}
+		if e.Type == "session" || strings.HasPrefix(e.Type, "presence.") {
+			continue
+		}
+		if e.Type != typ {
+			t.Fatalf("got a %s envelope %s, want %s", e.Type, e.Payload, typ)
+		}
+		return e
+	}
+}
+
+// chatMessage gives the message of a chat.message envelope, which the tests
+// only ever send as strings.
+func chatMessage(e testEnvelope) string {
+	var p struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(e.Payload, &p)
+	return p.Message
+}
+
+func TestResume(t *testing.T) {
+	s := pipeServer(t, WithHistory(3, 10))
+	tests := []struct {
+		name string
+		// The index of the last of the five messages the client saw.
+		saw      int
+		want     []string
+		complete bool
+	}{
+		{"missed what's kept", 1, []string{"3", "4", "5"}, true},
+		{"missed more than what's kept", 0, []string{"3", "4", "5"}, false},
+		{"missed nothing", 4, nil, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			room := fmt.Sprintf("room%d", i)
+			send := func(conn *pipedConn, message string) uint64 {
+				conn.InjectJSON(map[string]interface{}{"type": "chat.send", "payload": map[string]string{"room": room, "message": message}})
+				e := nextPiped(t, conn, "chat.message")
+				if e.Seq == 0 {
+					t.Fatalf("message %s broadcast without a sequence number", message)
+				}
+				return e.Seq
+			}
+			sender := pipeAPI(t, s, room)
+			var seqs []uint64
+			for _, message := range []string{"1", "2", "3", "4", "5"} {
+				seqs = append(seqs, send(sender, message))
+			}
+
+			conn := pipeAPI(t, s, "")
+			conn.InjectJSON(map[string]interface{}{"type": "chat.resume", "payload": map[string]interface{}{"room": room, "after": seqs[tt.saw]}})
+			var got []string
+			for range tt.want {
+				got = append(got, chatMessage(nextPiped(t, conn, "chat.message")))
+			}
+			var resumed resumedPayload
+			json.Unmarshal(nextPiped(t, conn, "chat.resumed").Payload, &resumed)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") || resumed.Complete != tt.complete {
+				t.Fatalf("resumed with %q, complete %t, want %q, complete %t", got, resumed.Complete, tt.want, tt.complete)
+			}
+
+			// And it's back in the room for what's broadcast after.
+			send(sender, "live")
+			if got := chatMessage(nextPiped(t, conn, "chat.message")); got != "live" {
+				t.Fatalf("got %q after resuming, want the live message", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Every upgrade request that gets rejected is answered with the same kind of
+// JSON body, so that clients can tell why they were turned away, and decide
+// for themselves whether it's worth trying again:
+//
+//	{"error":{"code":"address_denied","message":"..."}}
+//
+// The code is meant for machines, and won't change. The message is meant for
+// humans. Rejections that are only temporary also come with a Retry-After
+// header.
+
+const (
+	codeAddressDenied  = "address_denied"
+	codeUnknownAddress = "unknown_address"
+	codeBadOrigin      = "bad_origin"
+	codeBadHandshake   = "bad_handshake"
+	codeInternalError  = "internal_error"
+	codeUnauthorized   = "unauthorized"
+	codeInvalidConfig  = "invalid_config"
+	codeNotFound       = "not_found"
+	codeBadRequest     = "bad_request"
+	codeBanned         = "banned"
+	codeRateLimited    = "rate_limited"
+	codeShuttingDown   = "shutting_down"
+	codeTooManyConns   = "too_many_connections"
+	codeTooBig         = "message_too_big"
+)
+
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"`
+}
+
+// writeError rejects a request. A retryAfter of zero means that the request
+// should not be retried as is.
+func writeError(w http.ResponseWriter, status int, code, message string, retryAfter time.Duration) {
+	writeErrorDetail(w, status, errorDetail{Code: code, Message: message}, retryAfter)
+}
+
+func writeErrorDetail(w http.ResponseWriter, status int, detail errorDetail, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		// Retry-After is in whole seconds, so round up rather than telling the
+		// client to come back before it's any use.
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{detail})
+}
+
+// upgradeError is used as the Upgrader's Error, for when the request doesn't
+// make it through the WebSocket handshake itself.
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	code := codeBadHandshake
+	switch status {
+	case http.StatusForbidden:
+		code = codeBadOrigin
+	case http.StatusInternalServerError:
+		code = codeInternalError
+	}
+	writeError(w, status, code, reason.Error(), 0)
+}
@@ -0,0 +1,542 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sync/errgroup"
+)
+
+// The hub is what lets clients talk to each other, rather than just to the
+// server: every message broadcast through it goes out to every client in it,
+// or, if it's broadcast to a room, to every client that has joined the room.
+// Rooms exist for as long as they have anyone in them. A broadcast can also
+// pick out its clients by their labels; see labels.go.
+//
+// Broadcasts go through a single goroutine, one at a time, so that every
+// client gets them in the same order, though a big one is queued for its
+// clients by several goroutines at once; see fanout.go. Each one is only
+// queued for the clients, so none of them waits for any client to be written
+// to. A client whose queue is full is never waited for either: what happens
+// to it is up to the overflow policy, and a client that gets closed for it
+// leaves the hub.
+//
+// With a bus, broadcasts are relayed through every instance of the hub; see
+// bus.go.
+
+var chatRooms = expvar.NewInt("chat_rooms")
+
+// maxRoomsPerClient keeps a client from using up the server's memory by
+// joining rooms without end.
+const maxRoomsPerClient = 32
+
+var (
+	errNotInHub     = errors.New("client isn't in the hub")
+	errTooManyRooms = fmt.Errorf("can't be in more than %d rooms", maxRoomsPerClient)
+	errNotEncoded   = errors.New("the payload couldn't be encoded with the codec")
+)
+
+type broadcastMessage struct {
+	// The room to broadcast to, or "" for every client.
+	room        string
+	messageType int
+	data        []byte
+	// Or an envelope, encoded for each client with its own codec.
+	envelope *outgoing
+	// A client not to send it to, if any.
+	except *client
+	// Only the clients with every one of these labels, if there are any; see
+	// labels.go.
+	selector map[string]string
+	// Whether to keep the envelope in the room's history, if the hub has one.
+	kept bool
+	// How long it's worth sending, from when it goes out, or 0 for as long
+	// as it takes; see ttl.go.
+	ttl time.Duration
+}
+
+// outgoing is an envelope to broadcast, with its payload already encoded by
+// every codec, by name. A codec that can't encode the payload is missing, and
+// its clients don't get the envelope.
+type outgoing struct {
+	typ      string
+	payloads map[string][]byte
+	// When it expires, if it does, set as it goes out.
+	expires time.Time
+}
+
+func newOutgoing(typ string, payload interface{}) *outgoing {
+	o := &outgoing{typ: typ, payloads: map[string][]byte{}}
+	for _, c := range codecs {
+		if data, err := c.encodePayload(payload); err == nil {
+			o.payloads[c.name()] = data
+		}
+	}
+	return o
+}
+
+// encodeFor gives the message for the envelope, in the codec.
+func (o *outgoing) encodeFor(c codec, seq uint64) encoded {
+	payload, ok := o.payloads[c.name()]
+	if !ok {
+		return encoded{err: errNotEncoded}
+	}
+	var e encoded
+	e.messageType, e.data, e.err = c.encode(o.typ, seq, payload)
+	return e
+}
+
+// encoded is a message encoded with a codec, or the error encoding it.
+type encoded struct {
+	messageType int
+	data        []byte
+	err         error
+}
+
+type hub struct {
+	broadcasts chan broadcastMessage
+	// Closed once the hub has stopped.
+	done chan struct{}
+	// Carries broadcasts to and from the other instances of the hub, or nil
+	// when there's just this one. Set before the hub is run.
+	bus bus
+
+	mut sync.Mutex
+	// Every client, with the rooms it's in.
+	clients map[*client]map[string]struct{}
+	// Every room, with the clients in it. None is ever empty.
+	rooms map[string]map[*client]struct{}
+	// The names of the members of every room where any of them have one, by
+	// the name in lower case, and the name of each client in each of its
+	// rooms where it has one. See names.go.
+	names map[string]map[string]*client
+	nicks map[*client]map[string]string
+	// What to do with a name that's already taken in the room. Set before
+	// the hub is run.
+	conflicts nameConflicts
+	// Who's typing in which room, and how often the others in it are told,
+	// and for how long they're typing once they've said so, or zero for no
+	// typing indicators. The two durations are set before the hub is run.
+	// See typing.go.
+	typists        map[typingKey]*typingState
+	typingInterval time.Duration
+	typingTimeout  time.Duration
+	// The direct messages sent through the hub, with how far each has got.
+	// See receipts.go.
+	receipts *receiptBook
+	// Holds direct messages for users who aren't connected, or nil. Set
+	// before the hub is run. See mailbox.go.
+	mailbox *mailbox
+	// The clients of the hub's feeds, which get every broadcast, to every
+	// room, but are in none of them.
+	listeners map[*client]struct{}
+
+	// Whether to tell the members of a room who joins and leaves it. Set
+	// before the hub is run.
+	presence bool
+	// Keeps the recent envelopes broadcast to each room, or nil. Set before
+	// the hub is run.
+	history history
+	// Keeps the sessions of clients that drop off for a moment, or nil when
+	// they aren't kept. Set before the hub is run.
+	sessions *sessionStore
+	// The rate of each room's bucket of bytes, when rooms are throttled. Set
+	// before the hub is run.
+	roomRate writeRate
+	// The bucket of every room that has one, which it has for as long as
+	// anyone is in it.
+	roomBuckets map[string]*byteBucket
+	// The limits of each room, or nil. Set before the hub is run. See
+	// roomlimits.go.
+	roomLimits *roomPolicy
+	// The bucket of messages from its members of every room with a rate,
+	// which it has for as long as anyone is in it.
+	roomInbound map[string]roomInbound
+	// How many goroutines a broadcast can be queued by at once. Set before
+	// the hub is run.
+	workers int
+	// The labels of every client that has any, the clients with each label,
+	// and the keys clients can set, which are set before the hub is run. See
+	// labels.go.
+	labels    map[*client]map[string]string
+	labelled  map[labelPair]map[*client]struct{}
+	labelKeys map[string]bool
+	// The slash commands of the hub's clients on /chat, by name. See
+	// commands.go.
+	commands map[string]chatCommand
+}
+
+func newHub() *hub {
+	return &hub{
+		broadcasts: make(chan broadcastMessage),
+		done:       make(chan struct{}),
+		clients:    map[*client]map[string]struct{}{},
+		rooms:      map[string]map[*client]struct{}{},
+		listeners:  map[*client]struct{}{},
+		names:      map[string]map[string]*client{},
+		nicks:      map[*client]map[string]string{},
+		typists:    map[typingKey]*typingState{},
+		receipts:   newReceiptBook(maxDirects),
+
+		roomBuckets: map[string]*byteBucket{},
+		roomInbound: map[string]roomInbound{},
+		workers:     runtime.NumCPU(),
+		labels:      map[*client]map[string]string{},
+		labelled:    map[labelPair]map[*client]struct{}{},
+		commands:    builtinCommands(),
+	}
+}
+
+func (h *hub) join(c *client) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.clients[c] = map[string]struct{}{}
+	h.claimLabels(c)
+	h.deliverMail(c, time.Now())
+}
+
+// listen has the client sent every broadcast through the hub, until it
+// leaves.
+func (h *hub) listen(c *client) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.listeners[c] = struct{}{}
+}
+
+// leave takes the client out of the hub, and out of every room it's in.
+func (h *hub) leave(c *client) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.remove(c)
+}
+
+func (h *hub) remove(c *client) {
+	for room := range h.clients[c] {
+		h.removeFromRoom(c, room)
+	}
+	delete(h.clients, c)
+	delete(h.listeners, c)
+	h.forgetLabels(c)
+}
+
+// joinRoom puts a client that's in the hub into the room, creating the room
+// if nobody is in it yet. Joining a room twice is the same as joining it once.
+func (h *hub) joinRoom(c *client, room string) error {
+	_, err := h.joinRoomAs(c, room, "")
+	return err
+}
+
+// joinRoomAs is joinRoom, with the client given the name in the room, unless
+// it's "", and gives the name it ends up with; see names.go. A client that's
+// already in the room keeps the name it has.
+func (h *hub) joinRoomAs(c *client, room, name string) (string, error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if err := h.addToRoom(c, room, name); err != nil {
+		return "", err
+	}
+	return h.nameIn(c, room), nil
+}
+
+func (h *hub) addToRoom(c *client, room, name string) error {
+	rooms, ok := h.clients[c]
+	if !ok {
+		return errNotInHub
+	}
+	if _, ok := rooms[room]; ok {
+		return nil
+	}
+	if len(rooms) >= maxRoomsPerClient {
+		return errTooManyRooms
+	}
+	if h.roomFull(room) {
+		roomLimited.Add(codeRoomFull, 1)
+		return errRoomFull
+	}
+	if name != "" {
+		if _, err := h.claimName(c, room, name); err != nil {
+			return err
+		}
+	}
+	members, ok := h.rooms[room]
+	if !ok {
+		members = map[*client]struct{}{}
+		h.rooms[room] = members
+		chatRooms.Add(1)
+	}
+	members[c] = struct{}{}
+	rooms[room] = struct{}{}
+	h.announce(c, room, "presence.joined")
+	return nil
+}
+
+// resume puts the client into the room, as joinRoom does, and queues the
+// envelopes broadcast to it after the sequence number for the client, ahead
+// of anything broadcast to it later. It reports whether those were all of
+// them; without a history, they never are.
+func (h *hub) resume(c *client, room string, after uint64) (bool, error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if err := h.addToRoom(c, room, ""); err != nil {
+		return false, err
+	}
+	if h.history == nil {
+		return false, nil
+	}
+	kept, complete := h.history.since(room, after)
+	bucket := h.roomBucket(room)
+	now := time.Now()
+	for _, k := range kept {
+		if expired(k.envelope.expires, now) {
+			continue
+		}
+		e := k.envelope.encodeFor(c.codec, k.seq)
+		if e.err != nil {
+			continue
+		}
+		if err := c.writeBroadcast(e.messageType, e.data, bucket, k.envelope.expires); err != nil {
+			h.remove(c)
+			return false, err
+		}
+	}
+	return complete, nil
+}
+
+// leaveRoom takes the client out of the room, and reports whether it was in
+// it. The last client to leave a room removes it.
+func (h *hub) leaveRoom(c *client, room string) bool {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if _, ok := h.clients[c][room]; !ok {
+		return false
+	}
+	h.removeFromRoom(c, room)
+	return true
+}
+
+// roomsOf gives the rooms the client is in, in order.
+func (h *hub) roomsOf(c *client) []string {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	rooms := make([]string, 0, len(h.clients[c]))
+	for room := range h.clients[c] {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+func (h *hub) removeFromRoom(c *client, room string) {
+	delete(h.clients[c], room)
+	members := h.rooms[room]
+	delete(members, c)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+		delete(h.roomBuckets, room)
+		delete(h.roomInbound, room)
+		chatRooms.Add(-1)
+	} else {
+		h.announce(c, room, "presence.left")
+	}
+	h.releaseName(c, room)
+	h.forgetTyping(c, room)
+}
+
+func (h *hub) inRoom(c *client, room string) bool {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	_, ok := h.clients[c][room]
+	return ok
+}
+
+// broadcast sends the message to every client, including the one that sent
+// it, if it came from one.
+func (h *hub) broadcast(ctx context.Context, messageType int, data []byte) {
+	h.broadcastToRoom(ctx, "", messageType, data)
+}
+
+// broadcastToRoom sends the message to every client in the room, as of when
+// the broadcast goes out. A room that nobody is in by then gets nothing.
+func (h *hub) broadcastToRoom(ctx context.Context, room string, messageType int, data []byte) {
+	h.send(ctx, broadcastMessage{room: room, messageType: messageType, data: data})
+}
+
+// broadcastEnvelope broadcasts an envelope to every client in the room, with
+// each client's own codec, and keeps it in the room's history, for the TTL if
+// it's given one.
+func (h *hub) broadcastEnvelope(ctx context.Context, room, typ string, payload interface{}, ttl time.Duration) {
+	h.send(ctx, broadcastMessage{room: room, envelope: newOutgoing(typ, payload), kept: true, ttl: ttl})
+}
+
+// send publishes the broadcast on the bus, if there is one, or hands it to
+// the hub's goroutine to send out.
+func (h *hub) send(ctx context.Context, m broadcastMessage) {
+	if h.bus != nil {
+		err := h.bus.publish(ctx, toBusMessage(m))
+		if err == nil {
+			return
+		}
+		slog.Warn("Failed to publish a broadcast, sending it to local clients only", "room", m.room, "error", err)
+		busMessages.Add("publish_failures", 1)
+	}
+	select {
+	case h.broadcasts <- m:
+	case <-ctx.Done():
+	case <-h.done:
+	}
+}
+
+// run sends out the broadcasts until ctx is done, and then stops the hub.
+// It also stops the typing of those who have stopped, when there are typing
+// indicators, and drops expired mail, when there are mailboxes.
+func (h *hub) run(ctx context.Context) {
+	defer close(h.done)
+	var ticks <-chan time.Time
+	if h.typingTimeout > 0 {
+		ticker := time.NewTicker(typingTick)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	var mailTicks <-chan time.Time
+	if h.mailbox != nil {
+		ticker := time.NewTicker(mailboxTick)
+		defer ticker.Stop()
+		mailTicks = ticker.C
+	}
+	if h.bus != nil {
+		go h.bus.subscribe(ctx, func(bm busMessage) {
+			select {
+			case h.broadcasts <- fromBusMessage(bm):
+			case <-ctx.Done():
+			}
+		})
+	}
+	for {
+		select {
+		case m := <-h.broadcasts:
+			h.mut.Lock()
+			h.deliver(m)
+			h.mut.Unlock()
+		case now := <-ticks:
+			h.mut.Lock()
+			h.expireTyping(now)
+			h.mut.Unlock()
+		case now := <-mailTicks:
+			h.mut.Lock()
+			h.expireMail(now)
+			h.mut.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watch closes the client, in g, once the hub has stopped, since it can't be
+// served without the hub.
+func (h *hub) watch(ctx context.Context, g *errgroup.Group, c *client) {
+	g.Go(func() error {
+		select {
+		case <-h.done:
+			c.close(ctx, websocket.CloseGoingAway, "hub closed")
+			return errHubClosed
+		case <-ctx.Done():
+			return nil
+		}
+	})
+}
+
+// deliver queues the message for everyone it's for. h.mut must be held, and
+// is held for every broadcast, so that they all go out in the same order.
+func (h *hub) deliver(m broadcastMessage) {
+	expires := expiry(m.ttl, time.Now())
+	if m.envelope != nil {
+		m.envelope.expires = expires
+	}
+	var seq uint64
+	if m.kept && m.room != "" && h.history != nil {
+		seq = h.history.add(m.room, m.envelope)
+	}
+	bucket := h.roomBucket(m.room)
+	sender := func() func(c *client) error {
+		// The envelope is only encoded once for each codec, by each worker.
+		byCodec := map[codec]encoded{}
+		return func(c *client) error {
+			if c == m.except {
+				return nil
+			}
+			messageType, data := m.messageType, m.data
+			if m.envelope != nil {
+				e, ok := byCodec[c.codec]
+				if !ok {
+					e = m.envelope.encodeFor(c.codec, seq)
+					byCodec[c.codec] = e
+				}
+				if e.err != nil {
+					return nil
+				}
+				messageType, data = e.messageType, e.data
+			}
+			return c.writeBroadcast(messageType, data, bucket, expires)
+		}
+	}
+	for _, c := range h.fanOut(h.recipients(m.room, m.selector), sender) {
+		// Its reader will notice, and leave the hub, but there's no point
+		// sending it anything else in the meantime.
+		h.remove(c)
+	}
+}
+
+// roomBucket gives the room's bucket, or nil for a broadcast to everyone, or
+// when rooms aren't throttled. h.mut must be held.
+func (h *hub) roomBucket(room string) *byteBucket {
+	if room == "" || h.roomRate.rate <= 0 {
+		return nil
+	}
+	// A room nobody is in gets no bucket, since there's nobody to write to.
+	if _, ok := h.rooms[room]; !ok {
+		return nil
+	}
+	b, ok := h.roomBuckets[room]
+	if !ok {
+		b = h.roomRate.bucket()
+		h.roomBuckets[room] = b
+	}
+	return b
+}
+
+// recipients lists who a broadcast to the room, and to the clients with the
+// selector's labels, if it has any, goes to, which always includes the
+// listeners. It's a copy, since sending to them can take them out of the
+// room.
+func (h *hub) recipients(room string, selector map[string]string) []*client {
+	var clients []*client
+	for c := range h.listeners {
+		clients = append(clients, c)
+	}
+	if len(selector) > 0 {
+		for _, c := range h.matching(selector) {
+			if _, ok := h.clients[c][room]; room == "" || ok {
+				clients = append(clients, c)
+			}
+		}
+		return clients
+	}
+	if room == "" {
+		for c := range h.clients {
+			clients = append(clients, c)
+		}
+		return clients
+	}
+	for c := range h.rooms[room] {
+		clients = append(clients, c)
+	}
+	return clients
+}
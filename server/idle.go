@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Keepalive only tells whether the other host is still there, and a client
+// that answers every ping can hold on to its connection forever without ever
+// using it. An idle client is one that's there, but hasn't sent any message of
+// its own (pongs don't count) for the idle timeout. On every endpoint, it's
+// closed with 1000 (normal closure) and the reason "idle timeout", however
+// well the keepalive is going.
+//
+// On the endpoints whose clients understand it, the client is warned first,
+// with
+//
+//	{"type":"idle_warning","disconnect_in_ms":30000}
+//
+// and it's only closed if it still hasn't sent anything by the end of the
+// grace period, with 4000 and the reason "idle" rather than 1000, as it always
+// has been. Any message it sends in the meantime takes it back to not being
+// idle at all. A grace period of zero closes it without a warning, with 1000.
+//
+// Rather than have a timer per connection, a single reaper goroutine looks
+// over every idle-tracked connection once every idleTick, so the timeout and
+// the grace period are only as precise as that.
+
+const (
+	idleTick = time.Second
+
+	idleReason = "idle timeout"
+
+	// The close for a client that was warned, and still stayed idle.
+	closeIdle       = 4000
+	closeIdleReason = "idle"
+)
+
+var (
+	errIdle = errors.New("idle for too long")
+
+	idleWarnings = expvar.NewInt("idle_warnings")
+	idleKicks    = expvar.NewInt("idle_kicks")
+)
+
+type idleWarningMessage struct {
+	Type           string `json:"type"`
+	DisconnectInMS int64  `json:"disconnect_in_ms"`
+}
+
+func idleWarning(grace time.Duration) []byte {
+	message, _ := json.Marshal(idleWarningMessage{
+		Type:           "idle_warning",
+		DisconnectInMS: grace.Milliseconds(),
+	})
+	return message
+}
+
+// idleConn is the idle state of a single connection. Times are in Unix
+// nanoseconds, and warnedAt is zero when the connection hasn't been warned.
+type idleConn struct {
+	c          *client
+	now        func() time.Time
+	lastActive int64
+	warnedAt   int64
+	kicked     int32
+	// Set when the client is to be warned before it's closed.
+	warns int32
+}
+
+// warnFirst has the client warned before it's closed.
+func (c *idleConn) warnFirst() {
+	atomic.StoreInt32(&c.warns, 1)
+}
+
+// touch records that the client sent a message.
+func (c *idleConn) touch() {
+	atomic.StoreInt64(&c.lastActive, c.now().UnixNano())
+	atomic.StoreInt64(&c.warnedAt, 0)
+}
+
+// readError turns the read error into errIdle when the reaper is what closed
+// the connection.
+func (c *idleConn) readError(err error) error {
+	if atomic.LoadInt32(&c.kicked) == 1 {
+		return errIdle
+	}
+	return err
+}
+
+type idleReaper struct {
+	timeout time.Duration
+	grace   time.Duration
+	// The clock the connections are timed by, which tests replace.
+	now func() time.Time
+
+	mut   sync.Mutex
+	conns map[*idleConn]struct{}
+}
+
+func newIdleReaper(timeout, grace time.Duration) *idleReaper {
+	return &idleReaper{timeout: timeout, grace: grace, now: time.Now, conns: map[*idleConn]struct{}{}}
+}
+
+// watch starts tracking the connection, which counts as active as of now.
+func (r *idleReaper) watch(cl *client) *idleConn {
+	c := &idleConn{c: cl, now: r.now, lastActive: r.now().UnixNano()}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.conns[c] = struct{}{}
+	return c
+}
+
+func (r *idleReaper) unwatch(c *idleConn) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	delete(r.conns, c)
+}
+
+func (r *idleReaper) run(ctx context.Context) {
+	ticker := time.NewTicker(idleTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.check(r.now().UnixNano())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *idleReaper) check(now int64) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	for c := range r.conns {
+		warnedAt := atomic.LoadInt64(&c.warnedAt)
+		switch {
+		case warnedAt == 0:
+			if time.Duration(now-atomic.LoadInt64(&c.lastActive)) < r.timeout {
+				continue
+			}
+			if atomic.LoadInt32(&c.warns) == 0 || r.grace <= 0 {
+				r.kick(c, websocket.CloseNormalClosure, idleReason)
+				continue
+			}
+			// A message that shows up in between still cancels the warning,
+			// since touch clears warnedAt after setting lastActive.
+			if !atomic.CompareAndSwapInt64(&c.warnedAt, 0, now) {
+				continue
+			}
+			idleWarnings.Add(1)
+			// A client with a full queue isn't idle, just slow to read, and
+			// will get it next time round.
+			if !c.c.tryWrite(websocket.TextMessage, idleWarning(r.grace)) {
+				atomic.StoreInt64(&c.warnedAt, 0)
+			}
+		case time.Duration(now-warnedAt) >= r.grace:
+			r.kick(c, closeIdle, closeIdleReason)
+		}
+	}
+}
+
+// kick closes the connection for being idle, with the code and reason. r.mut
+// must be held.
+func (r *idleReaper) kick(c *idleConn, code int, reason string) {
+	delete(r.conns, c)
+	atomic.StoreInt32(&c.kicked, 1)
+	idleKicks.Add(1)
+	c.c.log.Info("Closing idle connection", "idle", r.now().Sub(time.Unix(0, atomic.LoadInt64(&c.lastActive))).Round(time.Second))
+	go c.c.t.Close(code, reason)
+}
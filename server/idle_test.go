@@ -0,0 +1,149 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIdleReaper(t *testing.T) {
+	const (
+		timeout = time.Minute
+		grace   = 30 * time.Second
+	)
+	// What to do at a point in time, and what the client should have been
+	// sent and closed with by then, or zero if it's still open.
+	type step struct {
+		at       time.Duration
+		touch    bool
+		warnings int
+		code     int
+	}
+	tests := []struct {
+		name  string
+		grace time.Duration
+		warns bool
+		// Fill the client's queue, so that the warning can't be queued, until
+		// it's drained at drainAt.
+		full    bool
+		drainAt time.Duration
+		steps   []step
+	}{
+		{
+			name:  "closed without a warning",
+			grace: grace,
+			steps: []step{
+				{at: timeout - time.Second},
+				{at: timeout, code: websocket.CloseNormalClosure},
+			},
+		},
+		{
+			name:  "warned, then closed",
+			grace: grace,
+			warns: true,
+			steps: []step{
+				{at: timeout - time.Second},
+				{at: timeout, warnings: 1},
+				{at: timeout + grace - time.Second, warnings: 1},
+				{at: timeout + grace, warnings: 1, code: closeIdle},
+			},
+		},
+		{
+			name:  "no grace period",
+			warns: true,
+			steps: []step{
+				{at: timeout, code: websocket.CloseNormalClosure},
+			},
+		},
+		{
+			name:  "active before the timeout",
+			grace: grace,
+			warns: true,
+			steps: []step{
+				{at: timeout / 2, touch: true},
+				{at: timeout},
+				{at: timeout/2 + timeout, warnings: 1},
+			},
+		},
+		{
+			name:  "active after the warning",
+			grace: grace,
+			warns: true,
+			steps: []step{
+				{at: timeout, warnings: 1},
+				{at: timeout + grace/2, touch: true, warnings: 1},
+				{at: timeout + grace, warnings: 1},
+				{at: timeout + grace/2 + timeout, warnings: 2},
+				{at: timeout + grace/2 + timeout + grace, warnings: 2, code: closeIdle},
+			},
+		},
+		{
+			name:    "queue full at the timeout",
+			grace:   grace,
+			warns:   true,
+			full:    true,
+			drainAt: timeout + grace,
+			steps: []step{
+				{at: timeout},
+				// And so it wasn't warned, and isn't closed as if it had been.
+				{at: timeout + grace, warnings: 1},
+				{at: timeout + 2*grace, warnings: 1, code: closeIdle},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Unix(1700000000, 0)
+			now := start
+			r := newIdleReaper(timeout, tt.grace)
+			r.now = func() time.Time { return now }
+
+			ft := newFakeTransport()
+			cl := newClient(ft, "", sendQueue{size: 1}, messageRate{})
+			cl.log = slog.New(slog.NewTextHandler(io.Discard, nil))
+			c := r.watch(cl)
+			if tt.warns {
+				c.warnFirst()
+			}
+			if tt.full {
+				cl.write(websocket.TextMessage, []byte("filler"))
+			}
+
+			warnings := 0
+			for _, s := range tt.steps {
+				now = start.Add(s.at)
+				if s.touch {
+					c.touch()
+				}
+				if tt.full && s.at >= tt.drainAt {
+					cl.pop()
+					tt.full = false
+				}
+				r.check(now.UnixNano())
+				for !tt.full {
+					m, ok := cl.pop()
+					if !ok {
+						break
+					}
+					if string(m.data) == string(idleWarning(tt.grace)) {
+						warnings++
+					}
+				}
+				if warnings != s.warnings {
+					t.Fatalf("at %s: %d warnings, want %d", s.at, warnings, s.warnings)
+				}
+				wait := 10 * time.Millisecond
+				if s.code != 0 {
+					wait = 5 * time.Second
+				}
+				code, _, closed := ft.closedWith(wait)
+				if closed != (s.code != 0) || code != s.code {
+					t.Fatalf("at %s: closed %t with %d, want %d", s.at, closed, code, s.code)
+				}
+			}
+		})
+	}
+}
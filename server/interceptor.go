@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"sync"
+)
+
+// Whatever has to be done to every message on every endpoint, such as
+// redacting it, stamping it with the time, or turning away what it mustn't
+// contain, can be done by interceptors, given to New with
+// WithInboundInterceptor and WithOutboundInterceptor. Each one is given the
+// message, and gives back the message to carry on with, which it can change,
+// or replace, or nil to drop it without a word:
+//
+//	func redactEmails(conn *server.Connection, m *server.Message) (*server.Message, error) {
+//		if m.Type == websocket.TextMessage {
+//			m.Data = emailAddress.ReplaceAll(m.Data, []byte("[redacted]"))
+//		}
+//		return m, nil
+//	}
+//
+// They run in the order they're given, each on what the one before gave back,
+// until one of them drops the message, or fails. An inbound message that an
+// interceptor fails on isn't handled, and the client is sent
+//
+//	{"type":"error","payload":{"code":"message_rejected","message":"..."}}
+//
+// with the error's text, and the connection carries on. An outbound message
+// that one fails on isn't written. Either way, it's counted under
+// intercepted_messages, as inbound_rejected or outbound_dropped.
+//
+// Inbound interceptors run on the connection's reader, once a message has
+// been read and let through by the message rate, and before the endpoint sees
+// it. Outbound ones run on its write pump, just before each message is
+// written, so nothing is intercepted for a client that it never gets. The
+// Connection's Context is done once the connection is. Streamed messages, as
+// on /echo and /upload, are never held whole, so they aren't intercepted;
+// neither are pings or close frames.
+//
+// The data of a broadcast is shared between everyone it's written to, so an
+// outbound interceptor that changes it has to give the Message new data,
+// rather than change the bytes in place. Interceptors that only look, such as
+// one that counts messages as messages_in and messages_out are counted, or
+// that logs them, are enough to do what the metrics and the frame tracer do.
+
+var interceptedMessages = expvar.NewMap("intercepted_messages")
+
+const codeRejected = "message_rejected"
+
+// Message is a whole message on a connection, as an interceptor sees it.
+type Message struct {
+	// websocket.TextMessage or websocket.BinaryMessage.
+	Type int
+	Data []byte
+}
+
+// Connection is the connection a message is on, for an interceptor, or a
+// connection to serve, for a handler; see typed.go.
+type Connection struct {
+	ConnInfo
+	ctx    context.Context
+	client *client
+	// The messages the client sends, from the one goroutine that reads
+	// them, once it's started, and the error it stopped with.
+	reading  sync.Once
+	incoming chan Message
+	readErr  error
+	// What handlers keep on the connection, and whether it's been dropped,
+	// once the connection is over; see connstate.go.
+	stateMut     sync.Mutex
+	state        map[string]any
+	stateDropped bool
+}
+
+// Context gives the connection's context, which is done once the connection
+// is.
+func (c *Connection) Context() context.Context { return c.ctx }
+
+// An Interceptor is given each message, and gives back the message to carry on
+// with, or nil to drop it. An error drops it too, and is reported as
+// WithInboundInterceptor and WithOutboundInterceptor describe.
+type Interceptor func(conn *Connection, m *Message) (*Message, error)
+
+type interceptorChain []Interceptor
+
+// run has the message through each interceptor in turn, and gives what the
+// last one gave back, or nil and the error of the one that failed.
+func (ch interceptorChain) run(conn *Connection, m *Message) (*Message, error) {
+	for _, intercept := range ch {
+		var err error
+		if m, err = intercept(conn, m); err != nil {
+			return nil, err
+		}
+		if m == nil {
+			return nil, nil
+		}
+	}
+	return m, nil
+}
+
+// connection gives the Connection that interceptors and handlers are given
+// for the client, with ctx as its context.
+func (c *liveConn) connection(ctx context.Context, cl *client) *Connection {
+	return &Connection{ConnInfo: c.info(), ctx: ctx, client: cl}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// mapValue gives the count under the key of an expvar map, or zero if there's
+// nothing counted under it yet.
+func mapValue(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestInterceptorChain(t *testing.T) {
+	upper := func(conn *Connection, m *Message) (*Message, error) {
+		return &Message{m.Type, bytes.ToUpper(m.Data)}, nil
+	}
+	exclaim := func(conn *Connection, m *Message) (*Message, error) {
+		m.Data = append(append([]byte(nil), m.Data...), '!')
+		return m, nil
+	}
+	drop := func(conn *Connection, m *Message) (*Message, error) { return nil, nil }
+	fail := func(conn *Connection, m *Message) (*Message, error) { return nil, errors.New("no") }
+	tests := []struct {
+		name  string
+		chain interceptorChain
+		want  string
+		err   bool
+	}{
+		{"none", nil, "hello", false},
+		{"in order", interceptorChain{upper, exclaim}, "HELLO!", false},
+		{"dropped", interceptorChain{upper, drop, exclaim}, "", false},
+		{"failed", interceptorChain{fail, exclaim}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := tt.chain.run(&Connection{}, &Message{websocket.TextMessage, []byte("hello")})
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want one: %t", err, tt.err)
+			}
+			got := ""
+			if m != nil {
+				got = string(m.Data)
+			}
+			if got != tt.want {
+				t.Fatalf("gave %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	for _, name := range transportNames {
+		t.Run(name, func(t *testing.T) {
+			// Counting what goes through, as the metrics do.
+			var in, out int64
+			count := func(n *int64) Interceptor {
+				return func(conn *Connection, m *Message) (*Message, error) {
+					if conn.Path != "/chat" || conn.Context().Err() != nil {
+						t.Errorf("intercepted on %q, with its context done: %v", conn.Path, conn.Context().Err())
+					}
+					atomic.AddInt64(n, 1)
+					return m, nil
+				}
+			}
+			rejectBanned := func(conn *Connection, m *Message) (*Message, error) {
+				if bytes.Contains(m.Data, []byte("banned")) {
+					return nil, errors.New("that's not allowed")
+				}
+				return m, nil
+			}
+			dropQuiet := func(conn *Connection, m *Message) (*Message, error) {
+				if bytes.HasPrefix(m.Data, []byte("quiet")) {
+					return nil, nil
+				}
+				return m, nil
+			}
+			redact := func(conn *Connection, m *Message) (*Message, error) {
+				return &Message{m.Type, bytes.ReplaceAll(m.Data, []byte("secret"), []byte("[redacted]"))}, nil
+			}
+			hideSeen := func(conn *Connection, m *Message) (*Message, error) {
+				if bytes.Contains(m.Data, []byte("hidden")) {
+					return nil, errors.New("not for clients")
+				}
+				return m, nil
+			}
+			url := testServer(t, WithTransport(name), WithMessageRate(0, 0, "drop"),
+				WithInboundInterceptor(count(&in), rejectBanned, dropQuiet),
+				WithInboundInterceptor(redact),
+				WithOutboundInterceptor(hideSeen, count(&out)))
+			conn, _, err := websocket.DefaultDialer.Dial(url+"/chat", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			next := func() string {
+				t.Helper()
+				for {
+					_, data, err := conn.ReadMessage()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !strings.Contains(string(data), `"session"`) {
+						return string(data)
+					}
+				}
+			}
+			rejected := mapValue(interceptedMessages, "inbound_rejected")
+			dropped := mapValue(interceptedMessages, "outbound_dropped")
+
+			for _, m := range []string{"quiet please", "this is banned", "a secret", "hidden"} {
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(m)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The quiet one is dropped without a word, and the banned one is
+			// answered with an error.
+			if got := next(); !strings.Contains(got, `"code":"message_rejected"`) || !strings.Contains(got, "that's not allowed") {
+				t.Fatalf("got %s, want a message_rejected error", got)
+			}
+			if got := next(); got != "a [redacted]" {
+				t.Fatalf("got %q, want the redacted message", got)
+			}
+			// The hidden one is broadcast, but never written; this one shows it's
+			// been and gone.
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("done")); err != nil {
+				t.Fatal(err)
+			}
+			if got := next(); got != "done" {
+				t.Fatalf("got %q, want done", got)
+			}
+
+			if got := atomic.LoadInt64(&in); got != 5 {
+				t.Fatalf("intercepted %d messages in, want 5", got)
+			}
+			// The session message, the error, and the two broadcasts.
+			if got := atomic.LoadInt64(&out); got != 4 {
+				t.Fatalf("intercepted %d messages out, want 4", got)
+			}
+			if got := mapValue(interceptedMessages, "inbound_rejected") - rejected; got != 1 {
+				t.Fatalf("inbound_rejected went up by %d, want 1", got)
+			}
+			if got := mapValue(interceptedMessages, "outbound_dropped") - dropped; got != 1 {
+				t.Fatalf("outbound_dropped went up by %d, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// IP rules are evaluated before the upgrade even happens, so that clients that
+// aren't supposed to reach us never get to hold a WebSocket connection.
+//
+// The rules themselves are immutable once loaded. Reloading swaps in a whole
+// new set atomically along with the rest of the settings, which means the hot
+// path (every upgrade request) never needs to take a lock.
+
+var ipRejections = expvar.NewMap("ip_rejections")
+
+type ipRule struct {
+	allow  bool
+	prefix netip.Prefix
+}
+
+func (r ipRule) String() string {
+	if r.allow {
+		return "allow " + r.prefix.String()
+	}
+	return "deny " + r.prefix.String()
+}
+
+type ipRules struct {
+	allow []ipRule
+	deny  []ipRule
+}
+
+// check reports whether the address is allowed through. When it isn't, the
+// returned string names the rule responsible for the rejection.
+//
+// Deny entries always win over allow entries. If there are no allow entries
+// at all, then everything not explicitly denied is let through.
+func (rules *ipRules) check(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	for _, rule := range rules.deny {
+		if rule.prefix.Contains(addr) {
+			return rule.String(), false
+		}
+	}
+	if len(rules.allow) == 0 {
+		return "", true
+	}
+	for _, rule := range rules.allow {
+		if rule.prefix.Contains(addr) {
+			return "", true
+		}
+	}
+	return "not allowed", false
+}
+
+// parseIPRule parses a single entry. Both CIDRs and plain addresses are
+// accepted; a plain address is treated as a single-host prefix. IPv4-mapped
+// IPv6 ones are taken as the IPv4 ones they are, since that's how addresses
+// are checked against them.
+func parseIPRule(allow bool, s string) (ipRule, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return ipRule{}, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return ipRule{allow, prefix.Masked()}, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return ipRule{}, err
+	}
+	addr = addr.Unmap()
+	return ipRule{allow, netip.PrefixFrom(addr, addr.BitLen())}, nil
+}
+
+// loadIPRules builds a rule set out of lists of allowed and denied CIDRs, plus
+// an optional file. Each line of the file is either "allow <cidr>" or
+// "deny <cidr>". Blank lines and lines starting with # are ignored.
+func loadIPRules(allow, deny []string, path string) (*ipRules, error) {
+	rules := &ipRules{}
+
+	add := func(allow bool, s string) error {
+		rule, err := parseIPRule(allow, s)
+		if err != nil {
+			return err
+		}
+		if allow {
+			rules.allow = append(rules.allow, rule)
+		} else {
+			rules.deny = append(rules.deny, rule)
+		}
+		return nil
+	}
+
+	for _, s := range allow {
+		if err := add(true, s); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range deny {
+		if err := add(false, s); err != nil {
+			return nil, err
+		}
+	}
+
+	if path == "" {
+		return rules, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+			return nil, fmt.Errorf("%s:%d: expected \"allow <cidr>\" or \"deny <cidr>\"", path, line)
+		}
+		if err := add(fields[0] == "allow", fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
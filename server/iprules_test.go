@@ -0,0 +1,148 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIPRulesCheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		addr        string
+		ok          bool
+		rule        string
+	}{
+		{name: "no rules", addr: "192.0.2.1", ok: true},
+		{name: "no rules, IPv6", addr: "2001:db8::1", ok: true},
+		{name: "allowed", allow: []string{"192.0.2.0/24"}, addr: "192.0.2.1", ok: true},
+		{name: "not allowed", allow: []string{"192.0.2.0/24"}, addr: "198.51.100.1", rule: "not allowed"},
+		{name: "denied", deny: []string{"192.0.2.0/24"}, addr: "192.0.2.1", rule: "deny 192.0.2.0/24"},
+		{name: "not denied", deny: []string{"192.0.2.0/24"}, addr: "198.51.100.1", ok: true},
+		{name: "single address", deny: []string{"192.0.2.7"}, addr: "192.0.2.7", rule: "deny 192.0.2.7/32"},
+		{name: "next to a single address", deny: []string{"192.0.2.7"}, addr: "192.0.2.8", ok: true},
+		{name: "host bits masked", deny: []string{"192.0.2.77/24"}, addr: "192.0.2.1", rule: "deny 192.0.2.0/24"},
+		{name: "IPv6 allowed", allow: []string{"2001:db8::/32"}, addr: "2001:db8:1::1", ok: true},
+		{name: "IPv6 not allowed", allow: []string{"2001:db8::/32"}, addr: "2001:db9::1", rule: "not allowed"},
+		{name: "IPv6 denied", deny: []string{"2001:db8::/32"}, addr: "2001:db8::1", rule: "deny 2001:db8::/32"},
+		{name: "IPv4 rule, IPv6 address", allow: []string{"192.0.2.0/24"}, addr: "2001:db8::1", rule: "not allowed"},
+		{name: "IPv6 rule, IPv4 address", deny: []string{"::/0"}, addr: "192.0.2.1", ok: true},
+		{name: "IPv4-mapped address", deny: []string{"192.0.2.0/24"}, addr: "::ffff:192.0.2.1", rule: "deny 192.0.2.0/24"},
+		{name: "IPv4-mapped rule", deny: []string{"::ffff:192.0.2.0/120"}, addr: "192.0.2.1", rule: "deny 192.0.2.0/24"},
+		{name: "IPv4-mapped single address", allow: []string{"::ffff:192.0.2.7"}, addr: "192.0.2.7", ok: true},
+		// Deny wins over allow, however the two overlap.
+		{name: "deny inside allow", allow: []string{"10.0.0.0/8"}, deny: []string{"10.1.0.0/16"}, addr: "10.1.2.3", rule: "deny 10.1.0.0/16"},
+		{name: "allow next to deny", allow: []string{"10.0.0.0/8"}, deny: []string{"10.1.0.0/16"}, addr: "10.2.0.1", ok: true},
+		{name: "allow inside deny", allow: []string{"10.1.2.0/24"}, deny: []string{"10.0.0.0/8"}, addr: "10.1.2.3", rule: "deny 10.0.0.0/8"},
+		{name: "same prefix both ways", allow: []string{"192.0.2.0/24"}, deny: []string{"192.0.2.0/24"}, addr: "192.0.2.1", rule: "deny 192.0.2.0/24"},
+		{name: "first deny that matches", deny: []string{"10.0.0.0/8", "10.1.0.0/16"}, addr: "10.1.2.3", rule: "deny 10.0.0.0/8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := loadIPRules(tt.allow, tt.deny, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rule, ok := rules.check(netip.MustParseAddr(tt.addr))
+			if ok != tt.ok || rule != tt.rule {
+				t.Fatalf("check(%s) = %q, %t, want %q, %t", tt.addr, rule, ok, tt.rule, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLoadIPRulesFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		allowed []string
+		denied  []string
+		err     string
+	}{
+		{
+			name:    "rules",
+			file:    "# office\nallow 192.0.2.0/24\n\n  deny 192.0.2.13  \nallow 2001:db8::/32\n",
+			allowed: []string{"192.0.2.1", "2001:db8::1"},
+			denied:  []string{"192.0.2.13", "198.51.100.1"},
+		},
+		{name: "unknown action", file: "permit 192.0.2.0/24\n", err: "rules:1: expected"},
+		{name: "missing prefix", file: "allow 192.0.2.0/24\ndeny\n", err: "rules:2: expected"},
+		{name: "extra field", file: "deny 192.0.2.0/24 now\n", err: "rules:1: expected"},
+		{name: "bad prefix", file: "\ndeny 192.0.2.0/33\n", err: "rules:2:"},
+		{name: "bad address", file: "allow 192.0.2\n", err: "rules:1:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules")
+			if err := os.WriteFile(path, []byte(tt.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+			rules, err := loadIPRules(nil, nil, path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("loadIPRules() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, addr := range tt.allowed {
+				if _, ok := rules.check(netip.MustParseAddr(addr)); !ok {
+					t.Errorf("%s denied, want allowed", addr)
+				}
+			}
+			for _, addr := range tt.denied {
+				if _, ok := rules.check(netip.MustParseAddr(addr)); ok {
+					t.Errorf("%s allowed, want denied", addr)
+				}
+			}
+		})
+	}
+}
+
+func TestUpgradeIPRules(t *testing.T) {
+	// The test server's peers are all 127.0.0.1, which is the proxy when
+	// there is one.
+	tests := []struct {
+		name           string
+		deny           []string
+		trustedProxies []string
+		forwardedFor   string
+		status         int
+	}{
+		{name: "unproxied", deny: []string{"203.0.113.0/24"}, status: http.StatusSwitchingProtocols},
+		{name: "unproxied peer denied", deny: []string{"127.0.0.1"}, status: http.StatusForbidden},
+		{name: "unproxied, forwarding ignored", deny: []string{"203.0.113.0/24"}, forwardedFor: "203.0.113.5", status: http.StatusSwitchingProtocols},
+		{name: "unproxied peer denied, forwarding ignored", deny: []string{"127.0.0.1"}, forwardedFor: "198.51.100.1", status: http.StatusForbidden},
+		{name: "proxied client denied", deny: []string{"203.0.113.0/24"}, trustedProxies: []string{"127.0.0.1"}, forwardedFor: "203.0.113.5", status: http.StatusForbidden},
+		{name: "proxied client allowed", deny: []string{"203.0.113.0/24"}, trustedProxies: []string{"127.0.0.1"}, forwardedFor: "198.51.100.1", status: http.StatusSwitchingProtocols},
+		{name: "proxy itself denied", deny: []string{"127.0.0.1"}, trustedProxies: []string{"127.0.0.1"}, forwardedFor: "198.51.100.1", status: http.StatusSwitchingProtocols},
+		{name: "proxied IPv6 client denied", deny: []string{"2001:db8::/32"}, trustedProxies: []string{"127.0.0.1"}, forwardedFor: "2001:db8::5", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := testServer(t, WithIPRules(nil, tt.deny, ""), WithTrustedProxies(tt.trustedProxies))
+			header := http.Header{}
+			if tt.forwardedFor != "" {
+				header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			conn, resp, err := websocket.DefaultDialer.Dial(url+"/ws", header)
+			if err == nil {
+				conn.Close()
+			}
+			if resp == nil {
+				t.Fatalf("dial: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Clients get a say in how often they are pinged. Mobile clients would rather
+// not have their radio woken up every minute, and latency-sensitive clients
+// want to notice a dead connection sooner. So a client can send
+//
+//	{"type":"configure","ping_interval_ms":120000}
+//
+// at any point (though ideally as its first frame), and the server clamps the
+// interval to its own bounds, and answers with what it's actually going to use:
+//
+//	{"type":"configured","ping_interval_ms":120000,"pong_wait_ms":133333}
+//
+// The pong wait keeps the same proportion to the ping interval as it does for
+// clients that don't ask, which are pinged every nine tenths of the server's
+// pong wait.
+
+type keepalive struct {
+	pingInterval time.Duration
+	pongWait     time.Duration
+}
+
+func keepaliveFor(pingInterval time.Duration) keepalive {
+	return keepalive{pingInterval, pingInterval * 10 / 9}
+}
+
+type keepaliveBounds struct {
+	min time.Duration
+	max time.Duration
+}
+
+func (b keepaliveBounds) clamp(d time.Duration) time.Duration {
+	if d < b.min {
+		return b.min
+	}
+	if d > b.max {
+		return b.max
+	}
+	return d
+}
+
+type configureMessage struct {
+	Type           string `json:"type"`
+	PingIntervalMS int64  `json:"ping_interval_ms"`
+}
+
+type configuredMessage struct {
+	Type           string `json:"type"`
+	PingIntervalMS int64  `json:"ping_interval_ms"`
+	PongWaitMS     int64  `json:"pong_wait_ms"`
+}
+
+// parseConfigure tells whether the message is a configure message, and if so,
+// gives the keepalive that the client should get.
+func parseConfigure(message []byte, bounds keepaliveBounds) (keepalive, bool) {
+	var configure configureMessage
+	if err := json.Unmarshal(message, &configure); err != nil || configure.Type != "configure" {
+		return keepalive{}, false
+	}
+	// Clamped as milliseconds first, since the client's interval can be big
+	// enough to overflow as a Duration.
+	ms := configure.PingIntervalMS
+	if min := bounds.min.Milliseconds(); ms < min {
+		ms = min
+	}
+	if max := bounds.max.Milliseconds(); ms > max {
+		ms = max
+	}
+	return keepaliveFor(bounds.clamp(time.Duration(ms) * time.Millisecond)), true
+}
+
+func configuredReply(ka keepalive) []byte {
+	reply, _ := json.Marshal(configuredMessage{
+		Type:           "configured",
+		PingIntervalMS: ka.pingInterval.Milliseconds(),
+		PongWaitMS:     ka.pongWait.Milliseconds(),
+	})
+	return reply
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseConfigure(t *testing.T) {
+	bounds := keepaliveBounds{min: 10 * time.Second, max: 5 * time.Minute}
+	tests := []struct {
+		ms   int64
+		want time.Duration
+	}{
+		{120000, 2 * time.Minute},
+		{1, bounds.min},
+		{0, bounds.min},
+		{3600000, bounds.max},
+		// Too big or too small to be a Duration in nanoseconds, which used to
+		// wrap around before being clamped.
+		{math.MaxInt64, bounds.max},
+		{math.MaxInt64 / 1000, bounds.max},
+		{math.MinInt64, bounds.min},
+		{-math.MaxInt64 / 1000, bounds.min},
+	}
+	for _, tt := range tests {
+		ka, ok := parseConfigure([]byte(fmt.Sprintf(`{"type":"configure","ping_interval_ms":%d}`, tt.ms)), bounds)
+		if !ok {
+			t.Fatalf("%d: not a configure message", tt.ms)
+		}
+		if ka.pingInterval != tt.want {
+			t.Fatalf("%d: ping interval %s, want %s", tt.ms, ka.pingInterval, tt.want)
+		}
+	}
+	if _, ok := parseConfigure([]byte(`{"type":"chat"}`), bounds); ok {
+		t.Fatal("took a chat message as a configure message")
+	}
+}
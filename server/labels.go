@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Rooms are only one way to pick who a broadcast goes to. A client of a hub
+// can also have labels, such as region=eu and tier=pro, and a broadcast can go
+// to the clients with all of a selector's labels, in whichever rooms they
+// are. A client starts with those in the labels claim of its JWT, an object
+// of strings, and can set more, or change them, as it goes, on /api with
+//
+//	{"type":"label","payload":{"labels":{"region":"eu","tier":"pro"}}}
+//
+// and on /chat with
+//
+//	{"action":"label","labels":{"region":"eu","tier":"pro"}}
+//
+// A label with an empty value is taken off. Either is answered with every
+// label the client has, as a labels envelope with the same payload, or on
+// /chat, {"type":"labels","labels":{...}}. Only the keys in -label-keys can be
+// set, either way: a label with any other is turned away with
+// label_not_allowed, or, in a claim, left off. A client can have up to 16
+// labels, with keys and values of up to 64 bytes. A resumed session keeps the
+// labels it had.
+//
+// Hub.BroadcastSelector, and POST /admin/broadcast with a "selector" object
+// as well as the announcement, send to the clients with every one of the
+// selector's labels, and, as ever, to the feeds. The hub keeps the clients
+// with each label, as they're set, changed and taken off, and as clients
+// leave, so matching a selector is intersecting its labels' sets, from the
+// smallest, rather than looking through every client. A selector matching
+// nobody sends nothing. With a bus, the selector goes along with the
+// broadcast, and every instance matches it against its own clients.
+
+const (
+	codeBadLabel        = "bad_label"
+	codeLabelNotAllowed = "label_not_allowed"
+)
+
+const (
+	maxLabelsPerClient = 16
+	// In bytes.
+	maxLabelLength = 64
+)
+
+var (
+	errBadLabel        = fmt.Errorf("label keys must be 1 to %d bytes of UTF-8, and values up to %d", maxLabelLength, maxLabelLength)
+	errTooManyLabels   = fmt.Errorf("can't have more than %d labels", maxLabelsPerClient)
+	errLabelNotAllowed = errors.New("the label can't be set")
+	errBadSelector     = errors.New("a selector's labels need a key and a value")
+)
+
+// labelPair is one label, which the hub keeps the clients with.
+type labelPair struct {
+	key, value string
+}
+
+// labelEntry is one label on the wire. A labelList of them is an object of
+// the keys and values in JSON, and the entries of a map<string, string> in
+// protobuf.
+type labelEntry struct {
+	Key   string `pb:"1"`
+	Value string `pb:"2"`
+}
+
+type labelList []labelEntry
+
+func listLabels(labels map[string]string) labelList {
+	l := make(labelList, 0, len(labels))
+	for k, v := range labels {
+		l = append(l, labelEntry{k, v})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Key < l[j].Key })
+	return l
+}
+
+func (l labelList) labels() map[string]string {
+	labels := make(map[string]string, len(l))
+	for _, e := range l {
+		labels[e.Key] = e.Value
+	}
+	return labels
+}
+
+func (l labelList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.labels())
+}
+
+func (l *labelList) UnmarshalJSON(data []byte) error {
+	var labels map[string]string
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return err
+	}
+	*l = listLabels(labels)
+	return nil
+}
+
+// labelsPayload is the payload of label, and of the labels that answers it.
+type labelsPayload struct {
+	Labels labelList `json:"labels" pb:"1"`
+}
+
+// checkLabelKey tells what's wrong with the key, if anything.
+func checkLabelKey(key string) error {
+	if key == "" || len(key) > maxLabelLength || !utf8.ValidString(key) {
+		return errBadLabel
+	}
+	return nil
+}
+
+// setLabels sets the client's labels, taking off those with an empty value,
+// and gives every label it ends up with. If any of them can't be set, none
+// of them are.
+func (h *hub) setLabels(c *client, labels map[string]string) (map[string]string, error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if _, ok := h.clients[c]; !ok {
+		return nil, errNotInHub
+	}
+	if err := h.checkLabels(c, labels); err != nil {
+		return nil, err
+	}
+	for k, v := range labels {
+		h.label(c, k, v)
+	}
+	all := map[string]string{}
+	maps.Copy(all, h.labels[c])
+	return all, nil
+}
+
+// checkLabels tells what's wrong with setting the labels on the client, on
+// top of those it has, if anything. h.mut must be held.
+func (h *hub) checkLabels(c *client, labels map[string]string) error {
+	has := h.labels[c]
+	n := len(has)
+	for k, v := range labels {
+		if checkLabelKey(k) != nil || len(v) > maxLabelLength || !utf8.ValidString(v) {
+			return errBadLabel
+		}
+		if !h.labelKeys[k] {
+			return fmt.Errorf("%w: %q", errLabelNotAllowed, k)
+		}
+		if _, ok := has[k]; ok && v == "" {
+			n--
+		} else if !ok && v != "" {
+			n++
+		}
+	}
+	if n > maxLabelsPerClient {
+		return errTooManyLabels
+	}
+	return nil
+}
+
+// label gives the client the label, or takes it off if the value is "", and
+// keeps the hub's sets of the clients with each label up to date. h.mut must
+// be held.
+func (h *hub) label(c *client, key, value string) {
+	labels := h.labels[c]
+	if old, ok := labels[key]; ok {
+		if old == value {
+			return
+		}
+		h.unlabel(c, labelPair{key, old})
+		delete(labels, key)
+	}
+	if value == "" {
+		if len(labels) == 0 {
+			delete(h.labels, c)
+		}
+		return
+	}
+	if labels == nil {
+		labels = map[string]string{}
+		h.labels[c] = labels
+	}
+	labels[key] = value
+	p := labelPair{key, value}
+	set, ok := h.labelled[p]
+	if !ok {
+		set = map[*client]struct{}{}
+		h.labelled[p] = set
+	}
+	set[c] = struct{}{}
+}
+
+// unlabel takes the client out of the set with the label. h.mut must be
+// held.
+func (h *hub) unlabel(c *client, p labelPair) {
+	set := h.labelled[p]
+	delete(set, c)
+	if len(set) == 0 {
+		delete(h.labelled, p)
+	}
+}
+
+// claimLabels gives the client the labels of its token, leaving off any it
+// can't be given. h.mut must be held.
+func (h *hub) claimLabels(c *client) {
+	keys := make([]string, 0, len(c.claimedLabels))
+	for k := range c.claimedLabels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := c.claimedLabels[k]
+		if v == "" || h.checkLabels(c, map[string]string{k: v}) != nil {
+			continue
+		}
+		h.label(c, k, v)
+	}
+}
+
+// forgetLabels takes every label off the client. h.mut must be held.
+func (h *hub) forgetLabels(c *client) {
+	for k, v := range h.labels[c] {
+		h.unlabel(c, labelPair{k, v})
+	}
+	delete(h.labels, c)
+}
+
+// moveLabels gives c old's labels, in its place. h.mut must be held.
+func (h *hub) moveLabels(old, c *client) {
+	labels := h.labels[old]
+	h.forgetLabels(old)
+	for k, v := range labels {
+		h.label(c, k, v)
+	}
+}
+
+// matching gives the clients with every label in the selector, which mustn't
+// be empty: those in the smallest of the sets with its labels that are in
+// all of the others too. h.mut must be held.
+func (h *hub) matching(selector map[string]string) []*client {
+	sets := make([]map[*client]struct{}, 0, len(selector))
+	for k, v := range selector {
+		set, ok := h.labelled[labelPair{k, v}]
+		if !ok {
+			return nil
+		}
+		sets = append(sets, set)
+	}
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+	var clients []*client
+outer:
+	for c := range sets[0] {
+		for _, set := range sets[1:] {
+			if _, ok := set[c]; !ok {
+				continue outer
+			}
+		}
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// checkSelector tells what's wrong with the selector, if anything.
+func checkSelector(selector map[string]string) error {
+	for k, v := range selector {
+		if k == "" || v == "" {
+			return errBadSelector
+		}
+	}
+	return nil
+}
+
+// labelError gives the reply for an error setting labels.
+func labelError(err error) error {
+	switch {
+	case errors.Is(err, errLabelNotAllowed):
+		return &replyError{codeLabelNotAllowed, err.Error()}
+	case errors.Is(err, errBadLabel), errors.Is(err, errTooManyLabels):
+		return &replyError{codeBadLabel, err.Error()}
+	}
+	return err
+}
+
+// handleLabels registers label with the dispatcher.
+func handleLabels(d *dispatcher, h *hub) {
+	d.handle("label", func(ctx context.Context, c *client, payload payload) error {
+		var p labelsPayload
+		if err := decodePayload(payload, &p); err != nil {
+			return err
+		}
+		labels, err := h.setLabels(c, p.Labels.labels())
+		if err != nil {
+			return labelError(err)
+		}
+		return sendEnvelope(ctx, c, "labels", labelsPayload{listLabels(labels)})
+	})
+}
+
+// labelMessage is the label action of /chat.
+type labelMessage struct {
+	Action string            `json:"action"`
+	Labels map[string]string `json:"labels"`
+}
+
+type labelReply struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+type labelErrorReply struct {
+	Type  string `json:"type"`
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error"`
+}
+
+// parseLabelMessage tells whether the message is the label action, and if
+// so, gives the labels.
+func parseLabelMessage(message []byte) (map[string]string, bool) {
+	var m labelMessage
+	if err := json.Unmarshal(message, &m); err != nil || m.Action != "label" {
+		return nil, false
+	}
+	return m.Labels, true
+}
+
+// handleLabelMessage sets the labels of the label action, and sends the
+// client the reply.
+func handleLabelMessage(h *hub, c *client, labels map[string]string) error {
+	labels, err := h.setLabels(c, labels)
+	var reply interface{} = labelReply{"labels", labels}
+	if err != nil {
+		r := labelErrorReply{Type: "error", Error: err.Error()}
+		var re *replyError
+		if errors.As(labelError(err), &re) {
+			r.Code = re.code
+		}
+		reply = r
+	}
+	message, _ := json.Marshal(reply)
+	return c.write(websocket.TextMessage, message)
+}
+
+// BroadcastSelector sends the message to every client of the hub with all of
+// the selector's labels, and every feed of it. An empty selector is every
+// client, as with Broadcast.
+func (h *Hub) BroadcastSelector(ctx context.Context, selector map[string]string, messageType int, data []byte) {
+	h.h.send(ctx, broadcastMessage{messageType: messageType, data: data, selector: maps.Clone(selector)})
+}
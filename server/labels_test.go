@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLabelIndex(t *testing.T) {
+	h := newHub()
+	h.labelKeys = map[string]bool{"region": true, "tier": true}
+	names := map[*client]string{}
+	newLabelled := func(name string, labels map[string]string) *client {
+		t.Helper()
+		c := newClient(newFakeTransport(), "", sendQueue{size: 10}, messageRate{})
+		h.join(c)
+		if _, err := h.setLabels(c, labels); err != nil {
+			t.Fatal(err)
+		}
+		names[c] = name
+		return c
+	}
+	alice := newLabelled("alice", map[string]string{"region": "eu", "tier": "pro"})
+	bob := newLabelled("bob", map[string]string{"region": "eu"})
+	carol := newLabelled("carol", map[string]string{"region": "us", "tier": "pro"})
+	matching := func(selector map[string]string) string {
+		h.mut.Lock()
+		defer h.mut.Unlock()
+		var got []string
+		for _, c := range h.recipients("", selector) {
+			got = append(got, names[c])
+		}
+		sort.Strings(got)
+		return strings.Join(got, " ")
+	}
+	for _, tt := range []struct {
+		selector map[string]string
+		want     string
+	}{
+		{map[string]string{"region": "eu"}, "alice bob"},
+		{map[string]string{"region": "eu", "tier": "pro"}, "alice"},
+		{map[string]string{"tier": "pro"}, "alice carol"},
+		{map[string]string{"region": "mars"}, ""},
+		{map[string]string{"region": "us", "tier": "free"}, ""},
+		{map[string]string{"colour": "red"}, ""},
+	} {
+		if got := matching(tt.selector); got != tt.want {
+			t.Errorf("%v matched %q, want %q", tt.selector, got, tt.want)
+		}
+	}
+
+	// Labels can change as the client goes, and come off with an empty value.
+	if labels, err := h.setLabels(bob, map[string]string{"region": "us", "tier": "free"}); err != nil || labels["region"] != "us" || labels["tier"] != "free" {
+		t.Fatalf("relabelling bob gave %v, %v", labels, err)
+	}
+	if got := matching(map[string]string{"region": "eu"}); got != "alice" {
+		t.Fatalf("after bob moved, region=eu matched %q", got)
+	}
+	if got := matching(map[string]string{"region": "us"}); got != "bob carol" {
+		t.Fatalf("after bob moved, region=us matched %q", got)
+	}
+	if labels, err := h.setLabels(bob, map[string]string{"tier": ""}); err != nil || len(labels) != 1 {
+		t.Fatalf("taking bob's tier off left %v, %v", labels, err)
+	}
+	if _, ok := h.labelled[labelPair{"tier", "free"}]; ok {
+		t.Fatal("kept a set for a label nobody has")
+	}
+
+	// A label that can't be set keeps the others from being set too.
+	_, err := h.setLabels(alice, map[string]string{"region": "us", "colour": "red"})
+	if !errors.Is(err, errLabelNotAllowed) {
+		t.Fatalf("setting a label that isn't allowed gave %v", err)
+	}
+	if _, err := h.setLabels(alice, map[string]string{"region": strings.Repeat("x", maxLabelLength+1)}); !errors.Is(err, errBadLabel) {
+		t.Fatalf("setting a label that's too long gave %v", err)
+	}
+	if got := matching(map[string]string{"region": "eu"}); got != "alice" {
+		t.Fatalf("after failing to relabel alice, region=eu matched %q", got)
+	}
+
+	// A selector with a room only matches those in it.
+	h.joinRoom(carol, "lobby")
+	h.mut.Lock()
+	inLobby := h.recipients("lobby", map[string]string{"tier": "pro"})
+	h.mut.Unlock()
+	if len(inLobby) != 1 || inLobby[0] != carol {
+		t.Fatalf("tier=pro in the lobby matched %d", len(inLobby))
+	}
+
+	// Leaving the hub takes the client's labels with it.
+	h.leave(alice)
+	h.leave(carol)
+	if got := matching(map[string]string{"tier": "pro"}); got != "" {
+		t.Fatalf("once they've left, tier=pro matched %q", got)
+	}
+	if len(h.labels) != 1 || len(h.labelled) != 1 {
+		t.Fatalf("%d labelled clients and %d labels left, want bob's", len(h.labels), len(h.labelled))
+	}
+}
+
+func TestBroadcastSelector(t *testing.T) {
+	s := pipeServer(t, WithLabelKeys([]string{"region"}))
+	hub := &Hub{s.chat}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// next gives the next message that isn't the session.
+	next := func(conn *pipedConn) string {
+		t.Helper()
+		for {
+			m, err := conn.Next(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(m.Data), `{"type":"session"`) {
+				return string(m.Data)
+			}
+		}
+	}
+	label := func(conn *pipedConn, labels map[string]string, want string) {
+		t.Helper()
+		conn.InjectJSON(labelMessage{"label", labels})
+		if got := next(conn); got != want {
+			t.Fatalf("labelling gave %s, want %s", got, want)
+		}
+	}
+	eu, us := pipeDial(t, s, "/chat"), pipeDial(t, s, "/chat")
+	label(eu, map[string]string{"region": "eu"}, `{"type":"labels","labels":{"region":"eu"}}`)
+	label(us, map[string]string{"region": "us"}, `{"type":"labels","labels":{"region":"us"}}`)
+	label(us, map[string]string{"tier": "pro"}, `{"type":"error","code":"label_not_allowed","error":"the label can't be set: \"tier\""}`)
+
+	// Each broadcast after one to a selector shows who it went to, since
+	// they go out in order.
+	hub.BroadcastSelector(ctx, map[string]string{"region": "eu"}, websocket.TextMessage, []byte("eu"))
+	hub.BroadcastSelector(ctx, map[string]string{"region": "mars"}, websocket.TextMessage, []byte("mars"))
+	hub.Broadcast(ctx, websocket.TextMessage, []byte("everyone"))
+	for conn, want := range map[*pipedConn]string{eu: "eu everyone", us: "everyone"} {
+		var got []string
+		for len(got) == 0 || got[len(got)-1] != "everyone" {
+			got = append(got, next(conn))
+		}
+		if strings.Join(got, " ") != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	// Moving region takes the client out of the old one's broadcasts, and
+	// into the new one's.
+	label(us, map[string]string{"region": "eu"}, `{"type":"labels","labels":{"region":"eu"}}`)
+	label(eu, map[string]string{"region": ""}, `{"type":"labels","labels":{}}`)
+	hub.BroadcastSelector(ctx, map[string]string{"region": "eu"}, websocket.TextMessage, []byte("eu again"))
+	hub.Broadcast(ctx, websocket.TextMessage, []byte("everyone"))
+	if got := next(us); got != "eu again" {
+		t.Fatalf("the client that moved to eu got %q", got)
+	}
+	if got := next(eu); got != "everyone" {
+		t.Fatalf("the client that left eu got %q", got)
+	}
+}
+
+// signedJWT gives an HS256 JWT with the claims, signed with the secret.
+func signedJWT(secret string, claims map[string]interface{}) string {
+	body, _ := json.Marshal(claims)
+	token := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256"}`)) + "." + base64.RawURLEncoding.EncodeToString(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(token))
+	return token + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestLabelsOverAPI(t *testing.T) {
+	const token, secret = "admin-secret", "jwt-secret"
+	secretFile := filepath.Join(t.TempDir(), "jwt")
+	os.WriteFile(secretFile, []byte(secret), 0o600)
+	s := pipeServer(t, WithAdminToken(token), WithAuth("", secretFile), WithLabelKeys([]string{"region", "tier"}))
+	dial := func(user string, labels map[string]string) *pipedConn {
+		t.Helper()
+		exp := time.Now().Add(time.Hour).Unix()
+		return pipeDial(t, s, "/api?token="+signedJWT(secret, map[string]interface{}{"sub": user, "exp": exp, "labels": labels}))
+	}
+	label := func(conn *pipedConn, labels map[string]string) map[string]string {
+		t.Helper()
+		conn.InjectJSON(map[string]interface{}{"type": "label", "payload": map[string]interface{}{"labels": labels}})
+		var p struct {
+			Labels map[string]string `json:"labels"`
+		}
+		json.Unmarshal(nextPiped(t, conn, "labels").Payload, &p)
+		return p.Labels
+	}
+	announce := func(body string) int {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/admin/broadcast", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	announced := func(conn *pipedConn) string {
+		t.Helper()
+		var a announcement
+		json.Unmarshal(nextPiped(t, conn, "server.announcement").Payload, &a)
+		return a.Message
+	}
+
+	// The claim gives alice the labels it can, and no others.
+	alice := dial("alice", map[string]string{"region": "eu", "colour": "red"})
+	if got := label(alice, nil); len(got) != 1 || got["region"] != "eu" {
+		t.Fatalf("alice's token gave it %v", got)
+	}
+	bob := dial("bob", nil)
+	if got := label(bob, map[string]string{"region": "us", "tier": "pro"}); len(got) != 2 {
+		t.Fatalf("bob has %v", got)
+	}
+	bob.InjectJSON(map[string]interface{}{"type": "label", "payload": map[string]interface{}{"labels": map[string]string{"colour": "red"}}})
+	var p errorPayload
+	if json.Unmarshal(nextPiped(t, bob, "error").Payload, &p); p.Code != codeLabelNotAllowed {
+		t.Fatalf("setting a label that isn't allowed gave %q", p.Code)
+	}
+
+	if code := announce(`{"message":"eu only","selector":{"region":"eu"}}`); code != http.StatusAccepted {
+		t.Fatalf("POST /admin/broadcast with a selector gave %d", code)
+	}
+	if code := announce(`{"message":"nobody","selector":{"region":"eu","tier":"pro"}}`); code != http.StatusAccepted {
+		t.Fatalf("POST /admin/broadcast with a selector nobody matches gave %d", code)
+	}
+	announce(`{"message":"everyone"}`)
+	if got := announced(alice); got != "eu only" {
+		t.Fatalf("alice was sent %q first", got)
+	}
+	for name, conn := range map[string]*pipedConn{"alice": alice, "bob": bob} {
+		if got := announced(conn); got != "everyone" {
+			t.Fatalf("%s was sent %q, want everyone", name, got)
+		}
+	}
+
+	// Once bob moves to eu, it's picked out too.
+	label(bob, map[string]string{"region": "eu"})
+	announce(`{"message":"eu pros","selector":{"region":"eu","tier":"pro"}}`)
+	if got := announced(bob); got != "eu pros" {
+		t.Fatalf("bob was sent %q", got)
+	}
+
+	if code := announce(`{"message":"hi","selector":{"region":""}}`); code != http.StatusBadRequest {
+		t.Fatalf("a selector with an empty label gave %d", code)
+	}
+}
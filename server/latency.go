@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Every ping the server sends carries the time it was sent, which the pong
+// echoes back, so each pong gives the round trip to the client. The last few
+// are averaged for each client, and listed as rtt_ms by GET
+// /admin/connections. With -latency-reports, clients on /ws are also told
+// theirs after every pong:
+//
+//	{"type":"latency","rtt_ms":12.5,"average_ms":14.1}
+//
+// A report is only sent if there's room for it in the client's queue, since
+// there'll be another one along soon enough. The coder transport makes up the
+// payloads of its pings itself, so there the round trip is timed around the
+// ping instead, and over Server-Sent Events there are no pongs to time at all.
+
+type latencyReport struct {
+	Type      string  `json:"type"`
+	RTTMS     float64 `json:"rtt_ms"`
+	AverageMS float64 `json:"average_ms"`
+}
+
+// milliseconds gives d in milliseconds, to the microsecond.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// observeRTT is told the round trip of every pong from the client.
+func (c *client) observeRTT(rtt time.Duration) {
+	c.rtt.Observe(rtt)
+	if atomic.LoadInt32(&c.reportLatency) == 0 {
+		return
+	}
+	report, _ := json.Marshal(latencyReport{
+		Type:      "latency",
+		RTTMS:     milliseconds(rtt),
+		AverageMS: milliseconds(c.rtt.Average()),
+	})
+	c.tryWrite(websocket.TextMessage, report)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The server can listen either on a TCP host:port, or on a unix domain socket
+// when the address is given as unix:///path/to/socket. The scheme prefix is
+// there so that a relative socket path can't be confused for a host name.
+//
+// The socket is made in a directory of its own that only the server can get
+// into, given its mode there, and only then moved into place, so that it's
+// never reachable with the looser mode that the umask would have given it.
+// Setting the umask instead would change it for the whole process, including
+// for the files other goroutines might be creating at the same time.
+
+const unixScheme = "unix://"
+
+func listen(addr string, socketMode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, unixScheme)
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sock")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, filepath.Base(path))
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: private, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The listener would remove the socket by the name it was made with.
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(private, socketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(private, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixListener{listener, path}, nil
+}
+
+// unixListener removes its socket when it's closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if err == nil {
+		os.Remove(l.path)
+	}
+	return err
+}
+
+// removeStaleSocket removes a socket file that was left behind by a previous
+// run that didn't get to clean up after itself. If something is still
+// listening on it, then it's left alone, and an error is returned instead.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+type connContextKey struct{}
+
+// withConn is used as the http.Server's ConnContext, to make the underlying
+// connection available to handlers via peerConn. For TLS, that's the
+// connection underneath it.
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+func peerConn(r *http.Request) net.Conn {
+	c, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	return c
+}
+
+func isUnixPeer(r *http.Request) bool {
+	_, ok := peerConn(r).(*net.UnixConn)
+	return ok
+}
+
+// describePeer gives something to identify the other end of a connection by
+// in the logs, for when it doesn't have an IP address.
+func describePeer(r *http.Request) string {
+	if creds, ok := peerCredentials(peerConn(r)); ok {
+		return "unix peer " + creds
+	}
+	if isUnixPeer(r) {
+		return "unix peer"
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestListenUnixMode(t *testing.T) {
+	for _, mode := range []os.FileMode{0600, 0660, 0666} {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "ws.sock")
+			l, err := listen(unixScheme+path, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			fi, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != mode {
+				t.Fatalf("socket mode = %s, want a socket with %s", fi.Mode(), mode)
+			}
+			// Nothing is left over from making it.
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Fatalf("%d entries in the directory, want just the socket", len(entries))
+			}
+			if got := l.Addr().String(); got != path {
+				t.Fatalf("Addr() = %s, want %s", got, path)
+			}
+
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Fatalf("socket still there after Close: %v", err)
+			}
+		})
+	}
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ws.sock")
+	l, err := listen(unixScheme+path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Still being listened on, so it isn't taken over.
+	if _, err := listen(unixScheme+path, 0600); err == nil {
+		t.Fatal("listened on a socket that's in use")
+	}
+	// Left behind, as by a crash, so it is.
+	l.(*unixListener).UnixListener.Close()
+	l, err = listen(unixScheme+path, 0600)
+	if err != nil {
+		t.Fatalf("listen over a stale socket: %v", err)
+	}
+	l.Close()
+}
+
+// unixDialer dials the socket at path, whatever the URL says.
+func unixDialer(path string) *websocket.Dialer {
+	var d net.Dialer
+	return &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", path)
+		},
+		HandshakeTimeout: 5 * time.Second,
+	}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ws.sock")
+	srv, err := New(
+		WithAddr(unixScheme+path),
+		WithSocketMode(0600),
+		WithIPRules(nil, []string{"203.0.113.0/24"}, ""),
+		WithShutdownTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run() = %v", err)
+		}
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("socket still there after Run returned: %v", err)
+		}
+	}()
+	for i := 0; ; i++ {
+		if _, err := os.Lstat(path); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the server never listened on the socket")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dialer := unixDialer(path)
+	// The host in the URL is only for the Host header.
+	conn, _, err := dialer.Dial("ws://localhost/echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, %v, want the echo", data, err)
+	}
+
+	// A unix peer's forwarded addresses are always believed, and checked
+	// against the rules.
+	for addr, status := range map[string]int{"203.0.113.5": http.StatusForbidden, "198.51.100.1": http.StatusSwitchingProtocols} {
+		header := http.Header{"X-Forwarded-For": {addr}}
+		conn, resp, err := dialer.Dial("ws://localhost/echo", header)
+		if err == nil {
+			conn.Close()
+		}
+		if resp == nil || resp.StatusCode != status {
+			t.Fatalf("forwarded for %s: %v, %v, want status %d", addr, resp, err, status)
+		}
+	}
+}
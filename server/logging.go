@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+// The server logs with slog's default logger, so it goes wherever, and at
+// whatever level, the program embedding it sets that up to log. At debug,
+// every message the /ws endpoint gets is logged too.
+//
+// Everything logged about a connection says which one it was, with:
+//
+//	conn         a UUID, given to the connection when it's upgraded
+//	id           the number it goes by in the /admin endpoints
+//	peer         the client's address
+//	user         who the client authenticated as, if anyone
+//	subprotocol  the negotiated subprotocol, if there is one
+//	stats        the messages and bytes read from and written to it so far
+//
+// so that one connection's lines can be picked out of everyone else's with a
+// grep for its UUID.
+
+// newConnUUID gives a random (version 4) UUID.
+func newConnUUID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		panic(err)
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// connStats counts what's gone through one connection.
+type connStats struct {
+	messagesIn  int64
+	messagesOut int64
+	bytesIn     int64
+	bytesOut    int64
+}
+
+func (s *connStats) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int64("messages_in", atomic.LoadInt64(&s.messagesIn)),
+		slog.Int64("messages_out", atomic.LoadInt64(&s.messagesOut)),
+		slog.Int64("bytes_in", atomic.LoadInt64(&s.bytesIn)),
+		slog.Int64("bytes_out", atomic.LoadInt64(&s.bytesOut)),
+	)
+}
+
+// newConnLogger gives the logger for the connection, which puts its
+// attributes on every line.
+func newConnLogger(c *liveConn) *slog.Logger {
+	attrs := []interface{}{"conn", c.uuid, "id", c.id, "peer", c.peer}
+	if c.user != "" {
+		attrs = append(attrs, "user", c.user)
+	}
+	if c.subprotocol != "" {
+		attrs = append(attrs, "subprotocol", c.subprotocol)
+	}
+	return slog.New(&statsHandler{slog.Default().Handler(), c.stats}).With(attrs...)
+}
+
+// statsHandler adds the connection's counters to every record. They can't be
+// added to the logger along with the rest of its attributes, since a handler
+// resolves those once, when they're added, and the counters keep changing.
+type statsHandler struct {
+	slog.Handler
+	stats *connStats
+}
+
+func (h *statsHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.AddAttrs(slog.Any("stats", h.stats))
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *statsHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &statsHandler{h.Handler.WithAttrs(attrs), h.stats}
+}
+
+func (h *statsHandler) WithGroup(name string) slog.Handler {
+	return &statsHandler{h.Handler.WithGroup(name), h.stats}
+}
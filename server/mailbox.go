@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// With -mailbox-ttl, a direct message for a user (see direct.go) who has no
+// connection to the hub just then is held for them, rather than turned away,
+// as long as they're a user the hub knows, having connected to it before.
+// The sender is told it's sent, with its id, and the message waits in the
+// user's mailbox, of up to -mailbox-size messages, for up to the TTL.
+//
+// When the user next connects, everything in their mailbox is queued for the
+// connection as it joins the hub, in the order it was sent, and each sender
+// is told it's delivered. That happens under the hub's lock, as do sending a
+// direct message and holding one, so nothing sent to the user can overtake
+// what's in the mailbox: a message sent before the connection joins is held
+// behind the others, and goes out with them, and one sent after it goes
+// straight to the connection, behind them.
+//
+// A message that's still in the mailbox when its TTL is up, or that doesn't
+// fit in it, is dropped, and its sender, if it's still connected, is sent
+//
+//	{"type":"undeliverable","payload":{"id":12,"ref":"a1","user":"bob","reason":"expired"}}
+//
+// with "mailbox_full" as the reason for one that didn't fit. The hub's
+// goroutine looks for expired messages once every mailboxTick. Mailboxes are
+// in memory, with the users the hub knows, and, like the history, belong to
+// the instance, and are lost on a restart.
+
+const mailboxTick = time.Second
+
+const (
+	undeliverableExpired = "expired"
+	undeliverableFull    = "mailbox_full"
+)
+
+type undeliverablePayload struct {
+	ID     uint64 `json:"id" pb:"1"`
+	Ref    string `json:"ref,omitempty" pb:"2"`
+	User   string `json:"user" pb:"3"`
+	Reason string `json:"reason" pb:"4"`
+}
+
+// mail is a direct message held for its user.
+type mail struct {
+	d       *direct
+	message directMessagePayload
+	expires time.Time
+}
+
+// mailbox is the mail held for each user the hub knows. It's guarded by the
+// hub's lock.
+type mailbox struct {
+	ttl  time.Duration
+	size int
+	// Every user that's connected to the hub.
+	known map[string]struct{}
+	// The mail for each user, in the order it was sent.
+	boxes map[string][]mail
+}
+
+func newMailbox(ttl time.Duration, size int) *mailbox {
+	return &mailbox{ttl: ttl, size: size, known: map[string]struct{}{}, boxes: map[string][]mail{}}
+}
+
+func (m *mailbox) knows(user string) bool {
+	_, ok := m.known[user]
+	return ok
+}
+
+// holdMail keeps the direct message, for its user, in their mailbox, and
+// tells the sender it's sent, or, if the mailbox is full, that it's
+// undeliverable. h.mut must be held.
+func (h *hub) holdMail(d *direct, message directMessagePayload, now time.Time) {
+	m := h.mailbox
+	if len(m.boxes[d.toUser]) >= m.size {
+		h.undeliverable(d, undeliverableFull)
+		return
+	}
+	expires := now.Add(m.ttl)
+	if !d.expires.IsZero() && d.expires.Before(expires) {
+		expires = d.expires
+	}
+	m.boxes[d.toUser] = append(m.boxes[d.toUser], mail{d, message, expires})
+	h.tellReceipt(d)
+}
+
+// deliverMail queues what's in the mailbox of the client's user for it, and
+// tells the senders it's delivered, other than what's expired, and has the
+// hub know the user from now on. h.mut must be held.
+func (h *hub) deliverMail(c *client, now time.Time) {
+	if h.mailbox == nil || c.user == "" {
+		return
+	}
+	m := h.mailbox
+	m.known[c.user] = struct{}{}
+	box := m.boxes[c.user]
+	delete(m.boxes, c.user)
+	for i, held := range box {
+		if !now.Before(held.expires) {
+			h.undeliverable(held.d, undeliverableExpired)
+			continue
+		}
+		if sendExpiring(context.Background(), c, "direct", held.message, held.d.expires) != nil {
+			// It's already on its way out, so the rest wait for the
+			// next one.
+			m.boxes[c.user] = box[i:]
+			return
+		}
+		h.receipts.keep(held.d)
+		if h.receipts.advance(held.d, receiptDelivered) {
+			h.tellReceipt(held.d)
+		}
+	}
+}
+
+// expireMail drops the mail that's expired, and tells the senders. h.mut must
+// be held.
+func (h *hub) expireMail(now time.Time) {
+	for user, box := range h.mailbox.boxes {
+		// What's left is kept in the order it was sent, though it doesn't
+		// all expire in that order, since messages can have their own TTLs.
+		kept := box[:0]
+		for _, held := range box {
+			if now.Before(held.expires) {
+				kept = append(kept, held)
+			} else {
+				h.undeliverable(held.d, undeliverableExpired)
+			}
+		}
+		if len(kept) == 0 {
+			delete(h.mailbox.boxes, user)
+		} else {
+			h.mailbox.boxes[user] = kept
+		}
+	}
+}
+
+// undeliverable forgets the direct message, and tells its sender why it
+// couldn't be delivered. h.mut must be held.
+func (h *hub) undeliverable(d *direct, reason string) {
+	h.receipts.forget(d)
+	h.tellSender(d, "undeliverable", undeliverablePayload{ID: d.id, Ref: d.ref, User: d.toUser, Reason: reason})
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queuedEnvelopes gives the envelopes queued for the client, and empties its
+// queue.
+func queuedEnvelopes(c *client) []testEnvelope {
+	var envelopes []testEnvelope
+	for _, m := range c.takeQueue() {
+		var e testEnvelope
+		json.Unmarshal(m.data, &e)
+		envelopes = append(envelopes, e)
+	}
+	return envelopes
+}
+
+// mailHub gives a hub with mailboxes, with alice in it, and bob, who's been
+// in it, and left.
+func mailHub(ttl time.Duration, size int) (*hub, *client) {
+	h := newHub()
+	h.mailbox = newMailbox(ttl, size)
+	alice := newClient(newFakeTransport(), "alice", sendQueue{size: 1000}, messageRate{})
+	h.join(alice)
+	bob := newClient(newFakeTransport(), "bob", sendQueue{size: 1000}, messageRate{})
+	h.join(bob)
+	h.leave(bob)
+	return h, alice
+}
+
+func toBob(ref string) directPayload {
+	return directPayload{User: "bob", Message: json.RawMessage(fmt.Sprintf("%q", ref)), Ref: ref}
+}
+
+func TestMailbox(t *testing.T) {
+	h, alice := mailHub(time.Minute, 2)
+	for _, ref := range []string{"1", "2", "3"} {
+		if err := h.sendDirect(context.Background(), alice, toBob(ref)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first two are held, and the third doesn't fit.
+	var told []string
+	for _, e := range queuedEnvelopes(alice) {
+		var p struct {
+			Ref, State, Reason string
+		}
+		json.Unmarshal(e.Payload, &p)
+		told = append(told, e.Type+" "+p.Ref+" "+p.State+p.Reason)
+	}
+	want := []string{"receipt 1 sent", "receipt 2 sent", "undeliverable 3 mailbox_full"}
+	if !reflect.DeepEqual(told, want) {
+		t.Fatalf("alice was told %v, want %v", told, want)
+	}
+
+	bob := newClient(newFakeTransport(), "bob", sendQueue{size: 1000}, messageRate{})
+	h.join(bob)
+	var got []string
+	var ids []uint64
+	for _, e := range queuedEnvelopes(bob) {
+		var p directMessagePayload
+		json.Unmarshal(e.Payload, &p)
+		got = append(got, string(p.Message))
+		ids = append(ids, p.ID)
+	}
+	if !reflect.DeepEqual(got, []string{`"1"`, `"2"`}) {
+		t.Fatalf("bob was sent %v once he connected", got)
+	}
+	if got := queuedTypes(alice); !reflect.DeepEqual(got, []string{"receipt", "receipt"}) {
+		t.Fatalf("alice was sent %v once bob connected", got)
+	}
+	// It's read the same as any other.
+	if err := h.read(bob, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := queuedTypes(alice); !reflect.DeepEqual(got, []string{"receipt"}) {
+		t.Fatalf("alice was sent %v once bob read it", got)
+	}
+
+	// Now that he's connected, it goes straight to him.
+	h.sendDirect(context.Background(), alice, toBob("4"))
+	if got := queuedTypes(bob); !reflect.DeepEqual(got, []string{"direct"}) {
+		t.Fatalf("bob was sent %v", got)
+	}
+	queuedTypes(alice)
+
+	// Someone unknown can't be held for.
+	carol := directPayload{User: "carol", Message: json.RawMessage(`"hi"`)}
+	if err := h.sendDirect(context.Background(), alice, carol); err == nil {
+		t.Fatal("held a message for a user the hub doesn't know")
+	}
+	if got := queuedTypes(alice); got != nil {
+		t.Fatalf("alice was sent %v for carol", got)
+	}
+}
+
+func TestMailboxExpiry(t *testing.T) {
+	h, alice := mailHub(time.Minute, 10)
+	h.sendDirect(context.Background(), alice, toBob("1"))
+	later := time.Now().Add(30 * time.Second)
+	h.sendDirect(context.Background(), alice, toBob("2"))
+	queuedTypes(alice)
+
+	h.mut.Lock()
+	h.expireMail(later)
+	h.mut.Unlock()
+	if got := queuedTypes(alice); got != nil {
+		t.Fatalf("alice was sent %v before anything expired", got)
+	}
+	h.mut.Lock()
+	h.expireMail(time.Now().Add(time.Minute))
+	h.mut.Unlock()
+	envelopes := queuedEnvelopes(alice)
+	if len(envelopes) != 2 {
+		t.Fatalf("alice was sent %d envelopes, want one for each expired message", len(envelopes))
+	}
+	for _, e := range envelopes {
+		var p undeliverablePayload
+		json.Unmarshal(e.Payload, &p)
+		if e.Type != "undeliverable" || p.Reason != undeliverableExpired || p.User != "bob" {
+			t.Fatalf("alice was sent a %s %+v", e.Type, p)
+		}
+	}
+	bob := newClient(newFakeTransport(), "bob", sendQueue{size: 1000}, messageRate{})
+	h.join(bob)
+	if got := queuedTypes(bob); got != nil {
+		t.Fatalf("bob was sent %v, after it expired", got)
+	}
+
+	// A sender that's gone isn't told.
+	h.leave(bob)
+	h.sendDirect(context.Background(), alice, toBob("3"))
+	h.leave(alice)
+	queuedTypes(alice)
+	h.mut.Lock()
+	h.expireMail(time.Now().Add(time.Minute))
+	h.mut.Unlock()
+	if got := queuedTypes(alice); got != nil {
+		t.Fatalf("alice was sent %v, after she left", got)
+	}
+}
+
+// Messages sent to bob as he connects are never sent to him ahead of what was
+// held for him, and all of them arrive, in order, once, whichever way the
+// race goes.
+func TestMailboxFlushRace(t *testing.T) {
+	const held, live = 5, 20
+	for run := 0; run < 50; run++ {
+		h, alice := mailHub(time.Minute, held+live)
+		for i := 0; i < held; i++ {
+			h.sendDirect(context.Background(), alice, toBob(fmt.Sprint(i)))
+		}
+		bob := newClient(newFakeTransport(), "bob", sendQueue{size: 1000}, messageRate{})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := held; i < held+live; i++ {
+				if err := h.sendDirect(context.Background(), alice, toBob(fmt.Sprint(i))); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			h.join(bob)
+		}()
+		wg.Wait()
+
+		var got []string
+		for _, e := range queuedEnvelopes(bob) {
+			var p directMessagePayload
+			json.Unmarshal(e.Payload, &p)
+			got = append(got, string(p.Message))
+		}
+		var want []string
+		for i := 0; i < held+live; i++ {
+			want = append(want, fmt.Sprintf(`"%d"`, i))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("run %d: bob was sent %v, want %v", run, got, want)
+		}
+
+		// Every one of them was delivered, and alice was told so, once
+		// each.
+		delivered := map[uint64]int{}
+		for _, e := range queuedEnvelopes(alice) {
+			var p receiptPayload
+			json.Unmarshal(e.Payload, &p)
+			if p.State == "delivered" {
+				delivered[p.ID]++
+			}
+		}
+		if len(delivered) != held+live {
+			t.Fatalf("run %d: alice was told %d were delivered, want %d", run, len(delivered), held+live)
+		}
+		for id, n := range delivered {
+			if n != 1 {
+				t.Fatalf("run %d: alice was told %d was delivered %d times", run, id, n)
+			}
+		}
+	}
+}
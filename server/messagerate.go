@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"time"
+)
+
+// Each connection gets a token bucket of messages from the client, so that no
+// single client can send more than -message-rate messages per second, after
+// an initial burst of -message-burst. What happens to a message over the limit
+// is up to -message-rate-policy:
+//
+//   - drop, the default, drops the message, and lets the client know with
+//
+//	{"type":"rate_limited","retry_in_ms":50}
+//
+//     where retry_in_ms is how long until it can send another;
+//   - disconnect closes the client with 1008 (policy violation).
+//
+// The bucket is checked as each message is read, so it applies to every
+// endpoint alike. Messages over the limit are counted under
+// rate_limited_messages.
+
+var rateLimitedMessages = expvar.NewInt("rate_limited_messages")
+
+var errMessageRate = errors.New("client sent messages too fast")
+
+type ratePolicy int
+
+const (
+	rateDrop ratePolicy = iota
+	rateDisconnect
+)
+
+func parseRatePolicy(s string) (ratePolicy, error) {
+	switch s {
+	case "drop":
+		return rateDrop, nil
+	case "disconnect":
+		return rateDisconnect, nil
+	}
+	return 0, fmt.Errorf("unknown rate policy %q; expected drop or disconnect", s)
+}
+
+// messageRate is how many messages per second a client may send, after a
+// burst, and what to do with the ones over that. A rate of zero is unlimited.
+type messageRate struct {
+	rate   int
+	burst  int
+	policy ratePolicy
+}
+
+// bucket gives a new bucket for a connection, or nil when it's unlimited. It's
+// the same kind of bucket as for -write-rate, counting messages instead of
+// bytes.
+func (r messageRate) bucket() *byteBucket {
+	if r.rate <= 0 {
+		return nil
+	}
+	return newByteBucket(r.rate, r.burst)
+}
+
+type rateLimitedMessage struct {
+	Type      string `json:"type"`
+	RetryInMS int64  `json:"retry_in_ms"`
+}
+
+func rateLimited(wait time.Duration) []byte {
+	message, _ := json.Marshal(rateLimitedMessage{
+		Type:      "rate_limited",
+		RetryInMS: wait.Milliseconds(),
+	})
+	return message
+}
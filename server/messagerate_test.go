@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMessageRate(t *testing.T) {
+	tests := []struct {
+		policy string
+		// What the client is sent for the four messages, and the close code
+		// it's closed with, if it is.
+		want []string
+		code int
+	}{
+		{"drop", []string{"1", "2", "rate_limited", "rate_limited"}, 0},
+		{"disconnect", []string{"1", "2"}, websocket.ClosePolicyViolation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			s := pipeServer(t, WithMessageRate(1, 2, tt.policy))
+			conn := pipeDial(t, s, "/echo")
+			for _, m := range []string{"1", "2", "3", "4"} {
+				conn.Inject(websocket.TextMessage, []byte(m))
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var got []string
+			for range tt.want {
+				m, err := conn.Next(ctx)
+				if err != nil {
+					t.Fatalf("after %v: %v", got, err)
+				}
+				var limited rateLimitedMessage
+				if json.Unmarshal(m.Data, &limited) == nil && limited.Type == "rate_limited" {
+					if limited.RetryInMS <= 0 || limited.RetryInMS > 1000 {
+						t.Fatalf("told to retry in %dms", limited.RetryInMS)
+					}
+					got = append(got, limited.Type)
+					continue
+				}
+				got = append(got, string(m.Data))
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Fatalf("sent %v, want %v", got, tt.want)
+			}
+			if tt.code == 0 {
+				return
+			}
+			select {
+			case <-conn.Done():
+			case <-ctx.Done():
+				t.Fatal("not closed")
+			}
+			if code, _, _ := conn.Closed(); code != tt.code {
+				t.Fatalf("closed with %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
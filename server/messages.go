@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"iter"
+)
+
+// A handler served with ConnectionHandler can range over what the client
+// sends, rather than call Read in a loop:
+//
+//	for m, err := range conn.Messages(ctx) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// The loop ends once ctx is done, without an error, or once the connection
+// is, with the error that ended it as the last one, which for a client that
+// closed it is a *websocket.CloseError with its code and reason.
+//
+// Messages, like Read, takes each message from the one goroutine that reads
+// the connection, which is started by whichever of them is called first, and
+// runs until the connection is over. It only reads a message once the one
+// before it has been taken, and a message it's read stays there until it is,
+// so breaking out of the loop, or ctx being done, leaves nothing behind: the
+// next Read, or the next loop over Messages, gets the message after the last
+// one the loop had.
+
+// readLoop reads the connection, handing each message over once it's taken,
+// until reading fails, or the connection is over.
+func (c *Connection) readLoop() {
+	defer close(c.incoming)
+	for {
+		messageType, data, err := c.client.read(c.ctx)
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		select {
+		case c.incoming <- Message{messageType, data}:
+		case <-c.ctx.Done():
+			c.readErr = c.ctx.Err()
+			return
+		}
+	}
+}
+
+// next gives the next message from the reader, or the error it stopped with,
+// or ctx's, if it's done first, leaving the message for the next call.
+func (c *Connection) next(ctx context.Context) (Message, error) {
+	c.reading.Do(func() {
+		c.incoming = make(chan Message)
+		go c.readLoop()
+	})
+	if err := ctx.Err(); err != nil {
+		return Message{}, err
+	}
+	select {
+	case m, ok := <-c.incoming:
+		if !ok {
+			return Message{}, c.readErr
+		}
+		return m, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// Messages gives every message from the client, in order, until ctx or the
+// connection is done, and then the error that ended the connection, if it
+// was that.
+func (c *Connection) Messages(ctx context.Context) iter.Seq2[Message, error] {
+	return func(yield func(Message, error) bool) {
+		for {
+			m, err := c.next(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					yield(Message{}, err)
+				}
+				return
+			}
+			if !yield(m, nil) {
+				return
+			}
+		}
+	}
+}
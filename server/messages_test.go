@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMessages(t *testing.T) {
+	s, err := New(WithUpgradeRate(0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ended := make(chan error, 1)
+	s.Handle("/messages", ConnectionHandler(func(conn *Connection) error {
+		// The first loop is broken out of after two messages, and the second
+		// has to start with the third.
+		ctx := context.Background()
+		n := 0
+		for m, err := range conn.Messages(ctx) {
+			if err != nil {
+				ended <- err
+				return err
+			}
+			conn.Write(m.Type, m.Data)
+			if n++; n == 2 {
+				break
+			}
+		}
+		// One that's cancelled ends without an error.
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		for _, err := range conn.Messages(cancelled) {
+			ended <- err
+			return err
+		}
+		for m, err := range conn.Messages(ctx) {
+			if err != nil {
+				ended <- err
+				return err
+			}
+			conn.Write(m.Type, m.Data)
+		}
+		return nil
+	}))
+	u := serveTest(t, s)
+
+	conn, _, err := websocket.DefaultDialer.Dial(u+"/messages", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, m := range []string{"1", "2", "3", "4"} {
+		conn.WriteMessage(websocket.TextMessage, []byte(m))
+	}
+	for _, want := range []string{"1", "2", "3", "4"} {
+		_, data, err := conn.ReadMessage()
+		if err != nil || string(data) != want {
+			t.Fatalf("read %q, %v, want %q", data, err, want)
+		}
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4001, "done"))
+	select {
+	case err := <-ended:
+		var ce *websocket.CloseError
+		if !errors.As(err, &ce) || ce.Code != 4001 || ce.Text != "done" {
+			t.Fatalf("the loop ended with %v, want the close", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the loop didn't end once the client closed")
+	}
+}
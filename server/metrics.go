@@ -0,0 +1,316 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// /metrics has the health of the connections in the Prometheus text format,
+// for scraping:
+//
+//	ws_connections_active{endpoint}          connections open right now
+//	ws_connections_total{endpoint}           connections ever opened
+//	ws_messages_received_total               messages read, of either type
+//	ws_messages_sent_total                   messages written
+//	ws_bytes_received_total                  bytes of those messages
+//	ws_bytes_sent_total
+//	ws_ping_rtt_seconds                      histogram of ping round trips
+//	ws_close_codes_total{code,by}            closes, by code, and whether the
+//	                                         client or the server sent them
+//	ws_send_queue_messages                   messages queued for clients
+//	ws_send_queue_bytes                      bytes of those, and of the ones
+//	                                         being written
+//
+// A connection that drops without a close frame is counted as the client
+// closing it with 1006 (abnormal closure), as the libraries report it. The
+// send queues are added up across the connections when they're scraped, so
+// that they're as they are right then.
+//
+// Everything is counted by a transport wrapped around every connection, so
+// that messages from the hub, and closes from the idle reaper or a ban, are
+// counted along with everything else. Counting a message is a couple of
+// atomic adds, so it doesn't slow anything down.
+//
+// There's no Prometheus client library behind this: the format is simple
+// enough to write out directly.
+
+var (
+	connectionsActive = newMetricVec("ws_connections_active", "WebSocket connections currently open.", "gauge", "endpoint")
+	connectionsTotal  = newMetricVec("ws_connections_total", "WebSocket connections opened.", "counter", "endpoint")
+	messagesReceived  = newMetricVec("ws_messages_received_total", "Messages received from clients.", "counter")
+	messagesSent      = newMetricVec("ws_messages_sent_total", "Messages sent to clients.", "counter")
+	bytesReceived     = newMetricVec("ws_bytes_received_total", "Bytes of messages received from clients.", "counter")
+	bytesSent         = newMetricVec("ws_bytes_sent_total", "Bytes of messages sent to clients.", "counter")
+	pingRTT           = newHistogram("ws_ping_rtt_seconds", "Time from sending a ping to getting the pong.",
+		[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10})
+	closeCodes = newMetricVec("ws_close_codes_total", "Close frames, by code, and by who sent them.", "counter", "code", "by")
+)
+
+// metrics is every metric, in the order they're written out.
+var metrics []metric
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+// metricVec is a counter or gauge, with a value for every combination of
+// label values. One without labels has just the one value.
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+
+	mut    sync.Mutex
+	values map[string]*labelledValue
+	// The value, for one without labels, so that it doesn't need the lock.
+	only *int64
+}
+
+type labelledValue struct {
+	labels []string
+	v      int64
+}
+
+func newMetricVec(name, help, kind string, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labels: labels, values: map[string]*labelledValue{}}
+	if len(labels) == 0 {
+		lv := &labelledValue{}
+		m.values[""] = lv
+		m.only = &lv.v
+	}
+	metrics = append(metrics, m)
+	return m
+}
+
+// with gives the value for the label values, to add to atomically.
+func (m *metricVec) with(labels ...string) *int64 {
+	if m.only != nil {
+		return m.only
+	}
+	key := strings.Join(labels, "\xff")
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	lv, ok := m.values[key]
+	if !ok {
+		lv = &labelledValue{labels: labels}
+		m.values[key] = lv
+	}
+	return &lv.v
+}
+
+func (m *metricVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	m.mut.Lock()
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]*labelledValue, len(keys))
+	for i, key := range keys {
+		values[i] = m.values[key]
+	}
+	m.mut.Unlock()
+
+	for _, lv := range values {
+		fmt.Fprintf(w, "%s%s %d\n", m.name, formatLabels(m.labels, lv.labels), atomic.LoadInt64(&lv.v))
+	}
+}
+
+type histogram struct {
+	name, help string
+	bounds     []float64
+
+	mut    sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, bounds []float64) *histogram {
+	h := &histogram{name: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds))}
+	metrics = append(metrics, h)
+	return h
+}
+
+func (h *histogram) observe(v float64) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mut.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	count, sum := h.count, h.sum
+	h.mut.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, strconv.FormatFloat(sum, 'g', -1, 64), h.name, count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// metricsHandler writes out every metric, and the send queues of the
+// connections in the registry.
+func metricsHandler(reg *connRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, m := range metrics {
+			m.writeTo(w)
+		}
+		var messages, bytes int
+		for _, c := range reg.list() {
+			if cl := c.served(); cl != nil {
+				m, b := cl.pending()
+				messages += m
+				bytes += b
+			}
+		}
+		writeGauge(w, "ws_send_queue_messages", "Messages queued for clients.", messages)
+		writeGauge(w, "ws_send_queue_bytes", "Bytes of messages queued for clients, or being written to them.", bytes)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, v int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+}
+
+// metricsTransport counts what goes through the connection.
+type metricsTransport struct {
+	Transport
+	stats *connStats
+	// Only the first close frame counts, whichever side sent it, since the
+	// other side's is only an answer to it, and any more aren't sent at all.
+	closed int32
+}
+
+func (t *metricsTransport) ReadMessage(ctx context.Context) (int, []byte, error) {
+	messageType, data, err := t.Transport.ReadMessage(ctx)
+	if err != nil {
+		t.readFailed(err)
+		return 0, nil, err
+	}
+	atomic.AddInt64(messagesReceived.with(), 1)
+	atomic.AddInt64(&t.stats.messagesIn, 1)
+	t.received(len(data))
+	return messageType, data, nil
+}
+
+// A streamed message counts once it starts coming in, and its bytes as they
+// do.
+func (t *metricsTransport) NextReader(ctx context.Context) (int, io.Reader, error) {
+	messageType, r, err := t.Transport.NextReader(ctx)
+	if err != nil {
+		t.readFailed(err)
+		return 0, nil, err
+	}
+	atomic.AddInt64(messagesReceived.with(), 1)
+	atomic.AddInt64(&t.stats.messagesIn, 1)
+	return messageType, readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		t.received(n)
+		if err != io.EOF {
+			t.readFailed(err)
+		}
+		return n, err
+	}), nil
+}
+
+func (t *metricsTransport) received(n int) {
+	atomic.AddInt64(bytesReceived.with(), int64(n))
+	atomic.AddInt64(&t.stats.bytesIn, int64(n))
+}
+
+func (t *metricsTransport) readFailed(err error) {
+	// A close from the client after the server's is only the client answering
+	// it.
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) && atomic.CompareAndSwapInt32(&t.closed, 0, 1) {
+		atomic.AddInt64(closeCodes.with(strconv.Itoa(ce.Code), "client"), 1)
+	}
+}
+
+func (t *metricsTransport) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	if err := t.Transport.WriteMessage(ctx, messageType, data); err != nil {
+		return err
+	}
+	atomic.AddInt64(messagesSent.with(), 1)
+	atomic.AddInt64(bytesSent.with(), int64(len(data)))
+	atomic.AddInt64(&t.stats.messagesOut, 1)
+	atomic.AddInt64(&t.stats.bytesOut, int64(len(data)))
+	return nil
+}
+
+// A streamed message counts once it's all gone out, and its bytes as they do.
+func (t *metricsTransport) NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error) {
+	w, err := t.Transport.NextWriter(ctx, messageType)
+	if err != nil {
+		return nil, err
+	}
+	return &streamWriter{
+		write: func(p []byte) (int, error) {
+			n, err := w.Write(p)
+			atomic.AddInt64(bytesSent.with(), int64(n))
+			atomic.AddInt64(&t.stats.bytesOut, int64(n))
+			return n, err
+		},
+		close: func() error {
+			if err := w.Close(); err != nil {
+				return err
+			}
+			atomic.AddInt64(messagesSent.with(), 1)
+			atomic.AddInt64(&t.stats.messagesOut, 1)
+			return nil
+		},
+	}, nil
+}
+
+func (t *metricsTransport) Ping(ctx context.Context) (time.Duration, error) {
+	rtt, err := t.Transport.Ping(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if rtt > 0 {
+		pingRTT.observe(rtt.Seconds())
+	}
+	return rtt, nil
+}
+
+func (t *metricsTransport) Close(code int, reason string) error {
+	if atomic.CompareAndSwapInt32(&t.closed, 0, 1) {
+		atomic.AddInt64(closeCodes.with(strconv.Itoa(code), "server"), 1)
+	}
+	return t.Transport.Close(code, reason)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"expvar"
+)
+
+// Whatever needs doing for every envelope, whatever its type, such as
+// checking who's allowed to send it, logging it or counting it, can be done
+// by middleware rather than by every handler. A middleware wraps a handler in
+// another, just as net/http middleware wraps an http.Handler:
+//
+//	func requireUser(next handlerFunc) handlerFunc {
+//		return func(ctx context.Context, c *client, p payload) error {
+//			if c.user == "" {
+//				return &replyError{"unauthorized", "sign in first"}
+//			}
+//			return next(ctx, c, p)
+//		}
+//	}
+//
+// and is added to a dispatcher with use. The payload's typ is the type of the
+// envelope, for middleware that cares which one it is. A middleware that
+// returns without calling next stops the envelope there, and whatever error
+// it returns goes back to the client, as a handler's would.
+//
+// Middleware is added to the handlers as they're registered, so, as with chi,
+// use has to come first. The first middleware added is the outermost one,
+// and sees every envelope first. Requests aren't envelopes, and don't go
+// through it.
+//
+// The /api dispatcher logs every envelope at debug, and counts them by type
+// under api_envelopes.
+
+var apiEnvelopes = expvar.NewMap("api_envelopes")
+
+// A middleware wraps a handler, to do something before or after it, or
+// instead of it.
+type middleware func(next handlerFunc) handlerFunc
+
+// use adds the middleware to every handler registered from now on. It panics
+// if there are handlers already, which would be left out.
+func (d *dispatcher) use(mw ...middleware) {
+	if len(d.handlers) > 0 {
+		panic("dispatcher: middleware must be added before any handler")
+	}
+	d.middleware = append(d.middleware, mw...)
+}
+
+// logEnvelopes logs every envelope at debug.
+func logEnvelopes(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, c *client, p payload) error {
+		c.log.Debug("Got envelope", "type", p.typ, "bytes", len(p.data))
+		return next(ctx, c, p)
+	}
+}
+
+// countEnvelopes counts every envelope under api_envelopes, by type.
+func countEnvelopes(next handlerFunc) handlerFunc {
+	return func(ctx context.Context, c *client, p payload) error {
+		apiEnvelopes.Add(p.typ, 1)
+		return next(ctx, c, p)
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sync/errgroup"
+)
+
+// Every WebSocket endpoint is a Mode on a path: what the endpoint does with
+// its connections, the subprotocols it speaks, and the limits its connections
+// get, where they aren't the server's. Everything else, from the upgrade to
+// the close, and the checks, auth and metrics along the way, is the same for
+// every mode, and done once, by connHandler and runConn. The server's own
+// endpoints are modes, and more can be added with Handle, before the server
+// is run:
+//
+//	s, err := server.New(opts...)
+//	...
+//	hub := server.NewHub()
+//	s.Handle("/ws/echo", server.EchoHandler())
+//	s.Handle("/ws/chat", server.HubHandler(hub))
+//	s.Handle("/ws/feed", server.FeedHandler(hub, server.ModeReadLimit(125)))
+//	go hub.Broadcast(ctx, websocket.TextMessage, []byte("hello"))
+//	err = s.Run(ctx)
+//
+// Connections are counted, and logged, under the path they were made on,
+// whichever mode it is.
+//
+// Out of the box, the server has /ws/echo and /ws/chat, the same as /echo and
+// /chat, on the same hub as /chat, and /ws/feed, the firehose of that hub,
+// which gets everything broadcast through it, to every room, and can't send
+// anything. A message from a feed client closes it with 1008 (policy
+// violation).
+
+var errFeedReadOnly = errors.New("client sent a message to a publish-only feed")
+
+// A Mode is what an endpoint does with its connections. It's made with
+// EchoHandler, HubHandler or FeedHandler, and given to Handle.
+type Mode struct {
+	subprotocols []string
+	serve        connServer
+	// The read limit and the send queue size of the mode's connections, or
+	// zero for the server's.
+	readLimit int64
+	sendQueue int
+	// Whether the clients only listen, so that they're never expected to send
+	// anything: they get no handshake grace period, and aren't idle.
+	listenOnly bool
+	// The hub the mode serves, if any, which the server runs.
+	hub *hub
+}
+
+// A ModeOption sets a limit for the connections of a mode.
+type ModeOption func(*Mode)
+
+// ModeReadLimit limits the size of the messages the mode's clients can send,
+// rather than the server's read limit.
+func ModeReadLimit(n int64) ModeOption {
+	return func(m *Mode) { m.readLimit = n }
+}
+
+// ModeSendQueue sets how many messages can be queued for each of the mode's
+// clients, rather than the server's send queue size.
+func ModeSendQueue(n int) ModeOption {
+	return func(m *Mode) { m.sendQueue = n }
+}
+
+func newMode(serve connServer, opts []ModeOption) Mode {
+	m := Mode{serve: serve}
+	for _, opt := range opts {
+		opt(&m)
+	}
+	return m
+}
+
+// EchoHandler is the strict echo of /echo: every message is sent straight
+// back as it is, and nothing else is ever sent.
+func EchoHandler(opts ...ModeOption) Mode {
+	return newMode(strictEchoServer(), opts)
+}
+
+// HubHandler is the chat of /chat, through the hub: every message is
+// broadcast to every client in the hub, apart from the room actions.
+func HubHandler(h *Hub, opts ...ModeOption) Mode {
+	m := newMode(chatServer(h.h), opts)
+	m.hub = h.h
+	return m
+}
+
+// FeedHandler is the firehose of the hub: its clients get everything
+// broadcast through the hub, to every room, and can't send anything.
+func FeedHandler(h *Hub, opts ...ModeOption) Mode {
+	m := newMode(feedServer(h.h), opts)
+	m.hub, m.listenOnly = h.h, true
+	return m
+}
+
+// A Hub is what the clients of HubHandler talk to each other through, and
+// what FeedHandler's listen to.
+type Hub struct {
+	h *hub
+}
+
+// NewHub makes a hub, which the server it's handled by runs.
+func NewHub() *Hub {
+	return &Hub{newHub()}
+}
+
+// Broadcast sends the message to every client of the hub, and every feed of
+// it.
+func (h *Hub) Broadcast(ctx context.Context, messageType int, data []byte) {
+	h.h.broadcast(ctx, messageType, data)
+}
+
+// settings gives cfg, with the mode's limits in place of the server's.
+func (m Mode) settings(cfg *settings) *settings {
+	if m.readLimit <= 0 && m.sendQueue <= 0 {
+		return cfg
+	}
+	own := *cfg
+	if m.readLimit > 0 {
+		own.readLimit = m.readLimit
+	}
+	if m.sendQueue > 0 {
+		own.sendQueue.size = m.sendQueue
+	}
+	return &own
+}
+
+// Handle serves the mode on the path. It has to be called before the server
+// is run.
+func (s *Server) Handle(path string, m Mode) {
+	if m.hub != nil {
+		s.addHub(m.hub)
+	}
+	s.modes.HandleFunc(path, s.wsHandler(m))
+}
+
+// addHub gives the hub the server's settings for hubs, and has the server run
+// it, unless it already does.
+func (s *Server) addHub(h *hub) {
+	for _, other := range s.hubs {
+		if other == h {
+			return
+		}
+	}
+	h.roomRate = writeRate{s.opts.roomRate, s.opts.roomBurst}
+	h.roomLimits = s.roomLimits
+	h.workers = s.opts.broadcastWorkers
+	h.labelKeys = s.labelKeys
+	h.conflicts = s.nameConflicts
+	if s.opts.sessionGrace > 0 {
+		h.sessions = newSessionStore(s.opts.sessionGrace)
+	}
+	s.hubs = append(s.hubs, h)
+}
+
+// feedServer is a feed of the hub: the client is sent everything broadcast
+// through it, and closed if it sends anything.
+func feedServer(h *hub) connServer {
+	return func(ctx context.Context, g *errgroup.Group, c *client) error {
+		h.listen(c)
+		defer h.leave(c)
+		h.watch(ctx, g, c)
+		if _, _, err := c.read(ctx); err != nil {
+			return err
+		}
+		c.close(ctx, websocket.ClosePolicyViolation, "the feed is publish-only")
+		return errFeedReadOnly
+	}
+}
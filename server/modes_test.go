@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestModes(t *testing.T) {
+	// Handled after New, and still ahead of the demo's files.
+	s, err := New(WithUpgradeRate(0, 0, 0), WithDemo(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Handle("/custom/echo", EchoHandler(ModeReadLimit(16)))
+	u := serveTest(t, s)
+
+	dial := func(t *testing.T, path string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(u+path, nil)
+		if err != nil {
+			t.Fatalf("dialing %s: %v", path, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	// Skipping the session a chat client is told it has.
+	read := func(t *testing.T, conn *websocket.Conn, want string) {
+		t.Helper()
+		_, message, err := conn.ReadMessage()
+		if err == nil && strings.HasPrefix(string(message), `{"type":"session"`) {
+			_, message, err = conn.ReadMessage()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(message) != want {
+			t.Fatalf("got %q, want %q", message, want)
+		}
+	}
+	closedWithCode := func(t *testing.T, conn *websocket.Conn, code int) {
+		t.Helper()
+		for {
+			_, _, err := conn.ReadMessage()
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				if ce.Code != code {
+					t.Fatalf("closed with %d, want %d", ce.Code, code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("echo with its own read limit", func(t *testing.T) {
+		total := atomic.LoadInt64(connectionsTotal.with("/custom/echo"))
+		echo := dial(t, "/custom/echo")
+		echo.WriteMessage(websocket.TextMessage, []byte("hello"))
+		read(t, echo, "hello")
+		if got := atomic.LoadInt64(connectionsTotal.with("/custom/echo")) - total; got != 1 {
+			t.Fatalf("ws_connections_total for /custom/echo went up by %d, want 1", got)
+		}
+		echo.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 17)))
+		closedWithCode(t, echo, websocket.CloseMessageTooBig)
+	})
+
+	t.Run("the server's own", func(t *testing.T) {
+		feed := dial(t, "/ws/feed")
+		chat := dial(t, "/chat")
+		chat.WriteMessage(websocket.TextMessage, []byte("hello"))
+		read(t, feed, "hello")
+		echo := dial(t, "/ws/echo")
+		echo.WriteMessage(websocket.BinaryMessage, []byte("hello"))
+		read(t, echo, "hello")
+	})
+}
+
+func TestFeedHub(t *testing.T) {
+	s, err := New(WithUpgradeRate(0, 0, 0), WithHandshakeGrace(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub()
+	s.Handle("/custom/chat", HubHandler(hub))
+	s.Handle("/custom/feed", FeedHandler(hub))
+	pipeServe(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Skipping the session a chat client is told it has.
+	read := func(conn *pipedConn, want string) {
+		t.Helper()
+		m, err := conn.Next(ctx)
+		if err == nil && strings.HasPrefix(string(m.Data), `{"type":"session"`) {
+			m, err = conn.Next(ctx)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Data) != want {
+			t.Fatalf("got %q, want %q", m.Data, want)
+		}
+	}
+
+	feed := pipeDial(t, s, "/custom/feed")
+	// Longer than the handshake grace, which a feed doesn't get.
+	time.Sleep(300 * time.Millisecond)
+	alice := pipeDial(t, s, "/custom/chat")
+	bob := pipeDial(t, s, "/custom/chat")
+	bob.Inject(websocket.TextMessage, []byte(`{"action":"join","room":"lobby"}`))
+	read(bob, `{"type":"joined","room":"lobby"}`)
+
+	alice.Inject(websocket.TextMessage, []byte("to everyone"))
+	read(feed, "to everyone")
+	read(bob, "to everyone")
+	hub.Broadcast(context.Background(), websocket.TextMessage, []byte("from the server"))
+	read(feed, "from the server")
+	read(bob, "from the server")
+	// It even gets what's said in rooms nobody on the feed is in.
+	said := `{"action":"send","room":"lobby","message":"to the lobby"}`
+	bob.Inject(websocket.TextMessage, []byte(said))
+	read(bob, said)
+	read(feed, said)
+
+	feed.Inject(websocket.TextMessage, []byte("hello?"))
+	select {
+	case <-feed.Done():
+	case <-ctx.Done():
+		t.Fatal("the feed wasn't closed for sending")
+	}
+	if code, _, _ := feed.Closed(); code != websocket.ClosePolicyViolation {
+		t.Fatalf("closed with %d, want %d", code, websocket.ClosePolicyViolation)
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A client on /api can give itself a display name in a room as it joins it:
+//
+//	{"type":"chat.join","payload":{"room":"lobby","name":"alice"}}
+//
+// A name is 1 to 32 characters, once the spaces around it are trimmed, none
+// of them a control character, and no two members of a room have the same
+// one, whatever their case. One that's taken is, by -name-conflicts, either
+// given a suffix, so that the second alice is alice-2, or turned away with
+// name_taken. The name the client ends up with is in its chat.joined. Names
+// are sent HTML-escaped, so that a name can't put markup on a page that shows
+// it, such as the browser demo's.
+//
+// The name is in the presence events and lists of the room, and in every
+// message the client sends to it, which, from chat.v3 on, says who it's from
+// as
+//
+//	{"type":"chat.message","payload":{"room":"lobby","message":"hello","from":{"id":4,"name":"alice","user":"alice"}}}
+//
+// with the connection's id, its name in the room, if it has one, and its user,
+// when authentication is on, whatever the client put there. Before chat.v3,
+// and on /api, from is still just the user. A member can change its name
+// with
+//
+//	{"type":"chat.nick","payload":{"room":"lobby","name":"bob"}}
+//
+// which gets the same treatment, and is told to everyone in the room,
+// including the member, as
+//
+//	{"type":"chat.renamed","payload":{"room":"lobby","id":4,"name":"bob","old":"alice"}}
+//
+// Names are taken and given up under the hub's lock, so that two members
+// can't both end up with the same one, however close together they ask.
+
+const (
+	codeBadName   = "bad_name"
+	codeNameTaken = "name_taken"
+)
+
+// In characters.
+const maxNameLength = 32
+
+var (
+	errBadName   = fmt.Errorf("names must be 1 to %d characters, with no control characters", maxNameLength)
+	errNameTaken = errors.New("the name is taken in the room")
+)
+
+// nameConflicts is what to do with a name that's taken.
+type nameConflicts int
+
+const (
+	nameSuffix nameConflicts = iota
+	nameReject
+)
+
+func parseNameConflicts(s string) (nameConflicts, error) {
+	switch s {
+	case "suffix":
+		return nameSuffix, nil
+	case "reject":
+		return nameReject, nil
+	}
+	return 0, fmt.Errorf("unknown name conflict policy %q; expected suffix or reject", s)
+}
+
+type joinPayload struct {
+	Room string `json:"room" pb:"1" validate:"required,max=64"`
+	Name string `json:"name,omitempty" pb:"2"`
+}
+
+type nickPayload struct {
+	Room string `json:"room" pb:"1" validate:"required,max=64"`
+	Name string `json:"name" pb:"2" validate:"required"`
+}
+
+type renamedPayload struct {
+	Room string `json:"room" pb:"1"`
+	ID   uint64 `json:"id" pb:"2"`
+	Name string `json:"name" pb:"3"`
+	Old  string `json:"old,omitempty" pb:"4"`
+}
+
+// chatSender is who a chat.message is from.
+type chatSender struct {
+	ID   uint64 `json:"id" pb:"1"`
+	Name string `json:"name,omitempty" pb:"2"`
+	User string `json:"user,omitempty" pb:"3"`
+}
+
+// checkName gives the name, trimmed, if it's one a client can have.
+func checkName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if n := utf8.RuneCountInString(name); n == 0 || n > maxNameLength {
+		return "", errBadName
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) && r != ' ' {
+			return "", errBadName
+		}
+	}
+	return name, nil
+}
+
+// withSuffix gives the name with the suffix, cut short to fit.
+func withSuffix(name string, n int) string {
+	suffix := "-" + strconv.Itoa(n)
+	runes := []rune(name)
+	if keep := maxNameLength - len(suffix); len(runes) > keep {
+		runes = runes[:keep]
+	}
+	return string(runes) + suffix
+}
+
+// claimName gives the client the name in the room it's in, in place of any it
+// has, and gives the name it ends up with, which, when it's taken and
+// conflicts are given a suffix, isn't quite the one it asked for. h.mut must
+// be held.
+func (h *hub) claimName(c *client, room, name string) (string, error) {
+	name, err := checkName(name)
+	if err != nil {
+		return "", err
+	}
+	taken := h.names[room]
+	if taken == nil {
+		taken = map[string]*client{}
+		h.names[room] = taken
+	}
+	free := func(name string) bool {
+		holder, ok := taken[strings.ToLower(name)]
+		return !ok || holder == c
+	}
+	if !free(name) {
+		if h.conflicts == nameReject {
+			return "", errNameTaken
+		}
+		base := name
+		for n := 2; !free(name); n++ {
+			name = withSuffix(base, n)
+		}
+	}
+	h.releaseName(c, room)
+	taken[strings.ToLower(name)] = c
+	if h.nicks[c] == nil {
+		h.nicks[c] = map[string]string{}
+	}
+	h.nicks[c][room] = name
+	return name, nil
+}
+
+// releaseName gives up the client's name in the room, if it has one. h.mut
+// must be held.
+func (h *hub) releaseName(c *client, room string) {
+	name, ok := h.nicks[c][room]
+	if !ok {
+		return
+	}
+	delete(h.nicks[c], room)
+	if len(h.nicks[c]) == 0 {
+		delete(h.nicks, c)
+	}
+	delete(h.names[room], strings.ToLower(name))
+	if len(h.names[room]) == 0 {
+		delete(h.names, room)
+	}
+}
+
+// nameIn gives the client's name in the room, escaped, or "" if it has none.
+// h.mut must be held.
+func (h *hub) nameIn(c *client, room string) string {
+	return html.EscapeString(h.nicks[c][room])
+}
+
+// sender gives who a message from the client to the room is from.
+func (h *hub) sender(c *client, room string) *chatSender {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return &chatSender{ID: c.id, Name: h.nameIn(c, room), User: c.user}
+}
+
+// rename gives the client a new name in the room, and tells everyone in it.
+func (h *hub) rename(c *client, room, name string) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if _, ok := h.clients[c][room]; !ok {
+		return errNotInRoom
+	}
+	old := h.nameIn(c, room)
+	if _, err := h.claimName(c, room, name); err != nil {
+		return err
+	}
+	h.deliver(broadcastMessage{
+		room:     room,
+		envelope: newOutgoing("chat.renamed", renamedPayload{Room: room, ID: c.id, Name: h.nameIn(c, room), Old: old}),
+	})
+	return nil
+}
+
+// nameError gives the reply for why the client can't have a name, or err as
+// it is if it isn't about the name.
+func nameError(err error) error {
+	switch {
+	case errors.Is(err, errBadName):
+		return &replyError{codeBadName, err.Error()}
+	case errors.Is(err, errNameTaken):
+		return &replyError{codeNameTaken, err.Error()}
+	case errors.Is(err, errNotInRoom):
+		return &replyError{codeNotInRoom, err.Error()}
+	}
+	return err
+}
+
+// handleNames registers chat.nick with the dispatcher.
+func handleNames(d *dispatcher, h *hub) {
+	d.validate("chat.nick", nickPayload{})
+	d.handle("chat.nick", func(ctx context.Context, c *client, payload payload) error {
+		var p nickPayload
+		if err := decodeRoomPayload(payload, &p, &p.Room); err != nil {
+			return err
+		}
+		return nameError(h.rename(c, p.Room, p.Name))
+	})
+}
+
+// A legacyPayload is a payload that's sent another way to clients of versions
+// before it changed.
+type legacyPayload interface {
+	legacy() interface{}
+}
+
+// legacyOf gives the payload as it's sent to clients of earlier versions.
+func legacyOf(payload interface{}) interface{} {
+	if l, ok := payload.(legacyPayload); ok {
+		return l.legacy()
+	}
+	return payload
+}
+
+// attributedCodec is JSON, as chat.v3 has it, with chat.message from a
+// chatSender, rather than the user. It's a codec of its own, so that
+// broadcasts are encoded for it separately.
+type attributedCodec struct {
+	jsonCodec
+}
+
+func (attributedCodec) name() string {
+	return "json-attributed"
+}
+
+func (attributedCodec) encodePayload(payload interface{}) ([]byte, error) {
+	return json.Marshal(payload)
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{"alice", "alice", nil},
+		{"  alice  ", "alice", nil},
+		{"Zoë Smith", "Zoë Smith", nil},
+		{strings.Repeat("é", maxNameLength), strings.Repeat("é", maxNameLength), nil},
+		{strings.Repeat("é", maxNameLength+1), "", errBadName},
+		{"", "", errBadName},
+		{"   ", "", errBadName},
+		{"al\x00ice", "", errBadName},
+		{"al\nice", "", errBadName},
+		{"al\u200bice", "", errBadName},
+	}
+	for _, tt := range tests {
+		got, err := checkName(tt.name)
+		if got != tt.want || err != tt.err {
+			t.Errorf("checkName(%q) = %q, %v, want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestWithSuffix(t *testing.T) {
+	if got := withSuffix("alice", 2); got != "alice-2" {
+		t.Errorf("got %q, want alice-2", got)
+	}
+	long := strings.Repeat("é", maxNameLength)
+	if got := withSuffix(long, 12); got != strings.Repeat("é", maxNameLength-3)+"-12" {
+		t.Errorf("got %q, which is %d characters", got, len([]rune(got)))
+	}
+}
+
+func TestClaimNameConcurrently(t *testing.T) {
+	for _, conflicts := range []nameConflicts{nameSuffix, nameReject} {
+		h := newHub()
+		h.conflicts = conflicts
+		clients := make([]*client, 20)
+		for i := range clients {
+			clients[i] = newClient(newFakeTransport(), "", sendQueue{size: 100}, messageRate{})
+			clients[i].id = uint64(i + 1)
+			h.join(clients[i])
+			if _, err := h.joinRoomAs(clients[i], "lobby", fmt.Sprint("member ", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var wg sync.WaitGroup
+		errs := make([]error, len(clients))
+		for i, c := range clients {
+			wg.Add(1)
+			go func(i int, c *client) {
+				defer wg.Done()
+				errs[i] = h.rename(c, "lobby", "Alice")
+			}(i, c)
+		}
+		wg.Wait()
+
+		seen := map[string]bool{}
+		renamed := 0
+		for i, c := range clients {
+			name := h.nicks[c]["lobby"]
+			if seen[strings.ToLower(name)] {
+				t.Fatalf("with %v, two members are called %q", conflicts, name)
+			}
+			seen[strings.ToLower(name)] = true
+			if errs[i] == nil {
+				renamed++
+			} else if errs[i] != errNameTaken || conflicts != nameReject {
+				t.Fatalf("with %v, renaming gave %v", conflicts, errs[i])
+			}
+			if h.names["lobby"][strings.ToLower(name)] != c {
+				t.Fatalf("with %v, %q isn't taken by the member who has it", conflicts, name)
+			}
+		}
+		if want := map[nameConflicts]int{nameSuffix: len(clients), nameReject: 1}[conflicts]; renamed != want {
+			t.Fatalf("with %v, %d were renamed, want %d", conflicts, renamed, want)
+		}
+		if len(h.names["lobby"]) != len(clients) {
+			t.Fatalf("with %v, %d names are taken, want %d", conflicts, len(h.names["lobby"]), len(clients))
+		}
+
+		// Leaving gives the name up.
+		for _, c := range clients {
+			h.leave(c)
+		}
+		if len(h.names) != 0 || len(h.nicks) != 0 {
+			t.Fatalf("with %v, names are still taken: %v", conflicts, h.names)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	u := testServer(t)
+	dial := func(t *testing.T, subprotocol, room, name string) (*websocket.Conn, string) {
+		t.Helper()
+		path, dialer := "/api", websocket.DefaultDialer
+		if subprotocol != "" {
+			path, dialer = "/api/versioned", &websocket.Dialer{Subprotocols: []string{subprotocol}}
+		}
+		conn, _, err := dialer.Dial(u+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		conn.WriteJSON(map[string]interface{}{"type": "chat.join", "payload": map[string]string{"room": room, "name": name}})
+		var p joinPayload
+		json.Unmarshal(nextEnvelope(t, conn, "chat.joined").Payload, &p)
+		return conn, p.Name
+	}
+
+	alice, name := dial(t, "chat.v3", "lobby", "alice")
+	if name != "alice" {
+		t.Fatalf("joined as %q, want alice", name)
+	}
+	// The name is taken, whatever the case, so it gets a suffix.
+	other, name := dial(t, "", "lobby", " ALICE ")
+	if name != "ALICE-2" {
+		t.Fatalf("joined as %q, want ALICE-2", name)
+	}
+	var joined presenceEvent
+	for joined.Name == "" {
+		var e testEnvelope
+		if err := alice.ReadJSON(&e); err != nil {
+			t.Fatalf("reading a presence.joined: %v", err)
+		}
+		if e.Type == "presence.joined" {
+			json.Unmarshal(e.Payload, &joined)
+		}
+	}
+	if joined.Name != "ALICE-2" {
+		t.Fatalf("presence.joined has the name %q, want ALICE-2", joined.Name)
+	}
+	// The same name is free in another room, and is escaped.
+	if _, name := dial(t, "", "elsewhere", "<b>alice</b>"); name != "&lt;b&gt;alice&lt;/b&gt;" {
+		t.Fatalf("joined as %q", name)
+	}
+
+	// Whatever the client puts in from is replaced, and from chat.v3 on,
+	// it's who the message is from.
+	other.WriteJSON(map[string]interface{}{"type": "chat.send", "payload": map[string]interface{}{"room": "lobby", "message": "hi", "from": "mallory"}})
+	var v3 struct {
+		From chatSender `json:"from"`
+	}
+	json.Unmarshal(nextEnvelope(t, alice, "chat.message").Payload, &v3)
+	if v3.From.Name != "ALICE-2" || v3.From.ID != joined.ID || v3.From.User != "" {
+		t.Fatalf("chat.v3 was sent the message from %+v", v3.From)
+	}
+	var legacy map[string]json.RawMessage
+	json.Unmarshal(nextEnvelope(t, other, "chat.message").Payload, &legacy)
+	if _, ok := legacy["from"]; ok {
+		t.Fatalf("/api was sent the message from %s, with authentication off", legacy["from"])
+	}
+
+	// Renames are told to everyone in the room.
+	other.WriteJSON(map[string]interface{}{"type": "chat.nick", "payload": map[string]string{"room": "lobby", "name": "bob"}})
+	for _, conn := range []*websocket.Conn{alice, other} {
+		var p renamedPayload
+		json.Unmarshal(nextEnvelope(t, conn, "chat.renamed").Payload, &p)
+		if p != (renamedPayload{Room: "lobby", ID: joined.ID, Name: "bob", Old: "ALICE-2"}) {
+			t.Fatalf("chat.renamed %+v", p)
+		}
+	}
+	for _, tt := range []struct {
+		room, name, code string
+	}{
+		{"lobby", "\x01", codeBadName},
+		{"elsewhere", "carol", codeNotInRoom},
+	} {
+		other.WriteJSON(map[string]interface{}{"type": "chat.nick", "payload": map[string]string{"room": tt.room, "name": tt.name}})
+		var p errorPayload
+		json.Unmarshal(nextEnvelope(t, other, "error").Payload, &p)
+		if p.Code != tt.code {
+			t.Fatalf("renaming to %q in %s gave %+v, want %s", tt.name, tt.room, p, tt.code)
+		}
+	}
+
+	// Without suffixes, a name that's taken is turned away.
+	u = testServer(t, WithNameConflicts("reject"))
+	dial(t, "", "lobby", "alice")
+	conn, _, err := websocket.DefaultDialer.Dial(u+"/api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteJSON(map[string]interface{}{"type": "chat.join", "payload": map[string]string{"room": "lobby", "name": "Alice"}})
+	var p errorPayload
+	json.Unmarshal(nextEnvelope(t, conn, "error").Payload, &p)
+	if p.Code != codeNameTaken {
+		t.Fatalf("joining as a name that's taken gave %+v", p)
+	}
+}
@@ -0,0 +1,507 @@
+package server
+
+import (
+	"log/slog"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Everything about the server that can be configured is set with an Option
+// given to New. Anything left alone gets the same default as the flag of the
+// same name in the wsexample command. Some of these are only the defaults of
+// the reloadable settings, which the config file can override; see
+// settings.go.
+
+// An Option configures a Server.
+type Option func(*options)
+
+type options struct {
+	addr            string
+	socketMode      os.FileMode
+	tlsCert         string
+	tlsKey          string
+	autocertDomains []string
+	autocertCache   string
+	redirectAddr    string
+	requireHTTPS    bool
+
+	readHeaderTimeout time.Duration
+	handshakeTimeout  time.Duration
+	handshakeGrace    time.Duration
+	writeWaits        writeWaits
+	pongWait          time.Duration
+	minPingInterval   time.Duration
+	maxPingInterval   time.Duration
+	readLimit         int64
+	streamLimit       int64
+	latencyReports    bool
+	demo              bool
+
+	sendQueue    int
+	sendOverflow string
+	messageRate  int
+	messageBurst int
+	ratePolicy   string
+	writeRate    int
+	writeBurst   int
+	roomRate     int
+	roomBurst    int
+	roomLimits   roomLimits
+	// How many goroutines a broadcast can be queued by at once.
+	broadcastWorkers int
+	// The most bytes of messages pending for a client, or 0 for no limit.
+	sendQueueBytes int
+	// The keys of the labels clients can set.
+	labelKeys []string
+	// What's done with a connection for a user with another open.
+	duplicateSessions string
+
+	allow          []string
+	deny           []string
+	ipRulesFile    string
+	tokensFile     string
+	jwtSecretFile  string
+	configFile     string
+	origins        []string
+	trustedProxies []string
+
+	transport            string
+	compression          bool
+	compressionThreshold int
+
+	traceFrames bool
+	traceFile   string
+	recordDir   string
+	dev         bool
+	chaos       string
+
+	idleTimeout   time.Duration
+	idleGrace     time.Duration
+	upgradeRate   int
+	upgradeWindow time.Duration
+	upgradeAddrs  int
+	maxConns      int
+	maxConnsPerIP int
+
+	historySize  int
+	historyRooms int
+	sessionGrace time.Duration
+	nameConflict string
+	typingEvery  time.Duration
+	typingFor    time.Duration
+	mailboxTTL   time.Duration
+	mailboxSize  int
+	redisURL     string
+	redisChannel string
+	banFile      string
+	rpcTimeout   time.Duration
+
+	shutdownTimeout time.Duration
+	adminToken      string
+	errorHook       ErrorHook
+	logLevel        *slog.LevelVar
+	interceptIn     interceptorChain
+	interceptOut    interceptorChain
+
+	signingKeysFile  string
+	signatureStrikes int
+}
+
+func defaultOptions() options {
+	return options{
+		addr:                 "0.0.0.0:8080",
+		socketMode:           0660,
+		autocertCache:        "autocert-cache",
+		readHeaderTimeout:    10 * time.Second,
+		handshakeTimeout:     10 * time.Second,
+		handshakeGrace:       10 * time.Second,
+		writeWaits:           writeWaits{control: 5 * time.Second, message: 60 * time.Second, broadcast: 2 * time.Minute, stream: 5 * time.Minute},
+		pongWait:             60 * time.Second,
+		minPingInterval:      10 * time.Second,
+		maxPingInterval:      5 * time.Minute,
+		readLimit:            readLimit,
+		streamLimit:          streamLimit,
+		sendQueue:            256,
+		sendOverflow:         "disconnect",
+		sendQueueBytes:       4 << 20,
+		messageRate:          20,
+		messageBurst:         40,
+		ratePolicy:           "drop",
+		transport:            "gorilla",
+		compressionThreshold: 512,
+		idleGrace:            30 * time.Second,
+		upgradeWindow:        time.Minute,
+		upgradeAddrs:         10000,
+		historySize:          100,
+		historyRooms:         1000,
+		sessionGrace:         30 * time.Second,
+		nameConflict:         "suffix",
+		duplicateSessions:    "allow",
+		typingEvery:          3 * time.Second,
+		typingFor:            5 * time.Second,
+		mailboxSize:          100,
+		redisChannel:         "wsexample",
+		signatureStrikes:     3,
+		broadcastWorkers:     runtime.NumCPU(),
+		rpcTimeout:           10 * time.Second,
+		shutdownTimeout:      10 * time.Second,
+		demo:                 true,
+	}
+}
+
+// WithAddr listens on the address, either host:port or
+// unix:///path/to/socket, unless systemd passes the server its sockets.
+func WithAddr(addr string) Option {
+	return func(o *options) { o.addr = addr }
+}
+
+// WithSocketMode sets the file mode of the unix socket, when listening on one.
+func WithSocketMode(mode os.FileMode) Option {
+	return func(o *options) { o.socketMode = mode }
+}
+
+// WithTLS serves TLS with the certificate and private key files.
+func WithTLS(certFile, keyFile string) Option {
+	return func(o *options) { o.tlsCert, o.tlsKey = certFile, keyFile }
+}
+
+// WithAutocert serves TLS for the domains with certificates from Let's
+// Encrypt, kept in the cache directory.
+func WithAutocert(domains []string, cache string) Option {
+	return func(o *options) { o.autocertDomains, o.autocertCache = domains, cache }
+}
+
+// WithHTTPSRedirect also listens on the address for plain HTTP, redirecting
+// everything to HTTPS.
+func WithHTTPSRedirect(addr string) Option {
+	return func(o *options) { o.redirectAddr = addr }
+}
+
+// WithRequireHTTPS redirects requests that weren't made over HTTPS, going by
+// X-Forwarded-Proto from trusted proxies.
+func WithRequireHTTPS(require bool) Option {
+	return func(o *options) { o.requireHTTPS = require }
+}
+
+// WithReadHeaderTimeout sets the time allowed to read the headers of a
+// request.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(o *options) { o.readHeaderTimeout = d }
+}
+
+// WithHandshakeTimeout sets the time allowed to complete the WebSocket
+// handshake.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(o *options) { o.handshakeTimeout = d }
+}
+
+// WithHandshakeGrace sets the time allowed between the upgrade and the first
+// frame from the client.
+func WithHandshakeGrace(d time.Duration) Option {
+	return func(o *options) { o.handshakeGrace = d }
+}
+
+// WithWriteWait sets the time allowed to write a message to a client, other
+// than a broadcast or a stream.
+func WithWriteWait(d time.Duration) Option {
+	return func(o *options) { o.writeWaits.message = d }
+}
+
+// WithControlWriteWait sets the time allowed to write a ping or a close frame
+// to a client.
+func WithControlWriteWait(d time.Duration) Option {
+	return func(o *options) { o.writeWaits.control = d }
+}
+
+// WithBroadcastWriteWait sets the time allowed to write a message broadcast to
+// a room, or to everyone, to a client.
+func WithBroadcastWriteWait(d time.Duration) Option {
+	return func(o *options) { o.writeWaits.broadcast = d }
+}
+
+// WithStreamWriteWait sets the time allowed to write the whole of a streamed
+// message to a client.
+func WithStreamWriteWait(d time.Duration) Option {
+	return func(o *options) { o.writeWaits.stream = d }
+}
+
+// WithPongWait sets the time allowed for a pong to come back, for clients
+// that haven't asked for a keepalive of their own. They're pinged every nine
+// tenths of it.
+func WithPongWait(d time.Duration) Option {
+	return func(o *options) { o.pongWait = d }
+}
+
+// WithPingIntervalBounds sets the shortest and longest ping interval a client
+// may ask for.
+func WithPingIntervalBounds(min, max time.Duration) Option {
+	return func(o *options) { o.minPingInterval, o.maxPingInterval = min, max }
+}
+
+// WithReadLimit sets the largest message, in bytes, a client may send.
+func WithReadLimit(n int64) Option {
+	return func(o *options) { o.readLimit = n }
+}
+
+// WithStreamLimit sets the largest message, in bytes, a client may stream in
+// on /upload.
+func WithStreamLimit(n int64) Option {
+	return func(o *options) { o.streamLimit = n }
+}
+
+// WithDemo has the browser demo served at /.
+func WithDemo(enabled bool) Option {
+	return func(o *options) { o.demo = enabled }
+}
+
+// WithLatencyReports has clients on /ws told the round trip of every ping,
+// along with the average of the last few.
+func WithLatencyReports(enabled bool) Option {
+	return func(o *options) { o.latencyReports = enabled }
+}
+
+// WithSendQueue sets how many messages can be queued for a client, and what
+// to do with a message for a client whose queue is full: disconnect,
+// drop-oldest or drop-newest.
+func WithSendQueue(size int, overflow string) Option {
+	return func(o *options) { o.sendQueue, o.sendOverflow = size, overflow }
+}
+
+// WithSendQueueBytes sets how many bytes of messages can be pending for a
+// client, queued or being written, before its overflow policy kicks in, as it
+// does for a queue that's full of messages. Zero is no limit.
+func WithSendQueueBytes(n int) Option {
+	return func(o *options) { o.sendQueueBytes = n }
+}
+
+// WithMessageRate sets how many messages per second a client may send, after
+// a burst of them, and what to do with the ones over it: drop or disconnect.
+// A rate of zero is unlimited, and a burst of zero is a second's worth.
+func WithMessageRate(rate, burst int, policy string) Option {
+	return func(o *options) { o.messageRate, o.messageBurst, o.ratePolicy = rate, burst, policy }
+}
+
+// WithWriteRate sets how many bytes per second of messages to send each
+// client, after a burst of them. A rate of zero is unlimited, and a burst of
+// zero is a second's worth.
+func WithWriteRate(rate, burst int) Option {
+	return func(o *options) { o.writeRate, o.writeBurst = rate, burst }
+}
+
+// WithRoomWriteRate sets how many bytes per second of broadcasts to send the
+// members of each room, between all of them, after a burst of them. A rate of
+// zero is unlimited, and a burst of zero is a second's worth.
+func WithRoomWriteRate(rate, burst int) Option {
+	return func(o *options) { o.roomRate, o.roomBurst = rate, burst }
+}
+
+// WithRoomLimits sets the limits every room has unless it's given its own,
+// through the admin API: how many members it can have, how many messages per
+// second its members can send it, after a burst, and how many bytes each can
+// be. Zero is no limit, and a burst of zero is a second's worth.
+func WithRoomLimits(maxMembers, messageRate, messageBurst, maxMessage int) Option {
+	return func(o *options) { o.roomLimits = roomLimits{maxMembers, messageRate, messageBurst, maxMessage} }
+}
+
+// WithBroadcastWorkers sets how many goroutines a broadcast to thousands of
+// clients can be queued for them by at once. It's one for each CPU by
+// default.
+func WithBroadcastWorkers(n int) Option {
+	return func(o *options) { o.broadcastWorkers = n }
+}
+
+// WithLabelKeys sets the keys of the labels that clients can give themselves,
+// or be given by their tokens. Without any, clients have no labels.
+func WithLabelKeys(keys []string) Option {
+	return func(o *options) { o.labelKeys = keys }
+}
+
+// WithIPRules sets the CIDRs allowed and denied to connect, along with a file
+// of "allow <cidr>" and "deny <cidr>" lines, which is re-read on Reload.
+func WithIPRules(allow, deny []string, file string) Option {
+	return func(o *options) { o.allow, o.deny, o.ipRulesFile = allow, deny, file }
+}
+
+// WithAuth has upgrades need a token, either one of those in the file of
+// "<token> <user> [<roles>]" lines, or an HS256 JWT signed with the secret in
+// the other file. Either can be empty. Both are re-read on Reload.
+func WithAuth(tokensFile, jwtSecretFile string) Option {
+	return func(o *options) { o.tokensFile, o.jwtSecretFile = tokensFile, jwtSecretFile }
+}
+
+// WithConfigFile has the reloadable settings overridden by the JSON file,
+// which is re-read on Reload.
+func WithConfigFile(path string) Option {
+	return func(o *options) { o.configFile = path }
+}
+
+// WithOrigins sets the origins allowed besides the server's own, such as
+// https://example.com or *.example.com.
+func WithOrigins(origins []string) Option {
+	return func(o *options) { o.origins = origins }
+}
+
+// WithTrustedProxies sets the CIDRs of the reverse proxies whose forwarding
+// headers are believed.
+func WithTrustedProxies(cidrs []string) Option {
+	return func(o *options) { o.trustedProxies = cidrs }
+}
+
+// WithTransport sets the WebSocket library to use, either gorilla or coder.
+func WithTransport(name string) Option {
+	return func(o *options) { o.transport = name }
+}
+
+// WithCompression has permessage-deflate negotiated with clients that offer
+// it, for messages of at least threshold bytes.
+func WithCompression(enabled bool, threshold int) Option {
+	return func(o *options) { o.compression, o.compressionThreshold = enabled, threshold }
+}
+
+// WithFrameTracing has every frame of every connection traced, or, with
+// enabled false, only those of the connections it's turned on for. Traces go
+// to the file, or the standard logger if it's empty.
+func WithFrameTracing(enabled bool, file string) Option {
+	return func(o *options) { o.traceFrames, o.traceFile = enabled, file }
+}
+
+// WithRecordDir sets the directory to write session recordings to.
+func WithRecordDir(dir string) Option {
+	return func(o *options) { o.recordDir = dir }
+}
+
+// WithDev enables development conveniences, such as recording a session
+// with ?record=1.
+func WithDev(dev bool) Option {
+	return func(o *options) { o.dev = dev }
+}
+
+// WithChaos injects faults into every connection, such as
+// latency=10ms-200ms,drop=0.05.
+func WithChaos(spec string) Option {
+	return func(o *options) { o.chaos = spec }
+}
+
+// WithIdleTimeout closes clients that send no message for the timeout, once
+// they've been warned, on the endpoints that warn them, and given the grace
+// period.
+func WithIdleTimeout(timeout, grace time.Duration) Option {
+	return func(o *options) { o.idleTimeout, o.idleGrace = timeout, grace }
+}
+
+// WithUpgradeRate limits how many upgrade attempts an address can make per
+// window, keeping track of up to addrs addresses. A rate of zero is
+// unlimited.
+func WithUpgradeRate(rate int, window time.Duration, addrs int) Option {
+	return func(o *options) { o.upgradeRate, o.upgradeWindow, o.upgradeAddrs = rate, window, addrs }
+}
+
+// WithMaxConnections limits how many connections can be open at once, across
+// every endpoint, and from any one client address. Zero is unlimited.
+func WithMaxConnections(total, perIP int) Option {
+	return func(o *options) { o.maxConns, o.maxConnsPerIP = total, perIP }
+}
+
+// WithHistory keeps the last size envelopes of each room on /api, for up to
+// rooms rooms, for clients that resume. A size of zero keeps none.
+func WithHistory(size, rooms int) Option {
+	return func(o *options) { o.historySize, o.historyRooms = size, rooms }
+}
+
+// WithSessionGrace keeps the session of a client on /chat or /api whose
+// connection drops for the grace period, for it to resume. Zero keeps none.
+func WithSessionGrace(d time.Duration) Option {
+	return func(o *options) { o.sessionGrace = d }
+}
+
+// WithNameConflicts sets what's done with a name a client asks for on /api
+// that's taken in the room: suffix gives it a suffix, and reject turns it
+// away.
+func WithNameConflicts(policy string) Option {
+	return func(o *options) { o.nameConflict = policy }
+}
+
+// WithDuplicateSessions sets what's done with a connection for a user that
+// already has one open: allow lets it be, kick_oldest closes the others, and
+// reject_newest turns it away.
+func WithDuplicateSessions(policy string) Option {
+	return func(o *options) { o.duplicateSessions = policy }
+}
+
+// WithTyping has the members of a room on /api told that another is typing
+// at most once every interval, and that it's stopped once it hasn't said it's
+// typing for the timeout. A timeout of zero turns typing indicators off.
+func WithTyping(interval, timeout time.Duration) Option {
+	return func(o *options) { o.typingEvery, o.typingFor = interval, timeout }
+}
+
+// WithMailbox has direct messages on /api for a user who isn't connected held
+// for them, for up to the TTL, up to size of them for each user, and sent once
+// they connect. A TTL of zero, the default, turns mailboxes off.
+func WithMailbox(ttl time.Duration, size int) Option {
+	return func(o *options) { o.mailboxTTL, o.mailboxSize = ttl, size }
+}
+
+// WithRedis relays broadcasts through the Redis server, on channels whose
+// names start with the prefix, to and from other instances.
+func WithRedis(url, channelPrefix string) Option {
+	return func(o *options) { o.redisURL, o.redisChannel = url, channelPrefix }
+}
+
+// WithBanFile keeps the bans in the file, so that they survive restarts.
+func WithBanFile(path string) Option {
+	return func(o *options) { o.banFile = path }
+}
+
+// WithRPCTimeout sets the time allowed to answer a request on /api.
+func WithRPCTimeout(d time.Duration) Option {
+	return func(o *options) { o.rpcTimeout = d }
+}
+
+// WithShutdownTimeout sets the time given to connections to close once Run's
+// context is done, before the server stops anyway.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(o *options) { o.shutdownTimeout = d }
+}
+
+// WithAdminToken serves the /admin endpoints, for requests with the token as
+// a bearer token.
+func WithAdminToken(token string) Option {
+	return func(o *options) { o.adminToken = token }
+}
+
+// WithErrorHook has every error on a connection handed to h instead of being
+// logged. Errors are still counted under conn_errors either way.
+func WithErrorHook(h ErrorHook) Option {
+	return func(o *options) { o.errorHook = h }
+}
+
+// WithLogLevel has the config file's log_level set v, on every reload. Without
+// one, v's level is left as it was when the server was made.
+func WithLogLevel(v *slog.LevelVar) Option {
+	return func(o *options) { o.logLevel = v }
+}
+
+// WithSigning has the envelopes on /api and /api/versioned signed with the
+// newest of the keys in the file, and the ones from clients checked against
+// all of them; see signing.go. The file is re-read on Reload. A client that
+// sends strikes envelopes with bad signatures is closed, or never, if strikes
+// is zero.
+func WithSigning(keysFile string, strikes int) Option {
+	return func(o *options) { o.signingKeysFile, o.signatureStrikes = keysFile, strikes }
+}
+
+// WithInboundInterceptor adds interceptors for every whole message a client
+// sends, after any added before; see interceptor.go. A message one of them
+// fails on is answered with a message_rejected error.
+func WithInboundInterceptor(i ...Interceptor) Option {
+	return func(o *options) { o.interceptIn = append(o.interceptIn, i...) }
+}
+
+// WithOutboundInterceptor adds interceptors for every whole message written to
+// a client, after any added before. A message one of them fails on isn't
+// written.
+func WithOutboundInterceptor(i ...Interceptor) Option {
+	return func(o *options) { o.interceptOut = append(o.interceptOut, i...) }
+}
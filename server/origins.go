@@ -0,0 +1,89 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Browsers let any page open a WebSocket to any server, cookies and all, so
+// it's up to the server to check the Origin header of the upgrade request. By
+// default, only pages from the server's own host (the request's Host) are let
+// in. -origins allows others, as a comma-separated list of any of:
+//
+//	example.com          that host, on any scheme, on the default port
+//	example.com:8443     that host and port, on any scheme
+//	https://example.com  that host and scheme only
+//	*.example.com        any subdomain of example.com, but not example.com
+//	*                    any origin at all
+//
+// Requests without an Origin header don't come from browsers, and are always
+// let in. With -dev, every origin is.
+//
+// Like the IP rules, the origins are part of the settings, and can be changed
+// by reloading them.
+
+var originRejections = expvar.NewInt("origin_rejections")
+
+type originPolicy struct {
+	any bool
+	// Hosts (with their ports, if given), and scheme://host origins.
+	exact map[string]struct{}
+	// Domain suffixes, with the leading dot.
+	suffixes []string
+}
+
+func parseOrigins(list []string) (*originPolicy, error) {
+	p := &originPolicy{exact: map[string]struct{}{}}
+	for _, entry := range list {
+		entry = strings.ToLower(entry)
+		switch {
+		case entry == "*":
+			p.any = true
+		case strings.HasPrefix(entry, "*."):
+			p.suffixes = append(p.suffixes, entry[1:])
+		case strings.Contains(entry, "://"):
+			u, err := url.Parse(entry)
+			if err != nil || u.Host == "" || (u.Path != "" && u.Path != "/") {
+				return nil, fmt.Errorf("%q isn't an origin", entry)
+			}
+			p.exact[u.Scheme+"://"+u.Host] = struct{}{}
+		case strings.ContainsAny(entry, "/*"):
+			return nil, fmt.Errorf("%q isn't a host", entry)
+		default:
+			p.exact[entry] = struct{}{}
+		}
+	}
+	return p, nil
+}
+
+// check reports whether the request's origin is allowed. When it isn't, the
+// returned string says why.
+func (p *originPolicy) check(r *http.Request) (string, bool) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.any {
+		return "", true
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return fmt.Sprintf("malformed origin %q", origin), false
+	}
+	if u.Host == strings.ToLower(r.Host) {
+		return "", true
+	}
+	if _, ok := p.exact[u.Host]; ok {
+		return "", true
+	}
+	if _, ok := p.exact[u.Scheme+"://"+u.Host]; ok {
+		return "", true
+	}
+	hostname := u.Hostname()
+	for _, suffix := range p.suffixes {
+		if strings.HasSuffix(hostname, suffix) {
+			return "", true
+		}
+	}
+	return fmt.Sprintf("origin %q not allowed", origin), false
+}
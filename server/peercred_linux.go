@@ -0,0 +1,31 @@
+//go:build linux
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials gives the PID and UID of the process on the other end of a
+// unix socket.
+func peerCredentials(c net.Conn) (string, bool) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return "", false
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return "", false
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return "", false
+	}
+	return fmt.Sprintf("pid=%d uid=%d", cred.Pid, cred.Uid), true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+// peerCredentials is only supported on Linux.
+func peerCredentials(c net.Conn) (string, bool) {
+	return "", false
+}
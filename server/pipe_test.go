@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"wsexample/wstest"
+)
+
+// pipeServer makes a Server with opts, without an upgrade rate, for its
+// connections to be served with pipeDial.
+func pipeServer(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+	s, err := New(append([]Option{WithUpgradeRate(0, 0, 0)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeServe(t, s)
+	return s
+}
+
+// pipeServe runs the server's hubs and schedules until the test is done, as
+// serveTest does, but without serving it over HTTP.
+func pipeServe(t *testing.T, s *Server) {
+	t.Helper()
+	for _, h := range s.hubs {
+		go h.run(s.hubCtx)
+	}
+	go s.schedules.run(s.hubCtx)
+	t.Cleanup(s.stopHubs)
+}
+
+// pipedConn is an in-memory connection that's being served.
+type pipedConn struct {
+	*wstest.Conn
+	served chan struct{}
+}
+
+// hangUp drops the connection, and waits for the server to be done with it.
+func (c *pipedConn) hangUp() {
+	c.CloseNow()
+	<-c.served
+}
+
+// pipeDial serves an in-memory connection to the path, until the test is
+// done, when it's hung up.
+func pipeDial(t *testing.T, s *Server, path string) *pipedConn {
+	t.Helper()
+	conn := &pipedConn{wstest.NewConn(), make(chan struct{})}
+	go func() {
+		defer close(conn.served)
+		s.ServeTransport(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil), conn.Conn)
+	}()
+	t.Cleanup(conn.hangUp)
+	return conn
+}
+
+// pipeAPI serves an in-memory connection to /api, which joins the room,
+// unless it's "".
+func pipeAPI(t *testing.T, s *Server, room string) *pipedConn {
+	t.Helper()
+	conn := pipeDial(t, s, "/api")
+	if room != "" {
+		conn.InjectJSON(map[string]interface{}{"type": "chat.join", "payload": map[string]string{"room": room}})
+		nextPiped(t, conn, "chat.joined")
+	}
+	return conn
+}
+
+// pipeSession serves an in-memory connection to /api, resuming the session
+// with the id, unless it's "", and gives the session it's told it has.
+func pipeSession(t *testing.T, s *Server, id string) (*pipedConn, sessionPayload) {
+	t.Helper()
+	path := "/api"
+	if id != "" {
+		path += "?session=" + id
+	}
+	conn := pipeDial(t, s, path)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var e testEnvelope
+	if err := conn.NextJSON(ctx, &e); err != nil || e.Type != "session" {
+		t.Fatalf("first envelope %s, %v, want the session", e.Type, err)
+	}
+	var p sessionPayload
+	json.Unmarshal(e.Payload, &p)
+	return conn, p
+}
+
+// pipedJoinedID is joinedID for an in-memory connection.
+func pipedJoinedID(t *testing.T, conn *pipedConn) uint64 {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		var e testEnvelope
+		if err := conn.NextJSON(ctx, &e); err != nil {
+			t.Fatalf("reading a presence.joined: %v", err)
+		}
+		if e.Type == "presence.joined" {
+			var p presenceEvent
+			json.Unmarshal(e.Payload, &p)
+			return p.ID
+		}
+	}
+}
+
+// nextPiped is nextEnvelope for an in-memory connection.
+func nextPiped(t *testing.T, conn *pipedConn, typ string) testEnvelope {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		var e testEnvelope
+		if err := conn.NextJSON(ctx, &e); err != nil {
+			t.Fatalf("reading a %s: %v", typ, err)
+		}
+		if e.Type == "session" || strings.HasPrefix(e.Type, "presence.") {
+			continue
+		}
+		if e.Type != typ {
+			t.Fatalf("got a %s envelope %s, want %s", e.Type, e.Payload, typ)
+		}
+		return e
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+// A hub with presence on tells the other members of a room whenever someone
+// joins or leaves it:
+//
+//	{"type":"presence.joined","payload":{"room":"lobby","user":"alice","connected_at":"2024-05-01T12:00:00.123Z","id":4}}
+//	{"type":"presence.left","payload":{"room":"lobby","user":"alice","connected_at":"2024-05-01T12:00:00.123Z","id":4}}
+//
+// The user is who the client authenticated as, and is left out when
+// authentication is off; connected_at is when the client connected, and id
+// is its connection's id, which is what peers address each other by; see
+// relay.go. The name is the client's in the room, when it has one; see
+// names.go. A client that disconnects, or that's dropped from the hub for
+// falling behind, leaves every room it was in.
+//
+// A member of a room can also ask who else is in it, with
+//
+//	{"type":"presence.list","payload":{"room":"lobby"}}
+//
+// which is answered with the members, longest connected first:
+//
+//	{"type":"presence.list","payload":{"room":"lobby","members":[{"user":"alice","connected_at":"...","id":4}]}}
+
+type presenceMember struct {
+	User        string `json:"user,omitempty" pb:"1"`
+	ConnectedAt string `json:"connected_at" pb:"2"`
+	ID          uint64 `json:"id" pb:"3"`
+	Name        string `json:"name,omitempty" pb:"4"`
+}
+
+type presenceEvent struct {
+	Room        string `json:"room" pb:"1"`
+	User        string `json:"user,omitempty" pb:"2"`
+	ConnectedAt string `json:"connected_at" pb:"3"`
+	ID          uint64 `json:"id" pb:"4"`
+	Name        string `json:"name,omitempty" pb:"5"`
+}
+
+type presenceList struct {
+	Room    string           `json:"room" pb:"1"`
+	Members []presenceMember `json:"members" pb:"2"`
+}
+
+func formatConnectedAt(c *client) string {
+	return c.connected.UTC().Format(time.RFC3339Nano)
+}
+
+// announce tells everyone else in the room that the client joined or left
+// it, with an envelope of the type. h.mut must be held.
+func (h *hub) announce(c *client, room, typ string) {
+	if !h.presence {
+		return
+	}
+	h.deliver(broadcastMessage{
+		room:     room,
+		envelope: newOutgoing(typ, presenceEvent{Room: room, User: c.user, ConnectedAt: formatConnectedAt(c), ID: c.id, Name: h.nameIn(c, room)}),
+		except:   c,
+	})
+}
+
+// members lists who's in the room, longest connected first, if the client is
+// in it.
+func (h *hub) members(c *client, room string) ([]presenceMember, bool) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if _, ok := h.clients[c][room]; !ok {
+		return nil, false
+	}
+	clients := make([]*client, 0, len(h.rooms[room]))
+	for member := range h.rooms[room] {
+		clients = append(clients, member)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].connected.Before(clients[j].connected)
+	})
+	members := make([]presenceMember, len(clients))
+	for i, member := range clients {
+		members[i] = presenceMember{User: member.user, ConnectedAt: formatConnectedAt(member), ID: member.id, Name: h.nameIn(member, room)}
+	}
+	return members, true
+}
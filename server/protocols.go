@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sync/errgroup"
+)
+
+// /api takes whatever a client sends it, in whichever codec it negotiates, so
+// there's no way to change what it does without breaking someone. So the same
+// chat is also served on /api/versioned, where the client has to say which
+// version of the protocol it speaks, with a subprotocol:
+//
+//	Sec-WebSocket-Protocol: chat.v3, chat.v2, chat.v1
+//
+// The server picks the first of its own versions, newest first, that the
+// client offers, and the connection is served by that version's dispatcher,
+// with its codec, for as long as it lasts. A client that offers none of them
+// is turned away before the upgrade, with a 400 and unsupported_subprotocol.
+// The versions are:
+//
+//   - chat.v1: the envelopes of /api, in JSON;
+//   - chat.v2: the same, except that chat.send can carry an id, which is
+//     broadcast with the message, and is answered with
+//     {"type":"chat.sent","payload":{"room":"lobby","id":"..."}} once the
+//     message has been handed to the hub;
+//   - chat.v3: the same, except that chat.message says who it's from with
+//     the sender's connection id, name and user, rather than just the user;
+//     see names.go.
+//
+// Every version shares /api's hub, so clients on /api, and on either version,
+// are in the same rooms, and get each other's messages. A version can only
+// ever be added to, by a new one; one that a client could have been written
+// against doesn't change.
+//
+// Connections are counted by version under api_versions at /debug/vars.
+
+const codeUnsupportedSubprotocol = "unsupported_subprotocol"
+
+var apiVersions = expvar.NewMap("api_versions")
+
+// protocolVersion is a version of a protocol, negotiated as a subprotocol.
+type protocolVersion struct {
+	subprotocol string
+	codec       codec
+	dispatcher  *dispatcher
+}
+
+// apiProtocolVersions gives the versions of /api's protocol, newest first,
+// with their dispatchers, made with newDispatcher.
+func apiProtocolVersions(h *hub, newDispatcher func() *dispatcher) []protocolVersion {
+	v1, v2, v3 := newDispatcher(), newDispatcher(), newDispatcher()
+	handleChat(v1, h, 1)
+	handleChat(v2, h, 2)
+	handleChat(v3, h, 3)
+	return []protocolVersion{
+		{"chat.v3", attributedCodec{}, v3},
+		{"chat.v2", jsonCodec{}, v2},
+		{"chat.v1", jsonCodec{}, v1},
+	}
+}
+
+// versionedHandler serves the versions, each with serve, given the version
+// negotiated, and turns away requests that offer none of them.
+func (s *Server) versionedHandler(versions []protocolVersion, serve func(v protocolVersion) connServer) http.HandlerFunc {
+	subprotocols := make([]string, len(versions))
+	for i, v := range versions {
+		subprotocols[i] = v.subprotocol
+	}
+	serveVersion := func(ctx context.Context, g *errgroup.Group, c *client) error {
+		for _, v := range versions {
+			if v.subprotocol == c.t.Subprotocol() {
+				apiVersions.Add(v.subprotocol, 1)
+				return serve(v)(ctx, g, c)
+			}
+		}
+		// The library didn't negotiate what was offered, which it always
+		// does.
+		return ProtocolViolation{websocket.CloseProtocolError}
+	}
+	handler := s.wsHandler(Mode{subprotocols: subprotocols, serve: serveVersion})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !offersAny(r, subprotocols) {
+			slog.Info("Rejected connection", "peer", describePeer(r), "subprotocols", websocket.Subprotocols(r))
+			writeError(w, http.StatusBadRequest, codeUnsupportedSubprotocol,
+				"none of the subprotocols offered are supported; offer one of "+strings.Join(subprotocols, ", "), 0)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// offersAny tells whether the upgrade request offers any of the subprotocols.
+func offersAny(r *http.Request, subprotocols []string) bool {
+	for _, offered := range websocket.Subprotocols(r) {
+		for _, p := range subprotocols {
+			if offered == p {
+				return true
+			}
+		}
+	}
+	return false
+}
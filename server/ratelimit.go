@@ -0,0 +1,85 @@
+package server
+
+import (
+	"container/list"
+	"expvar"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// A client stuck reconnecting in a tight loop costs a handshake every time,
+// even if it never gets to keep a connection. So with -upgrade-rate, each
+// address only gets that many upgrade attempts in any -upgrade-window, and
+// the ones over that are turned away with a 429 before any of the handshake
+// happens.
+//
+// The window slides: an address is let through as long as its attempt that
+// many attempts ago is more than a window old. Only the attempts that were let
+// through count, so a client that backs off as told by Retry-After gets back
+// in as soon as it's told it will. A client that connects and stays connected
+// uses one attempt, whenever it comes back.
+//
+// The addresses are kept in an LRU of bounded size, so a flood of addresses
+// can't run the server out of memory. An address pushed out of it starts over.
+
+var upgradeAttempts = expvar.NewMap("upgrade_attempts")
+
+type attemptLog struct {
+	addr netip.Addr
+
+	// The times of the last attempts, as a ring, with next being both the
+	// oldest and where the next one goes.
+	times []time.Time
+	next  int
+}
+
+type upgradeLimiter struct {
+	limit  int
+	window time.Duration
+	size   int
+
+	mut   sync.Mutex
+	lru   *list.List
+	addrs map[netip.Addr]*list.Element
+}
+
+func newUpgradeLimiter(limit int, window time.Duration, size int) *upgradeLimiter {
+	return &upgradeLimiter{
+		limit:  limit,
+		window: window,
+		size:   size,
+		lru:    list.New(),
+		addrs:  map[netip.Addr]*list.Element{},
+	}
+}
+
+// allow records an attempt from the address, if it's allowed. If it isn't, it
+// says how long until it would be.
+func (l *upgradeLimiter) allow(addr netip.Addr, now time.Time) (bool, time.Duration) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	var log *attemptLog
+	if e, ok := l.addrs[addr]; ok {
+		l.lru.MoveToFront(e)
+		log = e.Value.(*attemptLog)
+	} else {
+		if l.lru.Len() >= l.size {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.addrs, oldest.Value.(*attemptLog).addr)
+		}
+		log = &attemptLog{addr: addr, times: make([]time.Time, l.limit)}
+		l.addrs[addr] = l.lru.PushFront(log)
+	}
+
+	if oldest := log.times[log.next]; !oldest.IsZero() && now.Sub(oldest) < l.window {
+		upgradeAttempts.Add("limited", 1)
+		return false, oldest.Add(l.window).Sub(now)
+	}
+	log.times[log.next] = now
+	log.next = (log.next + 1) % l.limit
+	upgradeAttempts.Add("allowed", 1)
+	return true, 0
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewRejectsBadUpgradeLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		window time.Duration
+		addrs  int
+		want   string
+	}{
+		{"no addresses", time.Minute, 0, "invalid number of upgrade rate addresses 0"},
+		{"negative addresses", time.Minute, -1, "invalid number of upgrade rate addresses -1"},
+		{"no window", 0, 100, "invalid upgrade window 0s"},
+		{"negative window", -time.Second, 100, "invalid upgrade window -1s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(WithUpgradeRate(30, tt.window, tt.addrs))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("New() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	// Without a rate, the window and the addresses don't matter.
+	if _, err := New(WithUpgradeRate(0, 0, 0)); err != nil {
+		t.Fatalf("New() with no upgrade rate: %v", err)
+	}
+}
+
+func TestUpgradeLimiterReconnectLoop(t *testing.T) {
+	l := newUpgradeLimiter(30, time.Minute, 100)
+	addr := netip.MustParseAddr("192.0.2.1")
+	start := time.Unix(1700000000, 0)
+
+	// 100 attempts in 5 seconds: only the first 30 get through.
+	allowed := 0
+	var retryAfter time.Duration
+	for i := 0; i < 100; i++ {
+		now := start.Add(time.Duration(i) * 50 * time.Millisecond)
+		ok, wait := l.allow(addr, now)
+		if ok {
+			allowed++
+			continue
+		}
+		retryAfter = wait
+		if wait <= 0 || wait > time.Minute {
+			t.Fatalf("attempt %d: wait %s out of range", i, wait)
+		}
+	}
+	if allowed != 30 {
+		t.Fatalf("allowed %d attempts, want 30", allowed)
+	}
+	// The last one is told to wait until the first is a window old.
+	if want := start.Add(time.Minute).Sub(start.Add(99 * 50 * time.Millisecond)); retryAfter != want {
+		t.Fatalf("last retry after = %s, want %s", retryAfter, want)
+	}
+
+	// Waiting as told lets it back in, and only as far as the window has
+	// slid.
+	if ok, _ := l.allow(addr, start.Add(time.Minute)); !ok {
+		t.Fatal("attempt a window after the first was limited")
+	}
+	if ok, _ := l.allow(addr, start.Add(time.Minute)); ok {
+		t.Fatal("second attempt a window after the first was allowed")
+	}
+
+	// Other addresses have limits of their own.
+	if ok, _ := l.allow(netip.MustParseAddr("2001:db8::1"), start.Add(time.Second)); !ok {
+		t.Fatal("attempt from another address was limited")
+	}
+}
+
+func TestUpgradeLimiterLongLivedConnection(t *testing.T) {
+	l := newUpgradeLimiter(3, time.Minute, 10)
+	addr := netip.MustParseAddr("192.0.2.1")
+	start := time.Unix(1700000000, 0)
+	// A client that connects, stays connected for hours, and comes back, is
+	// let straight back in, however often that happens.
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.allow(addr, start.Add(time.Duration(i)*time.Hour)); !ok {
+			t.Fatalf("reconnect %d was limited", i)
+		}
+	}
+}
+
+func TestUpgradeLimiterEvictsOldest(t *testing.T) {
+	l := newUpgradeLimiter(1, time.Minute, 2)
+	now := time.Unix(1700000000, 0)
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("192.0.2.2")
+	c := netip.MustParseAddr("192.0.2.3")
+	for _, addr := range []netip.Addr{a, b, c} {
+		if ok, _ := l.allow(addr, now); !ok {
+			t.Fatalf("first attempt from %s was limited", addr)
+		}
+	}
+	if l.lru.Len() != 2 {
+		t.Fatalf("tracking %d addresses, want 2", l.lru.Len())
+	}
+	// a was pushed out, so it starts over.
+	if ok, _ := l.allow(a, now); !ok {
+		t.Fatal("address pushed out of the LRU was still limited")
+	}
+	// c is still tracked, and limited.
+	if ok, _ := l.allow(c, now); ok {
+		t.Fatal("tracked address wasn't limited")
+	}
+}
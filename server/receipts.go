@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// Every direct message is tracked by the hub, by its id, so that its sender
+// can be told how far it's got. A direct message is
+//
+//   - sent, once the server has it,
+//   - delivered, once it's queued for the recipient's connection, and
+//   - read, once the recipient says it's read it,
+//
+// in that order. It only ever moves on, never back, and moving it to where
+// it is, or where it's been already, does nothing, so its sender is told of
+// each state at most once, however often the recipient says it's read it.
+// The sender isn't told it's sent, since it knows that much, unless it's held
+// in a mailbox, so that it has the id; only that it's delivered, and later
+// read, as
+//
+//	{"type":"receipt","payload":{"id":12,"ref":"a1","state":"delivered"}}
+//
+// A receipt for a sender that's away, with its session kept for it, is
+// queued for it with everything else, and sent once it resumes, so it's
+// bounded the same way: the oldest is dropped to make room. A receipt for a
+// sender that's gone for good is dropped. Only the last maxDirects direct
+// messages of the hub are tracked, and one that's been forgotten can't be
+// read. Broadcasts, to a room or to everyone, have no receipts.
+
+// The number of direct messages a hub keeps track of.
+const maxDirects = 1024
+
+type receiptState int
+
+const (
+	receiptSent receiptState = iota + 1
+	receiptDelivered
+	receiptRead
+)
+
+var receiptStates = [...]string{
+	receiptSent:      "sent",
+	receiptDelivered: "delivered",
+	receiptRead:      "read",
+}
+
+func (s receiptState) String() string {
+	return receiptStates[s]
+}
+
+// advance gives the state after a move to next, and whether it's moved,
+// which it only does forwards.
+func (s receiptState) advance(next receiptState) (receiptState, bool) {
+	if next <= s {
+		return s, false
+	}
+	return next, true
+}
+
+type receiptPayload struct {
+	ID    uint64 `json:"id" pb:"1"`
+	Ref   string `json:"ref,omitempty" pb:"2"`
+	State string `json:"state" pb:"3"`
+}
+
+// direct is a direct message the hub is keeping track of.
+type direct struct {
+	id uint64
+	// What the sender calls it, if it said.
+	ref      string
+	from, to *client
+	// The user it's for, when it's for a user rather than a connection, in
+	// which case to is nil.
+	toUser string
+	state  receiptState
+	// When its TTL is up, if it has one.
+	expires time.Time
+}
+
+// isFor tells whether the direct message was sent to the client.
+func (d *direct) isFor(c *client) bool {
+	return d.to == c || d.toUser != "" && d.toUser == c.user
+}
+
+// receiptBook is the direct messages a hub is keeping track of, by id. It's
+// guarded by the hub's lock.
+type receiptBook struct {
+	limit   int
+	last    uint64
+	directs map[uint64]*direct
+	// The ids in directs, oldest first.
+	order []uint64
+}
+
+func newReceiptBook(limit int) *receiptBook {
+	return &receiptBook{limit: limit, directs: map[uint64]*direct{}}
+}
+
+// add keeps track of a new direct message, sent from one client to another,
+// with a new id, and forgets the oldest one if it's tracking too many.
+func (b *receiptBook) add(ref string, from, to *client) *direct {
+	b.last++
+	d := &direct{id: b.last, ref: ref, from: from, to: to, state: receiptSent}
+	b.keep(d)
+	return d
+}
+
+// keep keeps track of the direct message again, as the newest, if it's been
+// forgotten, as one that was held in a mailbox can have been.
+func (b *receiptBook) keep(d *direct) {
+	if _, ok := b.directs[d.id]; ok {
+		return
+	}
+	b.directs[d.id] = d
+	b.order = append(b.order, d.id)
+	for len(b.order) > b.limit {
+		delete(b.directs, b.order[0])
+		b.order = b.order[1:]
+	}
+}
+
+// find gives the direct message with the id, or nil if there's no such
+// message, or it's been forgotten.
+func (b *receiptBook) find(id uint64) *direct {
+	return b.directs[id]
+}
+
+// forget stops keeping track of the direct message.
+func (b *receiptBook) forget(d *direct) {
+	delete(b.directs, d.id)
+	for i, id := range b.order {
+		if id == d.id {
+			b.order = append(b.order[:i], b.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// advance moves the direct message on to the state, and reports whether it's
+// moved, and so whether its sender is to be told.
+func (b *receiptBook) advance(d *direct, next receiptState) bool {
+	var moved bool
+	d.state, moved = d.state.advance(next)
+	return moved
+}
+
+// handOver has the direct messages to and from old be to and from c instead.
+func (b *receiptBook) handOver(old, c *client) {
+	for _, d := range b.directs {
+		if d.from == old {
+			d.from = c
+		}
+		if d.to == old {
+			d.to = c
+		}
+	}
+}
+
+// tellReceipt tells the sender of the direct message what state it's in.
+// h.mut must be held.
+func (h *hub) tellReceipt(d *direct) {
+	h.tellSender(d, "receipt", receiptPayload{ID: d.id, Ref: d.ref, State: d.state.String()})
+}
+
+// tellSender sends the sender of the direct message an envelope about it, if
+// it's still in the hub. h.mut must be held.
+func (h *hub) tellSender(d *direct, typ string, payload interface{}) {
+	if _, ok := h.clients[d.from]; !ok {
+		return
+	}
+	sendEnvelope(context.Background(), d.from, typ, payload)
+}
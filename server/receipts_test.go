@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReceiptState(t *testing.T) {
+	tests := []struct {
+		from, to receiptState
+		want     receiptState
+		moved    bool
+	}{
+		{receiptSent, receiptDelivered, receiptDelivered, true},
+		{receiptDelivered, receiptRead, receiptRead, true},
+		// A read can't come before it's delivered, but if it did, it'd
+		// still be read.
+		{receiptSent, receiptRead, receiptRead, true},
+		{receiptSent, receiptSent, receiptSent, false},
+		{receiptDelivered, receiptDelivered, receiptDelivered, false},
+		{receiptRead, receiptRead, receiptRead, false},
+		{receiptRead, receiptDelivered, receiptRead, false},
+		{receiptDelivered, receiptSent, receiptDelivered, false},
+	}
+	for _, tt := range tests {
+		if got, moved := tt.from.advance(tt.to); got != tt.want || moved != tt.moved {
+			t.Errorf("%v to %v gave %v, %v, want %v, %v", tt.from, tt.to, got, moved, tt.want, tt.moved)
+		}
+	}
+}
+
+func TestReceiptBook(t *testing.T) {
+	alice := newClient(newFakeTransport(), "", sendQueue{size: 100}, messageRate{})
+	bob := newClient(newFakeTransport(), "", sendQueue{size: 100}, messageRate{})
+	b := newReceiptBook(3)
+	var ids []uint64
+	for i := 0; i < 5; i++ {
+		ids = append(ids, b.add("", alice, bob).id)
+	}
+	if !reflect.DeepEqual(ids, []uint64{1, 2, 3, 4, 5}) {
+		t.Fatalf("ids %v", ids)
+	}
+	// Only the last three are kept.
+	for _, id := range ids {
+		if got, want := b.find(id) != nil, id > 2; got != want {
+			t.Errorf("found %d: %v, want %v", id, got, want)
+		}
+	}
+	b.forget(b.find(4))
+	if b.find(4) != nil || !reflect.DeepEqual(b.order, []uint64{3, 5}) {
+		t.Fatalf("after forgetting 4, %v are kept", b.order)
+	}
+
+	d := b.find(5)
+	for _, step := range []struct {
+		to    receiptState
+		moved bool
+	}{{receiptDelivered, true}, {receiptDelivered, false}, {receiptRead, true}, {receiptRead, false}, {receiptDelivered, false}} {
+		if moved := b.advance(d, step.to); moved != step.moved {
+			t.Fatalf("moving to %v: moved %v, want %v", step.to, moved, step.moved)
+		}
+	}
+	if d.state != receiptRead {
+		t.Fatalf("ended up %v", d.state)
+	}
+
+	resumed := newClient(newFakeTransport(), "", sendQueue{size: 100}, messageRate{})
+	b.handOver(alice, resumed)
+	if d.from != resumed || d.to != bob {
+		t.Fatalf("handed over, it's from %p to %p", d.from, d.to)
+	}
+}
+
+func TestReceipts(t *testing.T) {
+	h := newHub()
+	alice := newClient(newFakeTransport(), "", sendQueue{size: 100}, messageRate{})
+	bob := newClient(newFakeTransport(), "", sendQueue{size: 100}, messageRate{})
+	alice.id, bob.id = 1, 2
+	for _, c := range []*client{alice, bob} {
+		h.join(c)
+		h.joinRoom(c, "lobby")
+	}
+	if err := h.sendDirect(context.Background(), alice, directPayload{To: 2, Message: json.RawMessage(`"hi"`), Ref: "a1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := queuedTypes(bob); !reflect.DeepEqual(got, []string{"direct"}) {
+		t.Fatalf("bob was sent %v", got)
+	}
+	receipt := func() receiptPayload {
+		t.Helper()
+		queue := alice.takeQueue()
+		if len(queue) != 1 {
+			t.Fatalf("alice was sent %d envelopes, want a receipt", len(queue))
+		}
+		var e testEnvelope
+		var p receiptPayload
+		json.Unmarshal(queue[0].data, &e)
+		json.Unmarshal(e.Payload, &p)
+		if e.Type != "receipt" {
+			t.Fatalf("alice was sent a %s", e.Type)
+		}
+		return p
+	}
+	if p := receipt(); p != (receiptPayload{ID: 1, Ref: "a1", State: "delivered"}) {
+		t.Fatalf("receipt %+v", p)
+	}
+
+	// Only bob can say he's read it, and only the first time counts.
+	if err := h.read(alice, 1); err != errNoMessage {
+		t.Fatalf("alice reading her own message gave %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := h.read(bob, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p := receipt(); p != (receiptPayload{ID: 1, Ref: "a1", State: "read"}) {
+		t.Fatalf("receipt %+v", p)
+	}
+	if err := h.read(bob, 2); err != errNoMessage {
+		t.Fatalf("reading a message that was never sent gave %v", err)
+	}
+
+	// Broadcasts have none.
+	h.mut.Lock()
+	h.deliver(broadcastMessage{room: "lobby", envelope: newOutgoing("chat.message", chatMessagePayload{Room: "lobby", Message: json.RawMessage(`"hi"`)})})
+	h.mut.Unlock()
+	if got := queuedTypes(alice); !reflect.DeepEqual(got, []string{"chat.message"}) {
+		t.Fatalf("alice was sent %v for a broadcast", got)
+	}
+
+	// A message to someone who isn't in a room with alice doesn't go.
+	carol := newClient(newFakeTransport(), "", sendQueue{size: 100}, messageRate{})
+	carol.id = 3
+	h.join(carol)
+	if err := h.sendDirect(context.Background(), alice, directPayload{To: 3, Message: json.RawMessage(`"hi"`)}); err == nil {
+		t.Fatal("sent a direct message to someone in none of alice's rooms")
+	}
+	if got := queuedTypes(carol); got != nil {
+		t.Fatalf("carol was sent %v", got)
+	}
+}
+
+func TestReceiptsForResume(t *testing.T) {
+	s := pipeServer(t, WithSessionGrace(time.Minute))
+	alice, sess := pipeSession(t, s, "")
+	alice.InjectJSON(map[string]interface{}{"type": "chat.join", "payload": map[string]string{"room": "lobby"}})
+	nextPiped(t, alice, "chat.joined")
+	bob := pipeAPI(t, s, "lobby")
+	bobID := pipedJoinedID(t, alice)
+
+	alice.InjectJSON(map[string]interface{}{"type": "direct", "payload": map[string]interface{}{"to": bobID, "message": "hi"}})
+	var direct directMessagePayload
+	json.Unmarshal(nextPiped(t, bob, "direct").Payload, &direct)
+	if string(direct.Message) != `"hi"` || direct.From == 0 {
+		t.Fatalf("bob was sent %+v", direct)
+	}
+	var p receiptPayload
+	json.Unmarshal(nextPiped(t, alice, "receipt").Payload, &p)
+	if p.ID != direct.ID || p.State != "delivered" {
+		t.Fatalf("receipt %+v for %d", p, direct.ID)
+	}
+
+	// Read while alice is away, it's kept for her session.
+	alice.hangUp()
+	bob.InjectJSON(map[string]interface{}{"type": "read", "payload": map[string]uint64{"id": direct.ID}})
+	bob.InjectJSON(map[string]interface{}{"type": "read", "payload": map[string]uint64{"id": direct.ID + 1}})
+	var e errorPayload
+	json.Unmarshal(nextPiped(t, bob, "error").Payload, &e)
+	if e.Code != codeNoMessage {
+		t.Fatalf("reading a message that was never sent gave %+v", e)
+	}
+	alice, _ = pipeSession(t, s, sess.Session)
+	json.Unmarshal(nextPiped(t, alice, "receipt").Payload, &p)
+	if p.ID != direct.ID || p.State != "read" {
+		t.Fatalf("receipt %+v on resuming", p)
+	}
+}
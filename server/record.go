@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"wsexample/internal/recording"
+)
+
+// To reproduce bugs that only show up with one particular client's traffic, a
+// whole session can be recorded to a file in -record-dir: every message in
+// and out, each with the time it happened, plus when the session started and
+// ended. The format is described in the recording package, and the cmd/wsreplay
+// tool plays a recording back against a server.
+//
+// Recording is started with POST /admin/connections/{id}/record, or, when
+// running with -dev, by connecting with ?record=1 in the URL. It carries on
+// until the connection closes.
+//
+// The recording is made as messages go through the transport, on the same
+// goroutines that read and write them, so it sees them in exactly the order
+// they actually happen.
+
+type sessionRecorder struct {
+	id    uint64
+	peer  string
+	dir   string
+	start time.Time
+	log   *slog.Logger
+
+	mut sync.Mutex
+	f   *os.File
+	w   *recording.Writer
+}
+
+func newSessionRecorder(id uint64, peer, dir string, lg *slog.Logger) *sessionRecorder {
+	return &sessionRecorder{id: id, peer: peer, dir: dir, start: time.Now(), log: lg}
+}
+
+// begin starts recording, unless it already has.
+func (rec *sessionRecorder) begin() error {
+	rec.mut.Lock()
+	defer rec.mut.Unlock()
+	if rec.f != nil {
+		return nil
+	}
+	if rec.dir == "" {
+		return errors.New("no -record-dir configured")
+	}
+	path := filepath.Join(rec.dir, fmt.Sprintf("conn-%d-%d.jsonl", rec.id, rec.start.Unix()))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	rec.f = f
+	rec.w = recording.NewWriter(f)
+	rec.write(recording.Record{Kind: recording.Open, Conn: rec.id, Peer: rec.peer, Time: &rec.start})
+	rec.log.Info("Recording the connection", "path", path)
+	return nil
+}
+
+// write must be called with mut held.
+func (rec *sessionRecorder) write(r recording.Record) {
+	if rec.w == nil {
+		return
+	}
+	r.Offset = time.Since(rec.start)
+	if err := rec.w.Write(r); err != nil {
+		rec.log.Error("Failed to record the connection, stopping", "error", err)
+		rec.f.Close()
+		rec.w = nil
+	}
+}
+
+func (rec *sessionRecorder) message(direction string, messageType int, data []byte) {
+	rec.mut.Lock()
+	defer rec.mut.Unlock()
+	kind := recording.Text
+	if messageType == websocket.BinaryMessage {
+		kind = recording.Binary
+	}
+	rec.write(recording.Record{Kind: kind, Direction: direction, Data: data})
+}
+
+// end stops the recording, noting why the session ended.
+func (rec *sessionRecorder) end(reason error) {
+	rec.mut.Lock()
+	defer rec.mut.Unlock()
+	if rec.w == nil {
+		return
+	}
+	r := recording.Record{Kind: recording.Close}
+	if reason != nil {
+		r.Reason = reason.Error()
+	}
+	rec.write(r)
+	if rec.w != nil {
+		rec.f.Close()
+		rec.w = nil
+	}
+}
+
+type recordingTransport struct {
+	Transport
+	rec *sessionRecorder
+}
+
+func (t *recordingTransport) ReadMessage(ctx context.Context) (int, []byte, error) {
+	messageType, data, err := t.Transport.ReadMessage(ctx)
+	if err == nil {
+		t.rec.message(recording.In, messageType, data)
+	}
+	return messageType, data, err
+}
+
+func (t *recordingTransport) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	t.rec.message(recording.Out, messageType, data)
+	return t.Transport.WriteMessage(ctx, messageType, data)
+}
+
+func recordHandler(reg *connRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := connFromVars(reg, r)
+		if !ok {
+			writeError(w, http.StatusNotFound, codeNotFound, "no such connection", 0)
+			return
+		}
+		if err := c.recorder.begin(); err != nil {
+			c.log.Error("Failed to start recording the connection", "error", err)
+			writeError(w, http.StatusInternalServerError, codeInternalError, "failed to start recording: "+err.Error(), 0)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// liveConn is the part of a live connection that can be reached from outside
+// of the connection itself, such as from the admin API.
+type liveConn struct {
+	id        uint64
+	uuid      string
+	peer      string
+	addr      netip.Addr
+	transport Transport
+	tracer    *frameTracer
+	recorder  *sessionRecorder
+	progress  *writeProgress
+	onError   errorHook
+	stats     *connStats
+	// The bucket the connection's writes are throttled by, or nil.
+	throttle *byteBucket
+	// What every message to and from the connection goes through, if
+	// anything.
+	interceptIn  interceptorChain
+	interceptOut interceptorChain
+	// Logs with the connection's attributes.
+	log *slog.Logger
+	// The path of the endpoint, and the subprotocol negotiated on it, if any.
+	path        string
+	subprotocol string
+	connected   time.Time
+	// The session the client asked to resume, if any.
+	session string
+	// Who the connection authenticated as.
+	principal
+
+	mut sync.Mutex
+	// The client serving the connection, once there is one.
+	client *client
+}
+
+func (c *liveConn) serving(cl *client) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.client = cl
+}
+
+// served gives the client serving the connection, or nil if there isn't one
+// yet.
+func (c *liveConn) served() *client {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.client
+}
+
+type connRegistry struct {
+	mut   sync.Mutex
+	conns map[uint64]*liveConn
+	// Closed once there are no connections, if anyone is waiting for that.
+	emptied chan struct{}
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: map[uint64]*liveConn{}}
+}
+
+func (reg *connRegistry) add(c *liveConn) {
+	reg.mut.Lock()
+	defer reg.mut.Unlock()
+	reg.conns[c.id] = c
+}
+
+func (reg *connRegistry) remove(id uint64) {
+	reg.mut.Lock()
+	defer reg.mut.Unlock()
+	delete(reg.conns, id)
+	if len(reg.conns) == 0 && reg.emptied != nil {
+		close(reg.emptied)
+		reg.emptied = nil
+	}
+}
+
+// wait waits until there are no connections, or until ctx is done.
+func (reg *connRegistry) wait(ctx context.Context) error {
+	reg.mut.Lock()
+	if len(reg.conns) == 0 {
+		reg.mut.Unlock()
+		return nil
+	}
+	if reg.emptied == nil {
+		reg.emptied = make(chan struct{})
+	}
+	emptied := reg.emptied
+	reg.mut.Unlock()
+
+	select {
+	case <-emptied:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (reg *connRegistry) get(id uint64) (*liveConn, bool) {
+	reg.mut.Lock()
+	defer reg.mut.Unlock()
+	c, ok := reg.conns[id]
+	return c, ok
+}
+
+func (reg *connRegistry) list() []*liveConn {
+	reg.mut.Lock()
+	defer reg.mut.Unlock()
+	conns := make([]*liveConn, 0, len(reg.conns))
+	for _, c := range reg.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+)
+
+// Two JSON clients on /api that are in a room together can also talk without
+// the server being able to read what they say, as a demo of relaying
+// end-to-end encrypted messages. They learn each other's connection ids from
+// presence, and hand each other their public keys with
+//
+//	{"type":"key","payload":{"to":7,"key":"..."}}
+//
+// which the server passes on to the peer, to connection 7, as
+//
+//	{"type":"key","payload":{"from":4,"user":"alice","key":"..."}}
+//
+// without looking at the key, which is whatever the clients make of it. The
+// client package's Box uses NaCl box, with Curve25519 keys in base64. From
+// then on, they send each other binary messages, each of them the id of the
+// peer it's for, in 8 bytes, big-endian, and then the ciphertext. The server
+// reads the id, replaces it with the sender's, and writes the message to the
+// peer, and that's all it does with it: binary messages from JSON clients
+// aren't envelopes, so they're never parsed, validated, handed to
+// middleware, kept in the history, or, either way, seen by interceptors.
+// They're still held to the read limit and the message rate, like any other
+// message.
+//
+// A key or a binary message for a connection that isn't in any room with the
+// sender, or that can't take binary messages, because it talks protobuf, is
+// answered with a no_peer error. Binary messages are counted under
+// relayed_frames, as relayed or undeliverable. Only connections to the same
+// instance can reach each other, since the bus only carries broadcasts.
+
+var relayedFrames = expvar.NewMap("relayed_frames")
+
+const codeNoPeer = "no_peer"
+
+// The length of the id at the front of a relayed binary message.
+const relayHeader = 8
+
+var errNoPeer = errors.New("there's no such peer")
+
+type keyPayload struct {
+	To uint64 `json:"to" pb:"1" validate:"required"`
+	// Base64 of a 32 byte key is 44 bytes.
+	Key string `json:"key" pb:"2" validate:"required,max=64"`
+}
+
+type relayedKeyPayload struct {
+	From uint64 `json:"from" pb:"1"`
+	User string `json:"user,omitempty" pb:"2"`
+	Key  string `json:"key" pb:"3"`
+}
+
+// handleRelay registers the key handler with the dispatcher, and has it relay
+// the binary messages of JSON clients to their peers in the hub.
+func handleRelay(d *dispatcher, h *hub) {
+	d.validate("key", keyPayload{})
+	d.handle("key", func(ctx context.Context, c *client, payload payload) error {
+		var p keyPayload
+		if err := decodePayload(payload, &p); err != nil {
+			return err
+		}
+		peer, err := h.peer(c, p.To)
+		if err != nil {
+			return err
+		}
+		if err := sendEnvelope(ctx, peer, "key", relayedKeyPayload{From: c.id, User: c.user, Key: p.Key}); err != nil {
+			return noPeer(p.To)
+		}
+		return nil
+	})
+	d.opaque = func(ctx context.Context, c *client, message []byte) error {
+		if len(message) < relayHeader {
+			relayedFrames.Add("undeliverable", 1)
+			return sendError(ctx, c, "", codeBadEnvelope, fmt.Sprintf("a binary message starts with the %d byte id of the peer it's for", relayHeader))
+		}
+		to := binary.BigEndian.Uint64(message)
+		peer, err := h.peer(c, to)
+		if err == nil {
+			frame := make([]byte, len(message))
+			binary.BigEndian.PutUint64(frame, c.id)
+			copy(frame[relayHeader:], message[relayHeader:])
+			if peer.writeOpaque(frame) != nil {
+				err = noPeer(to)
+			}
+		}
+		if err != nil {
+			relayedFrames.Add("undeliverable", 1)
+			var re *replyError
+			errors.As(err, &re)
+			return sendError(ctx, c, "", re.code, re.message)
+		}
+		relayedFrames.Add("relayed", 1)
+		return nil
+	}
+}
+
+// relaysBinary tells whether the client's binary messages are relayed to its
+// peers by the dispatcher, which they are for JSON clients.
+func relaysBinary(d *dispatcher, c *client) bool {
+	return d.opaque != nil && c.codec.name() == jsonCodec{}.name()
+}
+
+func noPeer(id uint64) error {
+	return &replyError{codeNoPeer, fmt.Sprintf("%s as %d in any of your rooms", errNoPeer.Error(), id)}
+}
+
+// peer gives the client with the id, if it's in a room with c, and takes
+// relayed binary messages, or else a no_peer error for c.
+func (h *hub) peer(c *client, id uint64) (*client, error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	member, _, ok := h.roommate(c, id)
+	if !ok || !member.opaque {
+		return nil, noPeer(id)
+	}
+	return member, nil
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// joinedID reads envelopes until someone joins one of the client's rooms, and
+// gives their connection id.
+func joinedID(t *testing.T, conn *websocket.Conn) uint64 {
+	t.Helper()
+	for {
+		var e testEnvelope
+		if err := conn.ReadJSON(&e); err != nil {
+			t.Fatalf("reading a presence.joined: %v", err)
+		}
+		if e.Type == "presence.joined" {
+			var p presenceEvent
+			json.Unmarshal(e.Payload, &p)
+			return p.ID
+		}
+	}
+}
+
+// relayFrame gives a binary message for the peer, or from it.
+func relayFrame(id uint64, data string) []byte {
+	frame := binary.BigEndian.AppendUint64(nil, id)
+	return append(frame, data...)
+}
+
+func TestRelay(t *testing.T) {
+	// Interceptors that would spoil a relayed message, if they saw it. The
+	// binary messages of protobuf clients are envelopes, which they do see.
+	tamper := func(conn *Connection, m *Message) (*Message, error) {
+		if m.Type == websocket.BinaryMessage && conn.Subprotocol != protoSubprotocol {
+			return &Message{m.Type, []byte("tampered with")}, nil
+		}
+		return m, nil
+	}
+	u := testServer(t, WithInboundInterceptor(tamper), WithOutboundInterceptor(tamper))
+	alice := apiDial(t, u, "lobby")
+	bob := apiDial(t, u, "lobby")
+	bobID := joinedID(t, alice)
+	watcher := apiDial(t, u, "elsewhere")
+	apiDial(t, u, "elsewhere")
+	charlieID := joinedID(t, watcher)
+	proto, _, err := (&websocket.Dialer{Subprotocols: []string{protoSubprotocol}}).Dial(u+"/api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proto.Close()
+	proto.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, join, err := encodeEnvelope(protoCodec{}, "chat.join", roomPayload{"lobby"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto.WriteMessage(websocket.BinaryMessage, join)
+	protoID := joinedID(t, alice)
+	before := mapValue(relayedFrames, "relayed")
+
+	// The key is passed on as it is, with who it's from.
+	alice.WriteJSON(map[string]interface{}{"type": "key", "payload": map[string]interface{}{"to": bobID, "key": "YWxpY2UncyBrZXk="}})
+	var key relayedKeyPayload
+	json.Unmarshal(nextEnvelope(t, bob, "key").Payload, &key)
+	if key.Key != "YWxpY2UncyBrZXk=" || key.From == 0 || key.From == bobID {
+		t.Fatalf("bob was given the key %+v", key)
+	}
+	aliceID := key.From
+
+	// So is a binary message, which isn't even valid UTF-8, or JSON, with
+	// the sender's id in place of the peer's.
+	ciphertext := "\xff\x00{\"type\":\"chat.send\"}"
+	alice.WriteMessage(websocket.BinaryMessage, relayFrame(bobID, ciphertext))
+	for {
+		messageType, message, err := bob.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		if !bytes.Equal(message, relayFrame(aliceID, ciphertext)) {
+			t.Fatalf("bob was sent %q, want %q", message, relayFrame(aliceID, ciphertext))
+		}
+		break
+	}
+	if got := mapValue(relayedFrames, "relayed") - before; got != 1 {
+		t.Fatalf("relayed went up by %d, want 1", got)
+	}
+
+	badFrames := []struct {
+		name  string
+		frame []byte
+		code  string
+	}{
+		{"to someone in no room with the sender", relayFrame(charlieID, ciphertext), codeNoPeer},
+		{"to a protobuf client", relayFrame(protoID, ciphertext), codeNoPeer},
+		{"to the sender", relayFrame(aliceID, ciphertext), codeNoPeer},
+		{"without an id", []byte{1, 2, 3}, codeBadEnvelope},
+	}
+	for _, tt := range badFrames {
+		t.Run(tt.name, func(t *testing.T) {
+			alice.WriteMessage(websocket.BinaryMessage, tt.frame)
+			var p errorPayload
+			json.Unmarshal(nextEnvelope(t, alice, "error").Payload, &p)
+			if p.Code != tt.code {
+				t.Fatalf("error %+v, want %s", p, tt.code)
+			}
+		})
+	}
+
+	// Nor can a protobuf client be handed a key, since it couldn't be sent
+	// what would come after it.
+	alice.WriteJSON(map[string]interface{}{"type": "key", "payload": map[string]interface{}{"to": protoID, "key": "YWxpY2UncyBrZXk="}})
+	var p errorPayload
+	json.Unmarshal(nextEnvelope(t, alice, "error").Payload, &p)
+	if p.Code != codeNoPeer || p.Type != "key" {
+		t.Fatalf("error %+v, want %s", p, codeNoPeer)
+	}
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Besides -room-write-rate, each room can be held to limits of its own, so
+// that one busy room can't take what the rest of the server has: how many
+// members it can have, how many messages per second its members can send it
+// between them, after a burst, and how big each of them can be, which is
+// meant to be well under -read-limit. Every room has the limits of
+// -room-max-members, -room-message-rate, -room-message-burst and
+// -room-max-message, unless it's been given limits of its own, by its name or
+// by a pattern, as path.Match has them, such as "prices-*". A room takes the
+// limits of its own name, if it has them, or else of the first pattern it
+// matches, in the order they were set, or else the defaults. Zero is no limit.
+//
+// A join that would take a room past its members is turned away before the
+// client is put in the room, with room_full. A message from a member over the
+// room's rate is dropped, and answered with room_rate_limited, and one over
+// its size with message_too_large_for_room. On /api those are error
+// envelopes, and on /chat, error replies with the code:
+//
+//	{"type":"error","room":"lobby","code":"room_full","error":"the room is full"}
+//
+// Each is counted by code under room_limited. The limits can be changed while
+// the server runs, through the admin API:
+//
+//	GET    /admin/rooms/limits         the defaults, and every room's own
+//	PUT    /admin/rooms/limits         set the defaults
+//	PUT    /admin/rooms/limits/{room}  set the limits of a room, or a pattern
+//	DELETE /admin/rooms/limits/{room}  take them away again
+//
+// where the limits are
+//
+//	{"max_members":100,"message_rate":50,"message_burst":100,"max_message_bytes":4096}
+//
+// New limits apply from the next join or message on. A room that already has
+// more members than a new limit keeps them, and its rate starts over.
+
+var roomLimited = expvar.NewMap("room_limited")
+
+const (
+	codeRoomFull        = "room_full"
+	codeRoomRateLimited = "room_rate_limited"
+	codeTooLargeForRoom = "message_too_large_for_room"
+)
+
+// A roomLimitError is a join or a message a room's limits turn away, with
+// the code to answer it with.
+type roomLimitError struct {
+	code string
+	msg  string
+}
+
+func (e *roomLimitError) Error() string { return e.msg }
+
+var errRoomFull = &roomLimitError{codeRoomFull, "the room is full"}
+
+type roomLimits struct {
+	MaxMembers   int `json:"max_members,omitempty"`
+	MessageRate  int `json:"message_rate,omitempty"`
+	MessageBurst int `json:"message_burst,omitempty"`
+	MaxMessage   int `json:"max_message_bytes,omitempty"`
+}
+
+func (l roomLimits) check() error {
+	if l.MaxMembers < 0 || l.MessageRate < 0 || l.MessageBurst < 0 || l.MaxMessage < 0 {
+		return fmt.Errorf("room limits can't be negative")
+	}
+	return nil
+}
+
+// roomOverride is a room's own limits, or a pattern's.
+type roomOverride struct {
+	Room string `json:"room"`
+	roomLimits
+}
+
+// roomPolicy is the limits of every room. It's shared by the hubs, and safe
+// for concurrent use.
+type roomPolicy struct {
+	mut       sync.Mutex
+	defaults  roomLimits
+	overrides []roomOverride
+}
+
+// limitsFor gives the limits of the room.
+func (p *roomPolicy) limitsFor(room string) roomLimits {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	for _, o := range p.overrides {
+		if o.Room == room {
+			return o.roomLimits
+		}
+	}
+	for _, o := range p.overrides {
+		if ok, _ := path.Match(o.Room, room); ok {
+			return o.roomLimits
+		}
+	}
+	return p.defaults
+}
+
+// set gives the room, or the rooms matching the pattern, the limits, in
+// place of any they had, or after the others, if they're new.
+func (p *roomPolicy) set(room string, l roomLimits) error {
+	if _, err := path.Match(room, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q", room)
+	}
+	if err := l.check(); err != nil {
+		return err
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	for i, o := range p.overrides {
+		if o.Room == room {
+			p.overrides[i].roomLimits = l
+			return nil
+		}
+	}
+	p.overrides = append(p.overrides, roomOverride{room, l})
+	return nil
+}
+
+// remove takes away the limits set for the room, or the pattern, and tells
+// whether there were any.
+func (p *roomPolicy) remove(room string) bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	for i, o := range p.overrides {
+		if o.Room == room {
+			p.overrides = append(p.overrides[:i], p.overrides[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *roomPolicy) setDefaults(l roomLimits) error {
+	if err := l.check(); err != nil {
+		return err
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.defaults = l
+	return nil
+}
+
+// roomLimitsList is what GET /admin/rooms/limits gives.
+type roomLimitsList struct {
+	Defaults roomLimits     `json:"defaults"`
+	Rooms    []roomOverride `json:"rooms"`
+}
+
+func (p *roomPolicy) list() roomLimitsList {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return roomLimitsList{p.defaults, append([]roomOverride{}, p.overrides...)}
+}
+
+// roomInbound is a room's bucket of messages from its members, with the
+// limits it was made for.
+type roomInbound struct {
+	limits roomLimits
+	bucket *byteBucket
+}
+
+// admitToRoom counts a message of size bytes from a member of the room
+// against the room's limits, and gives the *roomLimitError it's turned away
+// with, if it is.
+func (h *hub) admitToRoom(room string, size int, now time.Time) error {
+	if h.roomLimits == nil {
+		return nil
+	}
+	l := h.roomLimits.limitsFor(room)
+	if l.MaxMessage > 0 && size > l.MaxMessage {
+		roomLimited.Add(codeTooLargeForRoom, 1)
+		return &roomLimitError{codeTooLargeForRoom, fmt.Sprintf("messages to the room can be at most %d bytes", l.MaxMessage)}
+	}
+	if l.MessageRate <= 0 {
+		return nil
+	}
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	// A room nobody is in gets no bucket, as for roomBucket.
+	if _, ok := h.rooms[room]; !ok {
+		return nil
+	}
+	in, ok := h.roomInbound[room]
+	if !ok || in.limits != l {
+		in = roomInbound{l, newByteBucket(l.MessageRate, l.MessageBurst)}
+		// From now, which is before the bucket was made, so that it's full.
+		in.bucket.last = now
+		h.roomInbound[room] = in
+	}
+	wait := in.bucket.take(1, now)
+	if wait <= 0 {
+		return nil
+	}
+	// Only the messages that are let through count.
+	in.bucket.give(1)
+	roomLimited.Add(codeRoomRateLimited, 1)
+	return &roomLimitError{codeRoomRateLimited, fmt.Sprintf("the room is taking too many messages; try again in %dms", wait.Milliseconds())}
+}
+
+// roomFull tells whether the room has as many members as it can have. h.mut
+// must be held.
+func (h *hub) roomFull(room string) bool {
+	if h.roomLimits == nil {
+		return false
+	}
+	max := h.roomLimits.limitsFor(room).MaxMembers
+	return max > 0 && len(h.rooms[room]) >= max
+}
+
+// roomLimitsHandler serves /admin/rooms/limits, and the limits of each room
+// under it.
+func roomLimitsHandler(p *roomPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, ok := mux.Vars(r)["room"]
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(p.list())
+
+		case http.MethodPut:
+			var l roomLimits
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&l); err != nil {
+				writeError(w, http.StatusBadRequest, codeBadRequest, "invalid limits: "+err.Error(), 0)
+				return
+			}
+			var err error
+			if ok {
+				err = p.set(room, l)
+			} else {
+				err = p.setDefaults(l)
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeBadRequest, err.Error(), 0)
+				return
+			}
+			slog.Info("Set room limits", "room", room, "max_members", l.MaxMembers, "message_rate", l.MessageRate, "message_burst", l.MessageBurst, "max_message_bytes", l.MaxMessage)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(p.list())
+
+		case http.MethodDelete:
+			if !ok || !p.remove(room) {
+				writeError(w, http.StatusNotFound, codeNotFound, "the room has no limits of its own", 0)
+				return
+			}
+			slog.Info("Removed room limits", "room", room)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
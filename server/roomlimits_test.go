@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomPolicy(t *testing.T) {
+	p := &roomPolicy{defaults: roomLimits{MaxMembers: 100}}
+	for _, o := range []roomOverride{
+		{"prices-*", roomLimits{MessageRate: 5}},
+		{"prices-fx", roomLimits{MaxMessage: 512}},
+		{"prices-f*", roomLimits{MaxMembers: 3}},
+	} {
+		if err := p.set(o.Room, o.roomLimits); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		room string
+		want roomLimits
+	}{
+		{"lobby", roomLimits{MaxMembers: 100}},
+		{"prices-fx", roomLimits{MaxMessage: 512}},
+		{"prices-futures", roomLimits{MessageRate: 5}},
+		{"prices", roomLimits{MaxMembers: 100}},
+	} {
+		if got := p.limitsFor(tt.room); got != tt.want {
+			t.Errorf("%s has %+v, want %+v", tt.room, got, tt.want)
+		}
+	}
+
+	if !p.remove("prices-*") || p.remove("prices-*") {
+		t.Fatal("removed prices-* other than once")
+	}
+	if got := p.limitsFor("prices-futures"); got != (roomLimits{MaxMembers: 3}) {
+		t.Errorf("without prices-*, prices-futures has %+v", got)
+	}
+	if err := p.set("prices-[", roomLimits{}); err == nil {
+		t.Error("set a pattern that isn't one")
+	}
+	if err := p.set("lobby", roomLimits{MessageRate: -1}); err == nil {
+		t.Error("set a negative rate")
+	}
+	if err := p.setDefaults(roomLimits{MaxMembers: -1}); err == nil {
+		t.Error("set negative defaults")
+	}
+}
+
+func TestRoomLimitsAtTheHub(t *testing.T) {
+	h := newHub()
+	h.roomLimits = &roomPolicy{defaults: roomLimits{MaxMembers: 2, MessageRate: 1, MessageBurst: 2, MaxMessage: 10}}
+	var clients []*client
+	for i := 0; i < 3; i++ {
+		c := newClient(newFakeTransport(), "", sendQueue{size: 10}, messageRate{})
+		h.join(c)
+		clients = append(clients, c)
+	}
+	for i, want := range []error{nil, nil, errRoomFull} {
+		if err := h.joinRoom(clients[i], "lobby"); err != want {
+			t.Fatalf("join %d: %v, want %v", i, err, want)
+		}
+	}
+	// Once one leaves, there's room again.
+	h.leaveRoom(clients[0], "lobby")
+	if err := h.joinRoom(clients[2], "lobby"); err != nil {
+		t.Fatalf("joining once someone's left: %v", err)
+	}
+
+	now := time.Now()
+	for _, tt := range []struct {
+		size  int
+		after time.Duration
+		want  string
+	}{
+		{11, 0, codeTooLargeForRoom},
+		{10, 0, ""},
+		{1, 0, ""},
+		{1, 0, codeRoomRateLimited},
+		{1, 500 * time.Millisecond, codeRoomRateLimited},
+		{1, time.Second, ""},
+	} {
+		err := h.admitToRoom("lobby", tt.size, now.Add(tt.after))
+		code := ""
+		if le, ok := err.(*roomLimitError); ok {
+			code = le.code
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.want {
+			t.Fatalf("%d bytes after %s: %q, want %q", tt.size, tt.after, code, tt.want)
+		}
+	}
+
+	// A room nobody's in has nothing to limit, and keeps no bucket.
+	h.leaveRoom(clients[1], "lobby")
+	h.leaveRoom(clients[2], "lobby")
+	if err := h.admitToRoom("lobby", 1, now); err != nil || len(h.roomInbound) != 0 {
+		t.Fatalf("an empty room gave %v, with %d buckets", err, len(h.roomInbound))
+	}
+}
+
+func TestRoomLimits(t *testing.T) {
+	const token = "secret"
+	s := pipeServer(t, WithAdminToken(token), WithRoomLimits(2, 0, 0, 0))
+	admin := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, r)
+		return w
+	}
+	// apiError sends the envelope, and gives the code of the error it's
+	// answered with.
+	apiError := func(conn *pipedConn, typ string, payload interface{}) string {
+		t.Helper()
+		conn.InjectJSON(map[string]interface{}{"type": typ, "payload": payload})
+		var p errorPayload
+		json.Unmarshal(nextPiped(t, conn, "error").Payload, &p)
+		return p.Code
+	}
+
+	pipeAPI(t, s, "lobby")
+	alice := pipeAPI(t, s, "lobby")
+	bob := pipeAPI(t, s, "")
+	if code := apiError(bob, "chat.join", map[string]string{"room": "lobby"}); code != codeRoomFull {
+		t.Fatalf("joining a full room over /api gave %q", code)
+	}
+
+	// /chat, on a hub of its own, has the code in its reply.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i, want := range []string{"joined", "joined", "error"} {
+		chat := pipeDial(t, s, "/chat")
+		chat.InjectJSON(roomMessage{"join", "lobby"})
+		var reply roomReply
+		for reply.Type == "" || reply.Type == "session" {
+			if err := chat.NextJSON(ctx, &reply); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if reply.Type != want || want == "error" && reply.Code != codeRoomFull {
+			t.Fatalf("join %d over /chat gave %+v", i, reply)
+		}
+	}
+
+	// A room of its own, and the room is no longer full, but its messages
+	// are limited.
+	if w := admin(http.MethodPut, "/admin/rooms/limits/lob*", `{"max_members":3,"message_rate":1,"message_burst":1,"max_message_bytes":16}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT the lobby's limits: %d %s", w.Code, w.Body)
+	}
+	bob.InjectJSON(map[string]interface{}{"type": "chat.join", "payload": map[string]string{"room": "lobby"}})
+	nextPiped(t, bob, "chat.joined")
+	if code := apiError(alice, "chat.send", map[string]string{"room": "lobby", "message": strings.Repeat("x", 16)}); code != codeTooLargeForRoom {
+		t.Fatalf("sending too much gave %q", code)
+	}
+	alice.InjectJSON(map[string]interface{}{"type": "chat.send", "payload": map[string]string{"room": "lobby", "message": "hi"}})
+	nextPiped(t, alice, "chat.message")
+	if code := apiError(alice, "chat.send", map[string]string{"room": "lobby", "message": "hi"}); code != codeRoomRateLimited {
+		t.Fatalf("sending too often gave %q", code)
+	}
+	// The rate is the room's, not the sender's.
+	nextPiped(t, bob, "chat.message")
+	if code := apiError(bob, "chat.send", map[string]string{"room": "lobby", "message": "hi"}); code != codeRoomRateLimited {
+		t.Fatalf("bob sending too often gave %q", code)
+	}
+
+	var list roomLimitsList
+	json.NewDecoder(admin(http.MethodGet, "/admin/rooms/limits", "").Body).Decode(&list)
+	if list.Defaults != (roomLimits{MaxMembers: 2}) || len(list.Rooms) != 1 || list.Rooms[0].Room != "lob*" {
+		t.Fatalf("GET gave %+v", list)
+	}
+	for _, tt := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPut, "/admin/rooms/limits", `{"max_members":-1}`, http.StatusBadRequest},
+		{http.MethodPut, "/admin/rooms/limits", `{"max_people":1}`, http.StatusBadRequest},
+		{http.MethodPut, "/admin/rooms/limits/a[", `{}`, http.StatusBadRequest},
+		{http.MethodDelete, "/admin/rooms/limits/lobby", "", http.StatusNotFound},
+		{http.MethodDelete, "/admin/rooms/limits/lob*", "", http.StatusNoContent},
+		{http.MethodPut, "/admin/rooms/limits", `{}`, http.StatusOK},
+	} {
+		if w := admin(tt.method, tt.path, tt.body); w.Code != tt.want {
+			t.Errorf("%s %s %s: %d %s, want %d", tt.method, tt.path, tt.body, w.Code, w.Body, tt.want)
+		}
+	}
+	alice.InjectJSON(map[string]interface{}{"type": "chat.send", "payload": map[string]string{"room": "lobby", "message": strings.Repeat("x", 16)}})
+	nextPiped(t, alice, "chat.message")
+}
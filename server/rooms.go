@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// On /chat, a client can join named rooms, and send messages to just the
+// clients in one of them:
+//
+//	{"action":"join","room":"lobby"}
+//	{"action":"send","room":"lobby","message":"hello"}
+//	{"action":"leave","room":"lobby"}
+//
+// A message sent to a room goes out as it is, with the room in it, to every
+// client in the room, the sender included; it has to be in the room to send to
+// it. Joining and leaving are answered with
+//
+//	{"type":"joined","room":"lobby"}
+//	{"type":"left","room":"lobby"}
+//
+// and an action that can't be done is answered with
+//
+//	{"type":"error","room":"lobby","error":"not in the room"}
+//
+// with a code as well when it's a room's limits that turn it away; see
+// roomlimits.go. A client can also set its labels, with the label action;
+// see labels.go. Text that starts with a slash is a command, such as /join
+// lobby, rather than anything else; see commands.go.
+//
+// Anything that isn't one of these, or that, is broadcast to every client, as it was
+// before there were rooms.
+
+// maxRoomNameLength is in bytes.
+const maxRoomNameLength = 64
+
+var (
+	errBadRoomName = errors.New("room names must be 1 to 64 bytes of UTF-8")
+	errNotInRoom   = errors.New("not in the room")
+)
+
+func checkRoomName(room string) error {
+	if room == "" || len(room) > maxRoomNameLength || !utf8.ValidString(room) {
+		return errBadRoomName
+	}
+	return nil
+}
+
+type roomMessage struct {
+	Action string `json:"action"`
+	Room   string `json:"room"`
+}
+
+type roomReply struct {
+	Type string `json:"type"`
+	Room string `json:"room"`
+	// The code of a room limit that turned the action away; see
+	// roomlimits.go.
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// parseRoomMessage tells whether the message is a room action, and if so,
+// gives the action and the room.
+func parseRoomMessage(message []byte) (roomMessage, bool) {
+	var m roomMessage
+	if err := json.Unmarshal(message, &m); err != nil {
+		return roomMessage{}, false
+	}
+	switch m.Action {
+	case "join", "leave", "send":
+		return m, true
+	}
+	return roomMessage{}, false
+}
+
+func roomReplyMessage(typ, room, errMessage string) []byte {
+	reply, _ := json.Marshal(roomReply{Type: typ, Room: room, Error: errMessage})
+	return reply
+}
+
+// roomErrorMessage is the error reply for the action in the room that failed
+// with err, with its code, if a room limit turned it away.
+func roomErrorMessage(room string, err error) []byte {
+	r := roomReply{Type: "error", Room: room, Error: err.Error()}
+	var le *roomLimitError
+	if errors.As(err, &le) {
+		r.Code = le.code
+	}
+	reply, _ := json.Marshal(r)
+	return reply
+}
+
+// handleRoomMessage does what the room action says, and sends the client the
+// reply, if it gets one.
+func handleRoomMessage(ctx context.Context, h *hub, c *client, m roomMessage, message []byte) error {
+	reply := func(typ, errMessage string) error {
+		return c.write(websocket.TextMessage, roomReplyMessage(typ, m.Room, errMessage))
+	}
+	if err := checkRoomName(m.Room); err != nil {
+		return reply("error", err.Error())
+	}
+	switch m.Action {
+	case "join":
+		if err := h.joinRoom(c, m.Room); err != nil {
+			return c.write(websocket.TextMessage, roomErrorMessage(m.Room, err))
+		}
+		return reply("joined", "")
+	case "leave":
+		if !h.leaveRoom(c, m.Room) {
+			return reply("error", errNotInRoom.Error())
+		}
+		return reply("left", "")
+	default:
+		if !h.inRoom(c, m.Room) {
+			return reply("error", errNotInRoom.Error())
+		}
+		if err := h.admitToRoom(m.Room, len(message), time.Now()); err != nil {
+			return c.write(websocket.TextMessage, roomErrorMessage(m.Room, err))
+		}
+		h.broadcastToRoom(ctx, m.Room, websocket.TextMessage, message)
+		return nil
+	}
+}
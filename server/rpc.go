@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sync/errgroup"
+)
+
+// Besides envelopes, the dispatcher takes requests that want an answer, in
+// the style of JSON-RPC 2.0:
+//
+//	{"jsonrpc":"2.0","id":1,"method":"chat.rooms"}
+//
+// is answered with the same id, and either the result,
+//
+//	{"jsonrpc":"2.0","id":1,"result":{"rooms":["lobby"]}}
+//
+// or an error:
+//
+//	{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"there's no method \"chat.romos\""}}
+//
+// The "jsonrpc" member can be left out. A request without an id is a
+// notification, and isn't answered at all, even if it fails. Batches aren't
+// supported.
+//
+// Every request runs on its own, so a slow one doesn't hold up the others,
+// and answers can come back in any order. A request that isn't answered
+// within -rpc-timeout gets a timeout error, and its method is told to stop.
+// Only so many can be in flight on a connection at a time; any more are
+// answered with an error straight away.
+//
+// The codes are JSON-RPC's, and, in the range it leaves for servers, the
+// ones below.
+
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+
+	rpcTimeout      = -32000
+	rpcTooManyCalls = -32001
+)
+
+// maxCallsInFlight is how many requests a connection can have running at once.
+const maxCallsInFlight = 32
+
+// methodFunc handles a request. What it returns is sent back as the result.
+// If it fails, the client is sent the error; an *rpcError goes as it is, and
+// any other error as an internal error.
+type methodFunc func(ctx context.Context, c *client, params json.RawMessage) (interface{}, error)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  *string         `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// method registers the method. Like handle, it panics if the method already
+// has one.
+func (d *dispatcher) method(name string, m methodFunc) {
+	if _, ok := d.methods[name]; ok {
+		panic(fmt.Sprintf("dispatcher: a method %q is already registered", name))
+	}
+	d.methods[name] = m
+}
+
+// parseRPCRequest parses the message as a request, if it's one.
+func parseRPCRequest(message []byte) (rpcRequest, bool) {
+	var req rpcRequest
+	if err := json.Unmarshal(message, &req); err != nil || req.Method == nil {
+		return rpcRequest{}, false
+	}
+	return req, true
+}
+
+// call runs the request in g, and answers it once it's done. It only fails if
+// answering does.
+func (d *dispatcher) call(ctx context.Context, g *errgroup.Group, c *client, req rpcRequest, inFlight chan struct{}) error {
+	// An id that can't be echoed back is answered with a null one.
+	if !validID(req.ID) {
+		return reply(c, json.RawMessage("null"), nil, &rpcError{Code: rpcInvalidRequest, Message: "the id must be a string or a number"})
+	}
+	if req.JSONRPC != "" && req.JSONRPC != "2.0" {
+		return reply(c, req.ID, nil, &rpcError{Code: rpcInvalidRequest, Message: `"jsonrpc" must be "2.0"`})
+	}
+	m, ok := d.methods[*req.Method]
+	if !ok {
+		return reply(c, req.ID, nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("there's no method %q", *req.Method)})
+	}
+	select {
+	case inFlight <- struct{}{}:
+	default:
+		return reply(c, req.ID, nil, &rpcError{Code: rpcTooManyCalls, Message: fmt.Sprintf("no more than %d requests can be in flight", maxCallsInFlight)})
+	}
+
+	g.Go(func() error {
+		defer func() { <-inFlight }()
+		setPumpLabel(ctx, "rpc")
+		callCtx, cancel := context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+
+		type outcome struct {
+			result interface{}
+			err    error
+		}
+		done := make(chan outcome, 1)
+		go func() {
+			result, err := m(callCtx, c, req.Params)
+			done <- outcome{result, err}
+		}()
+		var o outcome
+		select {
+		case o = <-done:
+		case <-callCtx.Done():
+			if ctx.Err() != nil {
+				return nil
+			}
+			o.err = &rpcError{Code: rpcTimeout, Message: fmt.Sprintf("no answer within %s", d.timeout)}
+		}
+		var re *rpcError
+		if o.err != nil && !errors.As(o.err, &re) {
+			re = &rpcError{Code: rpcInternalError, Message: o.err.Error()}
+		}
+		return stopping(ctx, reply(c, req.ID, o.result, re))
+	})
+	return nil
+}
+
+// validID tells whether the id is a string, a number, or missing.
+func validID(id json.RawMessage) bool {
+	if len(id) == 0 {
+		return true
+	}
+	var v interface{}
+	if err := json.Unmarshal(id, &v); err != nil {
+		return false
+	}
+	switch v.(type) {
+	case string, float64:
+		return true
+	}
+	return false
+}
+
+// reply answers the request with the id, with either the result or the
+// error. Without an id, it's a notification, which isn't answered.
+func reply(c *client, id json.RawMessage, result interface{}, rerr *rpcError) error {
+	if len(id) == 0 {
+		return nil
+	}
+	resp := rpcResponse{JSONRPC: "2.0", ID: id, Error: rerr}
+	if rerr == nil {
+		// A method that has nothing to say still answers with a result.
+		if result == nil {
+			result = json.RawMessage("null")
+		}
+		resp.Result = result
+	}
+	message, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return c.write(websocket.TextMessage, message)
+}
+
+// decodeParams decodes the params into v, failing with an invalid params error
+// for the client if they don't fit.
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return &rpcError{Code: rpcInvalidParams, Message: "the request has no params"}
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The server can push messages of its own, on a schedule, with Every:
+//
+//	s.Every(time.Minute, "prices", func(ctx context.Context) (server.Message, error) {
+//		summary, err := marketSummary(ctx)
+//		if err != nil {
+//			return server.Message{}, err
+//		}
+//		return server.Message{Type: websocket.TextMessage, Data: summary}, nil
+//	})
+//
+// broadcasts what fn gives to the room "prices" once a minute, or, with a room
+// of "", to everyone, through the hub of /chat, or another one given with
+// ScheduleHub. A Message with no data is nothing to send that time. An error
+// is logged, and the schedule carries on, as it does if fn panics.
+//
+// Every schedule is run by one goroutine, which hands each one that's due to
+// one of a few that run fn, so a slow fn holds up only as many of the others
+// as there are of those. A schedule is never run again while it's still
+// running; a run that takes longer than the interval misses the runs it took
+// up, rather than have them pile up behind it. With ScheduleJitter, each run
+// is put off by a random part of the jitter, so that schedules set up
+// together don't all go off at once, each time. A schedule runs until it's
+// stopped, or the server is shut down, when fn's context is cancelled.
+//
+// Runs are counted as sent, skipped, for nothing to send, and failed, under
+// scheduled_broadcasts at /debug/vars.
+
+var scheduledBroadcasts = expvar.NewMap("scheduled_broadcasts")
+
+// scheduleWorkers is how many schedules can be running at once.
+const scheduleWorkers = 4
+
+// A Schedule is a message broadcast every so often, from when it's made with
+// Every until it's stopped.
+type Schedule struct {
+	every  time.Duration
+	jitter time.Duration
+	room   string
+	hub    *hub
+	fn     func(ctx context.Context) (Message, error)
+
+	// Cancelled when it's stopped.
+	ctx  context.Context
+	stop context.CancelFunc
+
+	// When it's due, and when it would be without its jitter, its place in
+	// the scheduler's queue, or -1 while it's running or stopped, and whether
+	// it has been. The scheduler's mut must be held.
+	next, planned time.Time
+	index         int
+	stopped       bool
+	sched         *scheduler
+}
+
+// A ScheduleOption sets how a Schedule goes.
+type ScheduleOption func(*Schedule)
+
+// ScheduleJitter puts each run off by a random time of up to d.
+func ScheduleJitter(d time.Duration) ScheduleOption {
+	return func(sc *Schedule) { sc.jitter = d }
+}
+
+// ScheduleHub broadcasts through the hub, rather than that of /chat.
+func ScheduleHub(h *Hub) ScheduleOption {
+	return func(sc *Schedule) { sc.hub = h.h }
+}
+
+// Every broadcasts what fn gives to the room, or to everyone if it's "", every
+// d, from d from now, until the Schedule is stopped, or the server is shut
+// down. It panics if d isn't positive.
+func (s *Server) Every(d time.Duration, room string, fn func(ctx context.Context) (Message, error), opts ...ScheduleOption) *Schedule {
+	if d <= 0 {
+		panic(fmt.Sprintf("server: Every with an interval of %s", d))
+	}
+	sc := &Schedule{every: d, room: room, hub: s.chat, fn: fn}
+	for _, opt := range opts {
+		opt(sc)
+	}
+	sc.ctx, sc.stop = context.WithCancel(context.Background())
+	s.schedules.add(sc, time.Now())
+	return sc
+}
+
+// Stop stops the schedule. A run that's already begun has fn's context
+// cancelled, though it may still broadcast what fn gives.
+func (sc *Schedule) Stop() {
+	sc.sched.remove(sc)
+	sc.stop()
+}
+
+// scheduler runs each Schedule when it's due.
+type scheduler struct {
+	mut   sync.Mutex
+	queue scheduleQueue
+	// Has a signal sent on it when the first schedule in the queue changes.
+	wake chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{wake: make(chan struct{}, 1)}
+}
+
+// add puts the schedule in the queue, for its first run.
+func (s *scheduler) add(sc *Schedule, now time.Time) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	sc.sched = s
+	sc.planned = now
+	s.requeue(sc, now)
+}
+
+// requeue puts the schedule back in the queue, for its next run after now.
+// s.mut must be held.
+func (s *scheduler) requeue(sc *Schedule, now time.Time) {
+	if sc.stopped {
+		return
+	}
+	sc.planned = sc.planned.Add(sc.every)
+	if !sc.planned.After(now) {
+		// It missed some, while it ran, or while the server was busy.
+		missed := now.Sub(sc.planned)/sc.every + 1
+		sc.planned = sc.planned.Add(missed * sc.every)
+	}
+	sc.next = sc.planned
+	if sc.jitter > 0 {
+		sc.next = sc.next.Add(time.Duration(rand.Int63n(int64(sc.jitter))))
+	}
+	heap.Push(&s.queue, sc)
+	if sc.index == 0 {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *scheduler) remove(sc *Schedule) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	sc.stopped = true
+	if sc.index >= 0 {
+		heap.Remove(&s.queue, sc.index)
+	}
+}
+
+// run runs the schedules as they come due, until ctx is done, and then waits
+// for any that are running.
+func (s *scheduler) run(ctx context.Context) {
+	due := make(chan *Schedule)
+	var wg sync.WaitGroup
+	for i := 0; i < scheduleWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sc := range due {
+				s.fire(ctx, sc)
+				s.mut.Lock()
+				s.requeue(sc, time.Now())
+				s.mut.Unlock()
+			}
+		}()
+	}
+	defer func() {
+		close(due)
+		wg.Wait()
+	}()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		s.mut.Lock()
+		var next *Schedule
+		wait := time.Hour
+		if len(s.queue) > 0 {
+			if wait = time.Until(s.queue[0].next); wait <= 0 {
+				next = heap.Pop(&s.queue).(*Schedule)
+			}
+		}
+		s.mut.Unlock()
+		if next != nil {
+			select {
+			case due <- next:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fire runs the schedule's fn, and broadcasts what it gives.
+func (s *scheduler) fire(ctx context.Context, sc *Schedule) {
+	if sc.ctx.Err() != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(sc.ctx, cancel)()
+	m, err := sc.call(ctx)
+	switch {
+	case err != nil:
+		scheduledBroadcasts.Add("failed", 1)
+		slog.Warn("Scheduled broadcast failed", "room", sc.room, "every", sc.every, "error", err)
+	case m.Data == nil:
+		scheduledBroadcasts.Add("skipped", 1)
+	default:
+		if m.Type == 0 {
+			m.Type = websocket.TextMessage
+		}
+		sc.hub.broadcastToRoom(ctx, sc.room, m.Type, m.Data)
+		scheduledBroadcasts.Add("sent", 1)
+	}
+}
+
+// call calls fn, with a panic as its error.
+func (sc *Schedule) call(ctx context.Context) (m Message, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return sc.fn(ctx)
+}
+
+// scheduleQueue is a heap of schedules, the next one due first.
+type scheduleQueue []*Schedule
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+
+func (q *scheduleQueue) Push(x any) {
+	sc := x.(*Schedule)
+	sc.index = len(*q)
+	*q = append(*q, sc)
+}
+
+func (q *scheduleQueue) Pop() any {
+	old := *q
+	sc := old[len(old)-1]
+	old[len(old)-1] = nil
+	sc.index = -1
+	*q = old[:len(old)-1]
+	return sc
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEvery(t *testing.T) {
+	s := pipeServer(t)
+	conn := pipeDial(t, s, "/chat")
+	var runs atomic.Int32
+	sc := s.Every(5*time.Millisecond, "", func(ctx context.Context) (Message, error) {
+		switch n := runs.Add(1); n {
+		case 2:
+			return Message{}, errors.New("no data")
+		case 3:
+			return Message{}, nil
+		case 4:
+			panic("and a panic")
+		default:
+			return Message{Data: []byte(fmt.Sprint("tick ", n))}, nil
+		}
+	})
+
+	// The failures and the skipped run are just left out.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var ticks []string
+	for len(ticks) < 2 {
+		m, err := conn.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(string(m.Data), "tick") {
+			ticks = append(ticks, string(m.Data))
+		}
+	}
+	if ticks[0] != "tick 1" || ticks[1] != "tick 5" {
+		t.Fatalf("got %q", ticks)
+	}
+
+	sc.Stop()
+	stopped := runs.Load()
+	time.Sleep(30 * time.Millisecond)
+	if n := runs.Load(); n > stopped+1 {
+		t.Fatalf("ran %d times after it was stopped", n-stopped)
+	}
+}
+
+func TestScheduleTimes(t *testing.T) {
+	const every, jitter = time.Minute, 10 * time.Second
+	s := newScheduler()
+	start := time.Now()
+	sc := &Schedule{every: every, jitter: jitter}
+	sc.ctx, sc.stop = context.WithCancel(context.Background())
+	s.add(sc, start)
+	for i := 1; i <= 3; i++ {
+		planned := start.Add(time.Duration(i) * every)
+		if !sc.planned.Equal(planned) || sc.next.Before(planned) || !sc.next.Before(planned.Add(jitter)) {
+			t.Fatalf("run %d is at %s, planned for %s", i, sc.next.Sub(start), sc.planned.Sub(start))
+		}
+		s.mut.Lock()
+		heap.Pop(&s.queue)
+		s.requeue(sc, planned.Add(jitter))
+		s.mut.Unlock()
+	}
+
+	// A run that overran is next run at the first time it hasn't missed.
+	s.mut.Lock()
+	heap.Pop(&s.queue)
+	s.requeue(sc, sc.planned.Add(3*every+every/2))
+	s.mut.Unlock()
+	if want := start.Add(8 * every); !sc.planned.Equal(want) {
+		t.Fatalf("after overrunning, it's planned for %s, want %s", sc.planned.Sub(start), want.Sub(start))
+	}
+
+	sc.Stop()
+	if len(s.queue) != 0 {
+		t.Fatalf("%d left in the queue once it's stopped", len(s.queue))
+	}
+}
+
+func TestScheduleShutdown(t *testing.T) {
+	s, err := New(WithUpgradeRate(0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	s.Every(time.Millisecond, "lobby", func(ctx context.Context) (Message, error) {
+		close(started)
+		<-ctx.Done()
+		return Message{}, ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.schedules.run(ctx)
+	}()
+	<-started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the scheduler didn't stop, with a schedule running")
+	}
+}
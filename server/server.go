@@ -0,0 +1,490 @@
+// Package server is the WebSocket server of the example, as a library, for
+// embedding in other programs. The wsexample command is just this, configured
+// from its flags:
+//
+//	srv, err := server.New(
+//		server.WithAddr("127.0.0.1:9000"),
+//		server.WithPongWait(30*time.Second),
+//		server.WithReadLimit(1<<20),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	return srv.Run(ctx)
+//
+// The server logs with slog's default logger. Its counters are published with
+// expvar, which has one set for the whole process, so every Server in it
+// shares them.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"wsexample/graphqlws"
+)
+
+// So, as it turns out, in order to maintain a more robust connection between
+// two hosts in a stable connection, ideally, both hosts need to be sending
+// pings to eachother. Otherwise, either hosts may mistake the other host as
+// having silently closed the connection.
+//
+// This example demoes on how to implement a WebSocket connection that will
+// be relatively stable.
+//
+// This example also demoes using some additional safeguards that WebSocket has.
+// For example, you may want to limit the amount of bytes being provided by the
+// client to the server. Additionally, bound the wait time until the other host
+// sends at least any message.
+
+// The origin has already been checked against the settings by the time the
+// upgrader sees the request.
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+	Error:       upgradeError,
+}
+
+// A 64KiB read limit from the other host, unless configured otherwise
+const readLimit = 1024 * 64
+
+// Sent when the other host didn't send anything within the handshake grace
+// period after the upgrade.
+const closeHandshakeTimeout = 4408
+
+var (
+	handshakeTimeouts = expvar.NewInt("handshake_timeouts")
+	pongTimeouts      = expvar.NewInt("pong_timeouts")
+)
+
+// So the idea is this:
+//
+// Every ping period, we send a ping, and wait for the pong. If it doesn't show
+// up within the pong wait, the other host is assumed to be gone.
+
+func randInt(max int) int {
+	return int(rand.Float32() * float32(max))
+}
+
+// Server is the WebSocket server, with every endpoint, and the admin API when
+// there's an admin token. It's made with New, and runs with Run, once.
+type Server struct {
+	opts options
+
+	holder    *settingsHolder
+	accept    acceptFunc
+	chaos     *chaosConfig
+	traceOut  *log.Logger
+	traceFile *os.File
+	bans      *banList
+	reg       *connRegistry
+	conns     *connCounter
+	connIDs   uint64
+	limiter   *upgradeLimiter
+	chat      *hub
+	apiHub    *hub
+	// The dispatcher of /api, which HandleTyped adds handlers to.
+	api     *dispatcher
+	idle    *idleReaper
+	events  *eventSessions
+	signer  *signer
+	onError errorHook
+	handler http.Handler
+
+	// Every hub, which Run runs, and the routes of the modes added with
+	// Handle, which come ahead of the demo's.
+	hubs  []*hub
+	modes *mux.Router
+	// The broadcasts made with Every; see schedule.go.
+	schedules *scheduler
+	// What the hubs do with names that are taken.
+	nameConflicts nameConflicts
+	// The limits of the hubs' rooms.
+	roomLimits *roomPolicy
+	// The keys of the labels the hubs' clients can set.
+	labelKeys map[string]bool
+	// What's done with a connection for a user with another open, and each
+	// user's connections; see duplicates.go.
+	duplicates duplicatePolicy
+	principals *principalIndex
+
+	// Set once the server is shutting down, and mustn't take new connections.
+	draining int32
+	// Cancelling the base context tells every connection to close. The hubs
+	// are only stopped once the connections are gone, so that they're still
+	// there for them as they close.
+	baseCtx  context.Context
+	shutdown context.CancelFunc
+	hubCtx   context.Context
+	stopHubs context.CancelFunc
+}
+
+// New makes a server with the options. It checks them, and loads the
+// settings, the bans and the trace file, but doesn't listen yet.
+func New(opts ...Option) (*Server, error) {
+	s := &Server{opts: defaultOptions()}
+	for _, opt := range opts {
+		opt(&s.opts)
+	}
+	o := &s.opts
+
+	var err error
+	if s.chaos, err = parseChaos(o.chaos); err != nil {
+		return nil, err
+	}
+	if o.compressionThreshold < 1 {
+		return nil, fmt.Errorf("invalid compression threshold %d", o.compressionThreshold)
+	}
+	if s.accept, err = transportAcceptor(o.transport, compression{o.compression, o.compressionThreshold}, o.handshakeTimeout, o.writeWaits.control); err != nil {
+		return nil, err
+	}
+	if o.minPingInterval <= 0 || o.minPingInterval > o.maxPingInterval {
+		return nil, fmt.Errorf("invalid ping interval bounds %s to %s", o.minPingInterval, o.maxPingInterval)
+	}
+	if err := o.writeWaits.validate(); err != nil {
+		return nil, err
+	}
+	if o.pongWait <= 0 {
+		return nil, errors.New("the pong wait must be positive")
+	}
+	if o.streamLimit < 1 {
+		return nil, fmt.Errorf("invalid stream limit %d", o.streamLimit)
+	}
+	if o.sessionGrace < 0 {
+		return nil, fmt.Errorf("invalid session grace %s", o.sessionGrace)
+	}
+	if o.historySize > 0 && o.historyRooms < 1 {
+		return nil, fmt.Errorf("invalid number of history rooms %d", o.historyRooms)
+	}
+	if o.upgradeRate > 0 && o.upgradeWindow <= 0 {
+		return nil, fmt.Errorf("invalid upgrade window %s", o.upgradeWindow)
+	}
+	if o.upgradeRate > 0 && o.upgradeAddrs < 1 {
+		return nil, fmt.Errorf("invalid number of upgrade rate addresses %d", o.upgradeAddrs)
+	}
+	if s.nameConflicts, err = parseNameConflicts(o.nameConflict); err != nil {
+		return nil, err
+	}
+	if s.duplicates, err = parseDuplicatePolicy(o.duplicateSessions); err != nil {
+		return nil, err
+	}
+	if o.typingFor < 0 || o.typingEvery < 0 {
+		return nil, fmt.Errorf("invalid typing interval %s or timeout %s", o.typingEvery, o.typingFor)
+	}
+	if o.mailboxTTL < 0 || (o.mailboxTTL > 0 && o.mailboxSize < 1) {
+		return nil, fmt.Errorf("invalid mailbox TTL %s or size %d", o.mailboxTTL, o.mailboxSize)
+	}
+	if o.signatureStrikes < 0 {
+		return nil, fmt.Errorf("invalid number of signature strikes %d", o.signatureStrikes)
+	}
+	if o.broadcastWorkers < 1 {
+		return nil, fmt.Errorf("invalid number of broadcast workers %d", o.broadcastWorkers)
+	}
+	if err := o.roomLimits.check(); err != nil {
+		return nil, err
+	}
+	s.roomLimits = &roomPolicy{defaults: o.roomLimits}
+	s.labelKeys = map[string]bool{}
+	for _, k := range o.labelKeys {
+		if checkLabelKey(k) != nil {
+			return nil, fmt.Errorf("invalid label key %q", k)
+		}
+		s.labelKeys[k] = true
+	}
+
+	s.holder = &settingsHolder{source: settingsSource{
+		allow:          o.allow,
+		deny:           o.deny,
+		trustedProxies: o.trustedProxies,
+		origins:        o.origins,
+		readLimit:      o.readLimit,
+		handshakeGrace: o.handshakeGrace,
+		sendQueue:      o.sendQueue,
+		sendOverflow:   o.sendOverflow,
+		sendQueueBytes: o.sendQueueBytes,
+		messageRate:    o.messageRate,
+		messageBurst:   o.messageBurst,
+		ratePolicy:     o.ratePolicy,
+		maxConns:       o.maxConns,
+		maxConnsPerIP:  o.maxConnsPerIP,
+		writeWaits:     o.writeWaits,
+		pongWait:       o.pongWait,
+		ipRulesFile:    o.ipRulesFile,
+		tokensFile:     o.tokensFile,
+		jwtSecretFile:  o.jwtSecretFile,
+		configFile:     o.configFile,
+		historySize:    o.historySize,
+		signingKeys:    o.signingKeysFile,
+	}, apply: s.applySettings}
+	if o.logLevel != nil {
+		s.holder.source.logLevel = o.logLevel.Level()
+	}
+	if problems := s.holder.reload(); problems != nil {
+		return nil, fmt.Errorf("invalid settings: %s", strings.Join(problems, "; "))
+	}
+
+	if s.bans, err = loadBanList(o.banFile); err != nil {
+		return nil, fmt.Errorf("failed to load the bans: %w", err)
+	}
+	s.traceOut = log.Default()
+	if o.traceFile != "" {
+		f, err := os.OpenFile(o.traceFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the trace file: %w", err)
+		}
+		s.traceFile = f
+		s.traceOut = log.New(f, "", log.LstdFlags|log.Lmicroseconds)
+	}
+
+	if o.signingKeysFile != "" {
+		s.signer = newSigner(s.holder.load().signingKeys, o.signatureStrikes)
+	}
+	s.onError = logError
+	if o.errorHook != nil {
+		s.onError = o.errorHook.hook()
+	}
+	s.reg = newConnRegistry()
+	s.conns = newConnCounter()
+	s.principals = newPrincipalIndex()
+	if o.upgradeRate > 0 {
+		s.limiter = newUpgradeLimiter(o.upgradeRate, o.upgradeWindow, o.upgradeAddrs)
+	}
+	s.schedules = newScheduler()
+	s.chat = newHub()
+	s.apiHub = newHub()
+	s.addHub(s.chat)
+	s.addHub(s.apiHub)
+	s.apiHub.presence = true
+	s.apiHub.typingInterval, s.apiHub.typingTimeout = o.typingEvery, o.typingFor
+	if o.mailboxTTL > 0 {
+		s.apiHub.mailbox = newMailbox(o.mailboxTTL, o.mailboxSize)
+	}
+	if o.historySize > 0 {
+		s.apiHub.history = newMemoryHistory(s.holder.load().historySize, o.historyRooms)
+	}
+	if o.redisURL != "" {
+		s.chat.bus = newRedisBus(o.redisURL, o.redisChannel+":chat")
+		s.apiHub.bus = newRedisBus(o.redisURL, o.redisChannel+":api")
+	}
+	newAPIDispatcher := func() *dispatcher {
+		d := newDispatcher(o.rpcTimeout)
+		d.use(logEnvelopes, countEnvelopes)
+		return d
+	}
+	api := newAPIDispatcher()
+	handleChat(api, s.apiHub, 1)
+	handleRelay(api, s.apiHub)
+	handleAdmin(api, s.reg, s.chat, s.apiHub)
+	s.api = api
+	versions := apiProtocolVersions(s.apiHub, newAPIDispatcher)
+	if o.idleTimeout > 0 {
+		s.idle = newIdleReaper(o.idleTimeout, o.idleGrace)
+	}
+
+	s.baseCtx, s.shutdown = context.WithCancel(context.Background())
+	s.hubCtx, s.stopHubs = context.WithCancel(context.Background())
+
+	r := mux.NewRouter()
+	r.Handle("/debug/vars", expvar.Handler())
+	r.HandleFunc("/metrics", metricsHandler(s.reg))
+	if token := o.adminToken; token != "" {
+		r.Handle("/admin/reload", requireAdmin(token, reloadHandler(s.holder))).Methods(http.MethodPost)
+		r.Handle("/admin/connections/{id}/trace", requireAdmin(token, traceHandler(s.reg))).Methods(http.MethodPost, http.MethodDelete)
+		r.Handle("/admin/connections/{id}/record", requireAdmin(token, recordHandler(s.reg))).Methods(http.MethodPost)
+		r.Handle("/admin/bans", requireAdmin(token, bansHandler(s.bans, s.reg))).Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
+		r.Handle("/admin/connections", requireAdmin(token, connectionsHandler(s.reg, s.chat, s.apiHub))).Methods(http.MethodGet)
+		r.Handle("/admin/connections/{id}", requireAdmin(token, disconnectHandler(s.reg))).Methods(http.MethodDelete)
+		r.Handle("/admin/broadcast", requireAdmin(token, broadcastHandler(s.chat, s.apiHub))).Methods(http.MethodPost)
+		r.Handle("/admin/rooms/limits", requireAdmin(token, roomLimitsHandler(s.roomLimits))).Methods(http.MethodGet, http.MethodPut)
+		r.Handle("/admin/rooms/limits/{room:.+}", requireAdmin(token, roomLimitsHandler(s.roomLimits))).Methods(http.MethodPut, http.MethodDelete)
+	}
+	bounds := keepaliveBounds{o.minPingInterval, o.maxPingInterval}
+	s.events = newEventSessions(o.writeWaits.control)
+	chat := HubHandler(&Hub{s.chat})
+	apiEndpoint := apiServer(api, s.apiHub, s.signer)
+	r.HandleFunc("/events", eventsHandler(map[string]http.HandlerFunc{
+		"chat": s.connHandler(s.events.acceptEvents, chat),
+		"api":  s.connHandler(s.events.acceptEvents, Mode{serve: apiEndpoint}),
+	})).Methods(http.MethodGet)
+	r.HandleFunc("/send", s.events.sendHandler).Methods(http.MethodPost)
+	r.HandleFunc("/ws", s.wsHandler(Mode{serve: echoServer(bounds, o.latencyReports)}))
+	r.HandleFunc("/echo", s.wsHandler(EchoHandler()))
+	r.HandleFunc("/chat", s.wsHandler(chat))
+	r.HandleFunc("/upload", s.wsHandler(Mode{serve: uploadServer(o.streamLimit)}))
+	r.HandleFunc("/api", s.wsHandler(Mode{subprotocols: []string{protoSubprotocol}, serve: apiEndpoint}))
+	r.HandleFunc("/api/versioned", s.versionedHandler(versions, versionServer(s.apiHub, s.signer)))
+	r.HandleFunc("/graphql", s.wsHandler(Mode{subprotocols: []string{graphqlws.Subprotocol}, serve: graphqlServer(&graphqlws.Server{
+		Resolver:     clockResolver{},
+		InitTimeout:  o.handshakeGrace,
+		WriteTimeout: o.writeWaits.message,
+	})}))
+	s.modes = r.NewRoute().Subrouter()
+	s.Handle("/ws/echo", EchoHandler())
+	s.Handle("/ws/chat", chat)
+	s.Handle("/ws/feed", FeedHandler(&Hub{s.chat}))
+	if o.demo {
+		// Last, so that it only gets what no endpoint does.
+		r.PathPrefix("/").Methods(http.MethodGet, http.MethodHead).Handler(staticHandler())
+	}
+	s.handler = r
+	if o.requireHTTPS {
+		s.handler = requireHTTPS(s.holder, r)
+	}
+	return s, nil
+}
+
+// Reload re-reads the config file, and the files of IP rules, tokens, the
+// JWT secret and the signing keys, as SIGHUP does for the command. If anything in them is
+// invalid, nothing is applied, and the error lists every problem.
+func (s *Server) Reload() error {
+	if problems := s.holder.reload(); problems != nil {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// applySettings puts the settings that take effect straight away into effect,
+// rather than for connections made from then on.
+func (s *Server) applySettings(cfg *settings) {
+	if s.opts.logLevel != nil {
+		s.opts.logLevel.Set(cfg.logLevel)
+	}
+	// As is the signer.
+	if s.signer != nil {
+		s.signer.setKeys(cfg.signingKeys)
+	}
+	// The hub is made after the first snapshot is loaded, with its size.
+	if s.apiHub == nil {
+		return
+	}
+	if h, ok := s.apiHub.history.(*memoryHistory); ok {
+		h.resize(cfg.historySize)
+	}
+}
+
+// Run listens, on the sockets passed by systemd if there are any, and serves
+// until ctx is done, or listening fails. Once ctx is done, new upgrades are
+// turned away, every connection is closed with a going away close frame, and
+// once they're all closed, or the shutdown timeout is up, the server is shut
+// down. Shutting it down also closes the listeners, which, for unix sockets
+// that it created itself, removes the socket file. If a listener fails, the
+// server is shut down the same way, and Run gives the error; otherwise it
+// gives nil.
+func (s *Server) Run(ctx context.Context) error {
+	o := &s.opts
+	if s.traceFile != nil {
+		defer s.traceFile.Close()
+	}
+	tlsConfig, acmeChallenges, err := loadTLS(o.tlsCert, o.tlsKey, o.autocertDomains, o.autocertCache)
+	if err != nil {
+		return fmt.Errorf("failed to set up TLS: %w", err)
+	}
+
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		return fmt.Errorf("failed to use the sockets passed by systemd: %w", err)
+	}
+	if len(listeners) == 0 {
+		listener, err := listen(o.addr, o.socketMode)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", o.addr, err)
+		}
+		listeners = []namedListener{{o.addr, listener}}
+	}
+	if tlsConfig != nil {
+		for i := range listeners {
+			listeners[i].Listener = tls.NewListener(listeners[i].Listener, tlsConfig)
+		}
+	}
+
+	errorLog := slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
+	srv := &http.Server{
+		Handler:           s.handler,
+		BaseContext:       func(net.Listener) context.Context { return s.baseCtx },
+		ConnContext:       withConn,
+		ReadHeaderTimeout: o.readHeaderTimeout,
+		ErrorLog:          errorLog,
+	}
+	var redirectSrv *http.Server
+	if o.redirectAddr != "" {
+		// Redirected to the port the server itself listens on, when that's
+		// known.
+		_, port, _ := net.SplitHostPort(o.addr)
+		if strings.HasPrefix(o.addr, unixScheme) {
+			port = ""
+		}
+		redirectSrv = &http.Server{
+			Addr:              o.redirectAddr,
+			Handler:           acmeChallenges(httpsRedirect(port)),
+			ReadHeaderTimeout: o.readHeaderTimeout,
+			ErrorLog:          errorLog,
+		}
+	}
+
+	errs := make(chan error, len(listeners)+1)
+	for _, listener := range listeners {
+		slog.Info("Server listening", "addr", listener.name)
+		go func(listener net.Listener) {
+			errs <- srv.Serve(listener)
+		}(listener.Listener)
+	}
+	if redirectSrv != nil {
+		slog.Info("Redirecting to HTTPS", "addr", o.redirectAddr)
+		go func() {
+			errs <- redirectSrv.ListenAndServe()
+		}()
+	}
+	go watchdog(s.baseCtx, s.reg, o.writeWaits.longest())
+	go s.bans.janitor(s.baseCtx)
+	for _, h := range s.hubs {
+		go h.run(s.hubCtx)
+	}
+	go s.schedules.run(s.baseCtx)
+	if s.idle != nil {
+		go s.idle.run(s.baseCtx)
+	}
+
+	if err := systemd.Notify("READY=1"); err != nil {
+		slog.Warn("Failed to notify systemd", "error", err)
+	}
+
+	var failed error
+	select {
+	case <-ctx.Done():
+	case failed = <-errs:
+	}
+
+	slog.Info("Shutting down")
+	if err := systemd.Notify("STOPPING=1"); err != nil {
+		slog.Warn("Failed to notify systemd", "error", err)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), o.shutdownTimeout)
+	defer cancel()
+	atomic.StoreInt32(&s.draining, 1)
+	s.shutdown()
+	if err := s.reg.wait(shutdownCtx); err != nil {
+		slog.Warn("Connections didn't close in time", "open", len(s.reg.list()), "timeout", o.shutdownTimeout)
+	}
+	s.stopHubs()
+	if redirectSrv != nil {
+		redirectSrv.Shutdown(shutdownCtx)
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down the server cleanly", "error", err)
+		srv.Close()
+	}
+	return failed
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testServer serves a Server made with opts, without an upgrade rate, and
+// gives its URL, as ws://. The hubs run, as they do in Run, but nothing else
+// Run starts does.
+func testServer(t *testing.T, opts ...Option) string {
+	t.Helper()
+	s, err := New(append([]Option{WithUpgradeRate(0, 0, 0)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveTest(t, s)
+}
+
+// serveTest runs the server's hubs and schedules, and serves it, until the
+// test is done.
+func serveTest(t *testing.T, s *Server) string {
+	t.Helper()
+	for _, h := range s.hubs {
+		go h.run(s.hubCtx)
+	}
+	go s.schedules.run(s.hubCtx)
+	t.Cleanup(s.stopHubs)
+	srv := httptest.NewServer(s.handler)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
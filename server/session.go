@@ -0,0 +1,254 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A client on /chat or /api that drops off the network for a moment would
+// otherwise come back as a stranger, out of every room it was in. So each one
+// is given a session when it connects, as the first thing it's sent:
+//
+//	{"type":"session","session":"0f8e...","resumed":false,"rooms":[]}
+//
+// on /chat, and on /api, a "session" envelope with the same payload, without
+// the type. A client that reconnects within -session-grace (30 seconds by
+// default) with ?session=0f8e... in the URL gets the same session back, back
+// in the rooms it was in, and is sent what was queued for it in the meantime,
+// ahead of anything else, after its own "session" message, with resumed true
+// and the rooms it's in.
+//
+// While a client is away, a stand-in takes its place in the hub, so that it
+// stays in its rooms, without anyone being told it left, and so that what's
+// broadcast to them is queued for it, along with whatever was still queued
+// when the connection dropped. The stand-in's queue is as long as the client's
+// was, and drops the oldest message to make room for a new one whatever the
+// overflow policy; resuming a room on /api sends anything that was dropped,
+// as long as it's in the history. If the client doesn't come back in time,
+// the stand-in leaves the hub for it.
+//
+// Only a connection that drops, without a close frame either way, keeps its
+// session. A client that closes the connection itself is done with it, and one
+// the server closes, for whatever reason, isn't to come back as it was,
+// unless it's closed for another of its user's connections to take over; see
+// duplicates.go. A
+// session can only be resumed on the endpoint it was started on, by the same
+// user, with the same codec. If the old connection is still open, as it can be
+// until its pongs time out, the new one takes over, and the old one is closed.
+
+var sessionEvents = expvar.NewMap("sessions")
+
+// sessionStore is a hub's sessions, by ID.
+type sessionStore struct {
+	grace time.Duration
+
+	mut      sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	id string
+	// The client in the hub for the session: the one connected as it, or its
+	// stand-in while it's away.
+	holder *client
+	// Set while the client is away, to end the session once the grace period
+	// is up.
+	expiry *time.Timer
+	// Set once another of the user's connections has taken the holder's place,
+	// to keep the session for it, however the holder's connection is closed;
+	// see duplicates.go.
+	superseded bool
+}
+
+func newSessionStore(grace time.Duration) *sessionStore {
+	return &sessionStore{grace: grace, sessions: map[string]*session{}}
+}
+
+// sessionPayload tells a client its session.
+type sessionPayload struct {
+	Session string   `json:"session" pb:"1"`
+	Resumed bool     `json:"resumed" pb:"2"`
+	Rooms   []string `json:"rooms" pb:"3"`
+}
+
+type sessionMessage struct {
+	Type string `json:"type"`
+	sessionPayload
+}
+
+// sessionReply gives the "session" message for /chat.
+func sessionReply(p sessionPayload) []byte {
+	message, _ := json.Marshal(sessionMessage{"session", p})
+	return message
+}
+
+// joinSession puts the client in the hub, in place of the session it asked to
+// resume, if it can, or with a new session, and tells it which with tell.
+// Without sessions, it only joins the hub. The client is taken out of the hub
+// by the func it gives, or, with sessions, once it's disconnected, unless its
+// session is kept for it.
+func (h *hub) joinSession(c *client, tell func(sessionPayload) error) (func(), error) {
+	if h.sessions == nil {
+		h.join(c)
+		return func() { h.leave(c) }, nil
+	}
+	s := h.sessions
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	sess, ok := s.sessions[c.session]
+	if ok && sess.holder.user == c.user && sess.holder.codec.name() == c.codec.name() {
+		old := sess.holder
+		// The client is sent this before it takes the old one's place, which
+		// is what gets it sent everything queued for the old one.
+		p := sessionPayload{Session: sess.id, Resumed: true, Rooms: h.roomsOf(old)}
+		if err := tell(p); err != nil {
+			return nil, err
+		}
+		if sess.expiry != nil {
+			sess.expiry.Stop()
+			sess.expiry = nil
+		}
+		c.connected = old.connected
+		sess.holder = c
+		superseded := sess.superseded
+		sess.superseded = false
+		if !h.handOver(old, c) {
+			// The old one was dropped from the hub for falling behind.
+			h.join(c)
+		}
+		if old.t != nil && !superseded {
+			// The old connection hasn't noticed it's gone yet. One that's
+			// been superseded is being closed already, with a close frame.
+			old.t.CloseNow()
+		}
+		sessionEvents.Add("resumed", 1)
+		c.log.Info("Resumed a session", "session", sess.id, "rooms", len(p.Rooms))
+	} else {
+		sess = &session{id: newConnUUID(), holder: c}
+		s.sessions[sess.id] = sess
+		c.session = sess.id
+		if err := tell(sessionPayload{Session: sess.id, Rooms: []string{}}); err != nil {
+			delete(s.sessions, sess.id)
+			return nil, err
+		}
+		h.join(c)
+		sessionEvents.Add("started", 1)
+	}
+	c.onDisconnect(func(c *client, code int, reason string) {
+		h.sessions.disconnected(h, sess, c, code)
+	})
+	return func() {}, nil
+}
+
+// disconnected keeps the session for the client, with a stand-in, if it's
+// still the client's and the connection dropped, or was superseded, and
+// otherwise ends it.
+func (s *sessionStore) disconnected(h *hub, sess *session, c *client, code int) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if sess.holder != c {
+		// Another connection has taken it over.
+		h.leave(c)
+		return
+	}
+	if code != websocket.CloseAbnormalClosure && !sess.superseded {
+		delete(s.sessions, sess.id)
+		h.leave(c)
+		return
+	}
+	standIn := &client{
+		principal: c.principal,
+		connected: c.connected,
+		codec:     c.codec,
+		session:   sess.id,
+		limits:    sendQueue{c.limits.size, overflowDropOldest, c.limits.bytes},
+		wake:      make(chan struct{}, 1),
+	}
+	if !h.handOver(c, standIn) {
+		// It was dropped from the hub, so there's nothing to keep.
+		delete(s.sessions, sess.id)
+		return
+	}
+	sess.holder = standIn
+	sess.expiry = time.AfterFunc(s.grace, func() { s.expire(h, sess, standIn) })
+	sessionEvents.Add("kept", 1)
+}
+
+// supersede keeps the session the client holds, if it holds one, for another
+// connection to take over, and gives its ID.
+func (s *sessionStore) supersede(c *client) string {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	sess, ok := s.sessions[c.session]
+	if !ok || sess.holder != c {
+		return ""
+	}
+	sess.superseded = true
+	return sess.id
+}
+
+// expire ends the session, unless a client has resumed it in the meantime.
+func (s *sessionStore) expire(h *hub, sess *session, standIn *client) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if sess.holder != standIn {
+		return
+	}
+	delete(s.sessions, sess.id)
+	h.leave(standIn)
+	sessionEvents.Add("expired", 1)
+}
+
+// handOver puts the client in the hub in old's place, in the same rooms,
+// without telling anyone, and queues everything that's queued for old for it
+// instead, after what's queued for it already. It reports whether old was in
+// the hub to be replaced.
+func (h *hub) handOver(old, c *client) bool {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	rooms, ok := h.clients[old]
+	if !ok {
+		return false
+	}
+	delete(h.clients, old)
+	h.clients[c] = rooms
+	for room := range rooms {
+		delete(h.rooms[room], old)
+		h.rooms[room][c] = struct{}{}
+		h.forgetTyping(old, room)
+	}
+	if nicks, ok := h.nicks[old]; ok {
+		delete(h.nicks, old)
+		h.nicks[c] = nicks
+		for room, name := range nicks {
+			h.names[room][strings.ToLower(name)] = c
+		}
+	}
+	h.receipts.handOver(old, c)
+	h.moveLabels(old, c)
+	for _, m := range old.takeQueue() {
+		c.enqueue(m)
+	}
+	return true
+}
+
+// takeQueue empties the queue, and gives the messages that were in it, other
+// than a close frame or a stream, which can't be sent on another connection.
+func (c *client) takeQueue() []outbound {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	var taken []outbound
+	for _, m := range c.queue {
+		c.pendingBytes -= len(m.data)
+		if m.close == nil && m.stream == nil {
+			taken = append(taken, m)
+		}
+	}
+	c.queue = nil
+	return taken
+}
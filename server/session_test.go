@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialSession connects to /api as the session, or as a new one if it's empty,
+// and gives the connection and the session it's told it has.
+func dialSession(t *testing.T, u, id string) (*websocket.Conn, sessionPayload) {
+	t.Helper()
+	if id != "" {
+		u += "?session=" + id
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var e testEnvelope
+	if err := conn.ReadJSON(&e); err != nil || e.Type != "session" {
+		t.Fatalf("first envelope %s, %v, want the session", e.Type, err)
+	}
+	var p sessionPayload
+	json.Unmarshal(e.Payload, &p)
+	return conn, p
+}
+
+func TestSessions(t *testing.T) {
+	const grace = 200 * time.Millisecond
+	base := testServer(t, WithSessionGrace(grace))
+	u := base + "/api"
+	tests := []struct {
+		name string
+		// How the first connection ends, if it does.
+		end     func(*websocket.Conn)
+		wait    time.Duration
+		resumed bool
+	}{
+		{
+			name:    "dropped",
+			end:     func(conn *websocket.Conn) { conn.UnderlyingConn().Close() },
+			resumed: true,
+		},
+		{
+			name: "closed by the client",
+			end: func(conn *websocket.Conn) {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+				conn.ReadMessage()
+			},
+		},
+		{
+			name: "dropped for too long",
+			end:  func(conn *websocket.Conn) { conn.UnderlyingConn().Close() },
+			wait: 3 * grace,
+		},
+		{
+			// The old connection hasn't noticed it's gone, and is taken
+			// over.
+			name:    "still open",
+			resumed: true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			room := fmt.Sprintf("room%d", i)
+			join := map[string]interface{}{"type": "chat.join", "payload": map[string]string{"room": room}}
+			old, first := dialSession(t, u, "")
+			if first.Resumed || first.Session == "" || len(first.Rooms) != 0 {
+				t.Fatalf("new session %+v", first)
+			}
+			old.WriteJSON(join)
+			nextEnvelope(t, old, "chat.joined")
+
+			if tt.end != nil {
+				tt.end(old)
+			}
+			// Give the server the time to notice, and then say something in
+			// the room while the client's away.
+			time.Sleep(50*time.Millisecond + tt.wait)
+			sender := apiDial(t, base, room)
+			sender.WriteJSON(map[string]interface{}{"type": "chat.send", "payload": map[string]string{"room": room, "message": "while you were out"}})
+			nextEnvelope(t, sender, "chat.message")
+
+			conn, got := dialSession(t, u, first.Session)
+			if !tt.resumed {
+				if got.Resumed || got.Session == first.Session {
+					t.Fatalf("resumed %+v, want a new session", got)
+				}
+				return
+			}
+			if !got.Resumed || got.Session != first.Session || len(got.Rooms) != 1 || got.Rooms[0] != room {
+				t.Fatalf("session %+v, want %s resumed in %s", got, first.Session, room)
+			}
+			if tt.end != nil {
+				// What was broadcast while it was away is waiting for it.
+				if message := chatMessage(nextEnvelope(t, conn, "chat.message")); message != "while you were out" {
+					t.Fatalf("got %q, want what was missed", message)
+				}
+			} else {
+				// Which the old connection got instead, before it was closed.
+				nextEnvelope(t, old, "chat.message")
+				if _, _, err := old.ReadMessage(); err == nil {
+					t.Fatal("the old connection is still open")
+				}
+			}
+			// And it's in the room for what's broadcast from now on.
+			sender.WriteJSON(map[string]interface{}{"type": "chat.send", "payload": map[string]string{"room": room, "message": "welcome back"}})
+			if message := chatMessage(nextEnvelope(t, conn, "chat.message")); message != "welcome back" {
+				t.Fatalf("got %q, want the live message", message)
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		if _, got := dialSession(t, u, "0f8e"); got.Resumed || got.Session == "0f8e" {
+			t.Fatalf("session %+v, want a new one", got)
+		}
+	})
+}
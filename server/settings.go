@@ -0,0 +1,335 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Some settings can be changed without restarting the server. They are loaded
+// from the command line flags, and then, optionally, overridden by a JSON
+// config file given via -config, which looks something like this:
+//
+//	{
+//		"allow": ["10.0.0.0/8"],
+//		"deny": ["10.1.2.3"],
+//		"trusted_proxies": ["127.0.0.1"],
+//		"origins": ["https://example.com", "*.example.com"],
+//		"read_limit": 65536,
+//		"handshake_grace": "10s",
+//		"send_queue": 256,
+//		"send_overflow": "drop-oldest",
+//		"send_queue_bytes": 4194304,
+//		"message_rate": 20,
+//		"message_burst": 40,
+//		"message_rate_policy": "disconnect",
+//		"max_connections": 10000,
+//		"max_connections_per_ip": 20,
+//		"log_level": "debug",
+//		"history_size": 50
+//	}
+//
+// Sending the server a SIGHUP, or calling POST /admin/reload, re-reads the
+// config file (and the -ip-rules, -auth-tokens, -jwt-secret-file and
+// -signing-keys files).
+// Everything is loaded into a brand new snapshot, which replaces the old one
+// atomically, and only if the whole thing is valid. A config with even a
+// single mistake in it is rejected, and the old snapshot stays in place.
+//
+// Each upgrade request takes the snapshot that's current at the time, and
+// keeps it for the life of the connection. So:
+//
+//   - allow, deny, trusted_proxies, origins, and the connection limits, as
+//     well as the tokens and the JWT secret, apply to every connection
+//     attempt made after the reload.
+//   - read_limit, handshake_grace, send_queue, send_overflow,
+//     send_queue_bytes and the message rate apply to connections made after the reload. Connections
+//     that are already established keep the values they started with.
+//   - log_level and history_size take effect straight away, for every
+//     connection. The level is set on the slog.LevelVar given to
+//     WithLogLevel, which the command logs at. A smaller history makes each
+//     room forget its oldest envelopes, and a server started without a
+//     history can't be given one. The signing keys are the same: envelopes
+//     to and from every connection are signed and checked with the new ones.
+//
+// Everything else is fixed at startup, including the command's -log-format.
+
+type settings struct {
+	rules          *ipRules
+	resolver       *clientIPResolver
+	origins        *originPolicy
+	auth           *authenticator
+	readLimit      int64
+	handshakeGrace time.Duration
+	sendQueue      sendQueue
+	messageRate    messageRate
+	connLimits     connLimits
+	logLevel       slog.Level
+	historySize    int
+	// The keys to sign envelopes with, newest last, or nil when they aren't
+	// signed.
+	signingKeys [][]byte
+
+	// These aren't in the config file, so they never change.
+	writeWaits writeWaits
+	keepalive  keepalive
+}
+
+// settingsSource describes where the settings are loaded from.
+type settingsSource struct {
+	// The flags, which give the defaults.
+	allow          []string
+	deny           []string
+	trustedProxies []string
+	origins        []string
+	readLimit      int64
+	handshakeGrace time.Duration
+	sendQueue      int
+	sendOverflow   string
+	sendQueueBytes int
+	messageRate    int
+	messageBurst   int
+	ratePolicy     string
+	maxConns       int
+	maxConnsPerIP  int
+	writeWaits     writeWaits
+	pongWait       time.Duration
+	logLevel       slog.Level
+	historySize    int
+
+	ipRulesFile   string
+	tokensFile    string
+	jwtSecretFile string
+	configFile    string
+	signingKeys   string
+}
+
+type settingsFile struct {
+	Allow          []string `json:"allow"`
+	Deny           []string `json:"deny"`
+	TrustedProxies []string `json:"trusted_proxies"`
+	Origins        []string `json:"origins"`
+	ReadLimit      *int64   `json:"read_limit"`
+	HandshakeGrace *string  `json:"handshake_grace"`
+	SendQueue      *int     `json:"send_queue"`
+	SendOverflow   *string  `json:"send_overflow"`
+	SendQueueBytes *int     `json:"send_queue_bytes"`
+	MessageRate    *int     `json:"message_rate"`
+	MessageBurst   *int     `json:"message_burst"`
+	RatePolicy     *string  `json:"message_rate_policy"`
+	MaxConns       *int     `json:"max_connections"`
+	MaxConnsPerIP  *int     `json:"max_connections_per_ip"`
+	LogLevel       *string  `json:"log_level"`
+	HistorySize    *int     `json:"history_size"`
+}
+
+// load builds a new snapshot. If anything is wrong, every problem found is
+// returned, and the snapshot is nil.
+func (src settingsSource) load() (*settings, []string) {
+	var problems []string
+
+	allow, deny, trustedProxies, origins := src.allow, src.deny, src.trustedProxies, src.origins
+	readLimit, handshakeGrace := src.readLimit, src.handshakeGrace
+	sendQueueSize, sendOverflow, sendQueueBytes := src.sendQueue, src.sendOverflow, src.sendQueueBytes
+	msgRate, msgBurst, ratePolicyName := src.messageRate, src.messageBurst, src.ratePolicy
+	maxConns, maxConnsPerIP := src.maxConns, src.maxConnsPerIP
+	logLevel, historySize := src.logLevel, src.historySize
+
+	if src.configFile != "" {
+		var file settingsFile
+		if err := readJSONFile(src.configFile, &file); err != nil {
+			return nil, []string{err.Error()}
+		}
+		if file.Allow != nil {
+			allow = file.Allow
+		}
+		if file.Deny != nil {
+			deny = file.Deny
+		}
+		if file.TrustedProxies != nil {
+			trustedProxies = file.TrustedProxies
+		}
+		if file.Origins != nil {
+			origins = file.Origins
+		}
+		if file.ReadLimit != nil {
+			readLimit = *file.ReadLimit
+		}
+		if file.HandshakeGrace != nil {
+			if d, err := time.ParseDuration(*file.HandshakeGrace); err != nil {
+				problems = append(problems, fmt.Sprintf("handshake_grace: %s", err.Error()))
+			} else {
+				handshakeGrace = d
+			}
+		}
+		if file.SendQueue != nil {
+			sendQueueSize = *file.SendQueue
+		}
+		if file.SendOverflow != nil {
+			sendOverflow = *file.SendOverflow
+		}
+		if file.SendQueueBytes != nil {
+			sendQueueBytes = *file.SendQueueBytes
+		}
+		if file.MessageRate != nil {
+			msgRate = *file.MessageRate
+		}
+		if file.MessageBurst != nil {
+			msgBurst = *file.MessageBurst
+		}
+		if file.RatePolicy != nil {
+			ratePolicyName = *file.RatePolicy
+		}
+		if file.MaxConns != nil {
+			maxConns = *file.MaxConns
+		}
+		if file.MaxConnsPerIP != nil {
+			maxConnsPerIP = *file.MaxConnsPerIP
+		}
+		if file.LogLevel != nil {
+			if err := logLevel.UnmarshalText([]byte(*file.LogLevel)); err != nil {
+				problems = append(problems, fmt.Sprintf("log_level: unknown level %q; expected debug, info, warn or error", *file.LogLevel))
+			}
+		}
+		if file.HistorySize != nil {
+			switch {
+			case src.historySize == 0:
+				problems = append(problems, "history_size: the server was started without a history")
+			case *file.HistorySize <= 0:
+				problems = append(problems, "history_size: must be positive")
+			default:
+				historySize = *file.HistorySize
+			}
+		}
+	}
+
+	rules, err := loadIPRules(allow, deny, src.ipRulesFile)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("ip rules: %s", err.Error()))
+	}
+	resolver, err := newClientIPResolver(trustedProxies)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("trusted_proxies: %s", err.Error()))
+	}
+	auth, err := loadAuthenticator(src.tokensFile, src.jwtSecretFile)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("auth: %s", err.Error()))
+	}
+	signingKeys, err := loadSigningKeys(src.signingKeys)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("signing keys: %s", err.Error()))
+	}
+	originPolicy, err := parseOrigins(origins)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("origins: %s", err.Error()))
+	}
+	if readLimit <= 0 {
+		problems = append(problems, "read_limit: must be positive")
+	}
+	if handshakeGrace <= 0 {
+		problems = append(problems, "handshake_grace: must be positive")
+	}
+	if sendQueueSize <= 0 {
+		problems = append(problems, "send_queue: must be positive")
+	}
+	overflow, err := parseOverflowPolicy(sendOverflow)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("send_overflow: %s", err.Error()))
+	}
+	if sendQueueBytes < 0 {
+		problems = append(problems, "send_queue_bytes: mustn't be negative")
+	}
+	if msgRate < 0 {
+		problems = append(problems, "message_rate: mustn't be negative")
+	}
+	if msgBurst < 0 {
+		problems = append(problems, "message_burst: mustn't be negative")
+	}
+	ratePolicy, err := parseRatePolicy(ratePolicyName)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("message_rate_policy: %s", err.Error()))
+	}
+	if maxConns < 0 {
+		problems = append(problems, "max_connections: mustn't be negative")
+	}
+	if maxConnsPerIP < 0 {
+		problems = append(problems, "max_connections_per_ip: mustn't be negative")
+	}
+
+	if problems != nil {
+		return nil, problems
+	}
+	return &settings{
+		rules:          rules,
+		resolver:       resolver,
+		origins:        originPolicy,
+		auth:           auth,
+		readLimit:      readLimit,
+		handshakeGrace: handshakeGrace,
+		sendQueue:      sendQueue{sendQueueSize, overflow, sendQueueBytes},
+		messageRate:    messageRate{msgRate, msgBurst, ratePolicy},
+		connLimits:     connLimits{maxConns, maxConnsPerIP},
+		logLevel:       logLevel,
+		historySize:    historySize,
+		signingKeys:    signingKeys,
+		writeWaits:     src.writeWaits,
+		keepalive:      keepaliveFor(src.pongWait * 9 / 10),
+	}, nil
+}
+
+func readJSONFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// SplitList splits up a comma-separated list, such as a flag value, into its
+// items, without the spaces around them, or any empty ones.
+func SplitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// settingsHolder holds the current *settings snapshot.
+type settingsHolder struct {
+	source settingsSource
+	v      atomic.Value
+	// Puts the settings that take effect straight away into effect, for
+	// each snapshot that's stored, if it's set.
+	apply func(*settings)
+}
+
+func (h *settingsHolder) load() *settings {
+	return h.v.Load().(*settings)
+}
+
+// reload replaces the current snapshot with a freshly loaded one. If the new
+// one doesn't load, the current one stays in place.
+func (h *settingsHolder) reload() []string {
+	s, problems := h.source.load()
+	if problems != nil {
+		return problems
+	}
+	h.v.Store(s)
+	if h.apply != nil {
+		h.apply(s)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadSettings(t *testing.T) {
+	src := settingsSource{
+		readLimit:      1024,
+		handshakeGrace: time.Second,
+		sendQueue:      16,
+		sendOverflow:   "disconnect",
+		ratePolicy:     "drop",
+		pongWait:       time.Minute,
+		logLevel:       slog.LevelInfo,
+		historySize:    100,
+	}
+	tests := []struct {
+		name   string
+		config string
+		// Whether there's a history to resize.
+		noHistory bool
+		// The problems, or nil if it loads.
+		problems    []string
+		logLevel    slog.Level
+		historySize int
+	}{
+		{"defaults", `{}`, false, nil, slog.LevelInfo, 100},
+		{"reloadable", `{"log_level":"debug","history_size":5}`, false, nil, slog.LevelDebug, 5},
+		{"bad log level", `{"log_level":"loud"}`, false, []string{`log_level: unknown level "loud"; expected debug, info, warn or error`}, 0, 0},
+		{"no history", `{"history_size":5}`, true, []string{"history_size: the server was started without a history"}, 0, 0},
+		{"empty history", `{"history_size":0}`, false, []string{"history_size: must be positive"}, 0, 0},
+		// Reported once, as not being a duration, rather than also as not
+		// being positive.
+		{"bad handshake grace", `{"handshake_grace":"soon"}`, false, []string{`handshake_grace: time: invalid duration "soon"`}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := src
+			src.configFile = filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(src.configFile, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if tt.noHistory {
+				src.historySize = 0
+			}
+			cfg, problems := src.load()
+			if strings.Join(problems, "\n") != strings.Join(tt.problems, "\n") {
+				t.Fatalf("problems %q, want %q", problems, tt.problems)
+			}
+			if problems != nil {
+				return
+			}
+			if cfg.logLevel != tt.logLevel || cfg.historySize != tt.historySize {
+				t.Fatalf("log level %s and history size %d, want %s and %d", cfg.logLevel, cfg.historySize, tt.logLevel, tt.historySize)
+			}
+		})
+	}
+}
+
+func TestReloadApplies(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(config, []byte(`{}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var level slog.LevelVar
+	s, err := New(WithConfigFile(config), WithLogLevel(&level), WithHistory(3, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.apiHub.history.(*memoryHistory)
+	for i := 0; i < 3; i++ {
+		h.add("lobby", newOutgoing("chat.message", nil))
+	}
+
+	if err := os.WriteFile(config, []byte(`{"log_level":"warn","history_size":1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := level.Level(); got != slog.LevelWarn {
+		t.Fatalf("log level %s after the reload, want %s", got, slog.LevelWarn)
+	}
+	if kept, _ := h.since("lobby", 0); len(kept) != 1 || kept[0].seq != 3 {
+		t.Fatalf("kept %v after the reload, want only 3", kept)
+	}
+
+	// A reload that fails leaves both alone.
+	if err := os.WriteFile(config, []byte(`{"log_level":"debug","history_size":-1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Fatal("reloaded a negative history size")
+	}
+	if got := level.Level(); got != slog.LevelWarn {
+		t.Fatalf("log level %s after a failed reload, want still %s", got, slog.LevelWarn)
+	}
+}
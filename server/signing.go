@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// When the WebSocket goes through something that isn't to be trusted, such as
+// a relay, the envelopes on /api and /api/versioned can be signed, with keys
+// shared with the clients, given with -signing-keys. Every envelope the
+// server sends then carries the time it was signed, in milliseconds since the
+// Unix epoch, and its HMAC-SHA256, in hex:
+//
+//	{"type":"chat.message","seq":7,"payload":{"room":"lobby","message":"hello"},
+//		"ts":1700000000000,"sig":"5d4c..."}
+//
+// With protobuf, they're the ts and sig fields of the Envelope, with sig as
+// the raw 32 bytes. The client has to sign every envelope it sends the same
+// way, with one of the keys.
+//
+// What's signed isn't the message, since a JSON object can be written any
+// number of ways that mean the same thing, but a canonical form of the
+// envelope: the version of the form, v1, and then the type, the sequence
+// number and the time, both in decimal, with no leading zeros, and the
+// payload, each as a netstring, which is its length in bytes, in decimal, a
+// colon, the bytes and a comma. The envelope above is signed as
+//
+//	2:v1,12:chat.message,1:7,13:1700000000000,34:{"room":"lobby","message":"hello"},
+//
+// A missing sequence number or time is 0, and a missing payload is empty.
+// With JSON, the payload is taken just as it is in the envelope, byte for
+// byte, except with the whitespace between its tokens taken out. Nothing else
+// is changed: the keys stay in the order they were written in, and strings and
+// numbers are left the way they were written, escapes and all. With
+// protobuf, the payload is its bytes as they are. Since every field has its
+// length in front of it, no two envelopes have the same form, whatever is in
+// them.
+//
+// The keys file has a key on each line, in hex, with the newest last; blank
+// lines and lines starting with # are skipped. Envelopes are signed with the
+// newest key, and checked against every one of them, so that to rotate the
+// keys, a new one is added at the end of the file, and the old one is taken
+// out once every client has the new one. The file is re-read on a reload, and
+// the keys it has are used for every connection from then on, including the
+// ones already open.
+//
+// An envelope that isn't signed, whose signature doesn't match, or that was
+// signed more than signatureSkew away from the server's clock, which keeps
+// an old envelope from being sent again much later, isn't handled. The client
+// is sent
+//
+//	{"type":"error","payload":{"code":"bad_signature","message":"...","type":"chat.send"}}
+//
+// and it's counted under bad_signatures. Once a client has sent
+// -signature-strikes of them, it's closed with 1008 (policy violation)
+// instead. Requests, as rpc.go has them, can't be signed, so they aren't
+// answered while envelopes are signed; they're bad envelopes like any other
+// that isn't signed. Binary messages relayed between peers, as relay.go has
+// them, aren't envelopes either, and aren't signed, since whatever they're
+// encrypted with is up to the peers.
+
+var badSignatures = expvar.NewInt("bad_signatures")
+
+const codeBadSignature = "bad_signature"
+
+// How far from the server's clock the time of an envelope from the client can
+// be.
+const signatureSkew = 5 * time.Minute
+
+// The shortest key there can be, in bytes.
+const minSigningKey = 16
+
+var (
+	errUnsigned      = errors.New("the envelope isn't signed")
+	errSignature     = errors.New("the signature doesn't match")
+	errSignatureTime = errors.New("the envelope wasn't signed close enough to now")
+	errBadSignatures = errors.New("client sent too many envelopes with bad signatures")
+	errNoSigningKeys = errors.New("there are no keys")
+	errShortKey      = fmt.Errorf("keys must be at least %d bytes", minSigningKey)
+)
+
+// canonicalEnvelope gives the form of the envelope that's signed, with the
+// payload already in its canonical form.
+func canonicalEnvelope(typ string, seq uint64, ts int64, payload []byte) []byte {
+	var b []byte
+	for _, field := range [][]byte{
+		[]byte("v1"),
+		[]byte(typ),
+		strconv.AppendUint(nil, seq, 10),
+		strconv.AppendInt(nil, ts, 10),
+		payload,
+	} {
+		b = strconv.AppendInt(b, int64(len(field)), 10)
+		b = append(b, ':')
+		b = append(b, field...)
+		b = append(b, ',')
+	}
+	return b
+}
+
+// A signableCodec is a codec that envelopes can be signed in.
+type signableCodec interface {
+	codec
+	// canonicalPayload gives the form of the payload that's signed.
+	canonicalPayload(payload []byte) ([]byte, error)
+	// encodeSigned is encode, with the time and the signature.
+	encodeSigned(typ string, seq uint64, payload []byte, ts int64, sig []byte) (int, []byte, error)
+}
+
+// signer signs envelopes, and checks the signatures of the ones from clients.
+type signer struct {
+	// The keys, newest last, which are replaced whole on a reload.
+	keys atomic.Pointer[[][]byte]
+	// How many bad signatures a client can send before it's closed, or zero
+	// for no end of them.
+	strikes int
+	// The clock envelopes are signed and checked by, which tests replace.
+	now func() time.Time
+	// The signed codec for each codec, by name, so that every client with
+	// the same one shares it, and a broadcast is only signed once for them.
+	codecs map[string]*signedCodec
+}
+
+func newSigner(keys [][]byte, strikes int) *signer {
+	s := &signer{strikes: strikes, now: time.Now, codecs: map[string]*signedCodec{}}
+	s.setKeys(keys)
+	for _, c := range codecs {
+		s.codecs[c.name()] = &signedCodec{c.(signableCodec), s}
+	}
+	return s
+}
+
+func (s *signer) setKeys(keys [][]byte) {
+	s.keys.Store(&keys)
+}
+
+// codec gives c, signed, or c as it is if s is nil.
+func (s *signer) codec(c codec) codec {
+	if s == nil {
+		return c
+	}
+	return s.codecs[c.name()]
+}
+
+func (s *signer) mac(key []byte, typ string, seq uint64, ts int64, payload []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(canonicalEnvelope(typ, seq, ts, payload))
+	return m.Sum(nil)
+}
+
+// verify checks the signature of an envelope from the client, with payload in
+// its canonical form.
+func (s *signer) verify(e incoming, payload []byte) error {
+	if len(e.sig) == 0 {
+		return errUnsigned
+	}
+	keys := *s.keys.Load()
+	matched := false
+	for _, key := range keys {
+		if hmac.Equal(e.sig, s.mac(key, e.typ, e.seq, e.ts, payload)) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return errSignature
+	}
+	if skew := s.now().Sub(time.UnixMilli(e.ts)); skew > signatureSkew || skew < -signatureSkew {
+		return errSignatureTime
+	}
+	return nil
+}
+
+// signedCodec is a codec whose envelopes are signed. It has the same name as
+// the codec, since it encodes payloads the same way.
+type signedCodec struct {
+	signableCodec
+	signer *signer
+}
+
+// decode gives the envelopes in the message, each with why its signature
+// doesn't check out, if it doesn't.
+func (c *signedCodec) decode(messageType int, message []byte) ([]incoming, error) {
+	envelopes, err := c.signableCodec.decode(messageType, message)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range envelopes {
+		payload, err := c.canonicalPayload(e.payload)
+		if err != nil {
+			envelopes[i].sigErr = err
+			continue
+		}
+		envelopes[i].sigErr = c.signer.verify(e, payload)
+	}
+	return envelopes, nil
+}
+
+func (c *signedCodec) encode(typ string, seq uint64, payload []byte) (int, []byte, error) {
+	payload, err := c.canonicalPayload(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	keys := *c.signer.keys.Load()
+	ts := c.signer.now().UnixMilli()
+	sig := c.signer.mac(keys[len(keys)-1], typ, seq, ts, payload)
+	return c.encodeSigned(typ, seq, payload, ts, sig)
+}
+
+// rejectSignature answers an envelope whose signature doesn't check out, or
+// closes the client, once it's sent too many of them.
+func rejectSignature(ctx context.Context, c *client, e incoming) error {
+	badSignatures.Add(1)
+	c.badSignatures++
+	if err := sendError(ctx, c, e.typ, codeBadSignature, e.sigErr.Error()); err != nil {
+		return err
+	}
+	if strikes := c.codec.(*signedCodec).signer.strikes; strikes > 0 && c.badSignatures >= strikes {
+		c.close(ctx, websocket.ClosePolicyViolation, "bad signatures")
+		return errBadSignatures
+	}
+	return nil
+}
+
+// loadSigningKeys loads the keys from the file, or none if there's no file.
+func loadSigningKeys(path string) ([][]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys [][]byte
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: expected a key in hex", path, line)
+		}
+		if len(key) < minSigningKey {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, errShortKey)
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("%s: %w", path, errNoSigningKeys)
+	}
+	return keys, nil
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	testSigningKey, _ = hex.DecodeString("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	oldSigningKey, _  = hex.DecodeString("ffeeddccbbaa99887766554433221100ffeeddccbbaa99887766554433221100")
+)
+
+// referenceMAC is the signature of an envelope as signing.go describes it,
+// worked out separately from the server's own.
+func referenceMAC(key []byte, typ string, seq uint64, ts int64, payload string) string {
+	var form strings.Builder
+	for _, field := range []string{"v1", typ, strconv.FormatUint(seq, 10), strconv.FormatInt(ts, 10), payload} {
+		fmt.Fprintf(&form, "%d:%s,", len(field), field)
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(form.String()))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func TestSignatureVectors(t *testing.T) {
+	// The signatures are from Python's hmac module, over the forms.
+	tests := []struct {
+		typ     string
+		seq     uint64
+		ts      int64
+		payload string
+		form    string
+		sig     string
+	}{
+		{
+			"chat.message", 7, 1700000000000, `{"room":"lobby","message":"hello"}`,
+			`2:v1,12:chat.message,1:7,13:1700000000000,34:{"room":"lobby","message":"hello"},`,
+			"fb39a0199beca60de61d5e63c3ee3a43b5ea2694f33e4fe09de8fad009924f90",
+		},
+		{
+			"chat.join", 0, 0, "",
+			`2:v1,9:chat.join,1:0,1:0,0:,`,
+			"aa9d427b90d1bc541fb8da5d555f5a767f744ff92c156a2530efbe91e7690f97",
+		},
+		{
+			"chat.send", 0, 1700000000123, `{"room":"café","message":"\u00e9 <b>"}`,
+			`2:v1,9:chat.send,1:0,13:1700000000123,39:{"room":"café","message":"\u00e9 <b>"},`,
+			"c13da67a67149f299902e89326f4519f75d6e2aca998264cd7aed3c77ae2ee38",
+		},
+		{
+			"chat.join", 0, 1700000000000, "\x0a\x05lobby",
+			"2:v1,9:chat.join,1:0,13:1700000000000,7:\x0a\x05lobby,",
+			"faf125a47e09c71e8b14167e25157d31294690fbfcaaa4568b87f08b89bae066",
+		},
+	}
+	s := newSigner([][]byte{testSigningKey}, 0)
+	for _, tt := range tests {
+		t.Run(tt.typ, func(t *testing.T) {
+			if got := string(canonicalEnvelope(tt.typ, tt.seq, tt.ts, []byte(tt.payload))); got != tt.form {
+				t.Fatalf("form %q, want %q", got, tt.form)
+			}
+			if got := hex.EncodeToString(s.mac(testSigningKey, tt.typ, tt.seq, tt.ts, []byte(tt.payload))); got != tt.sig {
+				t.Fatalf("signature %s, want %s", got, tt.sig)
+			}
+			if got := referenceMAC(testSigningKey, tt.typ, tt.seq, tt.ts, tt.payload); got != tt.sig {
+				t.Fatalf("reference signature %s, want %s", got, tt.sig)
+			}
+		})
+	}
+}
+
+func TestCanonicalPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+		ok      bool
+	}{
+		{"compact already", `{"room":"lobby"}`, `{"room":"lobby"}`, true},
+		{"whitespace between tokens", "{ \"room\" : \"lobby\" ,\n\t\"message\" : [ 1, 2 ] }", `{"room":"lobby","message":[1,2]}`, true},
+		{"keys in their order", `{"room":"lobby","message":"hi","a":1}`, `{"room":"lobby","message":"hi","a":1}`, true},
+		{"whitespace in strings", `{"message": " spaced  out "}`, `{"message":" spaced  out "}`, true},
+		{"escapes and numbers as written", `{"message": "é\/", "n": 1.50e0}`, `{"message":"é\/","n":1.50e0}`, true},
+		{"missing", ``, ``, true},
+		{"not JSON", `{"room":`, ``, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jsonCodec{}.canonicalPayload([]byte(tt.payload))
+			if (err == nil) != tt.ok {
+				t.Fatalf("error %v, want ok %t", err, tt.ok)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("canonical payload %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignedCodec(t *testing.T) {
+	s := newSigner([][]byte{oldSigningKey, testSigningKey}, 0)
+	now := time.UnixMilli(1700000000000)
+	s.now = func() time.Time { return now }
+
+	// The server signs with the newest key, as the reference does.
+	_, message, err := s.codec(jsonCodec{}).encode("chat.message", 7, []byte(`{"room":"lobby","message":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e jsonEnvelope
+	if err := json.Unmarshal(message, &e); err != nil {
+		t.Fatal(err)
+	}
+	if want := "fb39a0199beca60de61d5e63c3ee3a43b5ea2694f33e4fe09de8fad009924f90"; e.TS != 1700000000000 || e.Sig != want {
+		t.Fatalf("signed %s, want a ts of 1700000000000 and a sig of %s", message, want)
+	}
+
+	signed := func(key []byte, ts int64, payload string) string {
+		return fmt.Sprintf(`{"type":"chat.send","ts":%d,"payload":%s,"sig":%q}`, ts, payload, referenceMAC(key, "chat.send", 0, ts, strings.Join(strings.Fields(payload), "")))
+	}
+	ts := now.UnixMilli()
+	tests := []struct {
+		name    string
+		message string
+		want    error
+	}{
+		{"newest key", signed(testSigningKey, ts, `{"room":"lobby"}`), nil},
+		{"older key", signed(oldSigningKey, ts, `{"room":"lobby"}`), nil},
+		{"with whitespace", signed(testSigningKey, ts, `{ "room": "lobby" }`), nil},
+		{"unsigned", `{"type":"chat.send","ts":1700000000000,"payload":{"room":"lobby"}}`, errUnsigned},
+		{"sig not hex", `{"type":"chat.send","ts":1700000000000,"payload":{"room":"lobby"},"sig":"zz"}`, errUnsigned},
+		{"unknown key", signed([]byte("not one of the keys at all"), ts, `{"room":"lobby"}`), errSignature},
+		{"payload changed", strings.Replace(signed(testSigningKey, ts, `{"room":"lobby"}`), "lobby", "lobbx", 1), errSignature},
+		{"time changed", strings.Replace(signed(testSigningKey, ts, `{"room":"lobby"}`), `"ts":1700000000000`, `"ts":1700000000001`, 1), errSignature},
+		{"too old", signed(testSigningKey, ts-signatureSkew.Milliseconds()-1, `{"room":"lobby"}`), errSignatureTime},
+		{"too far ahead", signed(testSigningKey, ts+signatureSkew.Milliseconds()+1, `{"room":"lobby"}`), errSignatureTime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelopes, err := s.codec(jsonCodec{}).decode(websocket.TextMessage, []byte(tt.message))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := envelopes[0].sigErr; !errors.Is(got, tt.want) {
+				t.Fatalf("signature error %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// With protobuf, the payload is signed as its bytes, and the signature
+	// is too.
+	sig, _ := hex.DecodeString("faf125a47e09c71e8b14167e25157d31294690fbfcaaa4568b87f08b89bae066")
+	messageType, message, err := protoCodec{}.encodeSigned("chat.join", 0, []byte("\x0a\x05lobby"), 1700000000000, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelopes, err := s.codec(protoCodec{}).decode(messageType, message)
+	if err != nil || len(envelopes) != 1 || envelopes[0].sigErr != nil {
+		t.Fatalf("decoded %+v, %v from a signed protobuf envelope", envelopes, err)
+	}
+
+	// Once the old key is taken out, what's signed with it isn't taken.
+	s.setKeys([][]byte{testSigningKey})
+	envelopes, _ = s.codec(jsonCodec{}).decode(websocket.TextMessage, []byte(signed(oldSigningKey, ts, `{"room":"lobby"}`)))
+	if got := envelopes[0].sigErr; got != errSignature {
+		t.Fatalf("signature error %v with the old key taken out, want %v", got, errSignature)
+	}
+}
+
+func TestLoadSigningKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		keys int
+		err  string
+	}{
+		{"keys", "# the old one\n" + hex.EncodeToString(oldSigningKey) + "\n\n" + hex.EncodeToString(testSigningKey) + "\n", 2, ""},
+		{"not hex", "not a key\n", 0, "keys:1: expected a key in hex"},
+		{"short", "# short\n00112233\n", 0, "keys:2: keys must be at least 16 bytes"},
+		{"empty", "# nothing\n", 0, "keys: there are no keys"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys")
+			if err := os.WriteFile(path, []byte(tt.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := loadSigningKeys(path)
+			if tt.err != "" {
+				if err == nil || !strings.HasSuffix(err.Error(), tt.err) {
+					t.Fatalf("error %v, want one ending %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || len(keys) != tt.keys {
+				t.Fatalf("%d keys, %v, want %d", len(keys), err, tt.keys)
+			}
+		})
+	}
+}
+
+func TestSigning(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys")
+	writeKeys := func(keys ...[]byte) {
+		var b strings.Builder
+		for _, key := range keys {
+			b.WriteString(hex.EncodeToString(key) + "\n")
+		}
+		if err := os.WriteFile(keysFile, []byte(b.String()), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeys(oldSigningKey, testSigningKey)
+	s, err := New(WithUpgradeRate(0, 0, 0), WithSigning(keysFile, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.apiHub.run(s.hubCtx)
+	t.Cleanup(s.stopHubs)
+	srv := httptest.NewServer(s.handler)
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	send := func(key []byte, typ, payload string) {
+		t.Helper()
+		ts := time.Now().UnixMilli()
+		e := jsonEnvelope{Type: typ, Payload: json.RawMessage(payload), TS: ts}
+		if key != nil {
+			e.Sig = referenceMAC(key, typ, 0, ts, payload)
+		}
+		if err := conn.WriteJSON(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// next reads the next envelope that isn't about the session or presence,
+	// and checks it's of the type, and signed with the newest key.
+	next := func(typ string) jsonEnvelope {
+		t.Helper()
+		for {
+			var e jsonEnvelope
+			if err := conn.ReadJSON(&e); err != nil {
+				t.Fatalf("reading a %s: %v", typ, err)
+			}
+			if want := referenceMAC(testSigningKey, e.Type, e.Seq, e.TS, string(e.Payload)); e.Sig != want {
+				t.Fatalf("%s envelope signed %q, want %q", e.Type, e.Sig, want)
+			}
+			if e.Type == "session" || strings.HasPrefix(e.Type, "presence.") {
+				continue
+			}
+			if e.Type != typ {
+				t.Fatalf("got a %s envelope %s, want %s", e.Type, e.Payload, typ)
+			}
+			return e
+		}
+	}
+	badSignature := func(want string) {
+		t.Helper()
+		var p errorPayload
+		json.Unmarshal(next("error").Payload, &p)
+		if p.Code != codeBadSignature || p.Message != want {
+			t.Fatalf("error %+v, want %s %q", p, codeBadSignature, want)
+		}
+	}
+
+	before := badSignatures.Value()
+	send(oldSigningKey, "chat.join", `{"room":"lobby"}`)
+	next("chat.joined")
+	send(testSigningKey, "chat.send", `{"room":"lobby","message":"hello"}`)
+	if got := chatMessage(testEnvelope{Payload: next("chat.message").Payload}); got != "hello" {
+		t.Fatalf("chat.message %q, want hello", got)
+	}
+
+	// Once the old key is taken out, it's no good, even to a client that
+	// connected before.
+	writeKeys(testSigningKey)
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	send(oldSigningKey, "chat.send", `{"room":"lobby","message":"hello"}`)
+	badSignature(errSignature.Error())
+	// Requests can't be signed, so they're turned away like anything else
+	// that isn't.
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":1,"method":"chat.rooms"}`))
+	badSignature(errUnsigned.Error())
+	if got := badSignatures.Value() - before; got != 2 {
+		t.Fatalf("bad_signatures went up by %d, want 2", got)
+	}
+
+	// The third strike closes the client.
+	send(nil, "chat.send", `{"room":"lobby","message":"hello"}`)
+	badSignature(errUnsigned.Error())
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Fatalf("closed with %v, want %d", err, websocket.ClosePolicyViolation)
+			}
+			break
+		}
+	}
+}
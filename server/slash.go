@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+// A text message on /chat that starts with a slash is an IRC-style command,
+// such as /join lobby, rather than something to broadcast; see commands.go.
+// ParseCommand is what parses one, and has nothing to do with the hub, so
+// that anything else that takes commands can parse them the same way.
+//
+// After the slash comes the command's name, which is case-insensitive, and
+// then its arguments, separated by spaces. An argument with spaces in it can
+// be quoted, with double quotes, in which \" is a quote and \\ a backslash, or
+// with single quotes, in which nothing is escaped; quoted and unquoted text
+// next to each other, as in name="two words", make up one argument.
+// Backslashes are kept as they are anywhere else. A message that starts with
+// two slashes is text, with the first one taken off, so that text that starts
+// with a slash can still be sent.
+
+var (
+	errNoCommandName     = errors.New("a command needs a name after the slash")
+	errUnterminatedQuote = errors.New("a quote in the command isn't closed")
+)
+
+// Command is a slash command, as ParseCommand parses it.
+type Command struct {
+	// The command's name, lowercased, without the slash.
+	Name string
+	Args []string
+
+	text string
+	// Where the name ends in text, and then each argument.
+	ends []int
+}
+
+// After gives the text of the command after its first n arguments, as it was
+// sent, but for the spaces before it, or "" if it doesn't have that many. It's
+// what a command whose last argument is free text, such as a message, takes
+// it as, with its spaces and quotes.
+func (c Command) After(n int) string {
+	if n < 0 || n >= len(c.ends) {
+		return ""
+	}
+	return strings.TrimLeft(c.text[c.ends[n]:], commandSpaces)
+}
+
+const commandSpaces = " \t\r\n"
+
+func isCommandSpace(b byte) bool {
+	return strings.IndexByte(commandSpaces, b) >= 0
+}
+
+// ParseCommand parses the text of a message as a slash command, and reports
+// whether it's one. Text that doesn't start with a slash isn't, and nor is text
+// that starts with two, which is to be sent without the first. A command can
+// fail to parse, for want of a name, or for a quote that isn't closed.
+func ParseCommand(text string) (Command, bool, error) {
+	if !strings.HasPrefix(text, "/") || strings.HasPrefix(text, "//") {
+		return Command{}, false, nil
+	}
+	i := 1
+	for i < len(text) && !isCommandSpace(text[i]) {
+		i++
+	}
+	if i == 1 {
+		return Command{}, true, errNoCommandName
+	}
+	cmd := Command{Name: strings.ToLower(text[1:i]), text: text, ends: []int{i}}
+	for {
+		for i < len(text) && isCommandSpace(text[i]) {
+			i++
+		}
+		if i == len(text) {
+			return cmd, true, nil
+		}
+		arg, end, err := parseArg(text, i)
+		if err != nil {
+			return Command{}, true, err
+		}
+		cmd.Args = append(cmd.Args, arg)
+		cmd.ends = append(cmd.ends, end)
+		i = end
+	}
+}
+
+// parseArg parses the argument that starts at i in text, and gives it, and
+// where it ends.
+func parseArg(text string, i int) (string, int, error) {
+	var arg strings.Builder
+	for i < len(text) && !isCommandSpace(text[i]) {
+		switch q := text[i]; q {
+		case '"':
+			i++
+			for ; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' && i+1 < len(text) && (text[i+1] == '"' || text[i+1] == '\\') {
+					i++
+				}
+				arg.WriteByte(text[i])
+			}
+			if i == len(text) {
+				return "", 0, errUnterminatedQuote
+			}
+			i++
+		case '\'':
+			end := strings.IndexByte(text[i+1:], '\'')
+			if end < 0 {
+				return "", 0, errUnterminatedQuote
+			}
+			arg.WriteString(text[i+1 : i+1+end])
+			i += end + 2
+		default:
+			arg.WriteByte(q)
+			i++
+		}
+	}
+	return arg.String(), i, nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, tt := range []struct {
+		text  string
+		ok    bool
+		err   error
+		name  string
+		args  []string
+		after string
+	}{
+		{text: "hello"},
+		{text: "//not a command"},
+		{text: ""},
+		{text: "/who", ok: true, name: "who"},
+		{text: "/JOIN lobby", ok: true, name: "join", args: []string{"lobby"}},
+		{text: "/msg  7   hello   there ", ok: true, name: "msg", args: []string{"7", "hello", "there"}, after: "hello   there "},
+		{text: `/nick "alice smith"`, ok: true, name: "nick", args: []string{"alice smith"}},
+		{text: `/say "a \"quote\" and a \\" 'it''s' name="two words"`, ok: true, name: "say", args: []string{`a "quote" and a \`, "its", "name=two words"}, after: `'it''s' name="two words"`},
+		{text: `/path C:\temp "\n"`, ok: true, name: "path", args: []string{`C:\temp`, `\n`}, after: `"\n"`},
+		{text: `/empty "" ''`, ok: true, name: "empty", args: []string{"", ""}, after: "''"},
+		{text: "/\tjoin", ok: true, err: errNoCommandName},
+		{text: "/", ok: true, err: errNoCommandName},
+		{text: `/nick "alice`, ok: true, err: errUnterminatedQuote},
+		{text: `/nick 'alice`, ok: true, err: errUnterminatedQuote},
+		{text: `/nick "alice\"`, ok: true, err: errUnterminatedQuote},
+	} {
+		cmd, ok, err := ParseCommand(tt.text)
+		if ok != tt.ok || !errors.Is(err, tt.err) {
+			t.Errorf("%q parsed as %t, %v, want %t, %v", tt.text, ok, err, tt.ok, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if cmd.Name != tt.name || strings.Join(cmd.Args, "|") != strings.Join(tt.args, "|") || len(cmd.Args) != len(tt.args) {
+			t.Errorf("%q parsed as %q %q, want %q %q", tt.text, cmd.Name, cmd.Args, tt.name, tt.args)
+		}
+		if tt.after != "" && cmd.After(1) != tt.after {
+			t.Errorf("%q has %q after its first argument, want %q", tt.text, cmd.After(1), tt.after)
+		}
+	}
+}
+
+// quoteArg quotes the argument, as a command would have it.
+func quoteArg(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+func FuzzParseCommand(f *testing.F) {
+	for _, text := range []string{"/who", "/join lobby", `/say "a \"b\"" 'c d' e"f g"`, `/nick "x`, "//x", "/ x", "/msg 7 hi\tthere"} {
+		f.Add(text)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		cmd, ok, err := ParseCommand(text)
+		if !ok || err != nil {
+			if !ok && err != nil {
+				t.Fatalf("%q isn't a command, but failed with %v", text, err)
+			}
+			return
+		}
+		if cmd.Name == "" || strings.ContainsAny(cmd.Name, commandSpaces) {
+			t.Fatalf("%q has the name %q", text, cmd.Name)
+		}
+		if after := cmd.After(0); !strings.HasSuffix(text, after) {
+			t.Fatalf("%q has %q after its name", text, after)
+		}
+		if cmd.After(len(cmd.Args)) != "" {
+			t.Fatalf("%q has %q after its last argument", text, cmd.After(len(cmd.Args)))
+		}
+
+		// The arguments, quoted, parse back as they are.
+		quoted := "/" + cmd.Name
+		for _, arg := range cmd.Args {
+			quoted += " " + quoteArg(arg)
+		}
+		again, ok, err := ParseCommand(quoted)
+		if !ok || err != nil || again.Name != cmd.Name || len(again.Args) != len(cmd.Args) {
+			t.Fatalf("%q, quoted as %q, parsed as %q %q, %t, %v", text, quoted, again.Name, again.Args, ok, err)
+		}
+		for i := range cmd.Args {
+			if again.Args[i] != cmd.Args[i] {
+				t.Fatalf("%q, quoted as %q, has %q for %q", text, quoted, again.Args[i], cmd.Args[i])
+			}
+		}
+	})
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The pages under / are the browser demo, in static/, which is built into the
+// binary, so that the server can be tried out end to end with nothing but a
+// browser. It connects to /ws by default, negotiates a keepalive, reconnects
+// with backoff like the client package, and shows everything the server
+// sends; any other endpoint can be typed in instead, such as /chat, to see
+// its broadcasts. -demo=false leaves it out, for a server that shouldn't
+// serve anything but its endpoints.
+
+//go:embed static
+var staticFiles embed.FS
+
+// staticHandler serves the files in static/, with index.html for /.
+func staticHandler() http.Handler {
+	files, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}
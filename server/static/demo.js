@@ -0,0 +1,192 @@
+// The browser demo: a client for /ws, or any of the other endpoints, that
+// stays connected the same way the client package does.
+//
+// Browsers answer the server's pings themselves, without telling the page, so
+// the page can't see them. Instead, it asks for a keepalive of its own, and
+// asks again every so often; the "configured" that comes back, like anything
+// else from the server, is a sign of life, and the time it takes to come back
+// is the round trip. If nothing at all is heard for long enough, the
+// connection is given up on, and, as when it drops, it reconnects, waiting
+// longer after each failed attempt, with jitter. Only /ws takes "configure";
+// on the other endpoints, where it would be sent on as a message, the page
+// leaves keeping the connection alive to the browser and the server.
+"use strict";
+
+const pingIntervalMS = 10000;
+// Not a multiple of the ping interval, so that asking again doesn't keep
+// putting off the server's pings.
+const heartbeatMS = 15000;
+// How long the handshake can take, as the dialer's handshake timeout does.
+const connectTimeoutMS = 10000;
+const minBackoffMS = 500;
+const maxBackoffMS = 30000;
+
+const $ = (id) => document.getElementById(id);
+const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+$("url").value = scheme + "//" + location.host + "/ws";
+
+let ws = null;
+let wanted = false;
+let backoff = minBackoffMS;
+let reconnectTimer = null;
+let connectTimer = null;
+let heartbeatTimer = null;
+let livenessTimer = null;
+let lastHeard = 0;
+let heartbeatSent = 0;
+// How long to go without hearing from the server before giving up, which is
+// the pong wait it answers with, on top of the time between heartbeats.
+let silenceMS = heartbeatMS + 60000;
+
+function log(kind, text) {
+  const line = document.createElement("div");
+  line.className = kind;
+  const arrows = { in: "← ", out: "→ ", info: "" };
+  line.textContent = new Date().toLocaleTimeString() + " " + arrows[kind] + text;
+  const box = $("log");
+  const atBottom = box.scrollTop + box.clientHeight >= box.scrollHeight - 4;
+  box.appendChild(line);
+  if (atBottom) {
+    box.scrollTop = box.scrollHeight;
+  }
+}
+
+function setStatus(up, text) {
+  $("status").className = up ? "up" : "down";
+  $("status").textContent = text;
+}
+
+function configure() {
+  heartbeatSent = performance.now();
+  ws.send(JSON.stringify({ type: "configure", ping_interval_ms: pingIntervalMS }));
+}
+
+function connect() {
+  clearTimeout(reconnectTimer);
+  const url = $("url").value;
+  const heartbeats = new URL(url, location.href).pathname === "/ws";
+  log("info", "Connecting to " + url);
+  setStatus(false, "Connecting");
+  const socket = new WebSocket(url);
+  ws = socket;
+  connectTimer = setTimeout(() => {
+    log("info", "Timed out connecting");
+    socket.close();
+    dropped(socket, 0);
+  }, connectTimeoutMS);
+
+  socket.onopen = () => {
+    clearTimeout(connectTimer);
+    const opened = Date.now();
+    setStatus(true, "Connected");
+    log("info", "Connected");
+    lastHeard = opened;
+    if (heartbeats) {
+      configure();
+      heartbeatTimer = setInterval(configure, heartbeatMS);
+      livenessTimer = setInterval(() => {
+        if (Date.now() - lastHeard > silenceMS) {
+          log("info", "Nothing from the server in " + Math.round(silenceMS / 1000) + "s, giving up on the connection");
+          socket.close(4000, "no sign of life");
+          dropped(socket, opened);
+        }
+      }, 1000);
+    }
+    socket.onclose = (e) => {
+      log("info", "Disconnected: " + e.code + (e.reason ? " (" + e.reason + ")" : ""));
+      dropped(socket, opened);
+    };
+  };
+
+  socket.onclose = (e) => {
+    log("info", "Failed to connect" + (e.code !== 1006 ? ": " + e.code : ""));
+    dropped(socket, 0);
+  };
+
+  socket.onmessage = (e) => {
+    lastHeard = Date.now();
+    if (typeof e.data !== "string") {
+      log("in", "(" + e.data.size + " bytes of binary)");
+      return;
+    }
+    let message = null;
+    try {
+      message = JSON.parse(e.data);
+    } catch (err) {
+      // Not everything is JSON, such as /ws's echoes.
+    }
+    if (message && message.type === "configured") {
+      silenceMS = heartbeatMS + message.pong_wait_ms;
+      if (heartbeatSent) {
+        $("rtt").textContent = "round trip " + Math.round(performance.now() - heartbeatSent) + "ms";
+        heartbeatSent = 0;
+      }
+      return;
+    }
+    if (message && message.type === "latency") {
+      $("rtt").textContent = "round trip " + message.average_ms.toFixed(1) + "ms, as the server measures it";
+      return;
+    }
+    log("in", e.data);
+  };
+}
+
+// dropped tidies up after the connection, which was opened at opened, or
+// never if it's zero, and reconnects if it's still wanted.
+function dropped(socket, opened) {
+  if (socket !== ws) {
+    return;
+  }
+  ws = null;
+  clearTimeout(connectTimer);
+  clearInterval(heartbeatTimer);
+  clearInterval(livenessTimer);
+  socket.onopen = socket.onclose = socket.onmessage = null;
+  setStatus(false, "Disconnected");
+  if (!wanted) {
+    return;
+  }
+  // A connection that stayed up for longer than the wait before it starts the
+  // backoff over.
+  if (opened && Date.now() - opened > backoff) {
+    backoff = minBackoffMS;
+  }
+  const wait = backoff / 2 + Math.random() * backoff / 2;
+  backoff = Math.min(backoff * 2, maxBackoffMS);
+  log("info", "Reconnecting in " + (wait / 1000).toFixed(1) + "s");
+  reconnectTimer = setTimeout(connect, wait);
+}
+
+$("connect").onsubmit = (e) => {
+  e.preventDefault();
+  if (wanted) {
+    wanted = false;
+    $("connect-button").textContent = "Connect";
+    clearTimeout(reconnectTimer);
+    if (ws) {
+      const socket = ws;
+      socket.close(1000);
+      log("info", "Disconnected");
+      dropped(socket, 0);
+    }
+    return;
+  }
+  wanted = true;
+  backoff = minBackoffMS;
+  $("connect-button").textContent = "Disconnect";
+  connect();
+};
+
+$("send").onsubmit = (e) => {
+  e.preventDefault();
+  const text = $("message").value;
+  if (!ws || ws.readyState !== WebSocket.OPEN) {
+    log("info", "Not connected, so nothing was sent");
+    return;
+  }
+  ws.send(text);
+  log("out", text);
+  $("message").value = "";
+};
+
+$("connect").requestSubmit();
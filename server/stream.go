@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sync/errgroup"
+)
+
+// Messages are normally read and written whole, which is what the read limit
+// is for: every message has to fit in memory, and most endpoints have no use
+// for one anywhere near 64KiB. Anything bigger, such as a file upload, can be
+// streamed instead. NextReader gives a message as it comes in, and NextWriter
+// sends one out in fragments as it's written, so neither side ever holds the
+// whole thing, and a progress callback hears about every chunk of it.
+//
+// The /upload endpoint shows both. Every binary message a client sends is
+// read as a stream, up to -stream-limit (64MiB by default), and answered with
+//
+//	{"type":"progress","bytes":1048576}
+//
+// for every MiB of it that's come in, and once it's all in,
+//
+//	{"type":"uploaded","bytes":5000000,"sha256":"..."}
+//
+// A client that sends
+//
+//	{"type":"download","bytes":5000000}
+//
+// is sent that many bytes of random data, up to the limit, as one binary
+// message that's streamed out as it's made, followed by a "downloaded" message
+// of the same shape as "uploaded", to check it against. A message over the limit closes
+// the connection with 1009, as on any other endpoint over the read limit.
+//
+// Streamed messages are traced, counted, throttled and watched over as
+// they're read and written, but they aren't recorded, and chaos mode leaves
+// them alone.
+
+const (
+	// The size of the chunks streamed messages are written in.
+	streamChunk = 32 * 1024
+	// How often, in bytes, uploads are reported on.
+	progressInterval = 1 << 20
+	// The most an upload can be, unless configured otherwise.
+	streamLimit = 64 << 20
+)
+
+var (
+	streamsReceived = expvar.NewInt("streams_received")
+	streamsSent     = expvar.NewInt("streams_sent")
+)
+
+// streamProgress is told how many bytes of a stream have been read or written
+// so far, after every chunk.
+type streamProgress func(n int64)
+
+// readerFunc is an io.Reader made of a function, for the transports to wrap
+// the readers of the ones underneath with.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+// streamWriter is an io.WriteCloser made of functions, for the transports to
+// wrap the writers of the ones underneath with.
+type streamWriter struct {
+	write func(p []byte) (int, error)
+	close func() error
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) { return w.write(p) }
+
+func (w *streamWriter) Close() error { return w.close() }
+
+// outStream is a message for the write pump to stream out.
+type outStream struct {
+	r        io.Reader
+	progress streamProgress
+}
+
+// sourceError is a stream whose source failed, which is why it couldn't be
+// written.
+type sourceError struct {
+	err error
+}
+
+func (e *sourceError) Error() string { return e.err.Error() }
+
+func (e *sourceError) Unwrap() error { return e.err }
+
+// copyStream writes everything r gives as one message, in chunks, within the
+// write timeout for the whole thing.
+func copyStream(t Transport, timeout time.Duration, messageType int, s *outStream) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	w, err := t.NextWriter(ctx, messageType)
+	if err != nil {
+		return err
+	}
+	var written int64
+	buf := make([]byte, streamChunk)
+	for {
+		n, err := s.r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				w.Close()
+				return err
+			}
+			written += int64(n)
+			if s.progress != nil {
+				s.progress(written)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The message can't be taken back, and finishing it would pass off
+			// what's been sent of it as the whole thing, so the connection
+			// can't go on.
+			return &sourceError{err}
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	streamsSent.Add(1)
+	return nil
+}
+
+// utf8Checker checks that a text message is valid UTF-8 as it's streamed in,
+// holding on to the start of a character that's cut off at the end of a chunk
+// until the rest of it comes in.
+type utf8Checker struct {
+	partial []byte
+}
+
+func (u *utf8Checker) check(p []byte) bool {
+	if len(u.partial) > 0 {
+		// A character is at most four bytes.
+		for len(p) > 0 && len(u.partial) < utf8.UTFMax && !utf8.FullRune(u.partial) {
+			u.partial, p = append(u.partial, p[0]), p[1:]
+		}
+		if !utf8.FullRune(u.partial) {
+			return len(u.partial) < utf8.UTFMax
+		}
+		if !utf8.Valid(u.partial) {
+			return false
+		}
+		u.partial = u.partial[:0]
+	}
+	// Anything cut off at the end is held on to, so long as it could still
+	// turn out to be the start of a character.
+	end := len(p)
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	if !utf8.Valid(p[:end]) {
+		return false
+	}
+	u.partial = append(u.partial, p[end:]...)
+	return true
+}
+
+// done tells whether the message didn't end partway through a character.
+func (u *utf8Checker) done() bool {
+	return len(u.partial) == 0
+}
+
+// readStream is read for messages that are streamed in, calling progress
+// after every chunk that's read. The reader is only good until the next read.
+// Text messages are checked for valid UTF-8 as they're read, and the
+// connection is closed with 1007 over one that isn't.
+func (c *client) readStream(ctx context.Context, progress streamProgress) (int, io.Reader, error) {
+	for {
+		messageType, r, err := c.t.NextReader(context.Background())
+		if err != nil {
+			if c.idle != nil {
+				err = c.idle.readError(err)
+			}
+			return 0, nil, c.failed(err)
+		}
+		if c.idle != nil {
+			c.idle.touch()
+		}
+		if ok, err := c.admit(ctx); err != nil {
+			return 0, nil, err
+		} else if !ok {
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				return 0, nil, c.failed(err)
+			}
+			continue
+		}
+		var read int64
+		var text *utf8Checker
+		if messageType == websocket.TextMessage {
+			text = &utf8Checker{}
+		}
+		return messageType, readerFunc(func(p []byte) (int, error) {
+			n, err := r.Read(p)
+			if n > 0 {
+				if text != nil && !text.check(p[:n]) {
+					c.close(ctx, websocket.CloseInvalidFramePayloadData, "invalid UTF-8")
+					return n, errInvalidUTF8
+				}
+				read += int64(n)
+				// A client in the middle of a long upload isn't idle.
+				if c.idle != nil {
+					c.idle.touch()
+				}
+				if progress != nil {
+					progress(read)
+				}
+			}
+			if err == io.EOF {
+				if text != nil && !text.done() {
+					c.close(ctx, websocket.CloseInvalidFramePayloadData, "invalid UTF-8")
+					return n, errInvalidUTF8
+				}
+				streamsReceived.Add(1)
+			}
+			if err != nil && err != io.EOF {
+				err = c.failed(err)
+			}
+			return n, err
+		}), nil
+	}
+}
+
+// writeStream queues a message to be streamed out from r, in chunks, calling
+// progress after every one that's written. It counts as one message against
+// the send queue, and r is only read by the write pump, once it gets to it.
+func (c *client) writeStream(messageType int, r io.Reader, progress streamProgress) error {
+	return c.enqueue(outbound{messageType: messageType, stream: &outStream{r, progress}})
+}
+
+type streamMessage struct {
+	Type   string `json:"type"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func streamReply(typ string, n int64, sum []byte) []byte {
+	reply := streamMessage{Type: typ, Bytes: n}
+	if sum != nil {
+		reply.SHA256 = hex.EncodeToString(sum)
+	}
+	message, _ := json.Marshal(reply)
+	return message
+}
+
+// randomStream gives n bytes of random data, the same every time for the same
+// seed.
+func randomStream(seed int64, n int64) io.Reader {
+	return io.LimitReader(rand.New(rand.NewSource(seed)), n)
+}
+
+// uploadServer is the /upload endpoint: binary messages of up to limit bytes
+// are streamed in and hashed, and random ones are streamed out on request. A
+// text message over the usual read limit closes the connection with 1009.
+func uploadServer(limit int64) connServer {
+	return func(ctx context.Context, g *errgroup.Group, c *client) error {
+		c.t.SetReadLimit(limit)
+		for {
+			var reported int64
+			messageType, r, err := c.readStream(ctx, func(n int64) {
+				if n-reported >= progressInterval {
+					reported = n - n%progressInterval
+					c.write(websocket.TextMessage, streamReply("progress", reported, nil))
+				}
+			})
+			if err != nil {
+				return err
+			}
+
+			if messageType == websocket.TextMessage {
+				// Only uploads get the stream limit. A request is held to the
+				// usual read limit, rather than being decoded from however
+				// much JSON fits under the stream limit.
+				lr := &io.LimitedReader{R: r, N: c.readLimit + 1}
+				var request streamMessage
+				decodeErr := json.NewDecoder(lr).Decode(&request)
+				// coder/websocket won't read the next message until this one's
+				// been read to the end.
+				if _, err := io.Copy(io.Discard, lr); err != nil {
+					return err
+				}
+				if lr.N == 0 {
+					c.close(ctx, websocket.CloseMessageTooBig, "message too big")
+					return fmt.Errorf("text message over %d bytes: %w", c.readLimit, websocket.ErrReadLimit)
+				}
+				if decodeErr != nil || request.Type != "download" {
+					continue
+				}
+				if request.Bytes < 0 {
+					request.Bytes = 0
+				}
+				if request.Bytes > limit {
+					request.Bytes = limit
+				}
+				// The data is made twice over, once to hash it and once to
+				// send it, so that it never has to all be held at once.
+				seed := time.Now().UnixNano()
+				h := sha256.New()
+				io.Copy(h, randomStream(seed, request.Bytes))
+				start := time.Now()
+				size := request.Bytes
+				err := c.writeStream(websocket.BinaryMessage, randomStream(seed, size), func(n int64) {
+					if n == size {
+						c.log.Debug("Streamed a download", "bytes", n, "took", time.Since(start))
+					}
+				})
+				if err != nil {
+					return err
+				}
+				if err := c.write(websocket.TextMessage, streamReply("downloaded", size, h.Sum(nil))); err != nil {
+					return err
+				}
+				continue
+			}
+
+			h := sha256.New()
+			n, err := io.Copy(h, r)
+			if err != nil {
+				return err
+			}
+			c.log.Debug("Got an upload", "bytes", n)
+			if err := c.write(websocket.TextMessage, streamReply("uploaded", n, h.Sum(nil))); err != nil {
+				return err
+			}
+		}
+	}
+}
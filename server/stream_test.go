@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestUploadTextLimit(t *testing.T) {
+	for _, name := range transportNames {
+		t.Run(name, func(t *testing.T) {
+			url := testServer(t, WithTransport(name), WithReadLimit(1024), WithMessageRate(0, 0, "drop"))
+			conn, _, err := websocket.DefaultDialer.Dial(url+"/upload", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			// A request under the read limit is answered, and an upload over
+			// it is fine.
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"download","bytes":100}`)); err != nil {
+				t.Fatal(err)
+			}
+			if messageType, data, err := conn.ReadMessage(); err != nil || messageType != websocket.BinaryMessage || len(data) != 100 {
+				t.Fatalf("download = %d, %d bytes, %v, want 100 binary bytes", messageType, len(data), err)
+			}
+			var reply struct {
+				Type string `json:"type"`
+			}
+			if err := conn.ReadJSON(&reply); err != nil || reply.Type != "downloaded" {
+				t.Fatalf("after the download, got a %q, %v", reply.Type, err)
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, make([]byte, 4096)); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.ReadJSON(&reply); err != nil || reply.Type != "uploaded" {
+				t.Fatalf("after the upload, got a %q, %v", reply.Type, err)
+			}
+
+			// A text message over it isn't decoded.
+			request, _ := json.Marshal(map[string]string{"type": "download", "padding": strings.Repeat("x", 4096)})
+			if err := conn.WriteMessage(websocket.TextMessage, request); err != nil {
+				t.Fatal(err)
+			}
+			for {
+				_, _, err := conn.ReadMessage()
+				var ce *websocket.CloseError
+				if errors.As(err, &ce) {
+					if ce.Code != websocket.CloseMessageTooBig {
+						t.Fatalf("closed with %d, want %d", ce.Code, websocket.CloseMessageTooBig)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("read error %v, want a close frame", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// When run as a socket-activated systemd service, systemd binds the listening
+// sockets itself and hands them over to us as already open file descriptors.
+// That way the sockets stay open across restarts, and no connection attempt is
+// refused while the server is coming back up.
+//
+// The protocol is described in sd_listen_fds(3) and sd_notify(3). It is only
+// implemented on Linux. Everywhere else, systemd is a serviceManager that
+// never hands over any sockets, and ignores notifications.
+
+// serviceManager is whatever supervises this process.
+type serviceManager interface {
+	// Listeners gives the sockets handed over by the service manager, if any.
+	Listeners() ([]namedListener, error)
+
+	// Notify tells the service manager about a change in state, for example
+	// "READY=1" once the server is up.
+	Notify(state string) error
+}
+
+type namedListener struct {
+	name string
+	net.Listener
+}
+
+// The first file descriptor passed by systemd is always 3, right after
+// stdin, stdout, and stderr.
+const listenFDsStart = 3
+
+type listenFD struct {
+	fd   int
+	name string
+}
+
+// parseListenFDs works out which file descriptors were passed to us from the
+// LISTEN_PID, LISTEN_FDS, and LISTEN_FDNAMES environment variables. The
+// variables are meant for the process with the PID in LISTEN_PID only; any
+// other process (say, a child that inherited our environment) must ignore them.
+func parseListenFDs(getenv func(string) string, pid int) ([]listenFD, error) {
+	listenPID := getenv("LISTEN_PID")
+	if listenPID == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(listenPID); err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_PID %q", listenPID)
+	} else if p != pid {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+
+	var names []string
+	if s := getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+		if len(names) != count {
+			return nil, fmt.Errorf("LISTEN_FDNAMES has %d names for %d file descriptors", len(names), count)
+		}
+	}
+
+	fds := make([]listenFD, count)
+	for i := range fds {
+		fds[i].fd = listenFDsStart + i
+		if names != nil {
+			fds[i].name = names[i]
+		} else {
+			fds[i].name = "fd " + strconv.Itoa(fds[i].fd)
+		}
+	}
+	return fds, nil
+}
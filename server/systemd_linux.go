@@ -0,0 +1,62 @@
+//go:build linux
+
+package server
+
+import (
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+var systemd serviceManager = linuxSystemd{}
+
+type linuxSystemd struct{}
+
+func (linuxSystemd) Listeners() ([]namedListener, error) {
+	fds, err := parseListenFDs(os.Getenv, os.Getpid())
+	if err != nil || len(fds) == 0 {
+		return nil, err
+	}
+
+	// Not to be passed on to anything we might spawn.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []namedListener
+	for _, fd := range fds {
+		syscall.CloseOnExec(fd.fd)
+		f := os.NewFile(uintptr(fd.fd), fd.name)
+		listener, err := net.FileListener(f)
+		// FileListener dups the descriptor, so the original can be closed
+		// either way.
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, namedListener{fd.name, listener})
+	}
+	return listeners, nil
+}
+
+func (linuxSystemd) Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// A leading @ means the socket lives in the abstract namespace.
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,110 @@
+//go:build linux
+
+package server
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestSystemdListeners hands a socket to a copy of the test binary, the way
+// systemd would, and has it take the socket over in
+// TestSystemdListenersChild.
+func TestSystemdListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListenersChild$", "-test.v")
+	cmd.Env = append(os.Environ(),
+		"WSEXAMPLE_TEST_LISTEN_ADDR="+l.Addr().String(),
+		"LISTEN_FDS=1",
+		"LISTEN_FDNAMES=web",
+	)
+	// The first of the extra files is fd 3.
+	cmd.ExtraFiles = []*os.File{f}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+}
+
+func TestSystemdListenersChild(t *testing.T) {
+	addr := os.Getenv("WSEXAMPLE_TEST_LISTEN_ADDR")
+	if addr == "" {
+		t.Skip("only run by TestSystemdListeners")
+	}
+	// The PID isn't known until the process is started, so the child sets it
+	// for itself.
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || listeners[0].name != "web" || listeners[0].Addr().String() != addr {
+		t.Fatalf("Listeners() = %v, want web on %s", listeners, addr)
+	}
+	defer listeners[0].Close()
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(key); ok {
+			t.Errorf("%s is still set", key)
+		}
+	}
+}
+
+func TestSystemdListenersForAnotherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := systemd.Listeners()
+	if err != nil || len(listeners) != 0 {
+		t.Fatalf("Listeners() = %v, %v, want none", listeners, err)
+	}
+	// They're left for the process they're meant for.
+	if os.Getenv("LISTEN_FDS") != "1" {
+		t.Fatal("LISTEN_FDS was unset")
+	}
+}
+
+func TestSystemdNotify(t *testing.T) {
+	for _, abstract := range []bool{false, true} {
+		name := filepath.Join(t.TempDir(), "notify")
+		env := name
+		if abstract {
+			name = "\x00wsexample-test-" + strconv.Itoa(os.Getpid())
+			env = "@" + name[1:]
+		}
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		t.Setenv("NOTIFY_SOCKET", env)
+
+		if err := systemd.Notify("READY=1"); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != "READY=1" {
+			t.Fatalf("%s got %q, %v, want READY=1", env, buf[:n], err)
+		}
+	}
+
+	// Without a socket, there's no one to tell.
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := systemd.Notify("READY=1"); err != nil {
+		t.Fatalf("Notify() without a socket: %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package server
+
+var systemd serviceManager = noSystemd{}
+
+type noSystemd struct{}
+
+func (noSystemd) Listeners() ([]namedListener, error) { return nil, nil }
+
+func (noSystemd) Notify(state string) error { return nil }
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseListenFDs(t *testing.T) {
+	const pid = 4242
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []listenFD
+		err  string
+	}{
+		{name: "not socket activated", env: map[string]string{}},
+		{name: "for another process", env: map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "2"}},
+		{
+			name: "one socket",
+			env:  map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "1"},
+			want: []listenFD{{3, "fd 3"}},
+		},
+		{
+			name: "named sockets",
+			env:  map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "http:https"},
+			want: []listenFD{{3, "http"}, {4, "https"}},
+		},
+		{name: "no sockets", env: map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "0"}, want: []listenFD{}},
+		{name: "bad pid", env: map[string]string{"LISTEN_PID": "me", "LISTEN_FDS": "1"}, err: `invalid LISTEN_PID "me"`},
+		{name: "missing count", env: map[string]string{"LISTEN_PID": "4242"}, err: `invalid LISTEN_FDS ""`},
+		{name: "bad count", env: map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "two"}, err: `invalid LISTEN_FDS "two"`},
+		{name: "negative count", env: map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "-1"}, err: `invalid LISTEN_FDS "-1"`},
+		{
+			name: "too few names",
+			env:  map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "http"},
+			err:  "LISTEN_FDNAMES has 1 names for 2 file descriptors",
+		},
+		{
+			name: "too many names",
+			env:  map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "1", "LISTEN_FDNAMES": "http:https"},
+			err:  "LISTEN_FDNAMES has 2 names for 1 file descriptors",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(key string) string { return tt.env[key] }
+			fds, err := parseListenFDs(getenv, pid)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseListenFDs() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fds, tt.want) {
+				t.Fatalf("parseListenFDs() = %v, want %v", fds, tt.want)
+			}
+		})
+	}
+}
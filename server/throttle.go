@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"sync"
+	"time"
+)
+
+// With -write-rate, each connection gets a token bucket of bytes, so that no
+// single client can be sent more than that many bytes of messages per second,
+// after an initial burst. A write that doesn't have the bytes for it waits
+// until it does, rather than being dropped, and the wait counts against the
+// write timeout like any other; a message whose wait outlasts it is tried
+// once more before the connection is given up on, see writewait.go. Control
+// frames aren't throttled.
+//
+// The wait happens in the connection's write pump, so the messages queued for
+// the connection wait behind it, but nothing else does. Since it holds up the
+// queue, a client that's throttled for long enough fills it, and its
+// -send-overflow policy takes over, as it would for a client that's slow to
+// read.
+//
+// With -room-write-rate, each room of a hub gets a bucket of its own too,
+// which every message broadcast to the room takes from, once for each member
+// it's written to. So a room with a thousand members and a rate of 1MiB/s adds
+// up to 1MiB/s across all of them, however much is broadcast to it. A
+// broadcast waits for both its room's bucket and its connection's, and the
+// room's wait counts against the write timeout in the same way.
+//
+// Every connection's configured rate, and how much of it it has used, is
+// listed by GET /admin/connections.
+
+var (
+	throttledWrites = expvar.NewInt("throttled_writes")
+	throttleWaitMS  = expvar.NewInt("throttle_wait_ms")
+	// The bytes taken out of the buckets, both the connections' and the
+	// rooms'.
+	throttleBytes = expvar.NewInt("throttle_bytes")
+)
+
+// writeRate is the rate of a bucket of bytes, in bytes per second, and the
+// burst it starts with.
+type writeRate struct {
+	rate  int
+	burst int
+}
+
+// bucket gives a new bucket, or nil when writes are unlimited.
+func (r writeRate) bucket() *byteBucket {
+	if r.rate <= 0 {
+		return nil
+	}
+	return newByteBucket(r.rate, r.burst)
+}
+
+type byteBucket struct {
+	rate  float64
+	burst float64
+
+	mut    sync.Mutex
+	tokens float64
+	last   time.Time
+	// What's been taken out of the bucket, and the writes that had to wait
+	// for it, and for how long, in all.
+	consumed  int64
+	throttled int64
+	waited    time.Duration
+}
+
+// newByteBucket gives a full bucket. A burst of zero means a second's worth.
+func newByteBucket(rate, burst int) *byteBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &byteBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take takes n bytes out of the bucket, and says how long to wait before
+// sending them. A message bigger than what's in the bucket is allowed to go
+// into debt, which the messages after it pay for.
+func (b *byteBucket) take(n int, now time.Time) time.Duration {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	b.consumed += int64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// give puts back the bytes of a message that wasn't sent after all.
+func (b *byteBucket) give(n int) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.tokens += float64(n)
+	b.consumed -= int64(n)
+}
+
+// delayed counts a write that waited for the bucket.
+func (b *byteBucket) delayed(wait time.Duration) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.throttled++
+	b.waited += wait
+}
+
+// bucketStats are a bucket's rate, and what's been through it.
+type bucketStats struct {
+	rate      int
+	burst     int
+	consumed  int64
+	throttled int64
+	waited    time.Duration
+}
+
+func (b *byteBucket) stats() bucketStats {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return bucketStats{int(b.rate), int(b.burst), b.consumed, b.throttled, b.waited}
+}
+
+type throttledTransport struct {
+	Transport
+	bucket *byteBucket
+}
+
+func (t *throttledTransport) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	if err := t.wait(ctx, len(data)); err != nil {
+		// None of it has gone out, so it can be tried again.
+		return &unwrittenError{err}
+	}
+	return t.Transport.WriteMessage(ctx, messageType, data)
+}
+
+// A streamed message is throttled a chunk at a time.
+func (t *throttledTransport) NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error) {
+	w, err := t.Transport.NextWriter(ctx, messageType)
+	if err != nil {
+		return nil, err
+	}
+	return &streamWriter{
+		write: func(p []byte) (int, error) {
+			if err := t.wait(ctx, len(p)); err != nil {
+				return 0, err
+			}
+			return w.Write(p)
+		},
+		close: w.Close,
+	}, nil
+}
+
+// wait waits until n bytes can be sent, or ctx is done.
+func (t *throttledTransport) wait(ctx context.Context, n int) error {
+	wait := t.bucket.take(n, time.Now())
+	throttleBytes.Add(int64(n))
+	if wait <= 0 {
+		return nil
+	}
+	t.bucket.delayed(wait)
+	throttledWrites.Add(1)
+	throttleWaitMS.Add(wait.Milliseconds())
+	timer := time.NewTimer(wait)
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		timer.Stop()
+		t.bucket.give(n)
+		throttleBytes.Add(-int64(n))
+		return ctx.Err()
+	}
+}
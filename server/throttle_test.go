@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestByteBucketRate(t *testing.T) {
+	const rate = 64 << 10
+	tests := []struct {
+		name    string
+		burst   int
+		message int
+	}{
+		{"small messages", 4 << 10, 1 << 10},
+		{"messages the size of the burst", 4 << 10, 4 << 10},
+		// Bigger than the bucket, so every one goes into debt.
+		{"messages bigger than the burst", 4 << 10, 16 << 10},
+		{"default burst", 0, 1 << 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Unix(1700000000, 0)
+			b := newByteBucket(rate, tt.burst)
+			b.last = start
+			burst := tt.burst
+			if burst == 0 {
+				burst = rate
+			}
+
+			// Send a megabyte as fast as the bucket allows: each message as soon
+			// as it's been waited for.
+			now := start
+			sent := 0
+			for sent < 1<<20 {
+				now = now.Add(b.take(tt.message, now))
+				sent += tt.message
+			}
+			// The last message has already been waited for, so the time taken
+			// is what it took to send everything but the burst.
+			want := time.Duration(float64(sent-burst) / rate * float64(time.Second))
+			if got := now.Sub(start); math.Abs(float64(got-want)) > float64(time.Millisecond) {
+				t.Fatalf("took %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestByteBucketRefill(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	b := newByteBucket(1000, 500)
+	b.last = start
+	if wait := b.take(500, start); wait != 0 {
+		t.Fatalf("burst waited %s", wait)
+	}
+	if wait := b.take(100, start); wait != 100*time.Millisecond {
+		t.Fatalf("past the burst waited %s, want 100ms", wait)
+	}
+	// Putting it back, as a write that gave up does, makes it free again.
+	b.give(100)
+	if wait := b.take(0, start); wait != 0 {
+		t.Fatalf("after giving back waited %s", wait)
+	}
+	// An hour idle only refills it as far as the burst.
+	if wait := b.take(600, start.Add(time.Hour)); wait != 100*time.Millisecond {
+		t.Fatalf("after an hour waited %s, want 100ms", wait)
+	}
+}
+
+func TestThrottledTransport(t *testing.T) {
+	const (
+		rate    = 64 << 10
+		burst   = 4 << 10
+		message = 4 << 10
+		// Messages are offered at 1MiB/s, sixteen times what the throttle
+		// lets through, for as long as the rate is measured over.
+		offered = 1 << 20
+		measure = 2 * time.Second
+	)
+	for _, name := range transportNames {
+		t.Run(name, func(t *testing.T) {
+			tr, conn := transportPair(t, name)
+			tr = &throttledTransport{Transport: tr, bucket: newByteBucket(rate, burst)}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// The producer never waits for the writer, so what isn't written
+			// yet piles up in the queue.
+			queue := make(chan []byte, 2*offered/message*int(measure/time.Second))
+			var queued atomic.Int64
+			go func() {
+				ticker := time.NewTicker(time.Second * message / offered)
+				defer ticker.Stop()
+				data := make([]byte, message)
+				for {
+					select {
+					case <-ticker.C:
+						select {
+						case queue <- data:
+							queued.Add(message)
+						default:
+						}
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			go func() {
+				for {
+					select {
+					case data := <-queue:
+						if err := tr.WriteMessage(ctx, websocket.BinaryMessage, data); err != nil {
+							return
+						}
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+
+			// The first message is the burst, so it's what comes after it
+			// that's paced.
+			conn.SetReadDeadline(time.Now().Add(measure + 10*time.Second))
+			var first, last time.Time
+			received := 0
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				now := time.Now()
+				if first.IsZero() {
+					first = now
+					continue
+				}
+				if now.Sub(first) > measure {
+					break
+				}
+				received += len(data)
+				last = now
+			}
+			if got := queued.Load(); got < 8*int64(received) {
+				t.Fatalf("only %d bytes were offered for the %d received", got, received)
+			}
+			got := float64(received) / last.Sub(first).Seconds()
+			if got < rate*0.9 || got > rate*1.1 {
+				t.Fatalf("received %.0f bytes/s, want %d ±10%%", got, rate)
+			}
+		})
+	}
+}
+
+func TestRoomWriteRate(t *testing.T) {
+	const (
+		rate    = 256 << 10
+		burst   = 4 << 10
+		message = 4 << 10
+		count   = 16
+	)
+	h := newHub()
+	h.roomRate = writeRate{rate, burst}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var transports []*fakeTransport
+	for i := 0; i < 2; i++ {
+		ft := newFakeTransport()
+		c := newClient(ft, "", sendQueue{size: 2 * count}, messageRate{})
+		c.writeWaits = defaultOptions().writeWaits
+		go c.writePump(ctx)
+		h.join(c)
+		if err := h.joinRoom(c, "firehose"); err != nil {
+			t.Fatal(err)
+		}
+		transports = append(transports, ft)
+	}
+	// waitFor waits until each transport has been written n messages, and
+	// gives how long that took.
+	waitFor := func(n int) time.Duration {
+		t.Helper()
+		start := time.Now()
+		for _, ft := range transports {
+			for ft.writes() < n {
+				if time.Since(start) > 10*time.Second {
+					t.Fatalf("written %d messages, want %d", ft.writes(), n)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+		return time.Since(start)
+	}
+
+	start := time.Now()
+	data := make([]byte, message)
+	for i := 0; i < count; i++ {
+		h.mut.Lock()
+		h.deliver(broadcastMessage{room: "firehose", messageType: websocket.BinaryMessage, data: data})
+		h.mut.Unlock()
+	}
+	waitFor(count)
+	// Both members take from the room's bucket, so it's twice the bytes, less
+	// the burst, at the room's rate.
+	want := time.Duration(float64(2*count*message-burst) / rate * float64(time.Second))
+	if took := time.Since(start); took < want*9/10 || took > want*3/2 {
+		t.Fatalf("took %s to broadcast to the room, want about %s", took, want)
+	}
+
+	// A broadcast to everyone isn't the room's.
+	start = time.Now()
+	for i := 0; i < count; i++ {
+		h.mut.Lock()
+		h.deliver(broadcastMessage{messageType: websocket.BinaryMessage, data: data})
+		h.mut.Unlock()
+	}
+	waitFor(2 * count)
+	if took := time.Since(start); took > want/4 {
+		t.Fatalf("took %s to broadcast to everyone, which isn't throttled", took)
+	}
+}
+
+func TestDescribeThrottledConn(t *testing.T) {
+	now := time.Now()
+	c := &liveConn{id: 1, stats: &connStats{}, connected: now.Add(-2 * time.Second), throttle: newByteBucket(1000, 500)}
+	tr := &throttledTransport{Transport: newFakeTransport(), bucket: c.throttle}
+	for i := 0; i < 3; i++ {
+		if err := tr.WriteMessage(context.Background(), websocket.BinaryMessage, make([]byte, 250)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info := describeConn(c, now, nil)
+	if info.WriteRate != 1000 || info.WriteBurst != 500 {
+		t.Fatalf("listed at %d bytes/s after %d, want 1000 after 500", info.WriteRate, info.WriteBurst)
+	}
+	if info.WriteConsumed != 750 || info.WriteRateUsed != 375 {
+		t.Fatalf("listed as having used %d bytes, at %.0f bytes/s, want 750 at 375", info.WriteConsumed, info.WriteRateUsed)
+	}
+	// The third went past the burst, by what the bucket refilled with in the
+	// meantime less.
+	if info.ThrottledWrites != 1 || info.ThrottleWaitMS < 200 || info.ThrottleWaitMS > 250 {
+		t.Fatalf("listed %d throttled writes, waiting %dms, want 1 waiting about 250ms", info.ThrottledWrites, info.ThrottleWaitMS)
+	}
+}
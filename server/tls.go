@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// The server can serve wss:// itself, either with the certificate and key in
+// -tls-cert and -tls-key, or with certificates it gets from Let's Encrypt for
+// the -autocert-domains, kept in -autocert-cache. Either way, -redirect-addr
+// is an address to also listen on for plain HTTP, and redirect everything
+// to HTTPS; with autocert, it also answers the ACME HTTP challenges there.
+//
+// Behind a reverse proxy that does TLS itself, the server can't tell from
+// the connection whether the client used HTTPS. With -require-https, it goes
+// by the proto= of the Forwarded header, or X-Forwarded-Proto, when the
+// request comes from a trusted proxy, and redirects anything that wasn't
+// HTTPS. Those headers from anyone else are ignored, as for the client
+// address.
+//
+// Only HTTP/1.1 is offered, since that's what WebSocket upgrades need.
+
+// loadTLS gives the TLS config to serve with, and a wrapper for the redirect
+// handler, for the ACME challenges. The config is nil when TLS is off.
+func loadTLS(certFile, keyFile string, autocertDomains []string, autocertCache string) (*tls.Config, func(http.Handler) http.Handler, error) {
+	noChallenges := func(h http.Handler) http.Handler { return h }
+	switch {
+	case len(autocertDomains) > 0:
+		if certFile != "" || keyFile != "" {
+			return nil, nil, errors.New("-tls-cert and -tls-key can't be used with -autocert-domains")
+		}
+		return autocertTLS(autocertDomains, autocertCache)
+	case certFile == "" && keyFile == "":
+		return nil, noChallenges, nil
+	case certFile == "" || keyFile == "":
+		return nil, nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"http/1.1"},
+		MinVersion:   tls.VersionTLS12,
+	}, noChallenges, nil
+}
+
+// httpsRedirect redirects every request to the same URL over HTTPS, on the
+// given port.
+func httpsRedirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// requireHTTPS redirects requests that weren't made over HTTPS, as far as the
+// current settings can tell, to HTTPS.
+func requireHTTPS(holder *settingsHolder, next http.Handler) http.Handler {
+	redirect := httpsRedirect("")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if holder.load().resolver.scheme(r) != "https" {
+			redirect.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// When something isn't interoperating, it helps to see exactly what's going
+// over the wire. With frame tracing on, every message and control frame that
+// goes through a connection's transport is logged with its direction, type,
+// and length, along with the first 64 bytes of the payload, hex-encoded. The
+// rest of the payload is never logged.
+//
+// Tracing can be turned on for every connection with -trace-frames, or for a
+// single connection at a time with POST /admin/connections/{id}/trace (and
+// back off with DELETE). Records go to the standard logger, or to the file
+// given by -trace-file.
+//
+// Neither WebSocket library exposes the FIN and RSV bits of the frames it
+// reads, or the pings sent by the client, so those don't show up.
+
+const tracePreviewLen = 64
+
+type frameTracer struct {
+	id      uint64
+	enabled int32
+	out     *log.Logger
+}
+
+func (tr *frameTracer) on() bool {
+	return atomic.LoadInt32(&tr.enabled) == 1
+}
+
+func (tr *frameTracer) record(direction, kind string, payload []byte, extra string) {
+	tr.recordLen(direction, kind, int64(len(payload)), payload, extra)
+}
+
+// recordLen records a message of length bytes, starting with payload.
+func (tr *frameTracer) recordLen(direction, kind string, length int64, payload []byte, extra string) {
+	if !tr.on() {
+		return
+	}
+	preview := payload
+	if len(preview) > tracePreviewLen {
+		preview = preview[:tracePreviewLen]
+	}
+	line := fmt.Sprintf("trace conn=%d %s %s len=%d", tr.id, direction, kind, length)
+	if len(preview) > 0 {
+		line += " data=" + hex.EncodeToString(preview)
+	}
+	if extra != "" {
+		line += " " + extra
+	}
+	tr.out.Print(line)
+}
+
+func messageKind(messageType int) string {
+	switch messageType {
+	case websocket.TextMessage:
+		return "text"
+	case websocket.BinaryMessage:
+		return "binary"
+	}
+	return "opcode=" + strconv.Itoa(messageType)
+}
+
+// tracedTransport records everything going through the transport it wraps,
+// whenever its tracer is enabled.
+type tracedTransport struct {
+	Transport
+	tracer *frameTracer
+}
+
+func (t *tracedTransport) ReadMessage(ctx context.Context) (int, []byte, error) {
+	messageType, data, err := t.Transport.ReadMessage(ctx)
+	if err == nil {
+		t.tracer.record("in", messageKind(messageType), data, "")
+	}
+	t.readFailed(err)
+	return messageType, data, err
+}
+
+func (t *tracedTransport) readFailed(err error) {
+	var ce *websocket.CloseError
+	// 1006 is made up locally when the connection drops without a close frame,
+	// so it never went over the wire.
+	if errors.As(err, &ce) && ce.Code != websocket.CloseAbnormalClosure {
+		t.tracer.record("in", "close", []byte(ce.Text), fmt.Sprintf("code=%d", ce.Code))
+	}
+}
+
+func (t *tracedTransport) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	t.tracer.record("out", messageKind(messageType), data, "")
+	return t.Transport.WriteMessage(ctx, messageType, data)
+}
+
+// A streamed message is traced once it's all gone through, with its whole
+// length, and the start of it.
+func (t *tracedTransport) NextReader(ctx context.Context) (int, io.Reader, error) {
+	messageType, r, err := t.Transport.NextReader(ctx)
+	if err != nil {
+		t.readFailed(err)
+		return 0, nil, err
+	}
+	s := &tracedStream{}
+	return messageType, readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		s.add(p[:n])
+		if err == io.EOF {
+			t.tracer.recordLen("in", messageKind(messageType), s.length, s.preview, "streamed")
+		}
+		t.readFailed(err)
+		return n, err
+	}), nil
+}
+
+func (t *tracedTransport) NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error) {
+	w, err := t.Transport.NextWriter(ctx, messageType)
+	if err != nil {
+		return nil, err
+	}
+	s := &tracedStream{}
+	return &streamWriter{
+		write: func(p []byte) (int, error) {
+			n, err := w.Write(p)
+			s.add(p[:n])
+			return n, err
+		},
+		close: func() error {
+			t.tracer.recordLen("out", messageKind(messageType), s.length, s.preview, "streamed")
+			return w.Close()
+		},
+	}, nil
+}
+
+// tracedStream keeps the length of a streamed message so far, and as much of
+// the start of it as gets traced.
+type tracedStream struct {
+	length  int64
+	preview []byte
+}
+
+func (s *tracedStream) add(p []byte) {
+	s.length += int64(len(p))
+	if room := tracePreviewLen - len(s.preview); room > 0 {
+		if len(p) > room {
+			p = p[:room]
+		}
+		s.preview = append(s.preview, p...)
+	}
+}
+
+func (t *tracedTransport) Ping(ctx context.Context) (time.Duration, error) {
+	t.tracer.record("out", "ping", nil, "")
+	rtt, err := t.Transport.Ping(ctx)
+	if err == nil {
+		t.tracer.record("in", "pong", nil, "rtt="+rtt.String())
+	}
+	return rtt, err
+}
+
+func (t *tracedTransport) Close(code int, reason string) error {
+	t.tracer.record("out", "close", []byte(reason), fmt.Sprintf("code=%d", code))
+	return t.Transport.Close(code, reason)
+}
+
+func (tr *frameTracer) setEnabled(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&tr.enabled, v)
+}
+
+func traceHandler(reg *connRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := connFromVars(reg, r)
+		if !ok {
+			writeError(w, http.StatusNotFound, codeNotFound, "no such connection", 0)
+			return
+		}
+		c.tracer.setEnabled(r.Method == http.MethodPost)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
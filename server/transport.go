@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Everything that happens on a connection after the upgrade goes through a
+// transport, so that the WebSocket library underneath can be swapped out. The
+// default is gorilla/websocket; coder/websocket can be selected with
+// -transport coder instead.
+//
+// Message types use gorilla's numbering (websocket.TextMessage and
+// websocket.BinaryMessage) whichever library is underneath, a close from the
+// peer is always reported as a *websocket.CloseError from gorilla, and a
+// message over the read limit as websocket.ErrReadLimit.
+//
+// The two libraries don't behave quite the same. The differences that show
+// through are:
+//
+//   - coder/websocket answers rejected handshakes with its own plain text
+//     errors, rather than the structured JSON errors.
+//   - coder/websocket's Close waits for the peer to answer the close frame,
+//     which can take up to a few seconds, while gorilla's doesn't wait.
+//
+// A Transport can also be served without an upgrade at all, with
+// ServeTransport, such as wstest's in-memory Conn, so that what the hubs and
+// the dispatcher do with a connection can be tested without a listener or a
+// dialer.
+
+// Transport is everything the server does with a connection.
+type Transport interface {
+	// ReadMessage reads the next message. Only one goroutine may be reading at
+	// a time, and one must be, for pongs to be noticed. A read in progress is
+	// only interrupted by closing the transport.
+	ReadMessage(ctx context.Context) (messageType int, data []byte, err error)
+
+	// WriteMessage writes a message. Only one goroutine may be writing
+	// messages at a time.
+	WriteMessage(ctx context.Context, messageType int, data []byte) error
+
+	// NextReader gives the next message as a reader, for messages too big to
+	// read in one go, which ends with io.EOF at the end of the message. The
+	// reader is only good until the next read; otherwise NextReader is the same
+	// as ReadMessage. ctx has to last until the reader is done with.
+	NextReader(ctx context.Context) (messageType int, r io.Reader, err error)
+
+	// NextWriter gives a writer for a message, which goes out in fragments as
+	// it's written to, and is finished by closing the writer. Nothing else may
+	// be written until then, and ctx has to last until then too.
+	NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error)
+
+	// Ping sends a ping, and waits for the pong, or for ctx to be done, and
+	// gives the round trip time, or zero when there's no telling. It's safe to
+	// call alongside WriteMessage.
+	Ping(ctx context.Context) (time.Duration, error)
+
+	SetReadLimit(limit int64)
+
+	// Subprotocol gives the negotiated subprotocol, if any.
+	Subprotocol() string
+
+	// Extensions gives the negotiated extensions, as they were given in the
+	// handshake response, if any.
+	Extensions() string
+
+	// Close sends a close frame with the given code and reason, and closes the
+	// connection.
+	Close(code int, reason string) error
+
+	// CloseNow closes the connection without a close frame.
+	CloseNow() error
+}
+
+// acceptFunc completes the WebSocket handshake, picking the first of the given
+// subprotocols that the client offers, if any. If it fails, it has already
+// answered the request.
+type acceptFunc func(w http.ResponseWriter, r *http.Request, subprotocols []string) (Transport, error)
+
+// compression is whether to negotiate permessage-deflate (RFC 7692) with
+// clients that offer it, and the smallest message worth compressing. Smaller
+// ones are sent as they are, since compressing them costs more than it saves.
+// Both libraries only support it without context takeover, so every message
+// is compressed on its own.
+type compression struct {
+	enabled   bool
+	threshold int
+}
+
+// transportAcceptor gives the acceptFunc of the named library. The
+// handshake timeout only applies to gorilla, which does the handshake itself,
+// and the control write wait bounds the control frames it writes outside of a
+// context.
+func transportAcceptor(name string, comp compression, handshakeTimeout, writeWait time.Duration) (acceptFunc, error) {
+	switch name {
+	case "gorilla":
+		return func(w http.ResponseWriter, r *http.Request, subprotocols []string) (Transport, error) {
+			return acceptGorilla(w, r, subprotocols, comp, handshakeTimeout, writeWait)
+		}, nil
+	case "coder":
+		return func(w http.ResponseWriter, r *http.Request, subprotocols []string) (Transport, error) {
+			return acceptCoder(w, r, subprotocols, comp)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", name)
+}
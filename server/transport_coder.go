@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	cws "github.com/coder/websocket"
+	"github.com/gorilla/websocket"
+)
+
+type coderTransport struct {
+	c          *cws.Conn
+	extensions string
+}
+
+func acceptCoder(w http.ResponseWriter, r *http.Request, subprotocols []string, comp compression) (Transport, error) {
+	opts := &cws.AcceptOptions{
+		Subprotocols: subprotocols,
+		// The origin has already been checked, as for gorilla.
+		InsecureSkipVerify: true,
+	}
+	if comp.enabled {
+		// The same as gorilla's, rather than coder/websocket's default of
+		// keeping the context, which costs a lot more memory per connection.
+		opts.CompressionMode = cws.CompressionNoContextTakeover
+		opts.CompressionThreshold = comp.threshold
+	}
+	c, err := cws.Accept(w, r, opts)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake response went through w, so its headers are still there.
+	return &coderTransport{c, w.Header().Get("Sec-WebSocket-Extensions")}, nil
+}
+
+// coderError makes a close from the peer, or a message over the read limit,
+// look the same as it would coming from gorilla.
+func coderError(err error) error {
+	var ce cws.CloseError
+	if errors.As(err, &ce) {
+		return &websocket.CloseError{Code: int(ce.Code), Text: ce.Reason}
+	}
+	// coder/websocket doesn't have an error value for this one.
+	if err != nil && strings.Contains(err.Error(), "read limited at") {
+		return websocket.ErrReadLimit
+	}
+	return err
+}
+
+func (t *coderTransport) ReadMessage(ctx context.Context) (int, []byte, error) {
+	typ, data, err := t.c.Read(ctx)
+	if err != nil {
+		return 0, nil, coderError(err)
+	}
+	if typ == cws.MessageBinary {
+		return websocket.BinaryMessage, data, nil
+	}
+	return websocket.TextMessage, data, nil
+}
+
+func (t *coderTransport) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	if err := unstarted(ctx); err != nil {
+		return err
+	}
+	typ := cws.MessageText
+	if messageType == websocket.BinaryMessage {
+		typ = cws.MessageBinary
+	}
+	return coderError(t.c.Write(ctx, typ, data))
+}
+
+func (t *coderTransport) NextReader(ctx context.Context) (int, io.Reader, error) {
+	typ, r, err := t.c.Reader(ctx)
+	if err != nil {
+		return 0, nil, coderError(err)
+	}
+	messageType := websocket.TextMessage
+	if typ == cws.MessageBinary {
+		messageType = websocket.BinaryMessage
+	}
+	return messageType, readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		if err == io.EOF {
+			return n, err
+		}
+		return n, coderError(err)
+	}), nil
+}
+
+func (t *coderTransport) NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error) {
+	typ := cws.MessageText
+	if messageType == websocket.BinaryMessage {
+		typ = cws.MessageBinary
+	}
+	w, err := t.c.Writer(ctx, typ)
+	if err != nil {
+		return nil, coderError(err)
+	}
+	return w, nil
+}
+
+// coder/websocket makes up the payloads of its pings itself, so the round
+// trip is timed from out here instead, which comes to much the same thing.
+func (t *coderTransport) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if err := t.c.Ping(ctx); err != nil {
+		return 0, coderError(err)
+	}
+	return time.Since(start), nil
+}
+
+func (t *coderTransport) SetReadLimit(limit int64) {
+	t.c.SetReadLimit(limit)
+}
+
+func (t *coderTransport) Subprotocol() string {
+	return t.c.Subprotocol()
+}
+
+func (t *coderTransport) Extensions() string {
+	return t.extensions
+}
+
+func (t *coderTransport) Close(code int, reason string) error {
+	return t.c.Close(cws.StatusCode(code), reason)
+}
+
+func (t *coderTransport) CloseNow() error {
+	return t.c.CloseNow()
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"wsexample/internal/latency"
+)
+
+type gorillaTransport struct {
+	c *websocket.Conn
+	// The round trips of the pongs to the latest ping, whose timestamp, as in
+	// its payload, is pinged.
+	pongs      chan time.Duration
+	pinged     int64
+	extensions string
+	// Messages smaller than this are sent uncompressed. Zero when compression
+	// wasn't negotiated.
+	threshold int
+	// Bounds writing a ping or a close frame.
+	writeWait time.Duration
+}
+
+// gorillaDeflate is what gorilla answers an offer of permessage-deflate with,
+// whatever the parameters offered.
+const gorillaDeflate = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+func acceptGorilla(w http.ResponseWriter, r *http.Request, subprotocols []string, comp compression, handshakeTimeout, writeWait time.Duration) (Transport, error) {
+	u := upgrader
+	u.HandshakeTimeout = handshakeTimeout
+	u.Subprotocols = subprotocols
+	u.EnableCompression = comp.enabled
+	c, err := u.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	t := &gorillaTransport{c: c, pongs: make(chan time.Duration, 1), writeWait: writeWait}
+	// gorilla doesn't say whether it negotiated compression, but it always
+	// does when it's enabled and the client offers it.
+	if comp.enabled && offersDeflate(r.Header) {
+		t.extensions = gorillaDeflate
+		t.threshold = comp.threshold
+	}
+	c.SetPongHandler(func(payload string) error {
+		// A pong that shows up late for an earlier ping doesn't count for the
+		// latest one.
+		sent, ok := latency.Sent([]byte(payload))
+		if !ok || sent.UnixNano() != atomic.LoadInt64(&t.pinged) {
+			return nil
+		}
+		select {
+		case t.pongs <- time.Since(sent):
+		default:
+		}
+		return nil
+	})
+	return t, nil
+}
+
+// deadline gives ctx's deadline, or the zero time (meaning no deadline) if it
+// doesn't have one.
+func deadline(ctx context.Context) time.Time {
+	d, _ := ctx.Deadline()
+	return d
+}
+
+func (t *gorillaTransport) ReadMessage(ctx context.Context) (int, []byte, error) {
+	t.c.SetReadDeadline(deadline(ctx))
+	return t.c.ReadMessage()
+}
+
+func (t *gorillaTransport) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	if err := unstarted(ctx); err != nil {
+		return err
+	}
+	t.c.SetWriteDeadline(deadline(ctx))
+	if t.extensions != "" {
+		t.c.EnableWriteCompression(len(data) >= t.threshold)
+	}
+	return t.c.WriteMessage(messageType, data)
+}
+
+func (t *gorillaTransport) NextReader(ctx context.Context) (int, io.Reader, error) {
+	t.c.SetReadDeadline(deadline(ctx))
+	return t.c.NextReader()
+}
+
+func (t *gorillaTransport) NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error) {
+	t.c.SetWriteDeadline(deadline(ctx))
+	if t.extensions != "" {
+		// Whatever's big enough to stream is big enough to compress.
+		t.c.EnableWriteCompression(true)
+	}
+	return t.c.NextWriter(messageType)
+}
+
+func (t *gorillaTransport) Ping(ctx context.Context) (time.Duration, error) {
+	now := time.Now()
+	atomic.StoreInt64(&t.pinged, now.UnixNano())
+	// One that came in for the previous ping after it gave up doesn't count
+	// either.
+	select {
+	case <-t.pongs:
+	default:
+	}
+	if err := t.c.WriteControl(websocket.PingMessage, latency.Payload(now), now.Add(t.writeWait)); err != nil {
+		return 0, err
+	}
+	select {
+	case rtt := <-t.pongs:
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (t *gorillaTransport) SetReadLimit(limit int64) {
+	t.c.SetReadLimit(limit)
+}
+
+func (t *gorillaTransport) Subprotocol() string {
+	return t.c.Subprotocol()
+}
+
+func (t *gorillaTransport) Extensions() string {
+	return t.extensions
+}
+
+// offersDeflate tells whether the handshake request offers permessage-deflate,
+// in any of its Sec-WebSocket-Extensions headers.
+func offersDeflate(h http.Header) bool {
+	for _, offers := range h.Values("Sec-WebSocket-Extensions") {
+		for _, offer := range strings.Split(offers, ",") {
+			name, _, _ := strings.Cut(offer, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *gorillaTransport) Close(code int, reason string) error {
+	t.c.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(t.writeWait),
+	)
+	return t.c.Close()
+}
+
+func (t *gorillaTransport) CloseNow() error {
+	return t.c.Close()
+}
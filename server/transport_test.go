@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var transportNames = []string{"gorilla", "coder"}
+
+// fakeTransport is a transport that isn't connected to anything. Writes go
+// nowhere, though they're counted, reads wait until it's closed, and it
+// remembers how it was closed.
+type fakeTransport struct {
+	once    sync.Once
+	closed  chan struct{}
+	mut     sync.Mutex
+	code    int
+	reason  string
+	written int
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{closed: make(chan struct{})}
+}
+
+func (t *fakeTransport) ReadMessage(ctx context.Context) (int, []byte, error) {
+	<-t.closed
+	return 0, nil, net.ErrClosed
+}
+
+func (t *fakeTransport) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.written++
+	return nil
+}
+
+// writes gives how many messages have been written whole.
+func (t *fakeTransport) writes() int {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.written
+}
+
+func (t *fakeTransport) NextReader(ctx context.Context) (int, io.Reader, error) {
+	<-t.closed
+	return 0, nil, net.ErrClosed
+}
+
+func (t *fakeTransport) NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error) {
+	return nopWriteCloser{io.Discard}, nil
+}
+
+func (t *fakeTransport) Ping(ctx context.Context) (time.Duration, error) { return 0, nil }
+
+func (t *fakeTransport) SetReadLimit(limit int64) {}
+
+func (t *fakeTransport) Subprotocol() string { return "" }
+
+func (t *fakeTransport) Extensions() string { return "" }
+
+func (t *fakeTransport) Close(code int, reason string) error {
+	t.mut.Lock()
+	if t.code == 0 {
+		t.code, t.reason = code, reason
+	}
+	t.mut.Unlock()
+	return t.CloseNow()
+}
+
+func (t *fakeTransport) CloseNow() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+// closedWith waits a little for the transport to be closed, and gives the
+// code and reason of its close frame, or false if it wasn't closed.
+func (t *fakeTransport) closedWith(wait time.Duration) (int, string, bool) {
+	select {
+	case <-t.closed:
+	case <-time.After(wait):
+		return 0, "", false
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.code, t.reason, true
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// transportPair connects a gorilla client to a server side transport of the
+// named library, and gives both ends.
+func transportPair(t *testing.T, name string, subprotocols ...string) (Transport, *websocket.Conn) {
+	t.Helper()
+	accept, err := transportAcceptor(name, compression{}, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan Transport, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr, err := accept(w, r, subprotocols)
+		if err != nil {
+			t.Errorf("accept: %v", err)
+			close(accepted)
+			return
+		}
+		accepted <- tr
+	}))
+	t.Cleanup(srv.Close)
+
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	tr, ok := <-accepted
+	if !ok {
+		t.FailNow()
+	}
+	t.Cleanup(func() { tr.CloseNow() })
+	return tr, conn
+}
+
+func TestWriteAfterDeadline(t *testing.T) {
+	for _, name := range transportNames {
+		t.Run(name, func(t *testing.T) {
+			tr, conn := transportPair(t, name)
+
+			expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+			defer cancel()
+			canceled, cancel := context.WithCancel(context.Background())
+			cancel()
+			for _, ctx := range []context.Context{expired, canceled} {
+				err := tr.WriteMessage(ctx, websocket.TextMessage, []byte("never"))
+				var unwritten *unwrittenError
+				if !errors.As(err, &unwritten) {
+					t.Fatalf("WriteMessage() error = %v, want an unwrittenError", err)
+				}
+			}
+
+			// Nothing was handed to the library, so the connection is as good
+			// as it was, and the retry goes out.
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := tr.WriteMessage(ctx, websocket.TextMessage, []byte("retried")); err != nil {
+				t.Fatalf("WriteMessage() after the failures: %v", err)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, data, err := conn.ReadMessage(); err != nil || string(data) != "retried" {
+				t.Fatalf("read %q, %v, want the retried message", data, err)
+			}
+		})
+	}
+}
+
+// TestTransports runs the same conversations against the server with each of
+// the WebSocket libraries, which should look the same from the client's side.
+func TestTransports(t *testing.T) {
+	for _, name := range transportNames {
+		t.Run(name, func(t *testing.T) {
+			u := testServer(t, WithTransport(name), WithReadLimit(1024), WithCompression(true, 1))
+			dial := func(t *testing.T, d *websocket.Dialer, path string) (*websocket.Conn, *http.Response) {
+				t.Helper()
+				conn, resp, err := d.Dial(u+path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { conn.Close() })
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				return conn, resp
+			}
+
+			t.Run("echo", func(t *testing.T) {
+				conn, _ := dial(t, websocket.DefaultDialer, "/echo")
+				tests := []struct {
+					messageType int
+					data        string
+				}{
+					{websocket.TextMessage, "hello"},
+					{websocket.BinaryMessage, "\x00\x01\xff"},
+					{websocket.TextMessage, ""},
+					{websocket.TextMessage, strings.Repeat("x", 1024)},
+				}
+				for _, tt := range tests {
+					if err := conn.WriteMessage(tt.messageType, []byte(tt.data)); err != nil {
+						t.Fatal(err)
+					}
+					messageType, data, err := conn.ReadMessage()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if messageType != tt.messageType || string(data) != tt.data {
+						t.Fatalf("echoed %d %.20q, want %d %.20q", messageType, data, tt.messageType, tt.data)
+					}
+				}
+			})
+
+			t.Run("ping", func(t *testing.T) {
+				conn, _ := dial(t, websocket.DefaultDialer, "/echo")
+				pong := make(chan string, 1)
+				conn.SetPongHandler(func(data string) error {
+					pong <- data
+					return nil
+				})
+				if err := conn.WriteControl(websocket.PingMessage, []byte("are you there"), time.Now().Add(time.Second)); err != nil {
+					t.Fatal(err)
+				}
+				// Pongs are only seen while reading, so give it something to read.
+				if err := conn.WriteMessage(websocket.TextMessage, []byte("after the ping")); err != nil {
+					t.Fatal(err)
+				}
+				if _, _, err := conn.ReadMessage(); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case data := <-pong:
+					if data != "are you there" {
+						t.Fatalf("pong %q, want the ping's data", data)
+					}
+				default:
+					t.Fatal("no pong before the echo")
+				}
+			})
+
+			t.Run("read limit", func(t *testing.T) {
+				conn, _ := dial(t, websocket.DefaultDialer, "/echo")
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 1025))); err != nil {
+					t.Fatal(err)
+				}
+				_, _, err := conn.ReadMessage()
+				if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+					t.Fatalf("read error = %v, want a %d close", err, websocket.CloseMessageTooBig)
+				}
+			})
+
+			t.Run("close", func(t *testing.T) {
+				conn, _ := dial(t, websocket.DefaultDialer, "/echo")
+				msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")
+				if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+					t.Fatal(err)
+				}
+				_, _, err := conn.ReadMessage()
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					t.Fatalf("read error = %v, want the close echoed", err)
+				}
+			})
+
+			t.Run("subprotocol", func(t *testing.T) {
+				tests := []struct {
+					offered []string
+					want    string
+				}{
+					{[]string{"unknown", protoSubprotocol}, protoSubprotocol},
+					{nil, ""},
+				}
+				for _, tt := range tests {
+					conn, _ := dial(t, &websocket.Dialer{Subprotocols: tt.offered}, "/api")
+					if got := conn.Subprotocol(); got != tt.want {
+						t.Fatalf("offering %q, got subprotocol %q, want %q", tt.offered, got, tt.want)
+					}
+				}
+			})
+
+			t.Run("compression", func(t *testing.T) {
+				conn, resp := dial(t, &websocket.Dialer{EnableCompression: true}, "/echo")
+				if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+					t.Fatalf("extensions %q, want permessage-deflate", ext)
+				}
+				want := strings.Repeat("squash me ", 50)
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(want)); err != nil {
+					t.Fatal(err)
+				}
+				if _, data, err := conn.ReadMessage(); err != nil || string(data) != want {
+					t.Fatalf("read %.20q, %v, want the compressed message back", data, err)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"time"
+)
+
+// Some messages are only worth anything for a moment: a position update
+// that's thirty seconds old is worse than none, once a newer one is on its
+// way. So a message can be given a time to live, after which it's dropped
+// rather than written, if it's still waiting in a client's send queue. The
+// write pump checks as it takes each message off the queue, and counts those
+// it drops under expired_messages. A message without one waits as long as
+// it takes.
+//
+// A client gives the envelopes it sends one with ttl_ms, next to their type:
+//
+//	{"type":"chat.send","ttl_ms":5000,"payload":{"room":"lobby","message":{"x":1,"y":2}}}
+//
+// which chat.send and direct pass on to what they send, and admin.notice to
+// its announcement. POST /admin/broadcast takes one in its body, and
+// handlers set one for what they broadcast with broadcastMessage.ttl. The
+// TTL runs from when the message is queued, so a broadcast's runs from when
+// the hub sends it out, by the monotonic clock, whatever happens to the wall
+// clock in the meantime. A broadcast that's kept in a room's history is
+// skipped by a resume once its TTL is up, and a direct message held in a
+// mailbox expires at its TTL, if that's sooner than the mailbox's. TTLs
+// don't go out to clients, and over the bus, a broadcast's is the whole TTL
+// again on every instance it reaches.
+
+var expiredMessages = expvar.NewInt("expired_messages")
+
+// expiry gives when a message queued now with the TTL expires, or the zero
+// time if it doesn't.
+func expiry(ttl time.Duration, now time.Time) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// expired tells whether a message that expires when it does has by now.
+func expired(expires, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
+
+// ttlOf gives the TTL of ttl_ms, which is none if it isn't positive.
+func ttlOf(ms int64) time.Duration {
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// sendExpiring sends the client a message of the type, with the payload, as
+// sendEnvelope does, which is dropped if it's still queued when it expires.
+func sendExpiring(ctx context.Context, c *client, typ string, payload interface{}, expires time.Time) error {
+	messageType, message, err := encodeEnvelope(c.codec, typ, payload)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(outbound{messageType: messageType, data: message, expires: expires})
+}
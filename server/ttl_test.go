@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"wsexample/internal/protowire"
+)
+
+// writtenTransport is a fake transport that keeps what's written to it.
+type writtenTransport struct {
+	*fakeTransport
+	mut      sync.Mutex
+	messages [][]byte
+}
+
+func (t *writtenTransport) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.messages = append(t.messages, data)
+	return nil
+}
+
+// chatMessages gives the messages of the chat.message envelopes in messages.
+func chatMessages(messages [][]byte) []string {
+	var got []string
+	for _, m := range messages {
+		var e testEnvelope
+		json.Unmarshal(m, &e)
+		var p chatMessagePayload
+		json.Unmarshal(e.Payload, &p)
+		got = append(got, string(p.Message))
+	}
+	return got
+}
+
+func TestTTL(t *testing.T) {
+	h := newHub()
+	h.history = newMemoryHistory(10, 10)
+	tr := &writtenTransport{fakeTransport: newFakeTransport()}
+	c := newClient(tr, "", sendQueue{size: 100}, messageRate{})
+	c.writeWaits = writeWaits{message: time.Second, broadcast: time.Second}
+	h.join(c)
+	if err := h.joinRoom(c, "lobby"); err != nil {
+		t.Fatal(err)
+	}
+	c.takeQueue()
+
+	// Nothing reads what's queued for the client until they've all been
+	// sent, and the short TTLs are up.
+	broadcast := func(message string, ttl time.Duration) {
+		h.mut.Lock()
+		defer h.mut.Unlock()
+		payload := chatMessagePayload{Room: "lobby", Message: json.RawMessage(`"` + message + `"`)}
+		h.deliver(broadcastMessage{room: "lobby", envelope: newOutgoing("chat.message", payload), kept: true, ttl: ttl})
+	}
+	broadcast("stale", 10*time.Millisecond)
+	broadcast("fresh", time.Minute)
+	broadcast("stale", 10*time.Millisecond)
+	broadcast("forever", 0)
+	sendExpiring(context.Background(), c, "chat.message", chatMessagePayload{Message: json.RawMessage(`"stale"`)}, time.Now().Add(10*time.Millisecond))
+	time.Sleep(50 * time.Millisecond)
+
+	before := expiredMessages.Value()
+	go c.writePump(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.close(ctx, websocket.CloseNormalClosure, ""); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`"fresh"`, `"forever"`}
+	if got := chatMessages(tr.messages); !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrote %v, want %v", got, want)
+	}
+	if n := expiredMessages.Value() - before; n != 3 {
+		t.Fatalf("counted %d expired messages, want 3", n)
+	}
+
+	// A resume skips what's expired in the history, too.
+	late := newClient(newFakeTransport(), "", sendQueue{size: 100}, messageRate{})
+	h.join(late)
+	if _, err := h.resume(late, "lobby", 0); err != nil {
+		t.Fatal(err)
+	}
+	var resumed [][]byte
+	for _, m := range late.takeQueue() {
+		resumed = append(resumed, m.data)
+	}
+	if got := chatMessages(resumed); !reflect.DeepEqual(got, want) {
+		t.Fatalf("resumed with %v, want %v", got, want)
+	}
+}
+
+func TestTTLEnvelope(t *testing.T) {
+	pe, _ := protowire.Marshal(protoEnvelope{Type: "chat.send", TTLMS: 1500})
+	for _, tt := range []struct {
+		c           codec
+		messageType int
+		message     []byte
+	}{
+		{jsonCodec{}, websocket.TextMessage, []byte(`{"type":"chat.send","ttl_ms":1500,"payload":{}}`)},
+		{protoCodec{}, websocket.BinaryMessage, protowire.AppendDelimited(nil, pe)},
+	} {
+		envelopes, err := tt.c.decode(tt.messageType, tt.message)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.c.name(), err)
+		}
+		if envelopes[0].ttl != 1500*time.Millisecond {
+			t.Fatalf("%s: TTL %v", tt.c.name(), envelopes[0].ttl)
+		}
+	}
+}
+
+func TestMailboxTTL(t *testing.T) {
+	h, alice := mailHub(time.Minute, 10)
+	short := toBob("1")
+	short.ttl = 10 * time.Millisecond
+	h.sendDirect(context.Background(), alice, short)
+	h.sendDirect(context.Background(), alice, toBob("2"))
+	queuedTypes(alice)
+
+	h.mut.Lock()
+	h.expireMail(time.Now().Add(time.Second))
+	h.mut.Unlock()
+	envelopes := queuedEnvelopes(alice)
+	if len(envelopes) != 1 || envelopes[0].Type != "undeliverable" {
+		t.Fatalf("alice was sent %+v, want the one with the short TTL undeliverable", envelopes)
+	}
+	var p undeliverablePayload
+	json.Unmarshal(envelopes[0].Payload, &p)
+	if p.Ref != "1" || p.Reason != undeliverableExpired {
+		t.Fatalf("undeliverable %+v", p)
+	}
+	bob := newClient(newFakeTransport(), "bob", sendQueue{size: 1000}, messageRate{})
+	h.join(bob)
+	var got []string
+	for _, e := range queuedEnvelopes(bob) {
+		var p directMessagePayload
+		json.Unmarshal(e.Payload, &p)
+		got = append(got, string(p.Message))
+	}
+	if !reflect.DeepEqual(got, []string{`"2"`}) {
+		t.Fatalf("bob was sent %v", got)
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sync/errgroup"
+
+	"wsexample/internal/protowire"
+)
+
+// A program that embeds the server can serve connections of its own, with
+// ConnectionHandler, reading and writing whole messages with the
+// Connection's Read and Write, or, rather than decode and encode every message
+// by hand, through Typed, which does it with a Codec:
+//
+//	s.Handle("/ws/orders", server.ConnectionHandler(func(conn *server.Connection) error {
+//		orders, err := server.Typed[Order, Receipt](conn, server.JSONCodec)
+//		if err != nil {
+//			return err
+//		}
+//		for {
+//			order, err := orders.Receive()
+//			if err != nil {
+//				return err
+//			}
+//			if err := orders.Send(Receipt{ID: order.ID}); err != nil {
+//				return err
+//			}
+//		}
+//	}))
+//
+// JSONCodec has each message as JSON, in a text message, and ProtoCodec as
+// protobuf, in a binary one, with the fields tagged as internal/protowire has
+// them. Typed checks that both types can be encoded with the codec before the
+// connection gets that far, so that a struct left without pb tags, or with a
+// field protowire can't handle, is an error straight away, naming the field,
+// rather than a surprise on the first message. Receive fails with a
+// DecodeError if a message is of the wrong type for the codec, or doesn't
+// decode, and the handler can carry on or give up as it likes.
+//
+// The envelopes of /api can be given typed handlers, too. HandleTyped
+// registers a handler for a type of envelope, with its payload as a T, which
+// must be a struct, since it's decoded with whichever codec the client
+// speaks:
+//
+//	server.HandleTyped(s, "orders.place", func(conn *server.Connection, order Order) error {
+//		return conn.SendEnvelope("orders.placed", Receipt{ID: order.ID})
+//	})
+//
+// The payload is decoded, and checked against its validate tags, as the
+// server's own handlers' are, and one that doesn't decode or breaks a rule is
+// answered with a bad_payload or invalid_payload error without the handler
+// seeing it. An error from the handler is answered with handler_failed and
+// its text.
+//
+// Read, Write and SendEnvelope are for the handler the connection is served
+// by. An interceptor is given the same Connection, and mustn't call them.
+
+// A Codec is how a Typed connection encodes its messages.
+type Codec struct {
+	c           codec
+	messageType int
+}
+
+// The codecs there are: JSON, in text messages, and protobuf, in binary ones.
+var (
+	JSONCodec  = Codec{jsonCodec{}, websocket.TextMessage}
+	ProtoCodec = Codec{protoCodec{}, websocket.BinaryMessage}
+)
+
+func (c Codec) String() string {
+	return c.c.name()
+}
+
+// check tells why values of the type can't be encoded with the codec, if
+// they can't.
+func (c Codec) check(t reflect.Type) error {
+	if c.messageType == websocket.BinaryMessage {
+		return protowire.Check(t)
+	}
+	return nil
+}
+
+// ConnectionHandler serves each connection with serve, until it returns, and
+// the connection is closed with its error, as it is on the server's own
+// endpoints.
+func ConnectionHandler(serve func(conn *Connection) error, opts ...ModeOption) Mode {
+	return newMode(func(ctx context.Context, g *errgroup.Group, c *client) error {
+		return serve(c.conn)
+	}, opts)
+}
+
+// Read reads the next whole message from the client, after the message rate
+// and the inbound interceptors; see messages.go.
+func (c *Connection) Read() (messageType int, data []byte, err error) {
+	m, err := c.next(c.ctx)
+	return m.Type, m.Data, err
+}
+
+// Write queues the message for the client, as the server queues its own.
+func (c *Connection) Write(messageType int, data []byte) error {
+	return c.client.write(messageType, data)
+}
+
+// SendEnvelope sends the client of /api an envelope of the type, with the
+// payload, in the client's codec.
+func (c *Connection) SendEnvelope(typ string, payload interface{}) error {
+	return sendEnvelope(c.ctx, c.client, typ, payload)
+}
+
+// TypedConn is a Connection that receives In and sends Out, encoded with a
+// Codec.
+type TypedConn[In, Out any] struct {
+	conn  *Connection
+	codec Codec
+}
+
+// Typed gives the connection as one that receives In and sends Out, with the
+// codec, or why it can't, if either type can't be encoded with it.
+func Typed[In, Out any](conn *Connection, codec Codec) (*TypedConn[In, Out], error) {
+	for _, t := range []reflect.Type{reflect.TypeOf((*In)(nil)).Elem(), reflect.TypeOf((*Out)(nil)).Elem()} {
+		if err := codec.check(t); err != nil {
+			return nil, fmt.Errorf("server: Typed with %s: %w", codec, err)
+		}
+	}
+	return &TypedConn[In, Out]{conn, codec}, nil
+}
+
+// Receive reads the next message, and decodes it.
+func (t *TypedConn[In, Out]) Receive() (In, error) {
+	var v In
+	messageType, data, err := t.conn.Read()
+	if err != nil {
+		return v, err
+	}
+	if messageType != t.codec.messageType {
+		return v, &DecodeError{fmt.Errorf("server: %s needs %s messages, not %s ones", t.codec, messageKind(t.codec.messageType), messageKind(messageType))}
+	}
+	if err := t.codec.c.decodePayload(data, &v); err != nil {
+		return v, &DecodeError{fmt.Errorf("server: decoding a %T with %s: %w", v, t.codec, err)}
+	}
+	return v, nil
+}
+
+// A DecodeError is what Receive fails with for a message it can't decode.
+// Unlike an error reading it, it leaves the connection as it was, to carry on
+// with.
+type DecodeError struct {
+	err error
+}
+
+func (e *DecodeError) Error() string { return e.err.Error() }
+
+func (e *DecodeError) Unwrap() error { return e.err }
+
+// Send encodes the value, and queues it for the client.
+func (t *TypedConn[In, Out]) Send(v Out) error {
+	data, err := t.codec.c.encodePayload(v)
+	if err != nil {
+		return fmt.Errorf("server: encoding a %T with %s: %w", v, t.codec, err)
+	}
+	return t.conn.Write(t.codec.messageType, data)
+}
+
+// Conn gives the connection underneath, for the raw messages.
+func (t *TypedConn[In, Out]) Conn() *Connection {
+	return t.conn
+}
+
+// HandleTyped registers the handler for the envelopes of the type on /api. It
+// panics if T isn't a struct both codecs can decode, or has rules that aren't
+// ones there are, and, like the server's own, if the type already has a
+// handler. It has to be called before the server is run.
+func HandleTyped[T any](s *Server, typ string, h func(conn *Connection, payload T) error) {
+	var zero T
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if err := ProtoCodec.check(t); err != nil {
+		panic(fmt.Sprintf("server: HandleTyped %q: %v", typ, err))
+	}
+	s.api.validate(typ, zero)
+	s.api.handle(typ, func(ctx context.Context, c *client, payload payload) error {
+		var v T
+		if err := decodePayload(payload, &v); err != nil {
+			return err
+		}
+		return h(c.conn, v)
+	})
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"wsexample/internal/protowire"
+)
+
+type typedOrder struct {
+	ID       string `json:"id" pb:"1" validate:"required"`
+	Quantity int    `json:"quantity" pb:"2"`
+}
+
+type typedReceipt struct {
+	ID    string `json:"id" pb:"1"`
+	Total int    `json:"total" pb:"2"`
+}
+
+// typedServer serves orders on /orders, with JSON, and /orders.proto, with
+// protobuf, answering each one with a receipt, and a message that doesn't
+// decode with the error's text.
+func typedServer(t *testing.T) string {
+	t.Helper()
+	s, err := New(WithUpgradeRate(0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, codec := range map[string]Codec{"/orders": JSONCodec, "/orders.proto": ProtoCodec} {
+		codec := codec
+		s.Handle(path, ConnectionHandler(func(conn *Connection) error {
+			orders, err := Typed[typedOrder, typedReceipt](conn, codec)
+			if err != nil {
+				return err
+			}
+			for {
+				order, err := orders.Receive()
+				var de *DecodeError
+				if errors.As(err, &de) {
+					orders.Conn().Write(websocket.TextMessage, []byte(err.Error()))
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if err := orders.Send(typedReceipt{order.ID, order.Quantity * 3}); err != nil {
+					return err
+				}
+			}
+		}))
+	}
+	HandleTyped(s, "orders.place", func(conn *Connection, order typedOrder) error {
+		if order.Quantity < 0 {
+			return errors.New("can't order less than nothing")
+		}
+		return conn.SendEnvelope("orders.placed", typedReceipt{order.ID, order.Quantity * 3})
+	})
+	return serveTest(t, s)
+}
+
+func TestTyped(t *testing.T) {
+	u := typedServer(t)
+	dial := func(path string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(u+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	// A client of the JSON one sends and gets JSON.
+	conn := dial("/orders")
+	conn.WriteJSON(typedOrder{"a1", 2})
+	var r typedReceipt
+	if err := conn.ReadJSON(&r); err != nil || r != (typedReceipt{"a1", 6}) {
+		t.Fatalf("receipt %+v, %v", r, err)
+	}
+	for _, tt := range []struct {
+		messageType int
+		data        string
+		want        string
+	}{
+		{websocket.BinaryMessage, "\x0a\x02a1", "json needs text messages, not binary ones"},
+		{websocket.TextMessage, `{"id":7}`, "decoding a server.typedOrder with json"},
+	} {
+		conn.WriteMessage(tt.messageType, []byte(tt.data))
+		_, data, err := conn.ReadMessage()
+		if err != nil || !strings.Contains(string(data), tt.want) {
+			t.Fatalf("sending %q got %q, %v, want %q", tt.data, data, err, tt.want)
+		}
+	}
+
+	// And of the protobuf one, protobuf.
+	conn = dial("/orders.proto")
+	order, _ := protowire.Marshal(typedOrder{"b2", 5})
+	conn.WriteMessage(websocket.BinaryMessage, order)
+	messageType, data, err := conn.ReadMessage()
+	if err != nil || messageType != websocket.BinaryMessage {
+		t.Fatalf("read a %d message, %v", messageType, err)
+	}
+	r = typedReceipt{}
+	if err := protowire.Unmarshal(data, &r); err != nil || r != (typedReceipt{"b2", 15}) {
+		t.Fatalf("receipt %+v, %v", r, err)
+	}
+}
+
+func TestTypedCodecs(t *testing.T) {
+	type untagged struct{ ID string }
+	type badField struct {
+		ID    string            `pb:"1"`
+		Extra map[string]string `pb:"2"`
+	}
+	type sameNumber struct {
+		ID   string `pb:"1"`
+		Name string `pb:"1"`
+	}
+	for _, tt := range []struct {
+		name  string
+		typed func() error
+		want  string
+	}{
+		{"json takes anything", func() error { _, err := Typed[map[string]int, []string](nil, JSONCodec); return err }, ""},
+		{"proto", func() error { _, err := Typed[typedOrder, typedReceipt](nil, ProtoCodec); return err }, ""},
+		{"proto needs structs", func() error { _, err := Typed[typedOrder, string](nil, ProtoCodec); return err }, "only structs"},
+		{"proto needs pointers left out", func() error { _, err := Typed[*typedOrder, typedReceipt](nil, ProtoCodec); return err }, "only structs"},
+		{"without tags", func() error { _, err := Typed[untagged, typedReceipt](nil, ProtoCodec); return err }, "no fields with pb tags"},
+		{"with a field it can't encode", func() error { _, err := Typed[badField, typedReceipt](nil, ProtoCodec); return err }, "field Extra"},
+		{"with a number twice", func() error { _, err := Typed[sameNumber, typedReceipt](nil, ProtoCodec); return err }, "same field number"},
+	} {
+		err := tt.typed()
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	s, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("HandleTyped took a payload protobuf can't decode")
+		}
+	}()
+	HandleTyped(s, "orders.count", func(conn *Connection, n int) error { return nil })
+}
+
+func TestHandleTyped(t *testing.T) {
+	u := typedServer(t)
+	conn := apiDial(t, u, "")
+	send := func(payload string) testEnvelope {
+		t.Helper()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"orders.place","payload":`+payload+`}`))
+		for {
+			var e testEnvelope
+			if err := conn.ReadJSON(&e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Type != "session" {
+				return e
+			}
+		}
+	}
+	e := send(`{"id":"c3","quantity":1}`)
+	var r typedReceipt
+	json.Unmarshal(e.Payload, &r)
+	if e.Type != "orders.placed" || r != (typedReceipt{"c3", 3}) {
+		t.Fatalf("got a %s %s", e.Type, e.Payload)
+	}
+	for _, tt := range []struct {
+		payload string
+		code    string
+	}{
+		{`{"id":"c3","quantity":"lots"}`, codeBadPayload},
+		{`{"quantity":1}`, codeInvalid},
+		{`{"id":"c3","quantity":-1}`, codeHandlerFailed},
+	} {
+		e := send(tt.payload)
+		var p errorPayload
+		json.Unmarshal(e.Payload, &p)
+		if e.Type != "error" || p.Code != tt.code || p.Type != "orders.place" {
+			t.Errorf("%s got a %s %s, want %s", tt.payload, e.Type, e.Payload, tt.code)
+		}
+	}
+}
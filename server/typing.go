@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// A member of a room on /api can say it's typing, with
+//
+//	{"type":"chat.typing","payload":{"room":"lobby"}}
+//
+// as often as it likes, such as on every key press, and the others in the
+// room are told, as
+//
+//	{"type":"presence.typing","payload":{"room":"lobby","id":4,"name":"alice","user":"alice"}}
+//
+// but only once every typing interval, however often it says so in between.
+// Once it hasn't said so for the typing timeout, or as soon as it sends a
+// message to the room, they're sent a presence.typing_stopped, the same but
+// for the type, on its behalf. A member that leaves the room, or disconnects,
+// stops typing without a word, since presence.left says as much.
+//
+// Rather than have a timer for everyone who's typing, the hub's goroutine
+// looks over them all once every typingTick, so the timeout is only as
+// precise as that.
+
+const typingTick = 250 * time.Millisecond
+
+type typingPayload struct {
+	Room string `json:"room" pb:"1"`
+	ID   uint64 `json:"id" pb:"2"`
+	Name string `json:"name,omitempty" pb:"3"`
+	User string `json:"user,omitempty" pb:"4"`
+}
+
+type typingKey struct {
+	c    *client
+	room string
+}
+
+// typingState is when the others in the room were last told the client is
+// typing, and when it stops, unless it says it's typing again.
+type typingState struct {
+	told    time.Time
+	expires time.Time
+}
+
+// typing has the client typing in the room, as of now, and tells the others,
+// if they haven't been told in the typing interval.
+func (h *hub) typing(c *client, room string, now time.Time) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if _, ok := h.clients[c][room]; !ok {
+		return errNotInRoom
+	}
+	key := typingKey{c, room}
+	state, ok := h.typists[key]
+	if !ok {
+		state = &typingState{}
+		h.typists[key] = state
+	}
+	state.expires = now.Add(h.typingTimeout)
+	if now.Sub(state.told) >= h.typingInterval {
+		state.told = now
+		h.announceTyping(c, room, "presence.typing")
+	}
+	return nil
+}
+
+// sending tells whether the client is in the room, to send it a message, and
+// has it stop typing in it, if it is.
+func (h *hub) sending(c *client, room string) bool {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if _, ok := h.clients[c][room]; !ok {
+		return false
+	}
+	h.stopTyping(c, room)
+	return true
+}
+
+// stopTyping tells the others in the room that the client has stopped
+// typing, if it was. h.mut must be held.
+func (h *hub) stopTyping(c *client, room string) {
+	key := typingKey{c, room}
+	if _, ok := h.typists[key]; !ok {
+		return
+	}
+	delete(h.typists, key)
+	h.announceTyping(c, room, "presence.typing_stopped")
+}
+
+// forgetTyping forgets that the client is typing in the room, without telling
+// anyone. h.mut must be held.
+func (h *hub) forgetTyping(c *client, room string) {
+	delete(h.typists, typingKey{c, room})
+}
+
+// expireTyping stops everyone who hasn't said they're typing in the typing
+// timeout. h.mut must be held.
+func (h *hub) expireTyping(now time.Time) {
+	for key, state := range h.typists {
+		if !now.Before(state.expires) {
+			h.stopTyping(key.c, key.room)
+		}
+	}
+}
+
+// announceTyping tells everyone else in the room about the client's typing,
+// with an envelope of the type. h.mut must be held.
+func (h *hub) announceTyping(c *client, room, typ string) {
+	h.deliver(broadcastMessage{
+		room:     room,
+		envelope: newOutgoing(typ, typingPayload{Room: room, ID: c.id, Name: h.nameIn(c, room), User: c.user}),
+		except:   c,
+	})
+}
+
+// handleTyping registers chat.typing with the dispatcher, if the hub has
+// typing indicators.
+func handleTyping(d *dispatcher, h *hub) {
+	if h.typingTimeout <= 0 {
+		return
+	}
+	d.validate("chat.typing", roomPayload{})
+	d.handle("chat.typing", func(ctx context.Context, c *client, payload payload) error {
+		var p roomPayload
+		if err := decodeRoomPayload(payload, &p, &p.Room); err != nil {
+			return err
+		}
+		if err := h.typing(c, p.Room, time.Now()); err != nil {
+			return &replyError{codeNotInRoom, err.Error()}
+		}
+		return nil
+	})
+}
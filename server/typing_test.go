@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// queuedTypes gives the types of the envelopes queued for the client, and
+// empties its queue.
+func queuedTypes(c *client) []string {
+	var types []string
+	for _, m := range c.takeQueue() {
+		var e testEnvelope
+		json.Unmarshal(m.data, &e)
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestTyping(t *testing.T) {
+	h := newHub()
+	h.presence = true
+	h.typingInterval, h.typingTimeout = 3*time.Second, 5*time.Second
+	alice := newClient(newFakeTransport(), "", sendQueue{size: 100}, messageRate{})
+	bob := newClient(newFakeTransport(), "", sendQueue{size: 100}, messageRate{})
+	for _, c := range []*client{alice, bob} {
+		h.join(c)
+		h.joinRoom(c, "lobby")
+	}
+	queuedTypes(alice)
+	queuedTypes(bob)
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	steps := []struct {
+		name string
+		do   func()
+		want []string
+	}{
+		{"starting to type", func() { h.typing(alice, "lobby", at(0)) }, []string{"presence.typing"}},
+		{"typing again within the interval", func() { h.typing(alice, "lobby", at(time.Second)) }, nil},
+		{"typing again after the interval", func() { h.typing(alice, "lobby", at(3*time.Second)) }, []string{"presence.typing"}},
+		// The timeout is from the last time it said so, at 3s.
+		{"before the timeout", func() { h.expireTyping(at(7 * time.Second)) }, nil},
+		{"after the timeout", func() { h.expireTyping(at(8 * time.Second)) }, []string{"presence.typing_stopped"}},
+		{"after it's stopped", func() { h.expireTyping(at(20 * time.Second)) }, nil},
+		{"starting again", func() { h.typing(alice, "lobby", at(21*time.Second)) }, []string{"presence.typing"}},
+		{"sending a message", func() { h.sending(alice, "lobby") }, []string{"presence.typing_stopped"}},
+		{"sending another", func() { h.sending(alice, "lobby") }, nil},
+	}
+	for _, step := range steps {
+		step.do()
+		if got := queuedTypes(bob); !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("%s: bob was sent %v, want %v", step.name, got, step.want)
+		}
+		if got := queuedTypes(alice); got != nil {
+			t.Fatalf("%s: alice was sent %v", step.name, got)
+		}
+	}
+
+	if err := h.typing(alice, "elsewhere", at(30*time.Second)); err != errNotInRoom {
+		t.Fatalf("typing in a room alice isn't in gave %v", err)
+	}
+	// Leaving forgets the typing, without a word.
+	h.typing(alice, "lobby", at(30*time.Second))
+	queuedTypes(bob)
+	h.leave(alice)
+	if len(h.typists) != 0 {
+		t.Fatalf("%d are still typing", len(h.typists))
+	}
+	h.expireTyping(at(time.Hour))
+	if got := queuedTypes(bob); !reflect.DeepEqual(got, []string{"presence.left"}) {
+		t.Fatalf("bob was sent %v once alice left", got)
+	}
+}
+
+func TestTypingTimeout(t *testing.T) {
+	u := testServer(t, WithTyping(time.Hour, 300*time.Millisecond))
+	alice := apiDial(t, u, "lobby")
+	bob := apiDial(t, u, "lobby")
+	bobID := joinedID(t, alice)
+	next := func(typ string) typingPayload {
+		t.Helper()
+		for {
+			var e testEnvelope
+			if err := alice.ReadJSON(&e); err != nil {
+				t.Fatalf("reading a %s: %v", typ, err)
+			}
+			if e.Type == typ {
+				var p typingPayload
+				json.Unmarshal(e.Payload, &p)
+				return p
+			}
+		}
+	}
+
+	bob.WriteJSON(map[string]interface{}{"type": "chat.typing", "payload": map[string]string{"room": "lobby"}})
+	if p := next("presence.typing"); p.ID != bobID || p.Room != "lobby" {
+		t.Fatalf("presence.typing %+v, want bob's, %d", p, bobID)
+	}
+	// The hub stops it, with nothing more from bob.
+	began := time.Now()
+	next("presence.typing_stopped")
+	if waited := time.Since(began); waited > 300*time.Millisecond+2*typingTick {
+		t.Fatalf("stopped after %s", waited)
+	}
+
+	bob.WriteJSON(map[string]interface{}{"type": "chat.typing", "payload": map[string]string{"room": "elsewhere"}})
+	var p errorPayload
+	json.Unmarshal(nextEnvelope(t, bob, "error").Payload, &p)
+	if p.Code != codeNotInRoom {
+		t.Fatalf("typing in a room bob isn't in gave %+v", p)
+	}
+	bob.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
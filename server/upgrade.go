@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// Every WebSocket endpoint goes through the same checks and bookkeeping,
+// and only differs in its mode: the subprotocols it speaks, the limits of its
+// connections, and what it does with them once they're up.
+func (s *Server) wsHandler(m Mode) http.HandlerFunc {
+	return s.connHandler(s.accept, m)
+}
+
+// givenTransport is the context key of the transport ServeTransport serves a
+// request with.
+type givenTransport struct{}
+
+// ServeTransport serves the connection as the endpoint for r's path would
+// serve one upgraded from r, with every check but the upgrade itself, and
+// returns once the connection is done. A request turned away is answered on w,
+// as an upgrade would be, and the connection is left alone. The hubs run
+// under Run, so the endpoints that need one need the server to be running.
+func (s *Server) ServeTransport(w http.ResponseWriter, r *http.Request, t Transport) {
+	s.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), givenTransport{}, t)))
+}
+
+// connHandler is wsHandler for connections accepted with accept, which is
+// how the event streams get the same treatment.
+func (s *Server) connHandler(accept acceptFunc, m Mode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The same settings are used for the whole life of the connection, even
+		// if they get reloaded in the meantime.
+		cfg := m.settings(s.holder.load())
+
+		if atomic.LoadInt32(&s.draining) == 1 {
+			// By the end of the shutdown timeout, this server is gone, and
+			// whatever replaces it may be up.
+			writeError(w, http.StatusServiceUnavailable, codeShuttingDown, "the server is shutting down", s.opts.shutdownTimeout)
+			return
+		}
+
+		ip, err := cfg.resolver.clientIP(r)
+		if err != nil {
+			slog.Warn("Unable to determine the client address", "remote_addr", r.RemoteAddr, "error", err)
+			writeError(w, http.StatusForbidden, codeUnknownAddress, "unable to determine the client address", 0)
+			return
+		}
+		// A unix socket peer that doesn't forward a client address has no IP
+		// address to check the rules against.
+		peer := describePeer(r)
+		if ip.IsValid() {
+			peer = ip.String()
+			if rule, ok := cfg.rules.check(ip); !ok {
+				slog.Info("Rejected connection", "peer", ip, "rule", rule)
+				ipRejections.Add(rule, 1)
+				writeError(w, http.StatusForbidden, codeAddressDenied, "connections from this address are not allowed", 0)
+				return
+			}
+			if b, ok := s.bans.check(ip, time.Now()); ok {
+				slog.Info("Rejected connection", "peer", ip, "ban", b.Prefix)
+				banRejections.Add(1)
+				// Temporary bans are worth coming back after.
+				var retryAfter time.Duration
+				if b.Expires != nil {
+					retryAfter = time.Until(*b.Expires)
+				}
+				writeError(w, http.StatusForbidden, codeBanned, "this address is banned", retryAfter)
+				return
+			}
+			if s.limiter != nil {
+				if ok, retryAfter := s.limiter.allow(ip, time.Now()); !ok {
+					slog.Info("Rejected connection", "peer", ip, "upgrade_rate", s.opts.upgradeRate, "retry_after", retryAfter)
+					writeError(w, http.StatusTooManyRequests, codeRateLimited, "too many connection attempts from this address", retryAfter)
+					return
+				}
+			}
+		}
+
+		if reason, ok := cfg.origins.check(r); !ok && !s.opts.dev {
+			slog.Info("Rejected connection", "peer", peer, "origin", reason)
+			originRejections.Add(1)
+			writeError(w, http.StatusForbidden, codeBadOrigin, "connections from this origin are not allowed", 0)
+			return
+		}
+
+		offered := m.subprotocols
+		var who principal
+		if cfg.auth != nil {
+			token, viaSubprotocol := requestToken(r)
+			if who, err = cfg.auth.authenticate(token, time.Now()); err != nil {
+				slog.Info("Rejected connection", "peer", peer, "auth", err)
+				authFailures.Add(err.Error(), 1)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, codeUnauthorized, "a valid token is required", 0)
+				return
+			}
+			if viaSubprotocol {
+				offered = append(offered[:len(offered):len(offered)], authSubprotocol)
+			}
+		}
+
+		connChaos := s.chaos
+		if spec := r.URL.Query().Get("chaos"); s.opts.dev && spec != "" {
+			if connChaos, err = parseChaos(spec); err != nil {
+				writeError(w, http.StatusBadRequest, codeBadRequest, err.Error(), 0)
+				return
+			}
+		}
+
+		// Checked last, but for the user's other connections, so that a
+		// request turned away for anything else doesn't take up a slot, even
+		// for a moment.
+		release, limit, ok := s.conns.acquire(ip, cfg.connLimits)
+		if !ok {
+			slog.Info("Rejected connection", "peer", peer, "connection_limit", limit)
+			writeError(w, http.StatusServiceUnavailable, codeTooManyConns, "too many connections are open", connLimitRetry)
+			return
+		}
+		defer release()
+
+		// One of the user's connections, for the duplicate session policy; see
+		// duplicates.go.
+		var slot *principalSlot
+		if s.duplicates != duplicatesAllowed && who.user != "" {
+			if slot, ok = s.principals.reserve(who.user, s.duplicates); !ok {
+				slog.Info("Rejected connection", "peer", peer, "user", who.user, "duplicate_sessions", "reject_newest")
+				writeError(w, http.StatusConflict, codeAlreadyConnected, "the user already has a connection open", 0)
+				return
+			}
+			defer s.principals.release(slot)
+		}
+
+		id := atomic.AddUint64(&s.connIDs, 1)
+		// Handle the upgrade request, and acquire the WebSocket connection,
+		// unless it's already been given one.
+		t, given := r.Context().Value(givenTransport{}).(Transport)
+		if !given {
+			if t, err = accept(w, r, offered); err != nil {
+				slog.Info("Failed to upgrade", "peer", peer, "error", err)
+				return
+			}
+		}
+
+		c := &liveConn{
+			id:       id,
+			uuid:     newConnUUID(),
+			peer:     peer,
+			addr:     ip,
+			tracer:   &frameTracer{id: id, out: s.traceOut},
+			progress: &writeProgress{},
+			onError:  s.onError,
+
+			interceptIn:  s.opts.interceptIn,
+			interceptOut: s.opts.interceptOut,
+			stats:        &connStats{},
+
+			path:        r.URL.Path,
+			subprotocol: t.Subprotocol(),
+			connected:   time.Now(),
+			session:     r.URL.Query().Get("session"),
+
+			principal: who,
+		}
+		c.log = newConnLogger(c)
+		c.recorder = newSessionRecorder(id, peer, s.opts.recordDir, c.log)
+		attrs := []interface{}{"path", r.URL.Path}
+		if ext := t.Extensions(); ext != "" {
+			attrs = append(attrs, "extensions", ext)
+		}
+		c.log.Info("Got a new connection", attrs...)
+		t = wrapChaos(t, connChaos, c.log)
+		defer t.CloseNow()
+		c.tracer.setEnabled(s.opts.traceFrames)
+		t = &tracedTransport{t, c.tracer}
+		t = &recordingTransport{t, c.recorder}
+		t = &watchedTransport{t, c.progress}
+		if c.throttle = (writeRate{s.opts.writeRate, s.opts.writeBurst}).bucket(); c.throttle != nil {
+			t = &throttledTransport{t, c.throttle}
+		}
+		t = &metricsTransport{Transport: t, stats: c.stats}
+		t = &reportingTransport{Transport: t, c: c}
+		closes := &closeHandler{Transport: t}
+		c.transport = closes
+		if s.opts.dev && r.URL.Query().Get("record") != "" {
+			if err := c.recorder.begin(); err != nil {
+				c.log.Error("Failed to start recording the connection", "error", err)
+			}
+		}
+		if slot != nil && !s.takeOver(slot, c) {
+			c.log.Info("Closing the connection, as another of its user's has already taken its place")
+			closes.Close(closeSuperseded, "superseded")
+			return
+		}
+		s.reg.add(c)
+		defer s.reg.remove(id)
+		atomic.AddInt64(connectionsTotal.with(r.URL.Path), 1)
+		active := connectionsActive.with(r.URL.Path)
+		atomic.AddInt64(active, 1)
+		defer atomic.AddInt64(active, -1)
+
+		ctx := connLabels(r.Context(), id)
+		pprof.SetGoroutineLabels(ctx)
+		idle := s.idle
+		if m.listenOnly {
+			idle = nil
+		}
+		err = runConn(ctx, s.baseCtx.Done(), closes, cfg, idle, c, m)
+		status := closes.closeStatus()
+		err = c.reportError("serve", err, nil)
+		c.recorder.end(err)
+		c.log.Info("Connection closed", "status", status.String(), "reason", err)
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"io"
+	"runtime/pprof"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Every write is supposed to finish within its write wait, one way or another. If a
+// connection has had a write pending for a lot longer than that, then
+// something is stuck, and the connection is only half alive: it can still
+// read, but nothing will ever be written to it again.
+//
+// A write pump can also get stuck somewhere other than a write, such as
+// waiting on -write-rate, or on a bug of its own, and then the messages pile up
+// in its queue without any write being pending. So a connection whose queue
+// hasn't had a message taken off it for that long is stuck too.
+//
+// So a single watchdog goroutine looks over every connection every few
+// seconds, and closes the ones that are stuck like that with 1011. Since
+// being stuck is a bug, it also logs the stacks of the connection's
+// goroutines, which are labelled with the connection's ID for that purpose.
+
+const (
+	watchdogInterval = 5 * time.Second
+	watchdogSlack    = 10 * time.Second
+)
+
+var stuckWriters = expvar.NewInt("stuck_writers")
+
+// writeProgress tracks a connection's writes.
+type writeProgress struct {
+	pending int64
+
+	// When the last write finished, or, if nothing was pending before, when the
+	// current one started, in Unix nanoseconds.
+	lastProgress int64
+}
+
+func (p *writeProgress) stalledFor(now time.Time) (int64, time.Duration) {
+	pending := atomic.LoadInt64(&p.pending)
+	if pending == 0 {
+		return 0, 0
+	}
+	return pending, now.Sub(time.Unix(0, atomic.LoadInt64(&p.lastProgress)))
+}
+
+func (p *writeProgress) begin() {
+	if atomic.AddInt64(&p.pending, 1) == 1 {
+		atomic.StoreInt64(&p.lastProgress, time.Now().UnixNano())
+	}
+}
+
+func (p *writeProgress) end() {
+	atomic.StoreInt64(&p.lastProgress, time.Now().UnixNano())
+	atomic.AddInt64(&p.pending, -1)
+}
+
+type watchedTransport struct {
+	Transport
+	progress *writeProgress
+}
+
+func (t *watchedTransport) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	t.progress.begin()
+	defer t.progress.end()
+	return t.Transport.WriteMessage(ctx, messageType, data)
+}
+
+// A streamed message is pending from when it's started until it's closed,
+// and every chunk written is progress.
+func (t *watchedTransport) NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error) {
+	t.progress.begin()
+	w, err := t.Transport.NextWriter(ctx, messageType)
+	if err != nil {
+		t.progress.end()
+		return nil, err
+	}
+	return &streamWriter{
+		write: func(p []byte) (int, error) {
+			n, err := w.Write(p)
+			atomic.StoreInt64(&t.progress.lastProgress, time.Now().UnixNano())
+			return n, err
+		},
+		close: func() error {
+			defer t.progress.end()
+			return w.Close()
+		},
+	}, nil
+}
+
+// connLabels labels the goroutines of a connection, so that they can be picked
+// out of a goroutine dump.
+func connLabels(ctx context.Context, id uint64) context.Context {
+	return pprof.WithLabels(ctx, pprof.Labels("conn", strconv.FormatUint(id, 10)))
+}
+
+// setPumpLabel labels the calling goroutine as the given pump of the
+// connection in ctx.
+func setPumpLabel(ctx context.Context, pump string) {
+	pprof.SetGoroutineLabels(pprof.WithLabels(ctx, pprof.Labels("pump", pump)))
+}
+
+// connStacks dumps the stacks of the goroutines labelled with the connection's
+// ID.
+func connStacks(id uint64) string {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	label := []byte(`"conn":"` + strconv.FormatUint(id, 10) + `"`)
+	var stacks [][]byte
+	for _, stack := range bytes.Split(buf.Bytes(), []byte("\n\n")) {
+		if bytes.Contains(stack, label) {
+			stacks = append(stacks, stack)
+		}
+	}
+	return string(bytes.Join(stacks, []byte("\n\n")))
+}
+
+// watchdog closes the connections with a write stalled, or a queue that the
+// write pump hasn't taken anything off, for longer than writeWait, the longest
+// of the write waits, and then some.
+func watchdog(ctx context.Context, reg *connRegistry, writeWait time.Duration) {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			closeStuck(reg, now, writeWait+watchdogSlack)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// closeStuck closes the connections that have been stuck for longer than
+// limit, as of now.
+func closeStuck(reg *connRegistry, now time.Time, limit time.Duration) {
+	for _, c := range reg.list() {
+		pending, stalled := c.progress.stalledFor(now)
+		var queued int
+		var queueStalled time.Duration
+		if cl := c.served(); cl != nil {
+			queued, queueStalled = cl.queueStalledFor(now)
+		}
+		if stalled <= limit && queueStalled <= limit {
+			continue
+		}
+		stuckWriters.Add(1)
+		c.log.Error(
+			"Writes stuck, closing the connection",
+			"pending", pending, "stalled", stalled.Round(time.Second),
+			"queued", queued, "queue_stalled", queueStalled.Round(time.Second),
+			"goroutines", connStacks(c.id),
+		)
+		// Closing could get stuck too, for the same reason the writes did.
+		go func(c *liveConn) {
+			c.transport.Close(websocket.CloseInternalServerErr, "write stuck")
+			c.transport.CloseNow()
+		}(c)
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCloseStuck(t *testing.T) {
+	const limit = time.Minute
+	now := time.Now()
+	tests := []struct {
+		name string
+		// How long ago a write started that's still pending, if any.
+		writing time.Duration
+		// How many messages are queued, and how long ago the pump last took
+		// one.
+		queued int
+		pumped time.Duration
+		stuck  bool
+	}{
+		{name: "idle", pumped: time.Hour},
+		{name: "writing", writing: limit / 2},
+		{name: "write stalled", writing: 2 * limit, stuck: true},
+		{name: "queued", queued: 3, pumped: limit / 2},
+		{name: "queue stalled", queued: 3, pumped: 2 * limit, stuck: true},
+		{name: "queue stalled behind a write", writing: 2 * limit, queued: 1, pumped: 2 * limit, stuck: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ft := newFakeTransport()
+			c := &liveConn{
+				id:        1,
+				transport: ft,
+				progress:  &writeProgress{},
+				log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			if tt.writing > 0 {
+				c.progress.pending = 1
+				c.progress.lastProgress = now.Add(-tt.writing).UnixNano()
+			}
+			cl := newClient(ft, "", sendQueue{size: 10}, messageRate{})
+			for i := 0; i < tt.queued; i++ {
+				cl.write(websocket.TextMessage, []byte("hello"))
+			}
+			cl.pumped = now.Add(-tt.pumped)
+			c.serving(cl)
+			reg := newConnRegistry()
+			reg.add(c)
+
+			closeStuck(reg, now, limit)
+			wait := 100 * time.Millisecond
+			if tt.stuck {
+				wait = 5 * time.Second
+			}
+			code, _, closed := ft.closedWith(wait)
+			if closed != tt.stuck {
+				t.Fatalf("closed = %t, want %t", closed, tt.stuck)
+			}
+			if closed && code != websocket.CloseInternalServerErr {
+				t.Fatalf("closed with %d, want %d", code, websocket.CloseInternalServerErr)
+			}
+		})
+	}
+}
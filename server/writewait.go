@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"time"
+)
+
+// Not everything written to a client is as urgent as everything else. A ping
+// or a close frame that can't go out within a few seconds means the
+// connection is as good as gone, while a broadcast to a room full of clients,
+// or a large stream, can take its time without anything being wrong. So each
+// category of write has a deadline of its own:
+//
+//   - control frames, pings and close frames: -control-write-wait, 5 seconds;
+//   - messages to the client alone, such as replies: -write-wait, a minute;
+//   - broadcasts to a room, or to everyone, including the ones replayed when a
+//     room is resumed: -broadcast-write-wait, 2 minutes;
+//   - streamed messages, as a whole: -stream-write-wait, 5 minutes.
+//
+// A message write that fails before any of it went out, which is what a write
+// throttled by -write-rate does when its deadline is up before it had the
+// bytes for it, is tried once more, with a fresh deadline, before the
+// connection is given up on. So is any other write whose deadline is already
+// up, or whose context is done, by the time it gets to the WebSocket library,
+// since it's never handed to the library at all. Those retries are counted
+// under write_retries. The first failure isn't reported as a connection
+// error, since the connection isn't done with yet; the second is, as a write
+// timeout. A write that fails partway can't be tried again, because the
+// client would be sent part of the message twice, so neither can a stream.
+// Nor can any write that the library itself fails, even if none of it was
+// sent: both libraries give up on the connection after a failed write, and
+// neither says how much of it went out.
+
+var writeRetries = expvar.NewInt("write_retries")
+
+// writeWaits are the time allowed for each category of write.
+type writeWaits struct {
+	control   time.Duration
+	message   time.Duration
+	broadcast time.Duration
+	stream    time.Duration
+}
+
+func (w writeWaits) validate() error {
+	if w.control <= 0 || w.message <= 0 || w.broadcast <= 0 || w.stream <= 0 {
+		return errors.New("the write waits must be positive")
+	}
+	return nil
+}
+
+// longest is the longest any one write can take.
+func (w writeWaits) longest() time.Duration {
+	longest := w.control
+	for _, d := range []time.Duration{w.message, w.broadcast, w.stream} {
+		if d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+// unwrittenError is a write that failed before any of the message went out,
+// so that it can be tried again.
+type unwrittenError struct {
+	err error
+}
+
+func (e *unwrittenError) Error() string { return e.err.Error() }
+
+func (e *unwrittenError) Unwrap() error { return e.err }
+
+// unstarted gives an unwrittenError if ctx is already done, or its deadline
+// is up, so that a write that can only fail isn't begun.
+func unstarted(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return &unwrittenError{err}
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return &unwrittenError{context.DeadlineExceeded}
+	}
+	return nil
+}
+
+type retryKey struct{}
+
+// retrying marks ctx as the first attempt at a write, which is tried again if
+// it fails without any of it being written.
+func retrying(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryKey{}, true)
+}
+
+// willRetry reports whether a write with ctx that failed with err is to be
+// tried again.
+func willRetry(ctx context.Context, err error) bool {
+	var unwritten *unwrittenError
+	retry, _ := ctx.Value(retryKey{}).(bool)
+	return retry && errors.As(err, &unwritten)
+}
+
+// writeMessage writes a message within the write timeout, trying it once
+// more, with the timeout again, if it failed before any of it was written.
+// Only a client's write pump writes messages to it.
+func writeMessage(t Transport, timeout time.Duration, messageType int, data []byte) error {
+	ctx, cancel := context.WithTimeout(retrying(context.Background()), timeout)
+	err := t.WriteMessage(ctx, messageType, data)
+	cancel()
+	if !willRetry(ctx, err) {
+		return err
+	}
+	writeRetries.Add(1)
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return t.WriteMessage(ctx, messageType, data)
+}
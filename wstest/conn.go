@@ -0,0 +1,387 @@
+// Package wstest is an in-memory WebSocket connection, for testing what a
+// server does with one without a listener, a dialer or the network in
+// between.
+//
+// A Conn is the server's end of a connection, as a server.Transport. The test
+// plays the client, injecting what it sends with Inject, and taking what the
+// server writes with Next:
+//
+//	conn := wstest.NewConn()
+//	go s.ServeTransport(httptest.NewRecorder(), httptest.NewRequest("GET", "/api", nil), conn)
+//	conn.InjectJSON(map[string]any{"type": "chat.join", "payload": map[string]string{"room": "lobby"}})
+//	var e struct{ Type string }
+//	err := conn.NextJSON(ctx, &e)
+//
+// Nothing happens on a Conn until the test makes it happen, so there's
+// nothing to wait out and no timing to get lucky with. A read waits for a
+// message to be injected, and a write is kept as soon as it's made, unless
+// the Conn is stalled, like a client that's stopped reading, when it waits
+// until it's resumed. A read or a write can be made to fail with
+// InjectError and FailWrites, and InjectClose has the client close the
+// connection, with the *websocket.CloseError the server would get from a
+// real one.
+package wstest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A Message is a whole message, injected or written.
+type Message struct {
+	// websocket.TextMessage or websocket.BinaryMessage.
+	Type int
+	Data []byte
+}
+
+// A read is what the next read gives: a message, or an error.
+type read struct {
+	m   Message
+	err error
+}
+
+// Conn is an in-memory connection. It's made with NewConn, and is safe for
+// concurrent use, though, as with a real connection, only one goroutine may
+// read it at a time, and one write it.
+type Conn struct {
+	mut         sync.Mutex
+	subprotocol string
+	readLimit   int64
+	// What's been injected and not yet read, and what's been written, with
+	// taken of it given by Next. Each channel has a signal sent on it when
+	// there's more.
+	reads    []read
+	readable chan struct{}
+	written  []Message
+	taken    int
+	wrote    chan struct{}
+	// Closed while writes aren't stalled.
+	flowing  chan struct{}
+	writeErr error
+	pings    int
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	code      int
+	reason    string
+}
+
+// NewConn makes a connection that's open, with nothing to read yet.
+func NewConn() *Conn {
+	flowing := make(chan struct{})
+	close(flowing)
+	return &Conn{
+		readable: make(chan struct{}, 1),
+		wrote:    make(chan struct{}, 1),
+		flowing:  flowing,
+		closed:   make(chan struct{}),
+	}
+}
+
+// signal lets whoever's waiting on ch know there's more, without waiting.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// SetSubprotocol sets the subprotocol the connection reports, as if it had
+// been negotiated. It has to be set before the connection is served.
+func (c *Conn) SetSubprotocol(p string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.subprotocol = p
+}
+
+// Inject has the client send the message, for the server to read after
+// anything injected before it.
+func (c *Conn) Inject(messageType int, data []byte) {
+	c.push(read{m: Message{messageType, data}})
+}
+
+// InjectJSON has the client send the value, as JSON, in a text message.
+func (c *Conn) InjectJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.Inject(websocket.TextMessage, data)
+	return nil
+}
+
+// InjectError has the server's read fail with err, once it's read what was
+// injected before it.
+func (c *Conn) InjectError(err error) {
+	c.push(read{err: err})
+}
+
+// InjectClose has the client close the connection with the code and reason,
+// once the server has read what was injected before it.
+func (c *Conn) InjectClose(code int, reason string) {
+	c.push(read{err: &websocket.CloseError{Code: code, Text: reason}})
+}
+
+func (c *Conn) push(r read) {
+	c.mut.Lock()
+	c.reads = append(c.reads, r)
+	c.mut.Unlock()
+	signal(c.readable)
+}
+
+// Stall has writes wait, as they would for a client that's stopped reading,
+// until Resume is called, or the connection is closed, or the write's context
+// is done.
+func (c *Conn) Stall() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	select {
+	case <-c.flowing:
+		c.flowing = make(chan struct{})
+	default:
+	}
+}
+
+// Resume lets stalled writes through.
+func (c *Conn) Resume() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	select {
+	case <-c.flowing:
+	default:
+		close(c.flowing)
+	}
+}
+
+// FailWrites has every write from now on fail with err, or succeed again if
+// err is nil.
+func (c *Conn) FailWrites(err error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.writeErr = err
+}
+
+// Next waits for the next message the server writes, after the last one Next
+// gave, and gives it, or ctx's error if it's done first, or net.ErrClosed if
+// the connection is closed with nothing more written.
+func (c *Conn) Next(ctx context.Context) (Message, error) {
+	for {
+		c.mut.Lock()
+		if c.taken < len(c.written) {
+			m := c.written[c.taken]
+			c.taken++
+			c.mut.Unlock()
+			return m, nil
+		}
+		c.mut.Unlock()
+		select {
+		case <-c.wrote:
+		case <-c.closed:
+			// What was written before it was closed is still there to take.
+			c.mut.Lock()
+			more := c.taken < len(c.written)
+			c.mut.Unlock()
+			if !more {
+				return Message{}, net.ErrClosed
+			}
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		}
+	}
+}
+
+// NextJSON waits for the next message, as Next does, and decodes it as JSON
+// into v.
+func (c *Conn) NextJSON(ctx context.Context, v interface{}) error {
+	m, err := c.Next(ctx)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(m.Data, v)
+}
+
+// Written gives every message the server has written so far, whether Next
+// has given it or not.
+func (c *Conn) Written() []Message {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return append([]Message(nil), c.written...)
+}
+
+// Pings gives how many pings the server has sent.
+func (c *Conn) Pings() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.pings
+}
+
+// Done is closed once the connection is.
+func (c *Conn) Done() <-chan struct{} {
+	return c.closed
+}
+
+// Closed gives the code and reason the server closed the connection with, or
+// zero and "" if it closed it without a close frame, and whether it's closed
+// at all.
+func (c *Conn) Closed() (code int, reason string, ok bool) {
+	select {
+	case <-c.closed:
+	default:
+		return 0, "", false
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.code, c.reason, true
+}
+
+// The server's end.
+
+// ReadMessage reads the next message injected, waiting for one, until the
+// connection is closed, or ctx is done.
+func (c *Conn) ReadMessage(ctx context.Context) (int, []byte, error) {
+	for {
+		c.mut.Lock()
+		if len(c.reads) > 0 {
+			r := c.reads[0]
+			c.reads = c.reads[1:]
+			limit := c.readLimit
+			c.mut.Unlock()
+			if r.err != nil {
+				return 0, nil, r.err
+			}
+			if limit > 0 && int64(len(r.m.Data)) > limit {
+				return 0, nil, websocket.ErrReadLimit
+			}
+			return r.m.Type, r.m.Data, nil
+		}
+		c.mut.Unlock()
+		select {
+		case <-c.readable:
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		}
+	}
+}
+
+// NextReader reads the next message, as ReadMessage does, and gives it as a
+// reader.
+func (c *Conn) NextReader(ctx context.Context) (int, io.Reader, error) {
+	messageType, data, err := c.ReadMessage(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	return messageType, bytes.NewReader(data), nil
+}
+
+// WriteMessage keeps the message for Next, once the connection isn't stalled.
+func (c *Conn) WriteMessage(ctx context.Context, messageType int, data []byte) error {
+	c.mut.Lock()
+	flowing := c.flowing
+	c.mut.Unlock()
+	select {
+	case <-flowing:
+	case <-c.closed:
+		return net.ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	c.written = append(c.written, Message{messageType, append([]byte(nil), data...)})
+	signal(c.wrote)
+	return nil
+}
+
+// NextWriter gives a writer whose message is written, as WriteMessage writes
+// it, once it's closed.
+func (c *Conn) NextWriter(ctx context.Context, messageType int) (io.WriteCloser, error) {
+	select {
+	case <-c.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	return &writer{c: c, ctx: ctx, messageType: messageType}, nil
+}
+
+type writer struct {
+	c           *Conn
+	ctx         context.Context
+	messageType int
+	buf         bytes.Buffer
+}
+
+func (w *writer) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *writer) Close() error {
+	return w.c.WriteMessage(w.ctx, w.messageType, w.buf.Bytes())
+}
+
+// Ping counts the ping, and has the client answer it straight away, unless
+// writes are failing, or the connection is closed.
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	c.pings++
+	return 0, nil
+}
+
+// SetReadLimit has a read of a message longer than the limit fail with
+// websocket.ErrReadLimit.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.readLimit = limit
+}
+
+// Subprotocol gives what was set with SetSubprotocol.
+func (c *Conn) Subprotocol() string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.subprotocol
+}
+
+// Extensions gives none; there's no compression to negotiate.
+func (c *Conn) Extensions() string { return "" }
+
+// Close closes the connection, remembering the code and reason of the close
+// frame, if it's the first time it's closed.
+func (c *Conn) Close(code int, reason string) error {
+	c.closeOnce.Do(func() {
+		c.mut.Lock()
+		c.code, c.reason = code, reason
+		c.mut.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
+
+// CloseNow closes the connection without a close frame.
+func (c *Conn) CloseNow() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
@@ -0,0 +1,116 @@
+package wstest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnReads(t *testing.T) {
+	c := NewConn()
+	c.SetReadLimit(5)
+	c.Inject(websocket.TextMessage, []byte("one"))
+	c.Inject(websocket.BinaryMessage, []byte("too long"))
+	c.Inject(websocket.TextMessage, []byte("two"))
+	failed := errors.New("failed")
+	c.InjectError(failed)
+	c.InjectClose(4001, "bye")
+	ctx := context.Background()
+	for _, tt := range []struct {
+		messageType int
+		data        string
+		err         error
+	}{
+		{websocket.TextMessage, "one", nil},
+		{0, "", websocket.ErrReadLimit},
+		{websocket.TextMessage, "two", nil},
+		{0, "", failed},
+	} {
+		messageType, data, err := c.ReadMessage(ctx)
+		if messageType != tt.messageType || string(data) != tt.data || err != tt.err {
+			t.Fatalf("read %d %q, %v, want %d %q, %v", messageType, data, err, tt.messageType, tt.data, tt.err)
+		}
+	}
+	var ce *websocket.CloseError
+	if _, _, err := c.ReadMessage(ctx); !errors.As(err, &ce) || ce.Code != 4001 || ce.Text != "bye" {
+		t.Fatalf("read %v, want the close", err)
+	}
+
+	// A read waits for what's injected, or the close.
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadMessage(ctx)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		t.Fatalf("read %v with nothing injected", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	c.CloseNow()
+	if err := <-read; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("read %v once closed", err)
+	}
+}
+
+func TestConnWrites(t *testing.T) {
+	c := NewConn()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.WriteMessage(ctx, websocket.TextMessage, []byte("one"))
+	w, _ := c.NextWriter(ctx, websocket.BinaryMessage)
+	w.Write([]byte("tw"))
+	w.Write([]byte("o"))
+	w.Close()
+	for _, want := range []string{"one", "two"} {
+		if m, err := c.Next(ctx); err != nil || string(m.Data) != want {
+			t.Fatalf("next %q, %v, want %q", m.Data, err, want)
+		}
+	}
+
+	// A stalled write waits for the resume.
+	c.Stall()
+	wrote := make(chan error, 1)
+	go func() { wrote <- c.WriteMessage(ctx, websocket.TextMessage, []byte("three")) }()
+	select {
+	case err := <-wrote:
+		t.Fatalf("wrote %v while stalled", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if n := len(c.Written()); n != 2 {
+		t.Fatalf("%d written while stalled", n)
+	}
+	c.Resume()
+	if err := <-wrote; err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("failed")
+	c.FailWrites(failed)
+	if err := c.WriteMessage(ctx, websocket.TextMessage, []byte("four")); err != failed {
+		t.Fatalf("wrote %v, want it to fail", err)
+	}
+	if _, err := c.Ping(ctx); err != failed {
+		t.Fatalf("pinged %v, want it to fail", err)
+	}
+
+	// What was written before the close can still be taken after it.
+	c.Close(websocket.CloseGoingAway, "later")
+	c.Close(websocket.CloseInternalServerErr, "again")
+	if m, err := c.Next(ctx); err != nil || string(m.Data) != "three" {
+		t.Fatalf("next %q, %v after the close", m.Data, err)
+	}
+	if _, err := c.Next(ctx); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("next %v with nothing more written", err)
+	}
+	if code, reason, ok := c.Closed(); !ok || code != websocket.CloseGoingAway || reason != "later" {
+		t.Fatalf("closed with %d %q, %t", code, reason, ok)
+	}
+	if err := c.WriteMessage(ctx, websocket.TextMessage, nil); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("wrote %v once closed", err)
+	}
+}